@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/nsqd"
+)
+
+// the exported file formats:
+// json - one message for each line (JSON Lines), the ext and body are base64 encoded.
+// binary - the magic header and the ext flag, then the length prefixed records, each record
+// is the message data stored in the topic queue.
+const (
+	exportFormatJSON   = "json"
+	exportFormatBinary = "binary"
+)
+
+var binaryExportMagic = []byte("NSQEXP01")
+
+var errExtNotSupported = errors.New("the message with ext can not be imported to the topic without ext")
+
+type exportedMessage struct {
+	ID        uint64 `json:"id"`
+	TraceID   uint64 `json:"trace_id"`
+	Timestamp int64  `json:"timestamp"`
+	Attempts  uint16 `json:"attempts"`
+	ExtVer    uint8  `json:"ext_ver"`
+	Ext       []byte `json:"ext,omitempty"`
+	Body      []byte `json:"body"`
+}
+
+func newExportedMessage(msg *nsqd.Message) *exportedMessage {
+	return &exportedMessage{
+		ID:        uint64(msg.ID),
+		TraceID:   msg.TraceID,
+		Timestamp: msg.Timestamp,
+		Attempts:  msg.Attempts,
+		ExtVer:    uint8(msg.ExtVer),
+		Ext:       msg.ExtBytes,
+		Body:      msg.Body,
+	}
+}
+
+func (em *exportedMessage) toMessage() *nsqd.Message {
+	msg := nsqd.NewMessageWithExt(nsqd.MessageID(em.ID), em.Body, ext.ExtVer(em.ExtVer), em.Ext)
+	msg.TraceID = em.TraceID
+	msg.Timestamp = em.Timestamp
+	msg.Attempts = em.Attempts
+	return msg
+}
+
+type messageWriter interface {
+	WriteMessage(msg *nsqd.Message) error
+	Flush() error
+}
+
+type messageReader interface {
+	// return io.EOF if no more message
+	ReadMessage() (*nsqd.Message, error)
+}
+
+type jsonMessageWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONMessageWriter(w io.Writer) *jsonMessageWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonMessageWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (jw *jsonMessageWriter) WriteMessage(msg *nsqd.Message) error {
+	return jw.enc.Encode(newExportedMessage(msg))
+}
+
+func (jw *jsonMessageWriter) Flush() error {
+	return jw.w.Flush()
+}
+
+type binaryMessageWriter struct {
+	w     *bufio.Writer
+	isExt bool
+	buf   bytes.Buffer
+}
+
+func newBinaryMessageWriter(w io.Writer, isExt bool) (*binaryMessageWriter, error) {
+	bw := bufio.NewWriter(w)
+	_, err := bw.Write(binaryExportMagic)
+	if err != nil {
+		return nil, err
+	}
+	extFlag := byte(0)
+	if isExt {
+		extFlag = 1
+	}
+	err = bw.WriteByte(extFlag)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryMessageWriter{w: bw, isExt: isExt}, nil
+}
+
+func (bw *binaryMessageWriter) WriteMessage(msg *nsqd.Message) error {
+	if !bw.isExt && msg.ExtVer != ext.NO_EXT_VER {
+		return errExtNotSupported
+	}
+	bw.buf.Reset()
+	_, err := msg.WriteTo(&bw.buf, bw.isExt)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(bw.buf.Len()))
+	_, err = bw.w.Write(size[:])
+	if err != nil {
+		return err
+	}
+	_, err = bw.w.Write(bw.buf.Bytes())
+	return err
+}
+
+func (bw *binaryMessageWriter) Flush() error {
+	return bw.w.Flush()
+}
+
+type jsonMessageReader struct {
+	dec *json.Decoder
+}
+
+func (jr *jsonMessageReader) ReadMessage() (*nsqd.Message, error) {
+	var em exportedMessage
+	err := jr.dec.Decode(&em)
+	if err != nil {
+		return nil, err
+	}
+	return em.toMessage(), nil
+}
+
+type binaryMessageReader struct {
+	r     *bufio.Reader
+	isExt bool
+}
+
+func (br *binaryMessageReader) ReadMessage() (*nsqd.Message, error) {
+	var size uint32
+	err := binary.Read(br.r, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size > nsqd.MAX_POSSIBLE_MSG_SIZE {
+		return nil, errors.New("invalid message size in binary file")
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(br.r, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return nsqd.DecodeMessage(data, br.isExt)
+}
+
+// newMessageReader detect the file format by the magic header
+func newMessageReader(r io.Reader) (messageReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(binaryExportMagic))
+	if err == nil && bytes.Equal(magic, binaryExportMagic) {
+		br.Discard(len(binaryExportMagic))
+		extFlag, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryMessageReader{r: br, isExt: extFlag == 1}, nil
+	}
+	return &jsonMessageReader{dec: json.NewDecoder(br)}, nil
+}
+
+func newMessageWriter(w io.Writer, format string, isExt bool) (messageWriter, error) {
+	switch format {
+	case exportFormatJSON:
+		return newJSONMessageWriter(w), nil
+	case exportFormatBinary:
+		return newBinaryMessageWriter(w, isExt)
+	default:
+		return nil, errors.New("unknown export format: " + format)
+	}
+}
+
+func createExportFile(fileName string) (*os.File, error) {
+	if fileName == "" {
+		return nil, errors.New("--export_file is required")
+	}
+	return os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// exportTopicData export the messages from the snapshot until the end of the queue or
+// the stop condition matched, return the exported message count.
+func exportTopicData(snap *nsqd.DiskQueueSnapshot, fileName string, format string, isExt bool,
+	maxCnt int64, endID int64, endTimestamp int64) (int64, error) {
+	f, err := createExportFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	mw, err := newMessageWriter(f, format, isExt)
+	if err != nil {
+		return 0, err
+	}
+	cnt := int64(0)
+	for maxCnt <= 0 || cnt < maxCnt {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err == io.EOF {
+				break
+			}
+			return cnt, ret.Err
+		}
+		msg, err := nsqd.DecodeMessage(ret.Data, isExt)
+		if err != nil {
+			return cnt, err
+		}
+		if endID > 0 && int64(msg.ID) > endID {
+			break
+		}
+		if endTimestamp > 0 && msg.Timestamp > endTimestamp*1000*1000*1000 {
+			break
+		}
+		err = mw.WriteMessage(msg)
+		if err != nil {
+			return cnt, err
+		}
+		cnt++
+		if cnt%100000 == 0 {
+			log.Printf("exported %v messages, current offset: %v\n", cnt, ret.Offset)
+		}
+	}
+	err = mw.Flush()
+	if err != nil {
+		return cnt, err
+	}
+	return cnt, f.Sync()
+}
+
+// convertExportedData convert the exported file to another format
+func convertExportedData(srcFile string, dstFile string, format string, isExt bool) (int64, error) {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	mr, err := newMessageReader(src)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := createExportFile(dstFile)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	mw, err := newMessageWriter(dst, format, isExt)
+	if err != nil {
+		return 0, err
+	}
+	cnt := int64(0)
+	for {
+		msg, err := mr.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cnt, err
+		}
+		err = mw.WriteMessage(msg)
+		if err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+	err = mw.Flush()
+	if err != nil {
+		return cnt, err
+	}
+	return cnt, dst.Sync()
+}
+
+// importTopicData rebuild the topic partition (the disk queue and the commit log) from
+// the exported file, the partition should be empty. The message id will be regenerated
+// unless keepID is set, the kept id should be increasing and belong to the partition.
+func importTopicData(fileName string, topicName string, part int, dataPath string,
+	isExt bool, keepID bool, maxBytesPerFile int64) (int64, error) {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	mr, err := newMessageReader(src)
+	if err != nil {
+		return 0, err
+	}
+
+	topicDataPath := consistence.GetTopicPartitionBasePath(dataPath, topicName, part)
+	err = os.MkdirAll(topicDataPath, 0755)
+	if err != nil {
+		return 0, err
+	}
+	tpLogMgr, err := consistence.InitTopicCommitLogMgr(topicName, part, topicDataPath, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer tpLogMgr.Close()
+	if tpLogMgr.GetLastCommitLogID() > 0 {
+		return 0, errors.New("the commit log of the topic partition is not empty")
+	}
+	backendWriter, err := nsqd.NewDiskQueueWriter(getBackendName(topicName, part), topicDataPath,
+		maxBytesPerFile, 1, nsqd.MAX_POSSIBLE_MSG_SIZE, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer backendWriter.Close()
+	if backendWriter.GetQueueWriteEnd().TotalMsgCnt() > 0 || backendWriter.GetQueueWriteEnd().Offset() > 0 {
+		return 0, errors.New("the topic data of the topic partition is not empty")
+	}
+	if tw, ok := backendWriter.(interface {
+		SetTimeIndexEnabled(bool)
+	}); ok {
+		tw.SetTimeIndexEnabled(true)
+	}
+
+	minID := int64(uint64(part) << consistence.MAX_INCR_ID_BIT)
+	maxID := int64(uint64(part+1) << consistence.MAX_INCR_ID_BIT)
+	var buf bytes.Buffer
+	cnt := int64(0)
+	for {
+		msg, err := mr.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cnt, err
+		}
+		if !isExt && msg.ExtVer != ext.NO_EXT_VER {
+			return cnt, errExtNotSupported
+		}
+		if keepID {
+			id := int64(msg.ID)
+			if id <= tpLogMgr.GetLastCommitLogID() || id <= minID || id >= maxID {
+				log.Printf("the message id %v is not valid for the partition %v, last id: %v\n",
+					id, part, tpLogMgr.GetLastCommitLogID())
+				return cnt, consistence.ErrCommitLogWrongID
+			}
+		} else {
+			msg.ID = nsqd.MessageID(tpLogMgr.NextID())
+		}
+		buf.Reset()
+		_, err = msg.WriteTo(&buf, isExt)
+		if err != nil {
+			return cnt, err
+		}
+		offset, size, totalCnt, err := backendWriter.Put(buf.Bytes())
+		if err != nil {
+			return cnt, err
+		}
+		err = tpLogMgr.AppendCommitLog(&consistence.CommitLogData{
+			LogID:        int64(msg.ID),
+			LastMsgLogID: int64(msg.ID),
+			MsgOffset:    int64(offset),
+			MsgSize:      size,
+			MsgCnt:       totalCnt,
+			MsgNum:       1,
+		}, true)
+		if err != nil {
+			return cnt, err
+		}
+		cnt++
+		if cnt%100000 == 0 {
+			log.Printf("imported %v messages\n", cnt)
+		}
+	}
+	err = backendWriter.Flush()
+	if err != nil {
+		return cnt, err
+	}
+	tpLogMgr.FlushCommitLogs()
+	return cnt, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/test"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const testMaxBytesPerFile = 1024 * 1024
+
+func newTestMessages(n int) []*nsqd.Message {
+	msgs := make([]*nsqd.Message, 0, n)
+	for i := 0; i < n; i++ {
+		body := []byte(fmt.Sprintf("body-%v", i))
+		var msg *nsqd.Message
+		switch i % 3 {
+		case 0:
+			msg = nsqd.NewMessage(nsqd.MessageID(i+1), body)
+		case 1:
+			header := fmt.Sprintf(`{"key":"value-%v","##trace":"%v"}`, i, i)
+			msg = nsqd.NewMessageWithExt(nsqd.MessageID(i+1), body, ext.JSON_HEADER_EXT_VER, []byte(header))
+		case 2:
+			msg = nsqd.NewMessageWithExt(nsqd.MessageID(i+1), body, ext.TAG_EXT_VER, []byte("tag"))
+		}
+		msg.TraceID = uint64(i)
+		msg.Attempts = uint16(i % 5)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func writeTestExportFile(t *testing.T, fileName string, format string, isExt bool, msgs []*nsqd.Message) {
+	f, err := createExportFile(fileName)
+	test.Nil(t, err)
+	defer f.Close()
+	mw, err := newMessageWriter(f, format, isExt)
+	test.Nil(t, err)
+	for _, msg := range msgs {
+		test.Nil(t, mw.WriteMessage(msg))
+	}
+	test.Nil(t, mw.Flush())
+}
+
+func readTestExportFile(t *testing.T, fileName string) []*nsqd.Message {
+	f, err := os.Open(fileName)
+	test.Nil(t, err)
+	defer f.Close()
+	mr, err := newMessageReader(f)
+	test.Nil(t, err)
+	var msgs []*nsqd.Message
+	for {
+		msg, err := mr.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		test.Nil(t, err)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func exportTestTopic(t *testing.T, dataPath string, topicName string, fileName string, format string, isExt bool) int64 {
+	topicDataPath := consistence.GetTopicPartitionBasePath(dataPath, topicName, 0)
+	backendName := getBackendName(topicName, 0)
+	backendWriter, err := nsqd.NewDiskQueueWriterForRead(backendName, topicDataPath, testMaxBytesPerFile, 1,
+		nsqd.MAX_POSSIBLE_MSG_SIZE, 1)
+	test.Nil(t, err)
+	defer backendWriter.Close()
+	snap := nsqd.NewDiskQueueSnapshot(backendName, topicDataPath, backendWriter.GetQueueReadEnd())
+	defer snap.Close()
+	snap.SetQueueStart(backendWriter.GetQueueReadStart())
+	test.Nil(t, snap.SeekTo(0))
+	cnt, err := exportTopicData(snap, fileName, format, isExt, 0, 0, 0)
+	test.Nil(t, err)
+	return cnt
+}
+
+func checkSameMessages(t *testing.T, expected []*nsqd.Message, got []*nsqd.Message, checkID bool) {
+	test.Equal(t, len(expected), len(got))
+	for i := range expected {
+		if checkID {
+			test.Equal(t, expected[i].ID, got[i].ID)
+		} else if i > 0 {
+			test.Equal(t, true, got[i].ID > got[i-1].ID)
+		}
+		test.Equal(t, expected[i].TraceID, got[i].TraceID)
+		test.Equal(t, expected[i].Timestamp, got[i].Timestamp)
+		test.Equal(t, expected[i].Attempts, got[i].Attempts)
+		test.Equal(t, expected[i].ExtVer, got[i].ExtVer)
+		test.Equal(t, string(expected[i].ExtBytes), string(got[i].ExtBytes))
+		test.Equal(t, string(expected[i].Body), string(got[i].Body))
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-export-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	topicName := "test_export"
+	msgs := newTestMessages(100)
+	for _, keepID := range []bool{true, false} {
+		for _, format := range []string{exportFormatJSON, exportFormatBinary} {
+			dir := path.Join(tmpDir, fmt.Sprintf("%v-%v", format, keepID))
+			test.Nil(t, os.MkdirAll(dir, 0755))
+			srcFile := path.Join(dir, "src")
+			writeTestExportFile(t, srcFile, format, true, msgs)
+			checkSameMessages(t, msgs, readTestExportFile(t, srcFile), true)
+
+			cnt, err := importTopicData(srcFile, topicName, 0, path.Join(dir, "data1"), true, keepID, testMaxBytesPerFile)
+			test.Nil(t, err)
+			test.Equal(t, int64(len(msgs)), cnt)
+			// the partition should be empty while importing
+			_, err = importTopicData(srcFile, topicName, 0, path.Join(dir, "data1"), true, keepID, testMaxBytesPerFile)
+			test.NotNil(t, err)
+
+			exported1 := path.Join(dir, "exported1")
+			cnt = exportTestTopic(t, path.Join(dir, "data1"), topicName, exported1, format, true)
+			test.Equal(t, int64(len(msgs)), cnt)
+			msgs1 := readTestExportFile(t, exported1)
+			checkSameMessages(t, msgs, msgs1, keepID)
+
+			// import the exported data again with the id kept should get the same data
+			cnt, err = importTopicData(exported1, topicName, 0, path.Join(dir, "data2"), true, true, testMaxBytesPerFile)
+			test.Nil(t, err)
+			test.Equal(t, int64(len(msgs)), cnt)
+			exported2 := path.Join(dir, "exported2")
+			cnt = exportTestTopic(t, path.Join(dir, "data2"), topicName, exported2, exportFormatJSON, true)
+			test.Equal(t, int64(len(msgs)), cnt)
+			checkSameMessages(t, msgs1, readTestExportFile(t, exported2), true)
+
+			converted := path.Join(dir, "converted")
+			cnt, err = convertExportedData(exported2, converted, exportFormatBinary, true)
+			test.Nil(t, err)
+			test.Equal(t, int64(len(msgs)), cnt)
+			checkSameMessages(t, msgs1, readTestExportFile(t, converted), true)
+		}
+	}
+}
+
+func TestImportInvalidData(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-import-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	topicName := "test_import"
+	msgs := newTestMessages(10)
+	importCnt := 0
+	importFile := func(name string, isExt bool, keepID bool) (int64, error) {
+		// import to the new partition every time since the partition should be empty
+		importCnt++
+		return importTopicData(path.Join(tmpDir, name), topicName, 0, path.Join(tmpDir, fmt.Sprintf("data-%v", importCnt)),
+			isExt, keepID, testMaxBytesPerFile)
+	}
+
+	// the truncated binary file
+	binFile := path.Join(tmpDir, "truncated")
+	writeTestExportFile(t, binFile, exportFormatBinary, true, msgs)
+	fi, err := os.Stat(binFile)
+	test.Nil(t, err)
+	test.Nil(t, os.Truncate(binFile, fi.Size()-3))
+	cnt, err := importFile("truncated", true, true)
+	test.Equal(t, io.ErrUnexpectedEOF, err)
+	test.Equal(t, int64(len(msgs)-1), cnt)
+
+	// the corrupt size of the binary record
+	corruptFile := path.Join(tmpDir, "corrupt")
+	writeTestExportFile(t, corruptFile, exportFormatBinary, true, msgs[:1])
+	f, err := os.OpenFile(corruptFile, os.O_WRONLY|os.O_APPEND, 0644)
+	test.Nil(t, err)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], nsqd.MAX_POSSIBLE_MSG_SIZE+1)
+	f.Write(size[:])
+	f.Close()
+	cnt, err = importFile("corrupt", true, true)
+	test.NotNil(t, err)
+	test.Equal(t, int64(1), cnt)
+
+	// the corrupt json line
+	jsonFile := path.Join(tmpDir, "corrupt_json")
+	writeTestExportFile(t, jsonFile, exportFormatJSON, true, msgs[:2])
+	f, err = os.OpenFile(jsonFile, os.O_WRONLY|os.O_APPEND, 0644)
+	test.Nil(t, err)
+	f.Write([]byte(`{"id":3,"body":`))
+	f.Close()
+	cnt, err = importFile("corrupt_json", true, true)
+	test.NotNil(t, err)
+	test.Equal(t, int64(2), cnt)
+
+	// the message with ext can not be imported to the topic without ext
+	cnt, err = importFile("corrupt_json", false, true)
+	test.Equal(t, errExtNotSupported, err)
+	test.Equal(t, int64(1), cnt)
+	_, err = newMessageWriter(ioutil.Discard, "unknown", true)
+	test.NotNil(t, err)
+
+	// the kept id should be increasing
+	reversed := []*nsqd.Message{msgs[1], msgs[0]}
+	writeTestExportFile(t, path.Join(tmpDir, "reversed"), exportFormatJSON, true, reversed)
+	cnt, err = importFile("reversed", true, true)
+	test.Equal(t, consistence.ErrCommitLogWrongID, err)
+	test.Equal(t, int64(1), cnt)
+	cnt, err = importFile("reversed", true, false)
+	test.Nil(t, err)
+	test.Equal(t, int64(2), cnt)
+}
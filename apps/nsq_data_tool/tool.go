@@ -19,17 +19,26 @@ var (
 	topic              = flag.String("topic", "", "NSQ topic")
 	partition          = flag.Int("partition", -1, "NSQ topic partition")
 	dataPath           = flag.String("data_path", "", "the data path of nsqd")
-	view               = flag.String("view", "commitlog", "commitlog | topicdata | delayedqueue")
+	view               = flag.String("view", "commitlog", "commitlog | topicdata | delayedqueue | export | import | convert")
 	searchMode         = flag.String("search_mode", "count", "the view start of mode. (count|id|timestamp|virtual_offset)")
 	viewStart          = flag.Int64("view_start", 0, "the start count of message.")
 	viewStartID        = flag.Int64("view_start_id", 0, "the start id of message.")
-	viewStartTimestamp = flag.Int64("view_start_timestamp", 0, "the start timestamp of message.")
+	viewStartTimestamp = flag.Int64("view_start_timestamp", 0, "the start timestamp (in second) of message.")
 	viewOffset         = flag.Int64("view_offset", 0, "the virtual offset of the queue")
 	viewCnt            = flag.Int("view_cnt", 1, "the total count need to be viewed. should less than 1,000,000")
 	viewCh             = flag.String("view_channel", "", "channel detail need to view")
 	logLevel           = flag.Int("level", 3, "log level")
 	//TODO: add ext ver for decode message
 	isExt = flag.Bool("ext", false, "is there extension for message ")
+
+	exportFormat       = flag.String("format", "json", "the format of the exported file. (json|binary)")
+	exportFile         = flag.String("export_file", "", "the file the messages exported to")
+	importFile         = flag.String("import_file", "", "the exported file the messages imported from")
+	exportMaxCnt       = flag.Int64("export_max_cnt", 0, "the max count of messages exported, 0 means export to the end")
+	exportEndID        = flag.Int64("export_end_id", 0, "stop export if the message id is larger than this")
+	exportEndTimestamp = flag.Int64("export_end_timestamp", 0, "stop export if the message timestamp (in second) is larger than this")
+	importKeepID       = flag.Bool("import_keep_id", false, "keep the message id while importing, the id should be increasing and belong to the partition")
+	maxBytesPerFile    = flag.Int64("max_bytes_per_file", 1024*1024*100, "the max bytes of the segment file for the imported topic data")
 )
 
 func getBackendName(topicName string, part int) string {
@@ -63,6 +72,23 @@ func main() {
 		log.Fatal("--view_cnt is too large")
 	}
 
+	if *view == "convert" {
+		cnt, err := convertExportedData(*importFile, *exportFile, *exportFormat, *isExt)
+		if err != nil {
+			log.Fatalf("convert failed after %v messages: %v", cnt, err)
+		}
+		log.Printf("converted %v messages to %v\n", cnt, *exportFile)
+		return
+	}
+	if *view == "import" {
+		cnt, err := importTopicData(*importFile, *topic, *partition, *dataPath, *isExt, *importKeepID, *maxBytesPerFile)
+		if err != nil {
+			log.Fatalf("import failed after %v messages: %v", cnt, err)
+		}
+		log.Printf("imported %v messages to topic %v-%v\n", cnt, *topic, *partition)
+		return
+	}
+
 	topicDataPath := path.Join(*dataPath, *topic)
 	topicCommitLogPath := consistence.GetTopicPartitionBasePath(*dataPath, *topic, *partition)
 	tpLogMgr, err := consistence.InitTopicCommitLogMgr(*topic, *partition, topicCommitLogPath, 0)
@@ -120,6 +146,7 @@ func main() {
 	// we need to search in the ordered log data.
 	searchOffset := int64(0)
 	searchLogIndexStart := int64(0)
+	viewQueueOffset := *viewOffset
 	if *searchMode == "count" {
 		searchLogIndexStart, searchOffset, _, err = tpLogMgr.SearchLogDataByMsgCnt(*viewStart)
 		if err != nil {
@@ -135,6 +162,20 @@ func main() {
 		if err != nil {
 			log.Fatalln(err)
 		}
+	} else if *searchMode == "timestamp" {
+		snap := nsqd.NewDiskQueueSnapshot(backendName, topicDataPath, backendWriter.GetQueueReadEnd())
+		snap.SetQueueStart(backendWriter.GetQueueReadStart())
+		queueOffset, queueCnt, err := snap.SearchByTimestamp(*viewStartTimestamp * 1000 * 1000 * 1000)
+		snap.Close()
+		if err != nil {
+			log.Fatalf("search by time index failed: %v", err)
+		}
+		log.Printf("time index searched queue offset: %v, count: %v\n", queueOffset, queueCnt)
+		viewQueueOffset = int64(queueOffset)
+		searchLogIndexStart, searchOffset, _, err = tpLogMgr.SearchLogDataByMsgOffset(viewQueueOffset)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	} else {
 		log.Fatalln("not supported search mode")
 	}
@@ -156,17 +197,27 @@ func main() {
 		for _, l := range logs {
 			fmt.Println(l)
 		}
-	} else if *view == "topicdata" {
+	} else if *view == "topicdata" || *view == "export" {
 		queueOffset := logData.MsgOffset
-		if *searchMode == "virtual_offset" {
-			if queueOffset != *viewOffset {
-				queueOffset = *viewOffset
-				log.Printf("search virtual offset not the same : %v, %v\n", logData.MsgOffset, *viewOffset)
+		if *searchMode == "virtual_offset" || *searchMode == "timestamp" {
+			if queueOffset != viewQueueOffset {
+				queueOffset = viewQueueOffset
+				log.Printf("search virtual offset not the same : %v, %v\n", logData.MsgOffset, viewQueueOffset)
 			}
 		}
 		backendReader := nsqd.NewDiskQueueSnapshot(backendName, topicDataPath, backendWriter.GetQueueReadEnd())
 		backendReader.SetQueueStart(backendWriter.GetQueueReadStart())
 		backendReader.SeekTo(nsqd.BackendOffset(queueOffset))
+		if *view == "export" {
+			cnt, err := exportTopicData(backendReader, *exportFile, *exportFormat, *isExt,
+				*exportMaxCnt, *exportEndID, *exportEndTimestamp)
+			backendReader.Close()
+			if err != nil {
+				log.Fatalf("export failed after %v messages: %v", cnt, err)
+			}
+			log.Printf("exported %v messages to %v\n", cnt, *exportFile)
+			return
+		}
 		cnt := *viewCnt
 		for cnt > 0 {
 			cnt--
@@ -113,6 +113,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Duration("req-to-end-threshold", opts.ReqToEndThreshold, "duration threshold for requeue message to queue end")
+	flagSet.Duration("broadcast-member-timeout", opts.BroadcastMemberTimeout, "duration to keep the broadcast channel member without any client (0 means never remove)")
 	// remove, deprecated
 	flagSet.Int64("max-message-size", opts.MaxMsgSize, "(deprecated use --max-msg-size) maximum size of a single message in bytes")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
@@ -156,6 +157,16 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int("retention-days", int(opts.RetentionDays), "the default retention days for topic data")
 	flagSet.Int64("retention-size-per-day", int64(opts.RetentionSizePerDay), "the default retention bytes in a day for topic data")
 	flagSet.Bool("start-as-fix-mode", opts.StartAsFixMode, "enable data fix at start")
+	flagSet.String("archive-path", opts.ArchivePath, "directory to archive the old topic data before cleaned by retention")
+	flagSet.String("backend-storage", opts.BackendStorage, "storage engine for new topics without the cluster (files, memory, kv), the storage in cluster is decided while creating the topic")
+	flagSet.String("delay-queue-engine", opts.DelayQueueEngine, "kv storage engine for the delayed queue (bolt, lsm)")
+	flagSet.Int64("topic-disk-quota", opts.TopicDiskQuota, "max bytes on disk for each topic partition, publish will be refused if exceeded (0 for no limit)")
+	flagSet.Float64("disk-high-watermark", opts.DiskHighWatermark, "used ratio of the data path disk to refuse publish and avoid new topic placement (0 to disable)")
+	flagSet.Bool("segment-preallocate", opts.SegmentPreallocate, "preallocate the disk space of max-bytes-per-file for new topic segment files")
+	flagSet.Bool("mmap-read", opts.MmapRead, "read the sealed topic segment files through mmap while consumers catching up old data")
+	flagSet.Duration("txn-window", opts.TxnWindow, "the window to detect the retried transaction which has been committed to the destination topic")
+	flagSet.Int("producer-seq-window", opts.ProducerSeqWindow, "the recent sequences kept for each producer to detect the retried publish")
+	flagSet.Duration("producer-expire", opts.ProducerExpire, "the producer state will be removed if no publish in the duration")
 	flagSet.Bool("allow-ext-compatible", opts.AllowExtCompatible, "allow pub ext to non-ext topic(ignore ext) .")
 	flagSet.Bool("allow-sub-ext-compatible", opts.AllowSubExtCompatible, "allow sub ext-topic without ext in message.")
 
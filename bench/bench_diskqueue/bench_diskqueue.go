@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+var (
+	dataPath        = flag.String("data-path", "", "directory for the queue data (default a temp directory)")
+	size            = flag.Int("size", 200, "size of messages")
+	totalBytes      = flag.Int64("total-bytes", 1024*1024*1024, "total bytes of the messages to write")
+	maxBytesPerFile = flag.Int64("max-bytes-per-file", 100*1024*1024, "number of bytes per segment file")
+	preallocate     = flag.Bool("preallocate", false, "preallocate the disk space for new segment files")
+	mmapRead        = flag.Bool("mmap", false, "read the sealed segment files through mmap")
+	rawSize         = flag.Int("raw-size", 1024*1024, "size of each raw read")
+)
+
+// bench the segment writes and the snapshot reads of the disk queue without network,
+// compare the results with and without -preallocate and -mmap.
+func main() {
+	flag.Parse()
+	log.SetPrefix("[bench_diskqueue] ")
+
+	dir := *dataPath
+	if dir == "" {
+		tmpDir, err := ioutil.TempDir("", "bench_diskqueue")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+		dir = tmpDir
+	}
+	name := "bench_diskqueue-" + time.Now().Format("20060102150405")
+	dq, err := nsqd.NewDiskQueueWriter(name, dir, *maxBytesPerFile, 1, int32(*size)+1, 10000)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dq.Close()
+	if p, ok := dq.(interface {
+		SetPreallocateEnabled(bool)
+	}); ok {
+		p.SetPreallocateEnabled(*preallocate)
+	}
+
+	msg := make([]byte, *size)
+	cnt := *totalBytes / int64(*size)
+	start := time.Now()
+	for i := int64(0); i < cnt; i++ {
+		_, _, _, err := dq.Put(msg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	dq.Flush()
+	printResult("write", time.Since(start), cnt, cnt*int64(*size))
+
+	newSnapshot := func() *nsqd.DiskQueueSnapshot {
+		s := nsqd.NewDiskQueueSnapshot(name, dir, dq.GetQueueReadEnd())
+		s.SetQueueStart(dq.GetQueueReadStart())
+		s.SetMmapReadEnabled(*mmapRead)
+		return s
+	}
+
+	snap := newSnapshot()
+	readCnt := int64(0)
+	readBytes := int64(0)
+	start = time.Now()
+	for {
+		ret := snap.ReadOne()
+		if ret.Err == io.EOF {
+			break
+		}
+		if ret.Err != nil {
+			log.Fatal(ret.Err)
+		}
+		readCnt++
+		readBytes += int64(len(ret.Data))
+	}
+	printResult("read", time.Since(start), readCnt, readBytes)
+	snap.Close()
+
+	snap = newSnapshot()
+	readCnt = 0
+	readBytes = 0
+	start = time.Now()
+	left := int64(dq.GetQueueReadEnd().Offset()) - int64(dq.GetQueueReadStart().Offset())
+	for left > 0 {
+		n := int64(*rawSize)
+		if n > left {
+			n = left
+		}
+		data, err := snap.ReadRaw(int32(n))
+		if err != nil {
+			log.Fatal(err)
+		}
+		readBytes += int64(len(data))
+		left -= int64(len(data))
+		readCnt++
+	}
+	printResult("read raw", time.Since(start), readCnt, readBytes)
+	snap.Close()
+}
+
+func printResult(op string, duration time.Duration, cnt int64, bytes int64) {
+	if cnt == 0 {
+		cnt = 1
+	}
+	log.Printf("%s duration: %s - %.03fmb/s - %.03fops/s - %.03fus/op",
+		op,
+		duration,
+		float64(bytes)/duration.Seconds()/1024/1024,
+		float64(cnt)/duration.Seconds(),
+		float64(duration/time.Microsecond)/float64(cnt))
+}
@@ -12,6 +12,7 @@ import (
 	"sync/atomic"
 
 	"github.com/youzan/nsq/internal/util"
+	"github.com/youzan/nsq/nsqd"
 )
 
 const (
@@ -272,7 +273,14 @@ type TopicCommitLogMgr struct {
 	currentStart  int64
 	currentCount  int32
 	logStartInfo  LogStartInfo
+	// the cleaned segments will be uploaded to the archiver if set
+	archiver         nsqd.SegmentArchiver
+	archiveKeyPrefix string
 	sync.Mutex
+	// the sequence of the appended logs and the logs fsynced, used for group commit
+	appendSeq int64
+	syncedSeq int64
+	syncMutex sync.Mutex
 }
 
 func GetTopicPartitionLogPath(basepath, t string, p int) string {
@@ -722,6 +730,13 @@ func (self *TopicCommitLogMgr) prepareCleanOldData(fileIndex int64, fileOffset i
 	return oldStartInfo, oldCurrentStart, nil
 }
 
+func (self *TopicCommitLogMgr) SetArchiver(archiver nsqd.SegmentArchiver, keyPrefix string) {
+	self.Lock()
+	self.archiver = archiver
+	self.archiveKeyPrefix = keyPrefix
+	self.Unlock()
+}
+
 func (self *TopicCommitLogMgr) CleanOldData(fileIndex int64, fileOffset int64) error {
 	// clean the commit segment before the specific file index
 	oldStartInfo, oldCurrentStart, err := self.prepareCleanOldData(fileIndex, fileOffset)
@@ -778,6 +793,23 @@ func (self *TopicCommitLogMgr) CleanOldData(fileIndex int64, fileOffset int64) e
 		}
 	}
 
+	self.Lock()
+	archiver := self.archiver
+	archiveKeyPrefix := self.archiveKeyPrefix
+	self.Unlock()
+	if archiver != nil {
+		// upload the segments before moving the log start, the clean will be retried
+		// at next time if failed to upload
+		for i := cleanStart; i < fileIndex; i++ {
+			fName := getSegmentFilename(self.path, i)
+			err = nsqd.ArchiveFile(archiver, archiveKeyPrefix, fName)
+			if err != nil {
+				coordLog.Warningf("archive commit segment %v failed: %v", fName, err)
+				return err
+			}
+		}
+	}
+
 	self.Lock()
 	if oldStartInfo != self.logStartInfo || oldCurrentStart != self.currentStart {
 		coordLog.Warningf("commit %v log start info changed: %v, %v, %v, %v",
@@ -1109,6 +1141,34 @@ func (self *TopicCommitLogMgr) AppendCommitLog(l *CommitLogData, slave bool) err
 	}
 	self.currentCount++
 	atomic.StoreInt64(&self.pLogID, l.LogID)
+	atomic.AddInt64(&self.appendSeq, 1)
+	return nil
+}
+
+func (self *TopicCommitLogMgr) GetAppendSeq() int64 {
+	return atomic.LoadInt64(&self.appendSeq)
+}
+
+// SyncTo make sure the commit logs appended before the sequence are fsynced,
+// the concurrent callers will share one fsync.
+func (self *TopicCommitLogMgr) SyncTo(seq int64) error {
+	if atomic.LoadInt64(&self.syncedSeq) >= seq {
+		return nil
+	}
+	self.syncMutex.Lock()
+	defer self.syncMutex.Unlock()
+	if atomic.LoadInt64(&self.syncedSeq) >= seq {
+		return nil
+	}
+	self.Lock()
+	self.flushCommitLogsNoLock()
+	cur := atomic.LoadInt64(&self.appendSeq)
+	err := self.appender.Sync()
+	self.Unlock()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&self.syncedSeq, cur)
 	return nil
 }
 
@@ -0,0 +1,301 @@
+package consistence
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+// The consumer group is the members consuming the same channel of the topic, each partition of the
+// topic will be assigned to only one member in the group. The membership is saved in the leadership
+// server and maintained by the nsqlookup leader, the member should heartbeat to keep alive and the
+// partitions will be rebalanced while any member joined or left (or expired).
+// The nsqd watches the groups and will fence the SUB_ORDERED using the assignment, and the consumers
+// of the unassigned member will be closed while the generation changed, so only the assigned member
+// can consume the ordered partition.
+
+var (
+	ErrConsumerGroupNotFound       = errors.New("consumer group not found")
+	ErrConsumerGroupMemberNotFound = errors.New("consumer group member not found")
+	ErrInvalidConsumerGroupMember  = errors.New("invalid consumer group member")
+)
+
+const (
+	ConsumerGroupSessionTimeout = time.Second * 30
+	consumerGroupCheckInterval  = time.Second * 5
+	maxConsumerGroupMemberLen   = 128
+)
+
+type ConsumerGroupMember struct {
+	ID string
+	// unix seconds of the last heartbeat
+	LastHeartbeat int64
+}
+
+type ConsumerGroupInfo struct {
+	Topic   string
+	Channel string
+	// increased while the assignment changed
+	Generation int64
+	Members    []ConsumerGroupMember
+	// the partition to the assigned member id
+	Assignment map[int]string
+	Epoch      EpochType `json:"-"`
+}
+
+func (self *ConsumerGroupInfo) findMember(id string) int {
+	for i, m := range self.Members {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetAssignedMember return the member assigned to the partition, empty if not assigned.
+func (self *ConsumerGroupInfo) GetAssignedMember(partition int) string {
+	return self.Assignment[partition]
+}
+
+func (self *ConsumerGroupInfo) GetAssignedPartitions(member string) []int {
+	parts := make([]int, 0)
+	for pid, m := range self.Assignment {
+		if m == member {
+			parts = append(parts, pid)
+		}
+	}
+	sort.Ints(parts)
+	return parts
+}
+
+// rebalance assign the partitions to the members by round robin on the sorted member ids,
+// return true if the assignment changed.
+func (self *ConsumerGroupInfo) rebalance(partitionNum int) bool {
+	ids := make([]string, 0, len(self.Members))
+	for _, m := range self.Members {
+		ids = append(ids, m.ID)
+	}
+	sort.Strings(ids)
+	newAssign := make(map[int]string, partitionNum)
+	if len(ids) > 0 {
+		for pid := 0; pid < partitionNum; pid++ {
+			newAssign[pid] = ids[pid%len(ids)]
+		}
+	}
+	changed := len(newAssign) != len(self.Assignment)
+	if !changed {
+		for pid, m := range newAssign {
+			if self.Assignment[pid] != m {
+				changed = true
+				break
+			}
+		}
+	}
+	if changed {
+		self.Assignment = newAssign
+		self.Generation++
+	}
+	return changed
+}
+
+func IsValidConsumerGroupMember(id string) bool {
+	return len(id) > 0 && len(id) <= maxConsumerGroupMemberLen && protocol.IsValidChannelName(id)
+}
+
+func (self *NsqLookupCoordinator) checkConsumerGroupParams(topic string, channel string, member string) error {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		return ErrNotNsqLookupLeader
+	}
+	if !protocol.IsValidTopicName(topic) {
+		return errors.New("invalid topic name")
+	}
+	if !protocol.IsValidChannelName(channel) {
+		return errors.New("invalid channel name")
+	}
+	if member != "" && !IsValidConsumerGroupMember(member) {
+		return ErrInvalidConsumerGroupMember
+	}
+	return nil
+}
+
+// updateConsumerGroup apply the change to the newest group info and save it with check-and-set,
+// the partitions will be rebalanced if the members changed. If no member left the group will be deleted.
+func (self *NsqLookupCoordinator) updateConsumerGroup(topic string, channel string,
+	updateFunc func(group *ConsumerGroupInfo) (bool, error)) (*ConsumerGroupInfo, error) {
+	self.consumerGroupMutex.Lock()
+	defer self.consumerGroupMutex.Unlock()
+	meta, _, err := self.leadership.GetTopicMetaInfo(topic)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil, ErrTopicNotCreated
+		}
+		return nil, err
+	}
+	group, err := self.leadership.GetConsumerGroup(topic, channel)
+	if err == ErrKeyNotFound {
+		group = &ConsumerGroupInfo{
+			Topic:   topic,
+			Channel: channel,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	changed, err := updateFunc(group)
+	if err != nil {
+		return nil, err
+	}
+	if !changed && len(group.Assignment) == meta.PartitionNum {
+		return group, nil
+	}
+	if len(group.Members) == 0 {
+		if group.Epoch == 0 {
+			return group, nil
+		}
+		coordLog.Infof("consumer group %v-%v has no member, delete it", topic, channel)
+		err = self.leadership.DeleteConsumerGroup(topic, channel, group.Epoch)
+		return group, err
+	}
+	if group.rebalance(meta.PartitionNum) {
+		coordLog.Infof("consumer group %v-%v rebalanced, generation: %v, assignment: %v",
+			topic, channel, group.Generation, group.Assignment)
+	}
+	err = self.leadership.UpdateConsumerGroup(topic, channel, group, group.Epoch)
+	if err != nil {
+		coordLog.Infof("update consumer group %v-%v failed: %v", topic, channel, err)
+		return nil, err
+	}
+	return group, nil
+}
+
+// JoinConsumerGroup add the member to the group (or refresh the heartbeat if already joined),
+// return the group with the newest assignment.
+func (self *NsqLookupCoordinator) JoinConsumerGroup(topic string, channel string, member string) (*ConsumerGroupInfo, error) {
+	if member == "" {
+		return nil, ErrInvalidConsumerGroupMember
+	}
+	if err := self.checkConsumerGroupParams(topic, channel, member); err != nil {
+		return nil, err
+	}
+	return self.updateConsumerGroup(topic, channel, func(group *ConsumerGroupInfo) (bool, error) {
+		now := time.Now().Unix()
+		if i := group.findMember(member); i != -1 {
+			group.Members[i].LastHeartbeat = now
+			return true, nil
+		}
+		coordLog.Infof("member %v join the consumer group %v-%v", member, topic, channel)
+		group.Members = append(group.Members, ConsumerGroupMember{ID: member, LastHeartbeat: now})
+		return true, nil
+	})
+}
+
+// HeartbeatConsumerGroup refresh the heartbeat of the member, the member should join again
+// if ErrConsumerGroupMemberNotFound returned since it may be expired.
+func (self *NsqLookupCoordinator) HeartbeatConsumerGroup(topic string, channel string, member string) (*ConsumerGroupInfo, error) {
+	if member == "" {
+		return nil, ErrInvalidConsumerGroupMember
+	}
+	if err := self.checkConsumerGroupParams(topic, channel, member); err != nil {
+		return nil, err
+	}
+	return self.updateConsumerGroup(topic, channel, func(group *ConsumerGroupInfo) (bool, error) {
+		i := group.findMember(member)
+		if i == -1 {
+			return false, ErrConsumerGroupMemberNotFound
+		}
+		group.Members[i].LastHeartbeat = time.Now().Unix()
+		return true, nil
+	})
+}
+
+func (self *NsqLookupCoordinator) LeaveConsumerGroup(topic string, channel string, member string) error {
+	if member == "" {
+		return ErrInvalidConsumerGroupMember
+	}
+	if err := self.checkConsumerGroupParams(topic, channel, member); err != nil {
+		return err
+	}
+	_, err := self.updateConsumerGroup(topic, channel, func(group *ConsumerGroupInfo) (bool, error) {
+		i := group.findMember(member)
+		if i == -1 {
+			return false, nil
+		}
+		coordLog.Infof("member %v leave the consumer group %v-%v", member, topic, channel)
+		group.Members = append(group.Members[:i], group.Members[i+1:]...)
+		return true, nil
+	})
+	if err == ErrTopicNotCreated {
+		return nil
+	}
+	return err
+}
+
+func (self *NsqLookupCoordinator) GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error) {
+	group, err := self.leadership.GetConsumerGroup(topic, channel)
+	if err == ErrKeyNotFound {
+		return nil, ErrConsumerGroupNotFound
+	}
+	return group, err
+}
+
+func (self *NsqLookupCoordinator) removeExpiredConsumerGroupMembers() {
+	groups, err := self.leadership.ScanConsumerGroups()
+	if err != nil {
+		if err != ErrKeyNotFound {
+			coordLog.Infof("scan consumer groups failed: %v", err)
+		}
+		return
+	}
+	expired := time.Now().Add(-1 * ConsumerGroupSessionTimeout).Unix()
+	for _, g := range groups {
+		hasExpired := false
+		for _, m := range g.Members {
+			if m.LastHeartbeat < expired {
+				hasExpired = true
+				break
+			}
+		}
+		if !hasExpired {
+			continue
+		}
+		_, err := self.updateConsumerGroup(g.Topic, g.Channel, func(group *ConsumerGroupInfo) (bool, error) {
+			alive := group.Members[:0]
+			for _, m := range group.Members {
+				if m.LastHeartbeat < expired {
+					coordLog.Infof("member %v of the consumer group %v-%v expired", m.ID, g.Topic, g.Channel)
+					continue
+				}
+				alive = append(alive, m)
+			}
+			changed := len(alive) != len(group.Members)
+			group.Members = alive
+			return changed, nil
+		})
+		if err == ErrTopicNotCreated {
+			// the topic has been deleted
+			self.consumerGroupMutex.Lock()
+			err = self.leadership.DeleteConsumerGroup(g.Topic, g.Channel, g.Epoch)
+			self.consumerGroupMutex.Unlock()
+		}
+		if err != nil {
+			coordLog.Infof("remove expired members of the consumer group %v-%v failed: %v", g.Topic, g.Channel, err)
+		}
+	}
+}
+
+func (self *NsqLookupCoordinator) handleConsumerGroups(monitorChan chan struct{}) {
+	ticker := time.NewTicker(consumerGroupCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-monitorChan:
+			return
+		case <-ticker.C:
+			if self.leadership == nil {
+				continue
+			}
+			self.removeExpiredConsumerGroupMembers()
+		}
+	}
+}
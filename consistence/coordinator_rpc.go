@@ -541,6 +541,7 @@ func (self *NsqdCoordRpcServer) GetTopicStats(topic string) *NodeTopicStats {
 		topicStats = self.nsqdCoord.localNsqd.GetTopicStatsWithFilter(false, topic, true)
 	}
 	stat := NewNodeTopicStats(self.nsqdCoord.myNode.GetID(), len(topicStats)*2, runtime.NumCPU())
+	stat.DiskFull = self.nsqdCoord.localNsqd.IsDiskFull()
 	for _, ts := range topicStats {
 		pid, _ := strconv.Atoi(ts.TopicPartition)
 		// filter the catchup node
@@ -148,6 +148,8 @@ type NodeTopicStats struct {
 	ChannelList            map[string][]string
 	ChannelMetas           map[string][]nsqd.ChannelMetaInfo
 	ChannelOffsets         map[string][]WrapChannelConsumerOffset
+	// the disk usage of the node exceed the high watermark, no more new topic should be placed.
+	DiskFull bool
 }
 
 func NewNodeTopicStats(nid string, cap int, cpus int) *NodeTopicStats {
@@ -544,7 +546,8 @@ func (self *DataPlacement) DoBalance(monitorChan chan struct{}) {
 				nodeTopicStats = append(nodeTopicStats, *topicStat)
 				leaderLF, nodeLF := topicStat.GetNodeLoadFactor()
 				coordLog.Infof("nsqd node %v load factor is : (%v, %v)", nodeID, leaderLF, nodeLF)
-				if leaderLF < minLeaderLoad {
+				// the disk full node should not be chosen as the idle node to move data in
+				if leaderLF < minLeaderLoad && !topicStat.DiskFull {
 					topicStatsMinMax[0] = topicStat
 					minLeaderLoad = leaderLF
 				}
@@ -1211,6 +1214,10 @@ func (self *DataPlacement) allocNodeForTopic(topicInfo *TopicPartitionMetaInfo,
 			coordLog.Infof("failed to get topic status for this node: %v", nodeInfo)
 			continue
 		}
+		if topicStat.DiskFull {
+			coordLog.Infof("ignore the disk full node %v for topic: %v", nodeID, topicInfo.GetTopicDesp())
+			continue
+		}
 		if chosenNode.ID == "" {
 			chosenNode = nodeInfo
 			chosenStat = topicStat
@@ -1336,6 +1343,10 @@ func (self *DataPlacement) allocTopicLeaderAndISR(orderedMulti bool, currentNode
 			coordLog.Infof("got topic status for node %v failed: %v", nodeInfo.GetID(), err)
 			continue
 		}
+		if stats.DiskFull {
+			coordLog.Infof("ignore the disk full node %v", nodeInfo.GetID())
+			continue
+		}
 		nodeTopicStats = append(nodeTopicStats, *stats)
 	}
 	if len(nodeTopicStats) < partitionNum*replica {
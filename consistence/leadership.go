@@ -82,6 +82,22 @@ type TopicMetaInfo struct {
 	OrderedMulti bool
 	//used for message ext
 	Ext bool
+	// write crc32 checksum for each message on disk, should be enabled only after all the nsqd upgraded
+	Checksum bool
+	// the compress codec for the data on disk, empty means no compression
+	Compression string
+	// when the write can be acked: none, leader-fsync, all-isr-fsync. empty means none
+	Durability string
+	// the storage engine for the topic data: files, memory, kv. only used while creating,
+	// empty means the default of nsqd.
+	Storage string
+	// the json header key for the compaction of the ext topic, only the newest message
+	// of each key will be kept. empty means no compaction.
+	CompactKey string
+	// the max bytes on disk for each partition, 0 means the default of nsqd.
+	DiskQuota int64
+	// the window in seconds to dedup the messages by the dedup key of the ext topic, 0 means no dedup.
+	DedupWindow int64
 }
 
 type TopicPartitionReplicaInfo struct {
@@ -189,6 +205,14 @@ type NSQLookupdLeadership interface {
 	ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error
 	// get topic meta info map with passing topics slice
 	GetTopicsMetaInfoMap(topics []string) (map[string]TopicMetaInfo, error)
+	// get the consumer group of the topic channel, return ErrKeyNotFound if not exist.
+	// the epoch in the returned group should be used for update.
+	GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error)
+	// create the consumer group if oldGen is 0, otherwise do check-and-set.
+	// the epoch in group should be updated to the new epoch
+	UpdateConsumerGroup(topic string, channel string, group *ConsumerGroupInfo, oldGen EpochType) error
+	DeleteConsumerGroup(topic string, channel string, oldGen EpochType) error
+	ScanConsumerGroups() ([]ConsumerGroupInfo, error)
 }
 
 type NSQDLeadership interface {
@@ -207,4 +231,9 @@ type NSQDLeadership interface {
 	GetTopicInfo(topic string, partition int) (*TopicPartitionMetaInfo, error)
 	// get leadership information, if not exist should return ErrLeaderSessionNotExist as error
 	GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error)
+	// get the consumer group of the topic channel, return ErrKeyNotFound if not exist
+	GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error)
+	// get all the consumer groups and watch the change of them, all the groups will be
+	// sent while any changed.
+	WatchConsumerGroups(groups chan []ConsumerGroupInfo, stop chan struct{}) error
 }
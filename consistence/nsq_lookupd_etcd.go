@@ -787,6 +787,79 @@ func (self *NsqLookupdEtcdMgr) ReleaseTopicLeader(topic string, partition int, s
 	return err
 }
 
+func (self *NsqLookupdEtcdMgr) GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error) {
+	rsp, err := self.client.GetNewest(self.createConsumerGroupPath(topic, channel), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	var group ConsumerGroupInfo
+	if err = json.Unmarshal([]byte(rsp.Node.Value), &group); err != nil {
+		return nil, err
+	}
+	group.Epoch = EpochType(rsp.Node.ModifiedIndex)
+	return &group, nil
+}
+
+func (self *NsqLookupdEtcdMgr) UpdateConsumerGroup(topic string, channel string, group *ConsumerGroupInfo, oldGen EpochType) error {
+	value, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	var rsp *client.Response
+	if oldGen == 0 {
+		rsp, err = self.client.Create(self.createConsumerGroupPath(topic, channel), string(value), 0)
+	} else {
+		rsp, err = self.client.CompareAndSwap(self.createConsumerGroupPath(topic, channel), string(value), 0, "", uint64(oldGen))
+	}
+	if err != nil {
+		return err
+	}
+	group.Epoch = EpochType(rsp.Node.ModifiedIndex)
+	return nil
+}
+
+func (self *NsqLookupdEtcdMgr) DeleteConsumerGroup(topic string, channel string, oldGen EpochType) error {
+	var err error
+	if oldGen == 0 {
+		_, err = self.client.Delete(self.createConsumerGroupPath(topic, channel), false)
+	} else {
+		_, err = self.client.CompareAndDelete(self.createConsumerGroupPath(topic, channel), "", uint64(oldGen))
+	}
+	if err != nil && client.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (self *NsqLookupdEtcdMgr) ScanConsumerGroups() ([]ConsumerGroupInfo, error) {
+	rsp, err := self.client.GetNewest(self.createConsumerGroupRootPath(), false, true)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	groups := make([]ConsumerGroupInfo, 0)
+	for _, topicNode := range rsp.Node.Nodes {
+		for _, chNode := range topicNode.Nodes {
+			if chNode.Dir {
+				continue
+			}
+			var group ConsumerGroupInfo
+			if err := json.Unmarshal([]byte(chNode.Value), &group); err != nil {
+				coordLog.Infof("unmarshal consumer group %v failed: %v", chNode.Key, err)
+				continue
+			}
+			group.Epoch = EpochType(chNode.ModifiedIndex)
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
 func (self *NsqLookupdEtcdMgr) createClusterPath() string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID)
 }
@@ -830,3 +903,11 @@ func (self *NsqLookupdEtcdMgr) createTopicReplicaInfoPath(topic string, partitio
 func (self *NsqLookupdEtcdMgr) createTopicLeaderSessionPath(topic string, partition int) string {
 	return path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION)
 }
+
+func (self *NsqLookupdEtcdMgr) createConsumerGroupRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_CONSUMER_GROUP_DIR)
+}
+
+func (self *NsqLookupdEtcdMgr) createConsumerGroupPath(topic string, channel string) string {
+	return path.Join(self.createConsumerGroupRootPath(), topic, channel)
+}
@@ -74,6 +74,21 @@ type ILocalLogQueue interface {
 	TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanOffset nsqd.BackendOffset) (nsqd.BackendQueueEnd, error)
 }
 
+func newTopicDynamicConf(meta *TopicMetaInfo) *nsqd.TopicDynamicConf {
+	return &nsqd.TopicDynamicConf{SyncEvery: int64(meta.SyncEvery),
+		AutoCommit:   0,
+		RetentionDay: meta.RetentionDay,
+		OrderedMulti: meta.OrderedMulti,
+		Ext:          meta.Ext,
+		Checksum:     meta.Checksum,
+		Compression:  meta.Compression,
+		Durability:   meta.Durability,
+		CompactKey:   meta.CompactKey,
+		DiskQuota:    meta.DiskQuota,
+		DedupWindow:  meta.DedupWindow,
+	}
+}
+
 func getCommitLogAndLocalLogQ(tcData *coordData, localTopic *nsqd.Topic,
 	fromDelayedQueue bool) (ILocalLogQueue, *TopicCommitLogMgr) {
 	var localLogQ ILocalLogQueue
@@ -150,6 +165,9 @@ type NsqdCoordinator struct {
 	enableBenchCost        bool
 	stopping               int32
 	catchupRunning         int32
+	consumerGroupMutex     sync.RWMutex
+	// the consumer groups watched from the leadership, nil if not synced yet
+	consumerGroups map[string]*ConsumerGroupInfo
 }
 
 func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string, rootPath string, nsqd *nsqd.NSQD) *NsqdCoordinator {
@@ -221,6 +239,8 @@ func (self *NsqdCoordinator) acquireRpcClient(nid string) (*NsqdRpcClient, *Coor
 func (self *NsqdCoordinator) Start() error {
 	self.wg.Add(1)
 	go self.watchNsqLookupd()
+	self.wg.Add(1)
+	go self.watchConsumerGroups()
 
 	start := time.Now()
 	for {
@@ -391,6 +411,14 @@ func (self *NsqdCoordinator) checkAndCleanOldData() {
 				}
 				doLogQClean(tcData, localTopic, retentionSize, false)
 				doLogQClean(tcData, localTopic, retentionSize, true)
+				if tcData.topicInfo.CompactKey != "" {
+					removed, err := localTopic.TryCompactData()
+					if err != nil {
+						coordLog.Infof("topic %v compact failed: %v", tcData.topicInfo.GetTopicDesp(), err)
+					} else if removed > 0 {
+						coordLog.Infof("topic %v compacted, removed %v bytes", tcData.topicInfo.GetTopicDesp(), removed)
+					}
+				}
 			}
 		}
 	}
@@ -514,6 +542,93 @@ func (self *NsqdCoordinator) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error)
 	return self.leadership.GetAllLookupdNodes()
 }
 
+func getConsumerGroupKey(topic string, channel string) string {
+	return topic + "/" + channel
+}
+
+// GetConsumerGroup return ErrConsumerGroupNotFound if no consumer group for the channel. The groups
+// watched from the leadership are used, and the leadership is only read before the watch synced.
+func (self *NsqdCoordinator) GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error) {
+	if self.leadership == nil {
+		return nil, ErrConsumerGroupNotFound
+	}
+	self.consumerGroupMutex.RLock()
+	groups := self.consumerGroups
+	self.consumerGroupMutex.RUnlock()
+	if groups != nil {
+		group, ok := groups[getConsumerGroupKey(topic, channel)]
+		if !ok {
+			return nil, ErrConsumerGroupNotFound
+		}
+		return group, nil
+	}
+	group, err := self.leadership.GetConsumerGroup(topic, channel)
+	if err == ErrKeyNotFound {
+		return nil, ErrConsumerGroupNotFound
+	}
+	return group, err
+}
+
+func (self *NsqdCoordinator) watchConsumerGroups() {
+	defer self.wg.Done()
+	if self.leadership == nil {
+		return
+	}
+	groupsChan := make(chan []ConsumerGroupInfo, 1)
+	go self.leadership.WatchConsumerGroups(groupsChan, self.stopChan)
+	for {
+		select {
+		case groups, ok := <-groupsChan:
+			if !ok {
+				return
+			}
+			self.updateConsumerGroups(groups)
+		}
+	}
+}
+
+// updateConsumerGroups replace the cached groups, and fence the consumers of the group with
+// the changed generation.
+func (self *NsqdCoordinator) updateConsumerGroups(groups []ConsumerGroupInfo) {
+	newGroups := make(map[string]*ConsumerGroupInfo, len(groups))
+	for i := range groups {
+		newGroups[getConsumerGroupKey(groups[i].Topic, groups[i].Channel)] = &groups[i]
+	}
+	self.consumerGroupMutex.Lock()
+	oldGroups := self.consumerGroups
+	self.consumerGroups = newGroups
+	self.consumerGroupMutex.Unlock()
+	for key, group := range newGroups {
+		if old, ok := oldGroups[key]; ok && old.Generation == group.Generation {
+			continue
+		}
+		self.fenceConsumerGroup(group)
+	}
+}
+
+// fenceConsumerGroup close the consumers of the ordered channel on the local leader partitions if
+// the partition is not assigned to the member of the consumer, so the old member can not consume
+// after the partition reassigned.
+func (self *NsqdCoordinator) fenceConsumerGroup(group *ConsumerGroupInfo) {
+	for part, topic := range self.localNsqd.GetTopicPartitions(group.Topic) {
+		if !self.IsMineConsumeLeaderForTopic(group.Topic, part) {
+			continue
+		}
+		ch, err := topic.GetExistingChannel(group.Channel)
+		if err != nil || !ch.IsOrdered() {
+			continue
+		}
+		assigned := group.GetAssignedMember(part)
+		for _, c := range ch.GetClients() {
+			if member := c.Stats().ConsumerGroupMember; member == "" || member != assigned {
+				coordLog.Infof("kick the consumer %v (member %v) from %v-%v:%v since the partition is assigned to %v, generation %v",
+					c, member, group.Topic, part, group.Channel, assigned, group.Generation)
+				c.Exit()
+			}
+		}
+	}
+}
+
 func (self *NsqdCoordinator) watchNsqLookupd() {
 	// watch the leader of nsqlookupd, always check the leader before response
 	// to the nsqlookup admin operation.
@@ -739,12 +854,7 @@ func (self *NsqdCoordinator) loadLocalTopicData() error {
 				coordLog.Errorf("no coordinator for topic: %v", topicInfo.GetTopicDesp())
 				continue
 			}
-			dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(topicInfo.SyncEvery),
-				AutoCommit:   0,
-				RetentionDay: topicInfo.RetentionDay,
-				OrderedMulti: topicInfo.OrderedMulti,
-				Ext:          topicInfo.Ext,
-			}
+			dyConf := newTopicDynamicConf(&topicInfo.TopicMetaInfo)
 			tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 			maybeInitDelayedQ(tc.GetData(), topic)
 			topic.SetDynamicInfo(*dyConf, tc.GetData().logMgr)
@@ -1137,8 +1247,9 @@ func (self *NsqdCoordinator) SearchLogByMsgOffset(topic string, part int, offset
 		}
 
 		for {
-			ret := snap.ReadOne()
-			if ret.Err != nil {
+			// the compacted records should be counted
+			ret := snap.ReadOneRecord()
+			if ret.Err != nil && ret.Err != nsqd.ErrRecordCompacted {
 				coordLog.Infof("read disk queue error: %v", ret.Err)
 				if ret.Err == io.EOF {
 					return l, realOffset, curCount, nil
@@ -1181,8 +1292,9 @@ func (self *NsqdCoordinator) SearchLogByMsgCnt(topic string, part int, count int
 		}
 
 		for {
-			ret := snap.ReadOne()
-			if ret.Err != nil {
+			// the compacted records should be counted
+			ret := snap.ReadOneRecord()
+			if ret.Err != nil && ret.Err != nsqd.ErrRecordCompacted {
 				coordLog.Infof("read disk queue error: %v", ret.Err)
 				if ret.Err == io.EOF {
 					return l, realOffset, curCount, nil
@@ -1280,6 +1392,21 @@ func (self *NsqdCoordinator) SearchLogByMsgTimestamp(topic string, part int, ts_
 	}
 
 	startSearch := time.Now()
+	// try the time index first, and fallback to search the commit log if the
+	// data has no time index.
+	indexOffset, indexCnt, localErr := snap.SearchByTimestamp(comp.searchTs)
+	if localErr == nil {
+		coordLog.Infof("search time index cost: %v", time.Since(startSearch))
+		var l *CommitLogData
+		_, _, l, localErr = tcData.logMgr.SearchLogDataByMsgOffset(int64(indexOffset))
+		if localErr == nil && l != nil {
+			return l, int64(indexOffset), indexCnt, nil
+		}
+		if localErr == nil {
+			localErr = fmt.Errorf("no commit log for the indexed offset %v", indexOffset)
+		}
+	}
+	coordLog.Infof("search time index failed: %v, fallback to search commit log", localErr)
 	_, _, l, localErr := tcData.logMgr.SearchLogDataByComparator(comp)
 	coordLog.Infof("search log cost: %v", time.Since(startSearch))
 	if localErr != nil {
@@ -1295,8 +1422,14 @@ func (self *NsqdCoordinator) SearchLogByMsgTimestamp(topic string, part int, ts_
 	curCount := l.MsgCnt - 1
 
 	for {
-		ret := snap.ReadOne()
-		if ret.Err != nil {
+		ret := snap.ReadOneRecord()
+		if ret.Err == nsqd.ErrRecordCompacted {
+			if curCount > l.MsgCnt+int64(l.MsgNum-1) {
+				break
+			}
+			realOffset = int64(ret.Offset) + int64(ret.MovedSize)
+			curCount++
+		} else if ret.Err != nil {
 			coordLog.Infof("read disk queue error: %v", ret.Err)
 			if ret.Err == io.EOF {
 				return l, realOffset, curCount, nil
@@ -1829,12 +1962,7 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 		return coordErr
 	}
 
-	dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(topicInfo.SyncEvery),
-		AutoCommit:   0,
-		RetentionDay: topicInfo.RetentionDay,
-		OrderedMulti: topicInfo.OrderedMulti,
-		Ext:          topicInfo.Ext,
-	}
+	dyConf := newTopicDynamicConf(&topicInfo.TopicMetaInfo)
 	tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tc.GetData().logMgr)
 
@@ -1966,6 +2094,12 @@ func (self *NsqdCoordinator) syncChannelsFromOther(c *NsqdRpcClient, topicInfo T
 					if meta.IsZanTestSkipepd() {
 						ch.SkipZanTest()
 					}
+					ch.SetMaxAttempts(meta.MaxAttempts)
+					ch.SetRateLimit(meta.MsgRateLimit, meta.ByteRateLimit)
+					ch.SetExtFilterFromMeta(&meta)
+					ch.SetRequeuePolicyFromMeta(&meta)
+					ch.SetPriorityLane(meta.PriorityLane)
+					ch.SetBroadcastFromMeta(&meta)
 				}
 				if offset, ok := consumerOffsetMap[chName]; ok {
 					offset.AllowBackward = true
@@ -2291,12 +2425,7 @@ func (self *NsqdCoordinator) updateTopicLeaderSession(topicCoord *TopicCoordinat
 		coordLog.Infof("no topic on local: %v, %v", tcData.topicInfo.GetTopicDesp(), err)
 		return ErrLocalMissingTopic
 	}
-	dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(tcData.topicInfo.SyncEvery),
-		AutoCommit:   0,
-		RetentionDay: tcData.topicInfo.RetentionDay,
-		OrderedMulti: tcData.topicInfo.OrderedMulti,
-		Ext:          tcData.topicInfo.Ext,
-	}
+	dyConf := newTopicDynamicConf(&tcData.topicInfo.TopicMetaInfo)
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tcData.logMgr)
 	// leader changed (maybe down), we make sure out data is flushed to keep data safe
@@ -2347,6 +2476,18 @@ func (self *NsqdCoordinator) GetMasterTopicCoordData(topic string) (int, *coordD
 	return -1, nil, ErrMissingTopicCoord.ToErrorType()
 }
 
+// GetTopicPartitionNum return the partition number of the topic which has any partition on this node
+func (self *NsqdCoordinator) GetTopicPartitionNum(topic string) (int, error) {
+	self.coordMutex.RLock()
+	defer self.coordMutex.RUnlock()
+	if v, ok := self.topicCoords[topic]; ok {
+		for _, tc := range v {
+			return tc.GetData().topicInfo.PartitionNum, nil
+		}
+	}
+	return 0, ErrMissingTopicCoord.ToErrorType()
+}
+
 func (self *NsqdCoordinator) getTopicCoordData(topic string, partition int) (*coordData, *CoordErr) {
 	c, err := self.getTopicCoord(topic, partition)
 	if err != nil {
@@ -2541,6 +2682,14 @@ func (self *NsqdCoordinator) readTopicRawData(topic string, partition int, offse
 			coordLog.Infof("read topic data at offset %v, size:%v, error: %v", offset, size, err)
 			break
 		}
+		// avoid sending the damaged data to replicas
+		err = nsqd.CheckRawRecords(buf)
+		if err != nil {
+			coordLog.Errorf("read topic %v data at offset %v, size:%v, corrupted: %v", t.GetFullName(), offset, size, err)
+			t.SetDataFixState(true)
+			go self.HandleLocalDataCorrupted(topic, partition, err)
+			break
+		}
 		dataList = append(dataList, buf)
 	}
 	if err != nil {
@@ -2549,6 +2698,34 @@ func (self *NsqdCoordinator) readTopicRawData(topic string, partition int, offse
 	return dataList, nil
 }
 
+// HandleLocalDataCorrupted should be called after the local topic is marked as need fix
+// because of the corrupt data. We leave the isr, so the damaged data
+// can be fetched again from the other isr nodes while catchup.
+func (self *NsqdCoordinator) HandleLocalDataCorrupted(topic string, partition int, corruptErr error) {
+	tcData, err := self.getTopicCoordData(topic, partition)
+	if err != nil {
+		coordLog.Warningf("topic %v-%v data corrupted but no coordinator: %v", topic, partition, corruptErr)
+		return
+	}
+	topicInfo := tcData.topicInfo
+	if FindSlice(topicInfo.ISR, self.myNode.GetID()) == -1 {
+		// the data will be fixed while catchup since it is marked as fix
+		coordLog.Infof("topic %v data corrupted while not in isr: %v", topicInfo.GetTopicDesp(), corruptErr)
+		return
+	}
+	if len(topicInfo.ISR) <= 1 {
+		coordLog.Errorf("topic %v data corrupted without any other isr node to fix from: %v",
+			topicInfo.GetTopicDesp(), corruptErr)
+		return
+	}
+	coordLog.Warningf("topic %v data corrupted, leaving isr to fetch data from other isr nodes: %v",
+		topicInfo.GetTopicDesp(), corruptErr)
+	coordErr := self.requestLeaveFromISR(topic, partition)
+	if coordErr != nil {
+		coordLog.Warningf("topic %v request leave isr failed: %v", topicInfo.GetTopicDesp(), coordErr)
+	}
+}
+
 // flush cached data to disk. This should be called when topic isr list
 // changed or leader changed.
 func (self *NsqdCoordinator) notifyFlushData(topic string, partition int) {
@@ -2560,7 +2737,13 @@ func (self *NsqdCoordinator) notifyFlushData(topic string, partition int) {
 
 func (self *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInfo, tcData *coordData) (*nsqd.Topic, *CoordErr) {
 	// check topic exist and prepare on local.
-	t := self.localNsqd.GetTopicWithDisabled(topicInfo.Name, topicInfo.Partition, topicInfo.Ext, topicInfo.OrderedMulti)
+	// the storage of the topic is decided while creating, and the topic created before the
+	// storage introduced has no storage in meta.
+	storage := topicInfo.Storage
+	if storage == "" {
+		storage = nsqd.BackendStorageFiles
+	}
+	t := self.localNsqd.GetTopicWithStorage(topicInfo.Name, topicInfo.Partition, topicInfo.Ext, topicInfo.OrderedMulti, storage)
 	if t == nil {
 		return nil, ErrLocalInitTopicFailed
 	}
@@ -2568,18 +2751,20 @@ func (self *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInfo,
 	if localErr != nil {
 		return t, ErrLocalInitTopicFailed
 	}
-	dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(topicInfo.SyncEvery),
-		AutoCommit:   0,
-		RetentionDay: topicInfo.RetentionDay,
-		OrderedMulti: topicInfo.OrderedMulti,
-		Ext:          topicInfo.Ext,
-	}
+	dyConf := newTopicDynamicConf(&topicInfo.TopicMetaInfo)
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localErr = maybeInitDelayedQ(tcData, t)
 	if localErr != nil {
 		return t, ErrLocalInitTopicFailed
 	}
 	t.SetDynamicInfo(*dyConf, tcData.logMgr)
+	if archiver := self.localNsqd.GetOpts().Archiver; archiver != nil {
+		keyPrefix := path.Join(nsqd.GetTopicFullName(topicInfo.Name, topicInfo.Partition), "commitlog")
+		tcData.logMgr.SetArchiver(archiver, keyPrefix)
+		if tcData.delayedLogMgr != nil {
+			tcData.delayedLogMgr.SetArchiver(archiver, path.Join(keyPrefix, "delayed_queue"))
+		}
+	}
 
 	return t, nil
 }
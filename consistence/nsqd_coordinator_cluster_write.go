@@ -22,6 +22,16 @@ type handleSyncResultFunc func(int, *coordData) bool
 
 type checkDupFunc func(*coordData) bool
 
+// waitLocalDurable hold the write ack until the local data and commit log are fsynced.
+// The leader should call it out of the write lock, so the concurrent writers can share one fsync.
+func waitLocalDurable(topic *nsqd.Topic, logMgr *TopicCommitLogMgr, queueEnd nsqd.BackendQueueEnd, logSeq int64) error {
+	err := topic.SyncTo(queueEnd.Offset())
+	if err != nil {
+		return err
+	}
+	return logMgr.SyncTo(logSeq)
+}
+
 func (self *NsqdCoordinator) PutMessageBodyToCluster(topic *nsqd.Topic,
 	body []byte, traceID uint64) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
 	msg := nsqd.NewMessage(0, body)
@@ -59,6 +69,7 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 	}
 
 	var logMgr *TopicCommitLogMgr
+	var logSeq int64
 	var delayQ *nsqd.DelayQueue
 	doLocalWrite := func(d *coordData) *CoordErr {
 		logMgr = d.logMgr
@@ -117,6 +128,7 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 			coordLog.Errorf("topic : %v failed write commit log : %v, logmgr: %v, %v",
 				topic.GetFullName(), localErr, logMgr.pLogID, logMgr.nLogID)
 		}
+		logSeq = logMgr.GetAppendSeq()
 		if !putDelayed {
 			topic.Lock()
 			topic.UpdateCommittedOffset(queueEnd)
@@ -188,7 +200,13 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 	var err error
 	if clusterErr != nil {
 		err = clusterErr.ToErrorType()
-	} else if coordLog.Level() >= levellogger.LOG_DETAIL {
+	} else if !putDelayed && topic.GetDurabilityLevel() != nsqd.DurabilityNone {
+		err = waitLocalDurable(topic, logMgr, queueEnd, logSeq)
+		if err != nil {
+			coordLog.Warningf("topic %v failed to sync the write %v: %v", topic.GetFullName(), commitLog, err)
+		}
+	}
+	if err == nil && coordLog.Level() >= levellogger.LOG_DETAIL {
 		coordLog.Infof("sync write success put offset: %v, logmgr: %v, %v",
 			commitLog, logMgr.pLogID, logMgr.nLogID)
 	}
@@ -208,6 +226,7 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 
 	var queueEnd nsqd.BackendQueueEnd
 	var logMgr *TopicCommitLogMgr
+	var logSeq int64
 
 	doLocalWrite := func(d *coordData) *CoordErr {
 		topic.Lock()
@@ -247,6 +266,7 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 			coordLog.Errorf("topic : %v failed write commit log : %v, logMgr: %v, %v",
 				topic.GetFullName(), localErr, logMgr.pLogID, logMgr.nLogID)
 		}
+		logSeq = logMgr.GetAppendSeq()
 		topic.Lock()
 		topic.UpdateCommittedOffset(queueEnd)
 		topic.Unlock()
@@ -294,7 +314,13 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 	var err error
 	if clusterErr != nil {
 		err = clusterErr.ToErrorType()
-	} else if coordLog.Level() >= levellogger.LOG_DETAIL {
+	} else if topic.GetDurabilityLevel() != nsqd.DurabilityNone {
+		err = waitLocalDurable(topic, logMgr, queueEnd, logSeq)
+		if err != nil {
+			coordLog.Warningf("topic %v failed to sync the write %v: %v", topic.GetFullName(), commitLog, err)
+		}
+	}
+	if err == nil && coordLog.Level() >= levellogger.LOG_DETAIL {
 		coordLog.Infof("sync write success put offset: %v, logmgr: %v, %v",
 			commitLog, logMgr.pLogID, logMgr.nLogID)
 	}
@@ -596,6 +622,9 @@ func (self *NsqdCoordinator) putRawDataOnSlave(coord *TopicCoordinator, logData
 			topic.Lock()
 			topic.UpdateCommittedOffset(queueEnd)
 			topic.Unlock()
+			if topic.GetDurabilityLevel() == nsqd.DurabilityAllISRFsync {
+				return waitLocalDurable(topic, logMgr, queueEnd, logMgr.GetAppendSeq())
+			}
 		}
 		return nil
 	}
@@ -685,6 +714,9 @@ func (self *NsqdCoordinator) putMessageOnSlave(coord *TopicCoordinator, logData
 			topic.Lock()
 			topic.UpdateCommittedOffset(queueEnd)
 			topic.Unlock()
+			if topic.GetDurabilityLevel() == nsqd.DurabilityAllISRFsync {
+				return waitLocalDurable(topic, logMgr, queueEnd, logMgr.GetAppendSeq())
+			}
 		}
 		return nil
 	}
@@ -786,6 +818,10 @@ func (self *NsqdCoordinator) putMessagesOnSlave(coord *TopicCoordinator, logData
 		topic.Lock()
 		topic.UpdateCommittedOffset(queueEnd)
 		topic.Unlock()
+		if topic.GetDurabilityLevel() == nsqd.DurabilityAllISRFsync {
+			// the slave ack to leader after fsynced, and the leader will hold the client ack
+			return waitLocalDurable(topic, logMgr, queueEnd, logMgr.GetAppendSeq())
+		}
 		return nil
 	}
 
@@ -354,6 +354,98 @@ func (self *NsqdEtcdMgr) GetTopicLeaderSession(topic string, partition int) (*To
 	return &topicLeaderSession, nil
 }
 
+func (self *NsqdEtcdMgr) GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error) {
+	rsp, err := self.client.GetNewest(self.createConsumerGroupPath(topic, channel), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	var group ConsumerGroupInfo
+	if err = json.Unmarshal([]byte(rsp.Node.Value), &group); err != nil {
+		return nil, err
+	}
+	group.Epoch = EpochType(rsp.Node.ModifiedIndex)
+	return &group, nil
+}
+
+func (self *NsqdEtcdMgr) scanConsumerGroups() ([]ConsumerGroupInfo, uint64, error) {
+	rsp, err := self.client.GetNewest(self.createConsumerGroupRootPath(), false, true)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			// no any consumer group
+			return nil, err.(client.Error).Index, nil
+		}
+		return nil, 0, err
+	}
+	groups := make([]ConsumerGroupInfo, 0)
+	for _, topicNode := range rsp.Node.Nodes {
+		for _, chNode := range topicNode.Nodes {
+			if chNode.Dir {
+				continue
+			}
+			var group ConsumerGroupInfo
+			if err := json.Unmarshal([]byte(chNode.Value), &group); err != nil {
+				coordLog.Infof("unmarshal consumer group %v failed: %v", chNode.Key, err)
+				continue
+			}
+			group.Epoch = EpochType(chNode.ModifiedIndex)
+			groups = append(groups, group)
+		}
+	}
+	return groups, rsp.Index, nil
+}
+
+func (self *NsqdEtcdMgr) WatchConsumerGroups(groups chan []ConsumerGroupInfo, stop chan struct{}) error {
+	key := self.createConsumerGroupRootPath()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		}
+	}()
+	for {
+		list, index, err := self.scanConsumerGroups()
+		if err != nil {
+			coordLog.Errorf("scan consumer groups error: %v", err)
+			select {
+			case <-stop:
+				close(groups)
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		select {
+		case groups <- list:
+		case <-stop:
+			close(groups)
+			return nil
+		}
+		// scan all the groups again while any changed
+		watcher := self.client.Watch(key, index, true)
+		_, err = watcher.Next(ctx)
+		if err == context.Canceled {
+			coordLog.Infof("watch key[%s] canceled.", key)
+			close(groups)
+			return nil
+		}
+		if err != nil {
+			coordLog.Errorf("watcher key[%s] error: %s", key, err.Error())
+			if !IsEtcdWatchExpired(err) {
+				select {
+				case <-stop:
+					close(groups)
+					return nil
+				case <-time.After(5 * time.Second):
+				}
+			}
+		}
+	}
+}
+
 func (self *NsqdEtcdMgr) createNsqdNodePath(nodeData *NsqdNodeInfo) string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR, "Node-"+nodeData.ID)
 }
@@ -385,3 +477,11 @@ func (self *NsqdEtcdMgr) createTopicPartitionPath(topic string, partition int) s
 func (self *NsqdEtcdMgr) createTopicLeaderPath(topic string, partition int) string {
 	return path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION)
 }
+
+func (self *NsqdEtcdMgr) createConsumerGroupRootPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_CONSUMER_GROUP_DIR)
+}
+
+func (self *NsqdEtcdMgr) createConsumerGroupPath(topic string, channel string) string {
+	return path.Join(self.createConsumerGroupRootPath(), topic, channel)
+}
@@ -156,6 +156,20 @@ func (self *fakeNsqdLeadership) GetTopicInfo(topic string, partition int) (*Topi
 	return nil, errors.New("topic not exist")
 }
 
+func (self *fakeNsqdLeadership) GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error) {
+	return nil, ErrKeyNotFound
+}
+
+func (self *fakeNsqdLeadership) WatchConsumerGroups(groups chan []ConsumerGroupInfo, stop chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			close(groups)
+			return nil
+		}
+	}
+}
+
 func (self *fakeNsqdLeadership) GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error) {
 	self.Lock()
 	defer self.Unlock()
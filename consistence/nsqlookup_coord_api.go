@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/nsqd"
 )
 
 const (
@@ -350,8 +351,30 @@ func (self *NsqLookupCoordinator) deleteTopicPartition(topic string, pid int) er
 	return nil
 }
 
+// the compact key to disable the compaction of the topic
+const CompactKeyReset = "-"
+
+// TopicMetaExtraParam is the optional topic meta changes, the empty value means no change.
+type TopicMetaExtraParam struct {
+	// true or false to enable or disable the checksum
+	Checksum    string
+	Compression string
+	Durability  string
+	// the CompactKeyReset will clear the compact key
+	CompactKey string
+	// the negative disk quota will reset to the default of nsqd
+	DiskQuota int64
+	// the negative dedup window will disable the dedup
+	DedupWindow int64
+}
+
 func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 	newSyncEvery int, newRetentionDay int, newReplicator int, upgradeExt string) error {
+	return self.ChangeTopicMetaParamWithExtra(topic, newSyncEvery, newRetentionDay, newReplicator, upgradeExt, TopicMetaExtraParam{})
+}
+
+func (self *NsqLookupCoordinator) ChangeTopicMetaParamWithExtra(topic string,
+	newSyncEvery int, newRetentionDay int, newReplicator int, upgradeExt string, extra TopicMetaExtraParam) error {
 	if self.leaderNode.GetID() != self.myNode.GetID() {
 		coordLog.Infof("not leader while create topic")
 		return ErrNotNsqLookupLeader
@@ -370,6 +393,19 @@ func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 	if newReplicator > 5 {
 		return errors.New("max replicator allowed exceed")
 	}
+	if extra.Checksum != "" && extra.Checksum != "true" && extra.Checksum != "false" {
+		return errors.New("invalid checksum param")
+	}
+	if extra.Compression != "" {
+		if _, err := nsqd.ParseCompressCodec(extra.Compression); err != nil {
+			return err
+		}
+	}
+	if extra.Durability != "" {
+		if _, err := nsqd.ParseDurabilityLevel(extra.Durability); err != nil {
+			return err
+		}
+	}
 
 	self.joinStateMutex.Lock()
 	state, ok := self.joinISRState[topic]
@@ -405,12 +441,46 @@ func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 		if newReplicator > 0 {
 			meta.Replica = newReplicator
 		}
-		// change to ext only, can not change ext to non-ext
+		// the write size on replicas should be the same with the leader, so we
+		// disable the write until all the nodes changed the checksum or compression
 		needDisableWrite := false
+		if extra.Compression != "" && meta.Compression != extra.Compression {
+			meta.Compression = extra.Compression
+			needDisableWrite = true
+		}
+		if extra.Checksum != "" && meta.Checksum != (extra.Checksum == "true") {
+			meta.Checksum = extra.Checksum == "true"
+			needDisableWrite = true
+		}
+		if extra.Durability != "" {
+			meta.Durability = extra.Durability
+		}
+		if extra.CompactKey == CompactKeyReset {
+			meta.CompactKey = ""
+		} else if extra.CompactKey != "" {
+			meta.CompactKey = extra.CompactKey
+		}
+		if extra.DiskQuota > 0 {
+			meta.DiskQuota = extra.DiskQuota
+		} else if extra.DiskQuota < 0 {
+			meta.DiskQuota = 0
+		}
+		if extra.DedupWindow > 0 {
+			meta.DedupWindow = extra.DedupWindow
+		} else if extra.DedupWindow < 0 {
+			meta.DedupWindow = 0
+		}
+		// change to ext only, can not change ext to non-ext
 		if upgradeExt == "true" && !meta.Ext {
 			meta.Ext = true
 			needDisableWrite = true
 		}
+		if meta.CompactKey != "" && !meta.Ext {
+			return errors.New("compact key is only allowed for the ext topic")
+		}
+		if meta.DedupWindow > 0 && !meta.Ext {
+			return errors.New("dedup window is only allowed for the ext topic")
+		}
 		if needDisableWrite {
 			if !atomic.CompareAndSwapInt32(&self.isUpgrading, 0, 1) {
 				coordLog.Infof("the cluster state is already upgrading")
@@ -585,6 +655,10 @@ func (self *NsqLookupCoordinator) CreateTopic(topic string, meta TopicMetaInfo)
 		coordLog.Infof("topic %v sync every with too large %v, set to max", topic, meta)
 		meta.SyncEvery = MAX_SYNC_EVERY
 	}
+	// all the replicas should use the same storage engine, so the default is decided here
+	if meta.Storage == "" {
+		meta.Storage = nsqd.BackendStorageFiles
+	}
 
 	if ok, _ := self.leadership.IsExistTopic(topic); !ok {
 		meta.MagicCode = time.Now().UnixNano()
@@ -606,6 +680,10 @@ func (self *NsqLookupCoordinator) CreateTopic(topic string, meta TopicMetaInfo)
 		if oldMeta.SyncEvery >= MAX_SYNC_EVERY {
 			meta.SyncEvery = oldMeta.SyncEvery
 		}
+		// handle old topic created before the storage engine introduced
+		if oldMeta.Storage == "" && meta.Storage == nsqd.BackendStorageFiles {
+			meta.Storage = oldMeta.Storage
+		}
 		if oldMeta != meta {
 			return ErrAlreadyExist
 		}
@@ -107,6 +107,8 @@ type NsqLookupCoordinator struct {
 	dpm                *DataPlacement
 	balanceWaiting     int32
 	doChecking         int32
+	// serialize the update of the consumer groups
+	consumerGroupMutex sync.Mutex
 }
 
 func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Options) *NsqLookupCoordinator {
@@ -319,6 +321,11 @@ func (self *NsqLookupCoordinator) notifyLeaderChanged(monitorChan chan struct{})
 		defer self.wg.Done()
 		self.handleRemovingNodes(monitorChan)
 	}()
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		self.handleConsumerGroups(monitorChan)
+	}()
 }
 
 // for the nsqd node that temporally lost, we need send the related topics to
@@ -40,6 +40,7 @@ type FakeNsqlookupLeadership struct {
 	leaderSessionChanged chan *TopicLeaderSession
 	clusterEpoch         EpochType
 	exitChan             chan struct{}
+	fakeConsumerGroups   map[string]ConsumerGroupInfo
 }
 
 func NewFakeNsqlookupLeadership() *FakeNsqlookupLeadership {
@@ -51,6 +52,7 @@ func NewFakeNsqlookupLeadership() *FakeNsqlookupLeadership {
 		leaderChanged:        make(chan struct{}, 1),
 		leaderSessionChanged: make(chan *TopicLeaderSession, 1),
 		exitChan:             make(chan struct{}),
+		fakeConsumerGroups:   make(map[string]ConsumerGroupInfo),
 	}
 }
 
@@ -311,6 +313,60 @@ func (self *FakeNsqlookupLeadership) UpdateTopicMetaInfo(topic string, meta *Top
 	return nil
 }
 
+func (self *FakeNsqlookupLeadership) GetConsumerGroup(topic string, channel string) (*ConsumerGroupInfo, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	g, ok := self.fakeConsumerGroups[topic+"/"+channel]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return copyFakeConsumerGroup(&g), nil
+}
+
+func copyFakeConsumerGroup(group *ConsumerGroupInfo) *ConsumerGroupInfo {
+	c := *group
+	c.Members = append([]ConsumerGroupMember(nil), group.Members...)
+	c.Assignment = make(map[int]string, len(group.Assignment))
+	for k, v := range group.Assignment {
+		c.Assignment[k] = v
+	}
+	return &c
+}
+
+func (self *FakeNsqlookupLeadership) UpdateConsumerGroup(topic string, channel string, group *ConsumerGroupInfo, oldGen EpochType) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	key := topic + "/" + channel
+	old, ok := self.fakeConsumerGroups[key]
+	if oldGen == 0 && ok {
+		return ErrKeyAlreadyExist
+	}
+	if oldGen != 0 && (!ok || old.Epoch != oldGen) {
+		return errors.New("consumer group epoch mismatch")
+	}
+	self.clusterEpoch++
+	group.Epoch = self.clusterEpoch
+	self.fakeConsumerGroups[key] = *copyFakeConsumerGroup(group)
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) DeleteConsumerGroup(topic string, channel string, oldGen EpochType) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	delete(self.fakeConsumerGroups, topic+"/"+channel)
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) ScanConsumerGroups() ([]ConsumerGroupInfo, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	groups := make([]ConsumerGroupInfo, 0, len(self.fakeConsumerGroups))
+	for _, g := range self.fakeConsumerGroups {
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
 func (self *FakeNsqlookupLeadership) DeleteWholeTopic(topic string) error {
 	self.dataMutex.Lock()
 	defer self.dataMutex.Unlock()
@@ -503,6 +559,16 @@ func (self *FakeNsqlookupLeadership) WatchLookupdLeader(leader chan *NsqLookupdN
 	}
 }
 
+func (self *FakeNsqlookupLeadership) WatchConsumerGroups(groups chan []ConsumerGroupInfo, stop chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			close(groups)
+			return nil
+		}
+	}
+}
+
 func startNsqLookupCoord(t *testing.T, useFakeLeadership bool) (*NsqLookupCoordinator, int, *NsqLookupdNodeInfo) {
 	var n NsqLookupdNodeInfo
 	n.NodeIP = "127.0.0.1"
@@ -670,7 +736,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 
 	waitClusterStable(lookupCoord1, time.Second*3)
@@ -855,7 +921,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// test new topic create
 	coordLog.Warningf("============= begin test 3 replicas ====")
-	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// with 3 replica, the isr join timeout will change the isr list if the isr has the quorum nodes
@@ -986,7 +1052,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	pmeta, _, err := lookupLeadership.GetTopicMetaInfo(topic_p1_r1)
@@ -1008,7 +1074,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -1033,7 +1099,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 3)
 
-	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{3, 1, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{PartitionNum: 3, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1065,7 +1131,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc1.topicInfo.Leader, t1.Leader)
 	test.Equal(t, len(tc1.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1100,7 +1166,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p2_r2)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 1, 1, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2, MagicCode: 1, RetentionDay: 1})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1146,7 +1212,7 @@ func TestNsqLookupNsqdCreateTopicFailPartition(t *testing.T) {
 		lookupCoord1.Stop()
 	}()
 
-	err := lookupLeadership.CreateTopic(topic_p3_r1, &TopicMetaInfo{3, 1, 0, 0, 0, 0, false, false})
+	err := lookupLeadership.CreateTopic(topic_p3_r1, &TopicMetaInfo{PartitionNum: 3, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1178,7 +1244,7 @@ func TestNsqLookupNsqdCreateTopicFailPartition(t *testing.T) {
 	test.Equal(t, tc1.topicInfo.Leader, t1.Leader)
 	test.Equal(t, len(tc1.topicInfo.ISR), 1)
 
-	err = lookupLeadership.CreateTopic(topic_p2_r2, &TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupLeadership.CreateTopic(topic_p2_r2, &TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1243,11 +1309,11 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	time.Sleep(time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{2, 1, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{PartitionNum: 2, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -1362,15 +1428,15 @@ func TestNsqLookupMarkNodeRemove(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{4, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{PartitionNum: 4, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
@@ -1477,15 +1543,15 @@ func TestNsqLookupExpandPartition(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{PartitionNum: 1, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 	waitClusterStable(lookupCoord, time.Second)
@@ -1589,13 +1655,13 @@ func TestNsqLookupMovePartition(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*3)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
-	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{4, 3, 0, 0, 0, 0, true, false})
+	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{PartitionNum: 4, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -1871,14 +1937,14 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{8, 3, 0, 0, 0, 0, true, false})
+	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{PartitionNum: 8, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 
 	checkOrderedMultiTopic(t, topic_p8_r3, 8, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{13, 1, 0, 0, 0, 0, true, false})
+	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{PartitionNum: 13, Replica: 1, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -1887,7 +1953,7 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	checkOrderedMultiTopic(t, topic_p13_r1, 13, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 0, 0, true, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{PartitionNum: 25, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1898,7 +1964,7 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p25_r3)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 1, 1, true, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{PartitionNum: 25, Replica: 3, MagicCode: 1, RetentionDay: 1, OrderedMulti: true})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -2022,7 +2088,7 @@ func TestNsqLookupOrderedTopicBalance(t *testing.T) {
 		lookupCoord1.Stop()
 	}()
 
-	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{13, 2, 0, 0, 0, 0, true, false})
+	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{PartitionNum: 13, Replica: 2, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*10)
 	time.Sleep(time.Second * 3)
@@ -2088,3 +2154,62 @@ func TestNsqLookupOrderedTopicBalance(t *testing.T) {
 
 	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
 }
+
+func TestNsqLookupConsumerGroupRebalance(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	n := NsqLookupdNodeInfo{ID: "test-lookup-consumer-group", NodeIP: "127.0.0.1"}
+	lookupCoord := NewNsqLookupCoordinator(TEST_NSQ_CLUSTER_NAME, &n, nil)
+	fakeLeadership := NewFakeNsqlookupLeadership()
+	lookupCoord.leadership = fakeLeadership
+	lookupCoord.leaderNode = lookupCoord.myNode
+
+	topic := "test-consumer-group-topic"
+	channel := "ch"
+	meta := &TopicMetaInfo{PartitionNum: 3, Replica: 1}
+	test.Nil(t, fakeLeadership.CreateTopic(topic, meta))
+	for i := 0; i < meta.PartitionNum; i++ {
+		test.Nil(t, fakeLeadership.CreateTopicPartition(topic, i))
+	}
+
+	_, err := lookupCoord.GetConsumerGroup(topic, channel)
+	test.Equal(t, ErrConsumerGroupNotFound, err)
+	_, err = lookupCoord.JoinConsumerGroup(topic, channel, "")
+	test.Equal(t, ErrInvalidConsumerGroupMember, err)
+
+	group, err := lookupCoord.JoinConsumerGroup(topic, channel, "m1")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), group.Generation)
+	test.Equal(t, []int{0, 1, 2}, group.GetAssignedPartitions("m1"))
+
+	group, err = lookupCoord.JoinConsumerGroup(topic, channel, "m2")
+	test.Nil(t, err)
+	test.Equal(t, int64(2), group.Generation)
+	test.Equal(t, []int{0, 2}, group.GetAssignedPartitions("m1"))
+	test.Equal(t, []int{1}, group.GetAssignedPartitions("m2"))
+
+	// heartbeat should not change the assignment
+	group, err = lookupCoord.HeartbeatConsumerGroup(topic, channel, "m2")
+	test.Nil(t, err)
+	test.Equal(t, int64(2), group.Generation)
+	_, err = lookupCoord.HeartbeatConsumerGroup(topic, channel, "m3")
+	test.Equal(t, ErrConsumerGroupMemberNotFound, err)
+
+	test.Nil(t, lookupCoord.LeaveConsumerGroup(topic, channel, "m1"))
+	group, err = lookupCoord.GetConsumerGroup(topic, channel)
+	test.Nil(t, err)
+	test.Equal(t, int64(3), group.Generation)
+	test.Equal(t, 1, len(group.Members))
+	test.Equal(t, "m2", group.GetAssignedMember(0))
+	test.Equal(t, []int{0, 1, 2}, group.GetAssignedPartitions("m2"))
+
+	// the group should be removed after all the members expired
+	group.Members[0].LastHeartbeat = time.Now().Add(-2 * ConsumerGroupSessionTimeout).Unix()
+	test.Nil(t, fakeLeadership.UpdateConsumerGroup(topic, channel, group, group.Epoch))
+	lookupCoord.removeExpiredConsumerGroupMembers()
+	_, err = lookupCoord.GetConsumerGroup(topic, channel)
+	test.Equal(t, ErrConsumerGroupNotFound, err)
+
+	lookupCoord.leaderNode = NsqLookupdNodeInfo{ID: "other"}
+	_, err = lookupCoord.JoinConsumerGroup(topic, channel, "m1")
+	test.Equal(t, ErrNotNsqLookupLeader, err)
+}
@@ -17,6 +17,7 @@ const (
 	NSQ_LOOKUPD_DIR            = "NsqlookupdInfo"
 	NSQ_LOOKUPD_NODE_DIR       = "NsqlookupdNodes"
 	NSQ_LOOKUPD_LEADER_SESSION = "LookupdLeaderSession"
+	NSQ_CONSUMER_GROUP_DIR     = "ConsumerGroups"
 )
 
 const (
@@ -225,6 +225,8 @@ type ChannelStats struct {
 	Paused                  bool                                    `json:"paused"`
 	Skipped                 bool                                    `json:"skipped"`
 	ZanTestSkipped          bool					`json:"zan_test_skipped"`
+	MsgRateLimit            int64                                   `json:"msg_rate_limit"`
+	ByteRateLimit           int64                                   `json:"byte_rate_limit"`
 	IsMultiOrdered          bool                                    `json:"is_multi_ordered"`
 	IsExt                   bool                                    `json:"is_ext"`
 	MsgConsumeLatencyStats  []int64                                 `json:"msg_consume_latency_stats"`
@@ -277,6 +279,13 @@ func (c *ChannelStats) Merge(a *ChannelStats) {
 	if a.ZanTestSkipped {
 		c.ZanTestSkipped = a.ZanTestSkipped
 	}
+	// the limit is for each partition, show the max one in total
+	if a.MsgRateLimit > c.MsgRateLimit {
+		c.MsgRateLimit = a.MsgRateLimit
+	}
+	if a.ByteRateLimit > c.ByteRateLimit {
+		c.ByteRateLimit = a.ByteRateLimit
+	}
 	c.NodeStats = append(c.NodeStats, a.NodeStats...)
 	sort.Sort(ChannelStatsByPartAndHost{c.NodeStats})
 	if c.E2eProcessingLatency == nil {
@@ -330,6 +339,13 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	if a.ZanTestSkipped {
 		c.ZanTestSkipped = a.ZanTestSkipped
 	}
+	// the limit is for each partition, show the max one in total
+	if a.MsgRateLimit > c.MsgRateLimit {
+		c.MsgRateLimit = a.MsgRateLimit
+	}
+	if a.ByteRateLimit > c.ByteRateLimit {
+		c.ByteRateLimit = a.ByteRateLimit
+	}
 	c.NodeStats = append(c.NodeStats, a)
 	sort.Sort(ChannelStatsByPartAndHost{c.NodeStats})
 	if c.E2eProcessingLatency == nil {
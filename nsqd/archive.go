@@ -0,0 +1,286 @@
+package nsqd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// the archived segments fetched back will be stored in this directory under the topic data path
+	archiveCacheDir = "archive_cache"
+	// the cached segment not accessed for this time will be removed while cleaning
+	archiveCacheKeepTime = time.Hour
+)
+
+var ErrArchivedSegmentNotFound = errors.New("archived segment not found")
+
+// SegmentArchiver is the backend to keep the old segment files offloaded from local disk.
+// The rolled segment will be uploaded before cleaned by retention, and
+// fetched back on demand if the consumer seek to the position before the local queue start.
+type SegmentArchiver interface {
+	Upload(key string, localFile string) error
+	// Download should return ErrArchivedSegmentNotFound if the key is not archived.
+	Download(key string, localFile string) error
+}
+
+// S3Client is the minimal api of the S3-compatible object store needed by the archiver,
+// so any sdk can be adapted without depending on it here.
+// GetObject should return ErrArchivedSegmentNotFound if the object is not exist.
+type S3Client interface {
+	PutObject(bucket string, key string, r io.Reader, size int64) error
+	GetObject(bucket string, key string) (io.ReadCloser, error)
+}
+
+// writeFileAtomic write the data to a temp file first and then rename it,
+// so the reader will never see the partial file.
+func writeFileAtomic(fileName string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+	tmpName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+type LocalDirArchiver struct {
+	root string
+}
+
+func NewLocalDirArchiver(root string) (*LocalDirArchiver, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalDirArchiver{root: root}, nil
+}
+
+func (a *LocalDirArchiver) Upload(key string, localFile string) error {
+	f, err := os.Open(localFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFileAtomic(filepath.Join(a.root, filepath.FromSlash(key)), f)
+}
+
+func (a *LocalDirArchiver) Download(key string, localFile string) error {
+	f, err := os.Open(filepath.Join(a.root, filepath.FromSlash(key)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrArchivedSegmentNotFound
+		}
+		return err
+	}
+	defer f.Close()
+	return writeFileAtomic(localFile, f)
+}
+
+type S3Archiver struct {
+	client S3Client
+	bucket string
+	prefix string
+}
+
+func NewS3Archiver(client S3Client, bucket string, prefix string) *S3Archiver {
+	return &S3Archiver{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+func (a *S3Archiver) Upload(key string, localFile string) error {
+	f, err := os.Open(localFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return a.client.PutObject(a.bucket, path.Join(a.prefix, key), f, stat.Size())
+}
+
+func (a *S3Archiver) Download(key string, localFile string) error {
+	r, err := a.client.GetObject(a.bucket, path.Join(a.prefix, key))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFileAtomic(localFile, r)
+}
+
+func getArchiveKey(readFrom string, fileName string) string {
+	return path.Join(readFrom, filepath.Base(fileName))
+}
+
+// segmentArchive handle the archived segments of the disk queue
+type segmentArchive struct {
+	archiver SegmentArchiver
+	readFrom string
+	dataPath string
+}
+
+func newSegmentArchive(archiver SegmentArchiver, readFrom string, dataPath string) *segmentArchive {
+	if archiver == nil {
+		return nil
+	}
+	return &segmentArchive{
+		archiver: archiver,
+		readFrom: readFrom,
+		dataPath: dataPath,
+	}
+}
+
+func (a *segmentArchive) cacheFileName(fileNum int64) string {
+	return GetQueueFileName(path.Join(a.dataPath, archiveCacheDir), a.readFrom, fileNum)
+}
+
+// upload the segment data with the offset meta and the time index
+func (a *segmentArchive) upload(fileNum int64) error {
+	fName := GetQueueFileName(a.dataPath, a.readFrom, fileNum)
+	for _, suffix := range []string{".offsetmeta.dat", timeIndexFileSuffix, ""} {
+		err := a.archiver.Upload(getArchiveKey(a.readFrom, fName+suffix), fName+suffix)
+		if err != nil {
+			if suffix == timeIndexFileSuffix && os.IsNotExist(err) {
+				// old segment without time index
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentFile return the local file of the segment (the offset meta or the time index if with suffix),
+// the file will be fetched from the archive to the local cache if not exist on local.
+// The not exist error is returned if not archived.
+func (a *segmentArchive) segmentFile(fileNum int64, suffix string) (string, error) {
+	fName := GetQueueFileName(a.dataPath, a.readFrom, fileNum) + suffix
+	_, localErr := os.Stat(fName)
+	if localErr == nil || !os.IsNotExist(localErr) {
+		return fName, localErr
+	}
+	cached := a.cacheFileName(fileNum) + suffix
+	if _, err := os.Stat(cached); err == nil {
+		now := time.Now()
+		os.Chtimes(cached, now, now)
+		return cached, nil
+	}
+	err := a.archiver.Download(getArchiveKey(a.readFrom, fName), cached)
+	if err != nil {
+		if err == ErrArchivedSegmentNotFound {
+			return fName, localErr
+		}
+		nsqLog.LogWarningf("diskqueue(%s) fetch archived segment %v failed: %v", a.readFrom, fName, err)
+		return fName, err
+	}
+	nsqLog.Logf("diskqueue(%s) fetched archived segment %v to %v", a.readFrom, fName, cached)
+	return cached, nil
+}
+
+func (a *segmentArchive) getOffsetMeta(fileNum int64) (int64, int64, int64, error) {
+	fName, err := a.segmentFile(fileNum, ".offsetmeta.dat")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return getQueueFileOffsetMeta(strings.TrimSuffix(fName, ".offsetmeta.dat"))
+}
+
+func (a *segmentArchive) readFirstTimeIndex(fileNum int64) (timeIndexEntry, error) {
+	fName, err := a.segmentFile(fileNum, timeIndexFileSuffix)
+	if err != nil {
+		return timeIndexEntry{}, err
+	}
+	return readFirstTimeIndex(strings.TrimSuffix(fName, timeIndexFileSuffix))
+}
+
+func (a *segmentArchive) readTimeIndex(fileNum int64) ([]timeIndexEntry, error) {
+	fName, err := a.segmentFile(fileNum, timeIndexFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return readTimeIndex(strings.TrimSuffix(fName, timeIndexFileSuffix))
+}
+
+// locate search the segment position of the virtual offset backward from the segment fileNum
+func (a *segmentArchive) locate(voffset BackendOffset, fileNum int64) (diskQueueOffset, error) {
+	for ; fileNum >= 0; fileNum-- {
+		_, startPos, endPos, err := a.getOffsetMeta(fileNum)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return diskQueueOffset{}, ErrReadQueueAlreadyCleaned
+			}
+			return diskQueueOffset{}, err
+		}
+		if voffset >= BackendOffset(endPos) {
+			nsqLog.LogWarningf("diskqueue(%s) locate archived offset %v exceed segment %v end: %v", a.readFrom,
+				voffset, fileNum, endPos)
+			return diskQueueOffset{}, ErrMoveOffsetInvalid
+		}
+		if voffset >= BackendOffset(startPos) {
+			return diskQueueOffset{FileNum: fileNum, Pos: int64(voffset) - startPos}, nil
+		}
+	}
+	return diskQueueOffset{}, ErrReadQueueAlreadyCleaned
+}
+
+// searchTimeIndexSegment find the last archived segment before the fileNum
+// with the first indexed timestamp less than ts
+func (a *segmentArchive) searchTimeIndexSegment(fileNum int64, ts int64) (int64, bool) {
+	for fileNum--; fileNum >= 0; fileNum-- {
+		e, err := a.readFirstTimeIndex(fileNum)
+		if err != nil {
+			return 0, false
+		}
+		if e.Timestamp < ts {
+			return fileNum, true
+		}
+	}
+	return 0, false
+}
+
+// cleanCache remove the cached segments not accessed for the keep time
+func (a *segmentArchive) cleanCache(keep time.Duration) {
+	files, err := filepath.Glob(path.Join(a.dataPath, archiveCacheDir, a.readFrom+".diskqueue.*"))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, fName := range files {
+		stat, err := os.Stat(fName)
+		if err != nil || now.Sub(stat.ModTime()) < keep {
+			continue
+		}
+		err = os.Remove(fName)
+		if err != nil {
+			nsqLog.LogWarningf("diskqueue(%s) remove cached segment %v failed: %v", a.readFrom, fName, err)
+		} else {
+			nsqLog.Logf("diskqueue(%s) removed cached segment %v", a.readFrom, fName)
+		}
+	}
+}
+
+// ArchiveFile upload a single file (such as the commit log segment) to the archiver
+func ArchiveFile(archiver SegmentArchiver, keyPrefix string, fileName string) error {
+	return archiver.Upload(path.Join(keyPrefix, filepath.Base(fileName)), fileName)
+}
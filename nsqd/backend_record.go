@@ -0,0 +1,1530 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absolute8511/bolt"
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/util"
+)
+
+var (
+	bucketQueueRecords = []byte("records")
+	bucketQueueMeta    = []byte("meta")
+	keyQueueStart      = []byte("start")
+	keyQueueEnd        = []byte("end")
+)
+
+// storedRecord is a single record in the record store, the raw data has the
+// same format as the record in the disk queue segment (with the length prefix),
+// so the raw data can be replicated between the nodes using different engines.
+type storedRecord struct {
+	offset BackendOffset
+	// the total message count before this record
+	cnt  int64
+	msgs int32
+	raw  []byte
+}
+
+func (r *storedRecord) end() diskQueueEndInfo {
+	return newRecordQueueEnd(r.offset+BackendOffset(len(r.raw)), r.cnt+int64(r.msgs))
+}
+
+// the record queue has only one segment, so the position in segment is the same as the virtual offset.
+func newRecordQueueEnd(offset BackendOffset, cnt int64) diskQueueEndInfo {
+	return diskQueueEndInfo{
+		EndOffset:   diskQueueOffset{FileNum: 0, Pos: int64(offset)},
+		virtualEnd:  offset,
+		totalMsgCnt: cnt,
+	}
+}
+
+// recordStore is the storage of the records keyed by the virtual offset,
+// it should be safe to read while writing.
+type recordStore interface {
+	load() (diskQueueEndInfo, diskQueueEndInfo, error)
+	bounds() (diskQueueEndInfo, diskQueueEndInfo)
+	// get the record start at the offset, ErrReadQueueAlreadyCleaned if the
+	// offset is before the start and io.EOF if at the end.
+	get(offset BackendOffset) (storedRecord, error)
+	// seek the first record start at or after the offset
+	seek(offset BackendOffset) (storedRecord, error)
+	append(recs []storedRecord) error
+	truncate(end diskQueueEndInfo) error
+	cleanTo(start diskQueueEndInfo) error
+	reset(start diskQueueEndInfo) error
+	sync() error
+	close() error
+	remove() error
+	moveTo(destPath string) error
+}
+
+// memRecordStore keep the records in memory as a ring buffer, the oldest records
+// will be evicted if exceed the capacity, and the reference records of the evicted batch
+// record are evicted together. Only the end position is persisted, so all the data will
+// be lost after restart.
+type memRecordStore struct {
+	sync.RWMutex
+	metaFile string
+	capacity int64
+	size     int64
+	start    diskQueueEndInfo
+	end      diskQueueEndInfo
+	records  []storedRecord
+}
+
+func newMemRecordStore(name string, dataPath string, capacity int64) *memRecordStore {
+	return &memRecordStore{
+		metaFile: fmt.Sprintf(path.Join(dataPath, "%s.memqueue.meta.dat"), name),
+		capacity: capacity,
+	}
+}
+
+func (s *memRecordStore) load() (diskQueueEndInfo, diskQueueEndInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, err := os.Open(s.metaFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.start, s.end, nil
+		}
+		return s.start, s.end, err
+	}
+	defer f.Close()
+	var offset, cnt int64
+	_, err = fmt.Fscanf(f, "%d,%d\n", &offset, &cnt)
+	if err != nil {
+		return s.start, s.end, err
+	}
+	// the data in memory is lost, so the queue start from the last end
+	s.end = newRecordQueueEnd(BackendOffset(offset), cnt)
+	s.start = s.end
+	return s.start, s.end, nil
+}
+
+func (s *memRecordStore) bounds() (diskQueueEndInfo, diskQueueEndInfo) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.start, s.end
+}
+
+func (s *memRecordStore) search(offset BackendOffset) int {
+	return sort.Search(len(s.records), func(i int) bool {
+		return s.records[i].offset >= offset
+	})
+}
+
+func (s *memRecordStore) get(offset BackendOffset) (storedRecord, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if offset < s.start.Offset() {
+		return storedRecord{}, ErrReadQueueAlreadyCleaned
+	}
+	if offset >= s.end.Offset() {
+		return storedRecord{}, io.EOF
+	}
+	i := s.search(offset)
+	if i >= len(s.records) || s.records[i].offset != offset {
+		return storedRecord{}, ErrInvalidOffset
+	}
+	return s.records[i], nil
+}
+
+func (s *memRecordStore) seek(offset BackendOffset) (storedRecord, error) {
+	s.RLock()
+	defer s.RUnlock()
+	i := s.search(offset)
+	if i >= len(s.records) {
+		return storedRecord{}, io.EOF
+	}
+	return s.records[i], nil
+}
+
+func (s *memRecordStore) append(recs []storedRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, r := range recs {
+		s.records = append(s.records, r)
+		s.size += int64(len(r.raw))
+	}
+	s.end = recs[len(recs)-1].end()
+	for s.size > s.capacity && len(s.records) > 1 {
+		s.evictFirstNoLock()
+		// the reference records can not be read without the batch record
+		for len(s.records) > 0 {
+			if _, ok := rawRecordBatchRef(s.records[0].raw); !ok {
+				break
+			}
+			s.evictFirstNoLock()
+		}
+	}
+	return nil
+}
+
+func (s *memRecordStore) evictFirstNoLock() {
+	s.size -= int64(len(s.records[0].raw))
+	s.start = s.records[0].end()
+	s.records[0] = storedRecord{}
+	s.records = s.records[1:]
+}
+
+func (s *memRecordStore) truncate(end diskQueueEndInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	i := s.search(end.Offset())
+	if end.Offset() != s.end.Offset() && (i >= len(s.records) || s.records[i].offset != end.Offset()) {
+		return ErrInvalidOffset
+	}
+	for j := i; j < len(s.records); j++ {
+		s.size -= int64(len(s.records[j].raw))
+		s.records[j] = storedRecord{}
+	}
+	s.records = s.records[:i]
+	s.end = end
+	return nil
+}
+
+func (s *memRecordStore) cleanTo(start diskQueueEndInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	i := s.search(start.Offset())
+	for j := 0; j < i; j++ {
+		s.size -= int64(len(s.records[j].raw))
+	}
+	s.records = append([]storedRecord(nil), s.records[i:]...)
+	s.start = start
+	return nil
+}
+
+func (s *memRecordStore) reset(start diskQueueEndInfo) error {
+	s.Lock()
+	s.records = nil
+	s.size = 0
+	s.start = start
+	s.end = start
+	s.Unlock()
+	return s.sync()
+}
+
+func (s *memRecordStore) sync() error {
+	s.RLock()
+	end := s.end
+	s.RUnlock()
+	return writeFileAtomic(s.metaFile, strings.NewReader(fmt.Sprintf("%d,%d\n", end.Offset(), end.TotalMsgCnt())))
+}
+
+func (s *memRecordStore) close() error {
+	return s.sync()
+}
+
+func (s *memRecordStore) remove() error {
+	err := os.Remove(s.metaFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *memRecordStore) moveTo(destPath string) error {
+	err := util.AtomicRename(s.metaFile, path.Join(destPath, filepath.Base(s.metaFile)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// boltRecordStore keep the records in the embedded kv db, the records and
+// the queue positions are updated in the same transaction.
+type boltRecordStore struct {
+	sync.RWMutex
+	fileName string
+	db       *bolt.DB
+	start    diskQueueEndInfo
+	end      diskQueueEndInfo
+}
+
+func newBoltRecordStore(name string, dataPath string) (*boltRecordStore, error) {
+	s := &boltRecordStore{
+		fileName: fmt.Sprintf(path.Join(dataPath, "%s.kvqueue.db"), name),
+	}
+	var err error
+	s.db, err = bolt.Open(s.fileName, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	// the fsync is done by the queue flush
+	s.db.NoSync = true
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketQueueRecords)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketQueueMeta)
+		return err
+	})
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func encodeRecordKey(offset BackendOffset) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], uint64(offset))
+	return k[:]
+}
+
+func encodeRecordPos(e diskQueueEndInfo) []byte {
+	var v [16]byte
+	binary.BigEndian.PutUint64(v[:8], uint64(e.Offset()))
+	binary.BigEndian.PutUint64(v[8:], uint64(e.TotalMsgCnt()))
+	return v[:]
+}
+
+func decodeRecordPos(v []byte) (diskQueueEndInfo, error) {
+	if len(v) != 16 {
+		return diskQueueEndInfo{}, ErrInvalidRecordSize
+	}
+	return newRecordQueueEnd(BackendOffset(binary.BigEndian.Uint64(v[:8])), int64(binary.BigEndian.Uint64(v[8:]))), nil
+}
+
+// the value is the 8 bytes message count before the record, the 4 bytes message number
+// in the record and the raw record data.
+func decodeStoredRecord(k []byte, v []byte) (storedRecord, error) {
+	if len(k) != 8 || len(v) < 12 {
+		return storedRecord{}, ErrInvalidRecordSize
+	}
+	r := storedRecord{
+		offset: BackendOffset(binary.BigEndian.Uint64(k)),
+		cnt:    int64(binary.BigEndian.Uint64(v[:8])),
+		msgs:   int32(binary.BigEndian.Uint32(v[8:12])),
+	}
+	// the data is only valid in the transaction
+	r.raw = append([]byte(nil), v[12:]...)
+	return r, nil
+}
+
+func (s *boltRecordStore) load() (diskQueueEndInfo, diskQueueEndInfo, error) {
+	var start, end diskQueueEndInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketQueueMeta)
+		var err error
+		if v := b.Get(keyQueueStart); v != nil {
+			start, err = decodeRecordPos(v)
+			if err != nil {
+				return err
+			}
+		}
+		if v := b.Get(keyQueueEnd); v != nil {
+			end, err = decodeRecordPos(v)
+		}
+		return err
+	})
+	if err != nil {
+		return start, end, err
+	}
+	s.Lock()
+	s.start = start
+	s.end = end
+	s.Unlock()
+	return start, end, nil
+}
+
+func (s *boltRecordStore) bounds() (diskQueueEndInfo, diskQueueEndInfo) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.start, s.end
+}
+
+func (s *boltRecordStore) get(offset BackendOffset) (storedRecord, error) {
+	start, end := s.bounds()
+	if offset < start.Offset() {
+		return storedRecord{}, ErrReadQueueAlreadyCleaned
+	}
+	if offset >= end.Offset() {
+		return storedRecord{}, io.EOF
+	}
+	var r storedRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := encodeRecordKey(offset)
+		v := tx.Bucket(bucketQueueRecords).Get(k)
+		if v == nil {
+			return ErrInvalidOffset
+		}
+		var err error
+		r, err = decodeStoredRecord(k, v)
+		return err
+	})
+	return r, err
+}
+
+func (s *boltRecordStore) seek(offset BackendOffset) (storedRecord, error) {
+	var r storedRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(bucketQueueRecords).Cursor().Seek(encodeRecordKey(offset))
+		if k == nil {
+			return io.EOF
+		}
+		var err error
+		r, err = decodeStoredRecord(k, v)
+		return err
+	})
+	return r, err
+}
+
+func (s *boltRecordStore) updateWithPos(start *diskQueueEndInfo, end *diskQueueEndInfo, fn func(b *bolt.Bucket) error) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := fn(tx.Bucket(bucketQueueRecords))
+		if err != nil {
+			return err
+		}
+		meta := tx.Bucket(bucketQueueMeta)
+		if start != nil {
+			err = meta.Put(keyQueueStart, encodeRecordPos(*start))
+			if err != nil {
+				return err
+			}
+		}
+		if end != nil {
+			err = meta.Put(keyQueueEnd, encodeRecordPos(*end))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	if start != nil {
+		s.start = *start
+	}
+	if end != nil {
+		s.end = *end
+	}
+	s.Unlock()
+	return nil
+}
+
+func (s *boltRecordStore) append(recs []storedRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	end := recs[len(recs)-1].end()
+	return s.updateWithPos(nil, &end, func(b *bolt.Bucket) error {
+		for _, r := range recs {
+			v := make([]byte, 12+len(r.raw))
+			binary.BigEndian.PutUint64(v[:8], uint64(r.cnt))
+			binary.BigEndian.PutUint32(v[8:12], uint32(r.msgs))
+			copy(v[12:], r.raw)
+			err := b.Put(encodeRecordKey(r.offset), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRecordStore) truncate(end diskQueueEndInfo) error {
+	_, oldEnd := s.bounds()
+	return s.updateWithPos(nil, &end, func(b *bolt.Bucket) error {
+		c := b.Cursor()
+		k, _ := c.Seek(encodeRecordKey(end.Offset()))
+		if end.Offset() != oldEnd.Offset() && (k == nil || BackendOffset(binary.BigEndian.Uint64(k)) != end.Offset()) {
+			return ErrInvalidOffset
+		}
+		for ; k != nil; k, _ = c.Seek(encodeRecordKey(end.Offset())) {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRecordStore) cleanTo(start diskQueueEndInfo) error {
+	return s.updateWithPos(&start, nil, func(b *bolt.Bucket) error {
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && BackendOffset(binary.BigEndian.Uint64(k)) < start.Offset(); k, _ = c.First() {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRecordStore) reset(start diskQueueEndInfo) error {
+	return s.updateWithPos(&start, &start, func(b *bolt.Bucket) error {
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.First() {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRecordStore) sync() error {
+	return s.db.Sync()
+}
+
+func (s *boltRecordStore) close() error {
+	s.db.Sync()
+	return s.db.Close()
+}
+
+func (s *boltRecordStore) remove() error {
+	err := os.Remove(s.fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *boltRecordStore) moveTo(destPath string) error {
+	err := util.AtomicRename(s.fileName, path.Join(destPath, filepath.Base(s.fileName)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// recordQueueWriter implements the topic queue writer on the record store.
+type recordQueueWriter struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	writeEnd     diskQueueEndInfo
+	readEnd      diskQueueEndInfo
+	queueStart   diskQueueEndInfo
+	syncedOffset int64
+	sync.RWMutex
+	syncMutex sync.Mutex
+
+	name            string
+	dataPath        string
+	store           recordStore
+	minMsgSize      int32
+	maxMsgSize      int32
+	exitFlag        int32
+	needSync        bool
+	compressCodec   int32
+	checksumEnabled int32
+}
+
+func newRecordQueueWriter(name string, dataPath string, store recordStore,
+	minMsgSize int32, maxMsgSize int32) (*recordQueueWriter, error) {
+	d := &recordQueueWriter{
+		name:       name,
+		dataPath:   dataPath,
+		store:      store,
+		minMsgSize: minMsgSize,
+		maxMsgSize: maxMsgSize,
+	}
+	start, end, err := store.load()
+	if err != nil {
+		nsqLog.LogErrorf("recordqueue(%s) failed to load - %s", d.name, err)
+		store.close()
+		return nil, err
+	}
+	d.queueStart = start
+	d.writeEnd = end
+	d.readEnd = end
+	d.syncedOffset = int64(end.Offset())
+	return d, nil
+}
+
+func (d *recordQueueWriter) SetCompressCodec(codec CompressCodec) {
+	old := CompressCodec(atomic.SwapInt32(&d.compressCodec, int32(codec)))
+	if old != codec {
+		nsqLog.Logf("recordqueue(%s): compress codec changed from %v to %v", d.name, old, codec)
+	}
+}
+
+func (d *recordQueueWriter) SetChecksumEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.checksumEnabled, 1)
+	} else {
+		atomic.StoreInt32(&d.checksumEnabled, 0)
+	}
+}
+
+// the records can be located by offset directly, so no time index needed.
+func (d *recordQueueWriter) SetTimeIndexEnabled(enable bool) {
+}
+
+// the record store has no segment files to be archived.
+func (d *recordQueueWriter) SetArchiver(archiver SegmentArchiver) {
+}
+
+func (d *recordQueueWriter) PutV2(data []byte) (BackendOffset, int32, diskQueueEndInfo, error) {
+	return d.PutV2WithCheck(data, 0)
+}
+
+func (d *recordQueueWriter) PutV2WithCheck(data []byte, checkSize int64) (BackendOffset, int32, diskQueueEndInfo, error) {
+	dataLen := int32(len(data))
+	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+	}
+	raw := encodeRecord(CompressCodec(atomic.LoadInt32(&d.compressCodec)), atomic.LoadInt32(&d.checksumEnabled) == 1, data)
+	if checkSize > 0 && int64(len(raw)) != checkSize {
+		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("message write size mismatch %v vs %v", checkSize, len(raw))
+	}
+	return d.writeRecords([][]byte{raw}, 1)
+}
+
+// PutBatchV2 write the messages encoded the same as the disk queue, so the data replicated
+// between the nodes using different engines will have the same size. Each message has its own
+// record, and the batch record and the reference records are stored separately.
+func (d *recordQueueWriter) PutBatchV2(datas [][]byte, checkSize int64) (BackendOffset, []int32, diskQueueEndInfo, error) {
+	for _, data := range datas {
+		dataLen := int32(len(data))
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return 0, nil, diskQueueEndInfo{}, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+		}
+	}
+	units := encodeRecordBatch(CompressCodec(atomic.LoadInt32(&d.compressCodec)),
+		atomic.LoadInt32(&d.checksumEnabled) == 1, datas, d.maxMsgSize)
+	raws := make([][]byte, 0, len(datas))
+	sizes := make([]int32, 0, len(datas))
+	total := int64(0)
+	for _, unit := range units {
+		records, err := splitRawRecords(unit)
+		if err != nil {
+			return 0, nil, diskQueueEndInfo{}, err
+		}
+		for _, r := range records {
+			raws = append(raws, r)
+			sizes = append(sizes, int32(len(r)))
+		}
+		total += int64(len(unit))
+	}
+	if checkSize > 0 && total != checkSize {
+		return 0, nil, diskQueueEndInfo{}, fmt.Errorf("message write size mismatch %v vs %v", checkSize, total)
+	}
+	offset, _, dend, err := d.writeRecords(raws, int32(len(raws)))
+	return offset, sizes, dend, err
+}
+
+func (d *recordQueueWriter) PutRawV2(data []byte, msgCnt int32) (BackendOffset, int32, diskQueueEndInfo, error) {
+	// avoid copy the damaged data from other replica
+	err := CheckRawRecords(data)
+	if err != nil {
+		d.RLock()
+		end := d.writeEnd
+		d.RUnlock()
+		nsqLog.LogErrorf("recordqueue(%s): raw data check failed at %v: %v", d.name, end, err)
+		return 0, 0, diskQueueEndInfo{}, &DataCorruptionError{Name: d.name, Pos: end.EndOffset.Pos,
+			Offset: end.Offset(), Reason: err}
+	}
+	// the raw data buffer may be reused by the caller
+	raws, err := splitRawRecords(append([]byte(nil), data...))
+	if err != nil {
+		return 0, 0, diskQueueEndInfo{}, err
+	}
+	return d.writeRecords(raws, msgCnt)
+}
+
+func (d *recordQueueWriter) writeRecords(raws [][]byte, msgCnt int32) (BackendOffset, int32, diskQueueEndInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return 0, 0, diskQueueEndInfo{}, errors.New("exiting")
+	}
+	if len(raws) == 0 {
+		return d.writeEnd.Offset(), 0, d.writeEnd, nil
+	}
+	recs := make([]storedRecord, 0, len(raws))
+	offset := d.writeEnd.Offset()
+	cnt := d.writeEnd.TotalMsgCnt()
+	for _, raw := range raws {
+		recs = append(recs, storedRecord{offset: offset, cnt: cnt, msgs: 1, raw: raw})
+		offset += BackendOffset(len(raw))
+		cnt++
+	}
+	if int32(len(raws)) != msgCnt {
+		nsqLog.LogWarningf("recordqueue(%s): raw records %v not match the message count %v", d.name, len(raws), msgCnt)
+		recs[len(recs)-1].msgs += msgCnt - int32(len(raws))
+	}
+	writeOffset := d.writeEnd.Offset()
+	err := d.store.append(recs)
+	if err != nil {
+		nsqLog.LogErrorf("recordqueue(%s): write failed at %v: %v", d.name, d.writeEnd, err)
+		return 0, 0, diskQueueEndInfo{}, err
+	}
+	d.writeEnd = recs[len(recs)-1].end()
+	// the ring buffer may evict the oldest records
+	start, _ := d.store.bounds()
+	if start.Offset() > d.queueStart.Offset() {
+		d.queueStart = start
+	}
+	d.needSync = true
+	return writeOffset, int32(d.writeEnd.Offset() - writeOffset), d.writeEnd, nil
+}
+
+func (d *recordQueueWriter) Put(data []byte) (BackendOffset, int32, int64, error) {
+	offset, writeBytes, dend, err := d.PutV2(data)
+	return offset, writeBytes, dend.TotalMsgCnt(), err
+}
+
+func (d *recordQueueWriter) RollbackWriteV2(offset BackendOffset, diffCnt uint64) (diskQueueEndInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.internalResetEnd(offset, d.writeEnd.TotalMsgCnt()-int64(diffCnt))
+}
+
+func (d *recordQueueWriter) RollbackWrite(offset BackendOffset, diffCnt uint64) error {
+	_, err := d.RollbackWriteV2(offset, diffCnt)
+	return err
+}
+
+func (d *recordQueueWriter) ResetWriteEndV2(offset BackendOffset, totalCnt int64) (diskQueueEndInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.internalResetEnd(offset, totalCnt)
+}
+
+func (d *recordQueueWriter) ResetWriteEnd(offset BackendOffset, totalCnt int64) error {
+	_, err := d.ResetWriteEndV2(offset, totalCnt)
+	return err
+}
+
+func (d *recordQueueWriter) internalResetEnd(offset BackendOffset, totalCnt int64) (diskQueueEndInfo, error) {
+	if offset < d.queueStart.Offset() || totalCnt < d.queueStart.TotalMsgCnt() {
+		nsqLog.Logf("reset write end to %v:%v invalid, less than queue start %v", offset, totalCnt, d.queueStart)
+		return d.writeEnd, ErrInvalidOffset
+	}
+	if offset > d.writeEnd.Offset() {
+		return d.writeEnd, ErrInvalidOffset
+	}
+	nsqLog.Logf("recordqueue(%s) reset write end from %v to %v:%v", d.name, d.writeEnd, offset, totalCnt)
+	newEnd := newRecordQueueEnd(offset, totalCnt)
+	err := d.store.truncate(newEnd)
+	if err != nil {
+		nsqLog.LogErrorf("recordqueue(%s) reset write end to %v failed: %v", d.name, newEnd, err)
+		return d.writeEnd, err
+	}
+	d.writeEnd = newEnd
+	d.readEnd = newEnd
+	if BackendOffset(atomic.LoadInt64(&d.syncedOffset)) > offset {
+		atomic.StoreInt64(&d.syncedOffset, int64(offset))
+	}
+	d.needSync = true
+	return d.writeEnd, nil
+}
+
+func (d *recordQueueWriter) ResetWriteWithQueueStart(queueStart BackendQueueEnd) error {
+	d.Lock()
+	defer d.Unlock()
+	nsqLog.Warningf("recordqueue %v reset the queue start from %v:%v to new queue start: %v", d.name,
+		d.queueStart, d.writeEnd, queueStart)
+	start := newRecordQueueEnd(queueStart.Offset(), queueStart.TotalMsgCnt())
+	err := d.store.reset(start)
+	if err != nil {
+		return err
+	}
+	d.queueStart = start
+	d.writeEnd = start
+	d.readEnd = start
+	atomic.StoreInt64(&d.syncedOffset, int64(start.Offset()))
+	return nil
+}
+
+func (d *recordQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffset,
+	noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
+	if cleanEndInfo == nil {
+		return nil, nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	cleanOffset := cleanEndInfo.Offset()
+	if cleanOffset > d.readEnd.Offset() {
+		cleanOffset = d.readEnd.Offset()
+	}
+	if maxCleanOffset != BackendOffset(0) && cleanOffset > maxCleanOffset {
+		cleanOffset = maxCleanOffset
+	}
+	newStart := d.queueStart
+	if cleanOffset <= newStart.Offset() {
+		return &newStart, nil
+	}
+	r, err := d.store.seek(cleanOffset)
+	if err == io.EOF || (err == nil && r.offset > d.readEnd.Offset()) {
+		newStart = d.readEnd
+	} else if err != nil {
+		return &newStart, err
+	} else {
+		// keep the batch record while the reference records after it are kept
+		if back, ok := rawRecordBatchRef(r.raw); ok {
+			r, err = d.store.get(r.offset - BackendOffset(back))
+			if err == ErrReadQueueAlreadyCleaned {
+				return &newStart, nil
+			} else if err != nil {
+				return &newStart, err
+			}
+		}
+		newStart = newRecordQueueEnd(r.offset, r.cnt)
+	}
+	if newStart.Offset() <= d.queueStart.Offset() {
+		newStart = d.queueStart
+		return &newStart, nil
+	}
+	if maxCleanOffset != BackendOffset(0) && newStart.Offset() > maxCleanOffset {
+		newStart = d.queueStart
+		return &newStart, nil
+	}
+	if noRealClean {
+		return &newStart, nil
+	}
+	nsqLog.Infof("recordqueue %v clean queue from %v, %v to new start : %v", d.name,
+		d.queueStart, d.writeEnd, newStart)
+	err = d.store.cleanTo(newStart)
+	if err != nil {
+		return nil, err
+	}
+	d.queueStart = newStart
+	return &newStart, nil
+}
+
+func (d *recordQueueWriter) FlushBuffer() bool {
+	d.Lock()
+	hasData := d.readEnd != d.writeEnd
+	d.readEnd = d.writeEnd
+	d.Unlock()
+	return hasData
+}
+
+func (d *recordQueueWriter) Flush() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	if d.needSync {
+		return d.sync()
+	}
+	return nil
+}
+
+func (d *recordQueueWriter) sync() error {
+	d.readEnd = d.writeEnd
+	err := d.store.sync()
+	if err != nil {
+		return err
+	}
+	d.needSync = false
+	atomic.StoreInt64(&d.syncedOffset, int64(d.writeEnd.Offset()))
+	return nil
+}
+
+// SyncTo make sure the data before the offset is synced to the store,
+// the concurrent callers will share one sync.
+func (d *recordQueueWriter) SyncTo(offset BackendOffset) error {
+	if BackendOffset(atomic.LoadInt64(&d.syncedOffset)) >= offset {
+		return nil
+	}
+	d.syncMutex.Lock()
+	defer d.syncMutex.Unlock()
+	if BackendOffset(atomic.LoadInt64(&d.syncedOffset)) >= offset {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	if offset > d.writeEnd.Offset() {
+		return ErrInvalidOffset
+	}
+	return d.sync()
+}
+
+func (d *recordQueueWriter) GetQueueWriteEnd() BackendQueueEnd {
+	d.RLock()
+	e := d.writeEnd
+	d.RUnlock()
+	return &e
+}
+
+func (d *recordQueueWriter) GetQueueReadStart() BackendQueueEnd {
+	d.RLock()
+	e := d.queueStart
+	d.RUnlock()
+	return &e
+}
+
+func (d *recordQueueWriter) GetQueueReadEnd() BackendQueueEnd {
+	d.RLock()
+	e := d.readEnd
+	d.RUnlock()
+	return &e
+}
+
+func (d *recordQueueWriter) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil
+	}
+	d.exitFlag = 1
+	nsqLog.Logf("recordqueue(%s): closing", d.name)
+	d.sync()
+	return d.store.close()
+}
+
+func (d *recordQueueWriter) Delete() error {
+	d.Lock()
+	defer d.Unlock()
+	nsqLog.Logf("recordqueue(%s): deleting", d.name)
+	if d.exitFlag != 1 {
+		d.exitFlag = 1
+		d.store.close()
+	}
+	return d.store.remove()
+}
+
+// Empty destructively clears out all the data in the queue
+func (d *recordQueueWriter) Empty() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	nsqLog.Logf("recordqueue(%s): emptying", d.name)
+	err := d.store.reset(d.writeEnd)
+	if err != nil {
+		return err
+	}
+	d.queueStart = d.writeEnd
+	d.readEnd = d.writeEnd
+	return nil
+}
+
+func (d *recordQueueWriter) RemoveTo(destPath string) error {
+	d.Lock()
+	defer d.Unlock()
+	nsqLog.Logf("recordqueue(%s): removing to %v", d.name, destPath)
+	if d.exitFlag != 1 {
+		d.exitFlag = 1
+		d.sync()
+		d.store.close()
+	}
+	return d.store.moveTo(destPath)
+}
+
+func (d *recordQueueWriter) newSnapshot(end BackendQueueEnd) *DiskQueueSnapshot {
+	s := NewDiskQueueSnapshot(d.name, d.dataPath, end)
+	s.records = d.store
+	s.maxMsgSize = d.maxMsgSize
+	s.SetQueueStart(d.GetQueueReadStart())
+	return s
+}
+
+// recordQueueReader is the channel reader on the record store, the reader meta
+// is the same as the disk queue reader.
+type recordQueueReader struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	readQueueInfo diskQueueEndInfo
+	queueEndInfo  diskQueueEndInfo
+	// left message number for read
+	depth     int64
+	depthSize int64
+
+	sync.RWMutex
+
+	readerMetaName     string
+	readFrom           string
+	dataPath           string
+	syncEvery          int64
+	exitFlag           int32
+	needSync           bool
+	confirmedQueueInfo diskQueueEndInfo
+	store              recordStore
+	waitingMoreData    int32
+	// the max size of the decompressed data
+	maxMsgSize int32
+	// the messages of the last batch record read
+	batchCache recordBatchCache
+}
+
+func newRecordQueueReader(readFrom string, metaName string, dataPath string, store recordStore,
+	syncEvery int64, readEnd BackendQueueEnd) *recordQueueReader {
+	d := &recordQueueReader{
+		readFrom:       readFrom,
+		readerMetaName: metaName,
+		dataPath:       dataPath,
+		store:          store,
+		syncEvery:      syncEvery,
+		maxMsgSize:     MAX_POSSIBLE_MSG_SIZE,
+	}
+	// init the channel to end, so if any new channel without meta will be init to read at end
+	if end, ok := readEnd.(*diskQueueEndInfo); ok {
+		d.confirmedQueueInfo = *end
+		d.readQueueInfo = *end
+		d.queueEndInfo = *end
+		d.updateDepth()
+	}
+	err := d.retrieveMetaData()
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.LogErrorf("recordqueue(%s) failed to retrieveMetaData - %s", d.readerMetaName, err)
+	}
+	d.UpdateQueueEnd(readEnd, false)
+	return d
+}
+
+func (d *recordQueueReader) Depth() int64 {
+	return atomic.LoadInt64(&d.depth)
+}
+
+func (d *recordQueueReader) DepthSize() int64 {
+	return atomic.LoadInt64(&d.depthSize)
+}
+
+func (d *recordQueueReader) GetQueueReadEnd() BackendQueueEnd {
+	d.RLock()
+	e := d.queueEndInfo
+	d.RUnlock()
+	return &e
+}
+
+func (d *recordQueueReader) GetQueueConfirmed() BackendQueueEnd {
+	d.RLock()
+	e := d.confirmedQueueInfo
+	d.RUnlock()
+	return &e
+}
+
+func (d *recordQueueReader) GetQueueCurrentRead() BackendQueueEnd {
+	d.RLock()
+	e := d.readQueueInfo
+	d.RUnlock()
+	return &e
+}
+
+func (d *recordQueueReader) UpdateQueueEnd(e BackendQueueEnd, forceReload bool) (bool, error) {
+	end, ok := e.(*diskQueueEndInfo)
+	if !ok || end == nil {
+		return false, nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return false, ErrExiting
+	}
+	return d.internalUpdateEnd(end, forceReload)
+}
+
+func (d *recordQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReload bool) (bool, error) {
+	if endPos == nil {
+		if d.needSync {
+			d.sync()
+		}
+		return false, nil
+	}
+	if endPos.Offset() == d.queueEndInfo.Offset() && endPos.TotalMsgCnt() == d.queueEndInfo.TotalMsgCnt() {
+		return false, nil
+	}
+	d.needSync = true
+	if d.readQueueInfo.Offset() > endPos.Offset() {
+		nsqLog.LogWarningf("new end old than the read end: %v, %v, %v", d.readQueueInfo,
+			endPos, d.queueEndInfo)
+		if !forceReload {
+			return false, nil
+		}
+		d.readQueueInfo = *endPos
+	}
+	if d.confirmedQueueInfo.Offset() > d.readQueueInfo.Offset() {
+		d.confirmedQueueInfo = d.readQueueInfo
+	}
+	if endPos.Offset() > d.confirmedQueueInfo.Offset() {
+		atomic.StoreInt32(&d.waitingMoreData, 0)
+	}
+	d.queueEndInfo = *endPos
+	d.updateDepth()
+	if forceReload {
+		// the records may be rewritten after rollback
+		d.batchCache.reset()
+	}
+	return true, nil
+}
+
+func (d *recordQueueReader) updateDepth() {
+	newDepthSize := int64(d.queueEndInfo.Offset() - d.confirmedQueueInfo.Offset())
+	newDepth := d.queueEndInfo.TotalMsgCnt() - d.confirmedQueueInfo.TotalMsgCnt()
+	if newDepthSize == 0 {
+		if newDepth != 0 {
+			nsqLog.Warningf("the confirmed info conflict with queue end: %v, %v", d.confirmedQueueInfo, d.queueEndInfo)
+			d.confirmedQueueInfo = d.queueEndInfo
+		}
+		newDepth = 0
+	}
+	atomic.StoreInt64(&d.depthSize, newDepthSize)
+	atomic.StoreInt64(&d.depth, newDepth)
+	if newDepth == 0 {
+		atomic.StoreInt32(&d.waitingMoreData, 1)
+	}
+}
+
+func (d *recordQueueReader) Delete() error {
+	return d.exit(true)
+}
+
+func (d *recordQueueReader) Close() error {
+	return d.exit(false)
+}
+
+func (d *recordQueueReader) exit(deleted bool) error {
+	d.Lock()
+	defer d.Unlock()
+	d.exitFlag = 1
+	nsqLog.Logf("recordqueue(%s) exiting ", d.readerMetaName)
+	if deleted {
+		err := os.Remove(d.metaDataFileName())
+		if err != nil && !os.IsNotExist(err) {
+			nsqLog.LogErrorf("recordqueue(%s) failed to remove metadata file - %s", d.readerMetaName, err)
+		}
+		return nil
+	}
+	return d.sync()
+}
+
+func (d *recordQueueReader) maybeSync(old BackendOffset, force bool) {
+	if old != d.confirmedQueueInfo.Offset() {
+		d.needSync = true
+		if d.syncEvery == 1 || force {
+			d.sync()
+		}
+	}
+}
+
+func (d *recordQueueReader) ConfirmRead(offset BackendOffset, cnt int64) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return ErrExiting
+	}
+	old := d.confirmedQueueInfo.Offset()
+	err := d.internalConfirm(offset, cnt)
+	d.maybeSync(old, false)
+	return err
+}
+
+func (d *recordQueueReader) internalConfirm(offset BackendOffset, cnt int64) error {
+	if int64(offset) == -1 {
+		d.confirmedQueueInfo = d.readQueueInfo
+		d.updateDepth()
+		return nil
+	}
+	if offset <= d.confirmedQueueInfo.Offset() {
+		return nil
+	}
+	if offset > d.readQueueInfo.Offset() || offset > d.queueEndInfo.Offset() {
+		nsqLog.LogErrorf("confirm exceed read: %v, %v", offset, d.readQueueInfo)
+		return ErrConfirmSizeInvalid
+	}
+	if offset == d.readQueueInfo.Offset() {
+		if cnt == 0 {
+			cnt = d.readQueueInfo.TotalMsgCnt()
+		}
+		if cnt != d.readQueueInfo.TotalMsgCnt() {
+			nsqLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, d.readQueueInfo)
+			return ErrConfirmCntInvalid
+		}
+	}
+	if cnt == 0 && offset != BackendOffset(0) {
+		nsqLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, d.readQueueInfo)
+		return ErrConfirmCntInvalid
+	}
+	d.confirmedQueueInfo = newRecordQueueEnd(offset, cnt)
+	d.updateDepth()
+	return nil
+}
+
+func (d *recordQueueReader) Flush() {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return
+	}
+	d.internalUpdateEnd(nil, false)
+}
+
+func (d *recordQueueReader) ResetReadToConfirmed() (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	old := d.confirmedQueueInfo.Offset()
+	err := d.internalSkipTo(d.confirmedQueueInfo.Offset(), d.confirmedQueueInfo.TotalMsgCnt(), false)
+	if err == nil {
+		d.maybeSync(old, false)
+	}
+	e := d.confirmedQueueInfo
+	return &e, err
+}
+
+func (d *recordQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	old := d.confirmedQueueInfo.Offset()
+	nsqLog.Infof("reset from: %v, %v to: %v:%v", d.readQueueInfo, d.confirmedQueueInfo, offset, cnt)
+	err := d.internalSkipTo(offset, cnt, offset < old)
+	if err == nil {
+		d.maybeSync(old, true)
+	}
+	e := d.confirmedQueueInfo
+	return &e, err
+}
+
+func (d *recordQueueReader) ResetLastReadOne(offset BackendOffset, cnt int64, lastMoved int32) {
+	d.Lock()
+	defer d.Unlock()
+	if d.readQueueInfo.Offset() < BackendOffset(lastMoved) {
+		return
+	}
+	if cnt > 0 || (offset == 0 && cnt == 0) {
+		d.readQueueInfo = newRecordQueueEnd(offset, cnt)
+	} else {
+		d.readQueueInfo = newRecordQueueEnd(offset, d.readQueueInfo.TotalMsgCnt())
+	}
+}
+
+func (d *recordQueueReader) SkipReadToOffset(offset BackendOffset, cnt int64) (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	old := d.confirmedQueueInfo.Offset()
+	err := d.internalSkipTo(offset, cnt, false)
+	if err == nil {
+		d.maybeSync(old, false)
+	}
+	e := d.confirmedQueueInfo
+	return &e, err
+}
+
+func (d *recordQueueReader) SkipReadToEnd() (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	old := d.confirmedQueueInfo.Offset()
+	d.skipToEndofQueue()
+	d.maybeSync(old, false)
+	e := d.confirmedQueueInfo
+	return &e, nil
+}
+
+func (d *recordQueueReader) skipToEndofQueue() {
+	d.readQueueInfo = d.queueEndInfo
+	d.confirmedQueueInfo = d.queueEndInfo
+	d.updateDepth()
+}
+
+func (d *recordQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backToConfirmed bool) error {
+	if voffset == d.readQueueInfo.Offset() || voffset == d.confirmedQueueInfo.Offset() {
+		cur := d.readQueueInfo
+		if voffset == d.confirmedQueueInfo.Offset() {
+			cur = d.confirmedQueueInfo
+		}
+		if cnt != 0 && cur.TotalMsgCnt() != cnt {
+			nsqLog.Logf("try sync the message count since the cnt is not matched: %v, %v", cnt, cur)
+			cur.totalMsgCnt = cnt
+		}
+		d.readQueueInfo = cur
+		d.confirmedQueueInfo = cur
+		d.updateDepth()
+		return nil
+	}
+	if voffset < d.confirmedQueueInfo.Offset() && !backToConfirmed {
+		nsqLog.Logf("skip backward to less than confirmed: %v, %v", voffset, d.confirmedQueueInfo.Offset())
+		return ErrMoveOffsetInvalid
+	}
+	if voffset > d.queueEndInfo.Offset() || cnt > d.queueEndInfo.TotalMsgCnt() {
+		nsqLog.Logf("internal skip great than end : %v, skipping to : %v:%v", d.queueEndInfo, voffset, cnt)
+		return ErrMoveOffsetOverflowed
+	} else if voffset == d.queueEndInfo.Offset() {
+		if cnt == 0 {
+			cnt = d.queueEndInfo.TotalMsgCnt()
+		} else if cnt != d.queueEndInfo.TotalMsgCnt() {
+			nsqLog.LogErrorf("internal skip count invalid: %v:%v, current end: %v", voffset, cnt, d.queueEndInfo)
+			return ErrMoveOffsetInvalid
+		}
+	} else {
+		if cnt == 0 && voffset != BackendOffset(0) {
+			nsqLog.LogErrorf("skip read count invalid: %v:%v, %v", voffset, cnt, d.readQueueInfo)
+			return ErrMoveOffsetInvalid
+		}
+		// make sure the offset is at the record boundary
+		_, err := d.store.get(voffset)
+		if err != nil {
+			nsqLog.LogErrorf("internal skip error : %v, skipping to : %v", err, voffset)
+			return err
+		}
+	}
+	if voffset < d.readQueueInfo.Offset() || nsqLog.Level() > levellogger.LOG_DEBUG {
+		nsqLog.Logf("==== recordqueue(%s) read skip from %v to : %v:%v",
+			d.readerMetaName, d.readQueueInfo, voffset, cnt)
+	}
+	d.readQueueInfo = newRecordQueueEnd(voffset, cnt)
+	d.confirmedQueueInfo = d.readQueueInfo
+	d.updateDepth()
+	return nil
+}
+
+// waiting more data if all data has been confirmed to consumed
+func (d *recordQueueReader) IsWaitingMoreData() bool {
+	return atomic.LoadInt32(&d.waitingMoreData) == 1
+}
+
+func (d *recordQueueReader) isReadToEnd() bool {
+	if d.IsWaitingMoreData() {
+		return true
+	}
+	d.Lock()
+	hasData := d.queueEndInfo.Offset() > d.readQueueInfo.Offset()
+	d.Unlock()
+	return !hasData
+}
+
+// SkipToNext skip the record at the confirmed position which can not be read
+func (d *recordQueueReader) SkipToNext() (BackendQueueEnd, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return nil, ErrExiting
+	}
+	nsqLog.LogWarningf("recordqueue(%s) skip to next from %v, %v",
+		d.readerMetaName, d.readQueueInfo, d.confirmedQueueInfo)
+	r, err := d.store.get(d.confirmedQueueInfo.Offset())
+	if err != nil || r.offset >= d.queueEndInfo.Offset() {
+		d.skipToEndofQueue()
+	} else {
+		d.readQueueInfo = r.end()
+		d.confirmedQueueInfo = d.readQueueInfo
+		d.updateDepth()
+	}
+	d.needSync = true
+	e := d.confirmedQueueInfo
+	return &e, nil
+}
+
+func (d *recordQueueReader) TryReadOne() (ReadResult, bool) {
+	d.Lock()
+	defer d.Unlock()
+	if d.queueEndInfo.Offset() <= d.readQueueInfo.Offset() {
+		return ReadResult{}, false
+	}
+	return d.readOne(), true
+}
+
+func (d *recordQueueReader) readOne() ReadResult {
+	var result ReadResult
+	result.Offset = d.readQueueInfo.Offset()
+	r, err := d.store.get(d.readQueueInfo.Offset())
+	if err == ErrReadQueueAlreadyCleaned {
+		// the ring buffer evicted the data not consumed
+		start, _ := d.store.bounds()
+		nsqLog.LogWarningf("recordqueue(%s) read position %v cleaned, skip to the queue start %v",
+			d.readerMetaName, d.readQueueInfo, start)
+		if start.Offset() >= d.queueEndInfo.Offset() {
+			d.skipToEndofQueue()
+			result.Err = err
+			return result
+		}
+		d.readQueueInfo = start
+		if d.confirmedQueueInfo.Offset() < start.Offset() {
+			d.confirmedQueueInfo = start
+			d.needSync = true
+		}
+		d.updateDepth()
+		result.Offset = start.Offset()
+		r, err = d.store.get(start.Offset())
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Data, result.Err = decodeStoredRecordData(&d.batchCache, d.store, r, d.maxMsgSize)
+	if result.Err != nil {
+		result.Err = &DataCorruptionError{Name: d.readerMetaName, Pos: int64(r.offset),
+			Offset: r.offset, Reason: result.Err}
+		return result
+	}
+	result.MovedSize = BackendOffset(len(r.raw))
+	d.readQueueInfo = r.end()
+	if d.readQueueInfo.Offset() == d.queueEndInfo.Offset() {
+		d.readQueueInfo.totalMsgCnt = d.queueEndInfo.TotalMsgCnt()
+	}
+	result.CurCnt = d.readQueueInfo.TotalMsgCnt()
+	return result
+}
+
+// decodeStoredRecordData decode the record in the store, the batch record referenced
+// will be read from the store if it is not the last batch read.
+func decodeStoredRecordData(c *recordBatchCache, store recordStore, r storedRecord, maxSize int32) ([]byte, error) {
+	if len(r.raw) < 4 {
+		return nil, ErrInvalidRecordSize
+	}
+	size, flags, err := parseRecordHeader(int32(binary.BigEndian.Uint32(r.raw[:4])))
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 || int(size) > len(r.raw)-4 {
+		return nil, ErrInvalidRecordSize
+	}
+	return c.decodeRecord(0, int64(r.offset), size, flags, r.raw[4:4+size], maxSize, func(pos int64) ([]byte, error) {
+		batch, err := store.get(BackendOffset(pos))
+		if err != nil {
+			return nil, err
+		}
+		return batch.raw, nil
+	})
+}
+
+func (d *recordQueueReader) sync() error {
+	err := d.persistMetaData()
+	if err != nil {
+		return err
+	}
+	d.needSync = false
+	return nil
+}
+
+func (d *recordQueueReader) retrieveMetaData() error {
+	f, err := os.OpenFile(d.metaDataFileName(), os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var confirmed, end diskQueueEndInfo
+	_, err = fmt.Fscanf(f, "%d\n%d\n%d,%d,%d\n%d,%d,%d\n",
+		&confirmed.totalMsgCnt,
+		&end.totalMsgCnt,
+		&confirmed.EndOffset.FileNum, &confirmed.EndOffset.Pos, &confirmed.virtualEnd,
+		&end.EndOffset.FileNum, &end.EndOffset.Pos, &end.virtualEnd)
+	if err != nil {
+		return err
+	}
+	d.confirmedQueueInfo = newRecordQueueEnd(confirmed.Offset(), confirmed.TotalMsgCnt())
+	d.queueEndInfo = newRecordQueueEnd(end.Offset(), end.TotalMsgCnt())
+	d.readQueueInfo = d.confirmedQueueInfo
+	d.updateDepth()
+	return nil
+}
+
+func (d *recordQueueReader) persistMetaData() error {
+	data := fmt.Sprintf("%d\n%d\n%d,%d,%d\n%d,%d,%d\n",
+		d.confirmedQueueInfo.TotalMsgCnt(),
+		d.queueEndInfo.TotalMsgCnt(),
+		d.confirmedQueueInfo.EndOffset.FileNum, d.confirmedQueueInfo.EndOffset.Pos, d.confirmedQueueInfo.Offset(),
+		d.queueEndInfo.EndOffset.FileNum, d.queueEndInfo.EndOffset.Pos, d.queueEndInfo.Offset())
+	return writeFileAtomic(d.metaDataFileName(), strings.NewReader(data))
+}
+
+func (d *recordQueueReader) metaDataFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.v2.reader.dat"),
+		d.readerMetaName)
+}
+
+func (d *DiskQueueSnapshot) recordSeekTo(voffset BackendOffset, allowBackward bool) error {
+	if voffset > d.endPos.Offset() {
+		return ErrMoveOffsetOverflowed
+	}
+	if voffset < d.queueStart.Offset() {
+		nsqLog.LogWarningf("seek error : seek queue position cleaned : %v, %v", voffset, d.queueStart)
+		return ErrReadQueueAlreadyCleaned
+	}
+	if !allowBackward && voffset < d.readPos.Offset() {
+		return fmt.Errorf("can not step backward")
+	}
+	if voffset != d.endPos.Offset() {
+		_, err := d.records.get(voffset)
+		if err != nil {
+			return err
+		}
+	}
+	d.readPos.EndOffset.Pos = int64(voffset)
+	d.readPos.virtualEnd = voffset
+	return nil
+}
+
+func (d *DiskQueueSnapshot) recordSkipToNext() error {
+	if d.readPos.Offset() >= d.endPos.Offset() {
+		return ErrReadEndOfQueue
+	}
+	r, err := d.records.get(d.readPos.Offset())
+	if err != nil {
+		return err
+	}
+	d.readPos.EndOffset.Pos = int64(r.offset) + int64(len(r.raw))
+	d.readPos.virtualEnd = BackendOffset(d.readPos.EndOffset.Pos)
+	return nil
+}
+
+func (d *DiskQueueSnapshot) recordReadOne() ReadResult {
+	var result ReadResult
+	result.Offset = d.readPos.Offset()
+	if d.readPos.Offset() >= d.endPos.Offset() {
+		result.Err = io.EOF
+		return result
+	}
+	r, err := d.records.get(d.readPos.Offset())
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Data, result.Err = decodeStoredRecordData(&d.batchCache, d.records, r, d.maxMsgSize)
+	if result.Err != nil {
+		result.Err = d.newCorruptionError(result.Err)
+		return result
+	}
+	result.MovedSize = BackendOffset(len(r.raw))
+	d.readPos.EndOffset.Pos += int64(result.MovedSize)
+	d.readPos.virtualEnd += result.MovedSize
+	return result
+}
+
+// the raw data can only be read from the record boundary
+func (d *DiskQueueSnapshot) recordReadRaw(size int32) ([]byte, error) {
+	result := make([]byte, 0, size)
+	for int32(len(result)) < size {
+		if d.readPos.Offset() >= d.endPos.Offset() {
+			return result, io.EOF
+		}
+		r, err := d.records.get(d.readPos.Offset())
+		if err != nil {
+			return result, err
+		}
+		if int32(len(result)+len(r.raw)) > size {
+			return result, ErrInvalidOffset
+		}
+		result = append(result, r.raw...)
+		d.readPos.EndOffset.Pos += int64(len(r.raw))
+		d.readPos.virtualEnd += BackendOffset(len(r.raw))
+	}
+	return result, nil
+}
@@ -0,0 +1,210 @@
+package nsqd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+// the storage engines for the topic data, the engine is chosen while the topic
+// is created and can not be changed after data written.
+const (
+	// the segment files on disk, the default engine
+	BackendStorageFiles = "files"
+	// the ring buffer in memory, the oldest data will be dropped even if not consumed while
+	// exceeding the max-bytes-per-file, and all the data will be lost after restart.
+	BackendStorageMemory = "memory"
+	// the embedded kv db
+	BackendStorageKV = "kv"
+)
+
+var ErrUnknownBackendStorage = errors.New("unknown backend storage engine")
+
+// topicQueueWriter is the storage engine for the topic data, the data written
+// should keep the same record format as the disk queue segment, so the raw data
+// can be replicated between the replicas.
+type topicQueueWriter interface {
+	BackendQueueWriter
+	PutV2(data []byte) (BackendOffset, int32, diskQueueEndInfo, error)
+	PutV2WithCheck(data []byte, checkSize int64) (BackendOffset, int32, diskQueueEndInfo, error)
+	PutRawV2(data []byte, msgCnt int32) (BackendOffset, int32, diskQueueEndInfo, error)
+	// write the messages together and return the size on disk of each message, the checkSize
+	// is the total size on disk if not 0.
+	PutBatchV2(datas [][]byte, checkSize int64) (BackendOffset, []int32, diskQueueEndInfo, error)
+	RollbackWriteV2(offset BackendOffset, diffCnt uint64) (diskQueueEndInfo, error)
+	ResetWriteEndV2(offset BackendOffset, totalCnt int64) (diskQueueEndInfo, error)
+	ResetWriteWithQueueStart(queueStart BackendQueueEnd) error
+	CleanOldDataByRetention(cleanEndInfo BackendQueueOffset,
+		noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error)
+	FlushBuffer() bool
+	SyncTo(offset BackendOffset) error
+	RemoveTo(destPath string) error
+	SetCompressCodec(codec CompressCodec)
+	SetChecksumEnabled(enable bool)
+	SetTimeIndexEnabled(enable bool)
+	SetArchiver(archiver SegmentArchiver)
+	// the snapshot reading the data between the queue start and the end
+	newSnapshot(end BackendQueueEnd) *DiskQueueSnapshot
+	// the channel reader of the topic data
+	newReader(metaName string, opt *Options, syncEvery int64, readEnd BackendQueueEnd) channelQueueReader
+}
+
+type channelQueueReader interface {
+	BackendQueueReader
+	GetQueueCurrentRead() BackendQueueEnd
+	ResetReadToOffset(offset BackendOffset, cnt int64) (BackendQueueEnd, error)
+	ResetLastReadOne(offset BackendOffset, cnt int64, lastMoved int32)
+	SkipToNext() (BackendQueueEnd, error)
+	IsWaitingMoreData() bool
+	isReadToEnd() bool
+	Flush()
+}
+
+type backendStorageFactory func(name string, dataPath string, opt *Options) (topicQueueWriter, error)
+
+var backendStorages = make(map[string]backendStorageFactory)
+
+// registerBackendStorage should be called in init, the registry is not protected by lock.
+func registerBackendStorage(name string, factory backendStorageFactory) {
+	backendStorages[name] = factory
+}
+
+func IsValidBackendStorage(name string) bool {
+	_, ok := backendStorages[name]
+	return ok
+}
+
+func init() {
+	registerBackendStorage(BackendStorageFiles, newFilesQueueWriter)
+	registerBackendStorage(BackendStorageMemory, newMemoryQueueWriter)
+	registerBackendStorage(BackendStorageKV, newKVQueueWriter)
+}
+
+func newFilesQueueWriter(name string, dataPath string, opt *Options) (topicQueueWriter, error) {
+	queue, err := NewDiskQueueWriter(name,
+		dataPath,
+		opt.MaxBytesPerFile,
+		int32(minValidMsgLength),
+		int32(opt.MaxMsgSize)+minValidMsgLength,
+		opt.SyncEvery)
+	// the queue is returned even if error, since it may need fix the queue start
+	d := queue.(*diskQueueWriter)
+	d.SetPreallocateEnabled(opt.SegmentPreallocate)
+	d.SetMmapReadEnabled(opt.MmapRead)
+	return d, err
+}
+
+func newMemoryQueueWriter(name string, dataPath string, opt *Options) (topicQueueWriter, error) {
+	return newRecordStorageWriter(name, dataPath, newMemRecordStore(name, dataPath, opt.MaxBytesPerFile), opt)
+}
+
+func newKVQueueWriter(name string, dataPath string, opt *Options) (topicQueueWriter, error) {
+	store, err := newBoltRecordStore(name, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	return newRecordStorageWriter(name, dataPath, store, opt)
+}
+
+func newRecordStorageWriter(name string, dataPath string, store recordStore, opt *Options) (topicQueueWriter, error) {
+	w, err := newRecordQueueWriter(name, dataPath, store,
+		int32(minValidMsgLength), int32(opt.MaxMsgSize)+minValidMsgLength)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (d *diskQueueWriter) newSnapshot(end BackendQueueEnd) *DiskQueueSnapshot {
+	s := NewDiskQueueSnapshot(d.name, d.dataPath, end)
+	s.SetQueueStart(d.GetQueueReadStart())
+	s.SetArchiver(d.getArchiver())
+	s.SetMmapReadEnabled(d.IsMmapReadEnabled())
+	s.maxMsgSize = d.maxMsgSize
+	return s
+}
+
+func (d *diskQueueWriter) newReader(metaName string, opt *Options, syncEvery int64, readEnd BackendQueueEnd) channelQueueReader {
+	r := newDiskQueueReader(d.name, metaName,
+		d.dataPath,
+		opt.MaxBytesPerFile,
+		int32(minValidMsgLength),
+		int32(opt.MaxMsgSize)+minValidMsgLength,
+		syncEvery,
+		opt.SyncTimeout,
+		readEnd,
+		false).(*diskQueueReader)
+	if archiver := d.getArchiver(); archiver != nil {
+		r.SetArchiver(archiver)
+	}
+	r.SetMmapReadEnabled(d.IsMmapReadEnabled())
+	return r
+}
+
+func (d *recordQueueWriter) newReader(metaName string, opt *Options, syncEvery int64, readEnd BackendQueueEnd) channelQueueReader {
+	r := newRecordQueueReader(d.name, metaName, d.dataPath, d.store, syncEvery, readEnd)
+	r.maxMsgSize = d.maxMsgSize
+	return r
+}
+
+func getBackendStorageFileName(dataPath string, backendName string) string {
+	return path.Join(dataPath, backendName+".storage.dat")
+}
+
+// resolveBackendStorage decide the storage engine for the topic, the engine of the
+// existing topic data will never be changed. The storage of the topic in cluster is
+// decided while creating in the topic meta, so the empty storage is only used for the
+// topic without the cluster, and the node default is used.
+func resolveBackendStorage(dataPath string, backendName string, storage string,
+	opt *Options) (string, error) {
+	fName := getBackendStorageFileName(dataPath, backendName)
+	data, err := ioutil.ReadFile(fName)
+	if err == nil {
+		saved := strings.TrimSpace(string(data))
+		if !IsValidBackendStorage(saved) {
+			return "", ErrUnknownBackendStorage
+		}
+		if storage != "" && storage != saved {
+			nsqLog.LogWarningf("topic %v storage %v can not be changed to %v", backendName, saved, storage)
+		}
+		return saved, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, err := os.Stat(path.Join(dataPath, backendName+".diskqueue.meta.writer.dat")); err == nil {
+		// the old topic data before the storage engine introduced
+		storage = BackendStorageFiles
+	} else if storage == "" {
+		storage = opt.BackendStorage
+	}
+	if storage == "" {
+		storage = BackendStorageFiles
+	}
+	if !IsValidBackendStorage(storage) {
+		return "", ErrUnknownBackendStorage
+	}
+	err = writeFileAtomic(fName, strings.NewReader(storage))
+	if err != nil {
+		return "", err
+	}
+	return storage, nil
+}
+
+func moveBackendStorageFile(dataPath string, backendName string, destPath string) {
+	fName := getBackendStorageFileName(dataPath, backendName)
+	err := util.AtomicRename(fName, getBackendStorageFileName(destPath, backendName))
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.LogWarningf("failed to move the storage file %v: %v", fName, err)
+	}
+}
+
+func removeBackendStorageFile(dataPath string, backendName string) {
+	err := os.Remove(getBackendStorageFileName(dataPath, backendName))
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.LogWarningf("failed to remove the storage file of %v: %v", backendName, err)
+	}
+}
@@ -0,0 +1,730 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/levellogger"
+)
+
+// In the broadcast channel every message is sent to all the members instead of one client.
+// The member is identified by the client id in IDENTIFY, and the clients with the same client
+// id share the messages of the member. The message read from the backend is confirmed in the
+// channel only after all the active members finished it. The member without any client is
+// still active until BroadcastMemberTimeout, so the restarted client will not lose the messages
+// published while it is disconnected.
+
+var (
+	ErrBroadcastOrdered    = errors.New("broadcast is not allowed for the ordered channel")
+	ErrBroadcastNoClientID = errors.New("client id is needed for the broadcast channel")
+)
+
+type BroadcastMemberStats struct {
+	ClientID   string `json:"client_id"`
+	ClientNum  int    `json:"client_num"`
+	Offset     int64  `json:"offset"`
+	Pending    int    `json:"pending"`
+	InFlight   int    `json:"in_flight"`
+	Finished   uint64 `json:"finished"`
+	LastActive int64  `json:"last_active"`
+}
+
+// broadcastMsg is the message read from the backend waiting the members to finish
+type broadcastMsg struct {
+	msg     *Message
+	pending map[string]struct{}
+}
+
+type broadcastMember struct {
+	sync.Mutex
+	id         string
+	clients    map[int64]Consumer
+	msgChan    chan *Message
+	notifyChan chan bool
+	exitChan   chan int
+	// the messages waiting to be sent to the clients
+	queue []*Message
+	// the messages sent to the clients (or deferred) and waiting finish
+	inFlight map[MessageID]*Message
+	// all the messages not finished by the member
+	pending map[MessageID]*Message
+	// the end offset of the last dispatched message
+	dispatched BackendOffset
+	// the messages before this offset are already finished by the member
+	skipBefore BackendOffset
+	finished   uint64
+	lastActive int64
+	// the number of the messages requeued to the head of the queue
+	requeued uint64
+}
+
+func (m *broadcastMember) notify() {
+	select {
+	case m.notifyChan <- true:
+	default:
+	}
+}
+
+// offsetNoLock return the offset before which all the messages are finished by the member
+func (m *broadcastMember) offsetNoLock() BackendOffset {
+	offset := m.dispatched
+	for _, msg := range m.pending {
+		if msg.DelayedType != ChannelDelayed && msg.Offset < offset {
+			offset = msg.Offset
+		}
+	}
+	return offset
+}
+
+func (m *broadcastMember) pushNoLock(msg *Message) {
+	m.queue = append(m.queue, msg)
+	m.pending[msg.ID] = msg
+	if msg.DelayedType != ChannelDelayed && msg.Offset+msg.RawMoveSize > m.dispatched {
+		m.dispatched = msg.Offset + msg.RawMoveSize
+	}
+	m.notify()
+}
+
+// requeueNoLock put the message back to the head of the queue
+func (m *broadcastMember) requeueNoLock(msg *Message) {
+	atomic.StoreInt32(&msg.deferredCnt, 0)
+	m.queue = append([]*Message{msg}, m.queue...)
+	m.requeued++
+	m.notify()
+}
+
+// unpopNoLock put back the popped message not sent, the messages requeued after
+// popped should be kept before it.
+func (m *broadcastMember) unpopNoLock(msg *Message, requeuedBefore uint64) {
+	pos := int(m.requeued - requeuedBefore)
+	if pos > len(m.queue) {
+		pos = len(m.queue)
+	}
+	m.queue = append(m.queue, nil)
+	copy(m.queue[pos+1:], m.queue[pos:])
+	m.queue[pos] = msg
+	m.notify()
+}
+
+// popNoLock move the head message to in flight if any client can receive it
+func (m *broadcastMember) popNoLock(timeout time.Duration) *Message {
+	if len(m.queue) == 0 || len(m.clients) == 0 {
+		return nil
+	}
+	msg := m.queue[0]
+	m.queue[0] = nil
+	m.queue = m.queue[1:]
+	msg.belongedConsumer = nil
+	msg.pri = time.Now().Add(timeout).UnixNano()
+	m.inFlight[msg.ID] = msg
+	return msg
+}
+
+func (m *broadcastMember) removeNoLock(id MessageID) *Message {
+	msg, ok := m.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(m.pending, id)
+	delete(m.inFlight, id)
+	for i, qm := range m.queue {
+		if qm.ID == id {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			break
+		}
+	}
+	return msg
+}
+
+func (m *broadcastMember) clearNoLock(offset BackendOffset) {
+	for _, msg := range m.inFlight {
+		if msg.belongedConsumer != nil {
+			msg.belongedConsumer.RequeuedMessage()
+			msg.belongedConsumer = nil
+		}
+	}
+	m.queue = nil
+	m.inFlight = make(map[MessageID]*Message)
+	m.pending = make(map[MessageID]*Message)
+	m.dispatched = offset
+	m.skipBefore = offset
+}
+
+func (c *Channel) IsBroadcast() bool {
+	return atomic.LoadInt32(&c.broadcast) == 1
+}
+
+// SetBroadcast change the consume mode of the channel, the messages not finished by all
+// the members will be read again from the confirmed offset while the broadcast is disabled.
+func (c *Channel) SetBroadcast(enable bool) error {
+	if enable {
+		if c.IsOrdered() {
+			return ErrBroadcastOrdered
+		}
+		atomic.StoreInt32(&c.broadcast, 1)
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&c.broadcast, 1, 0) {
+		return nil
+	}
+	c.bcMutex.Lock()
+	for _, m := range c.bcMembers {
+		c.removeBroadcastMemberNoLock(m)
+	}
+	c.bcMsgs = make(map[MessageID]*broadcastMsg)
+	c.bcMutex.Unlock()
+	c.notifyBroadcastChanged()
+	atomic.StoreInt32(&c.needResetReader, 1)
+	c.TryWakeupRead()
+	return nil
+}
+
+// SetBroadcastFromMeta restore the broadcast mode and the offsets of the members
+func (c *Channel) SetBroadcastFromMeta(meta *ChannelMetaInfo) {
+	err := c.SetBroadcast(meta.Broadcast)
+	if err != nil {
+		nsqLog.LogWarningf("channel %v-%v set broadcast from meta failed: %v",
+			c.GetTopicName(), c.GetName(), err)
+		return
+	}
+	if !meta.Broadcast || len(meta.BroadcastMembers) == 0 {
+		return
+	}
+	c.bcMutex.Lock()
+	for id, offset := range meta.BroadcastMembers {
+		if _, ok := c.bcMembers[id]; ok {
+			continue
+		}
+		c.newBroadcastMemberNoLock(id, BackendOffset(offset))
+	}
+	c.bcMutex.Unlock()
+	c.notifyBroadcastChanged()
+}
+
+// notifyBroadcastChanged wake up the messagePump waiting the members or the slow members
+func (c *Channel) notifyBroadcastChanged() {
+	select {
+	case c.bcChanged <- true:
+	default:
+	}
+}
+
+// should be protected by bcMutex
+func (c *Channel) newBroadcastMemberNoLock(id string, offset BackendOffset) *broadcastMember {
+	m := &broadcastMember{
+		id:         id,
+		clients:    make(map[int64]Consumer),
+		msgChan:    make(chan *Message),
+		notifyChan: make(chan bool, 1),
+		exitChan:   make(chan int),
+		inFlight:   make(map[MessageID]*Message),
+		pending:    make(map[MessageID]*Message),
+		dispatched: offset,
+		skipBefore: offset,
+		lastActive: time.Now().UnixNano(),
+	}
+	c.bcMembers[id] = m
+	go c.broadcastMemberPump(m)
+	nsqLog.Logf("channel %v-%v new broadcast member %v from offset %v",
+		c.GetTopicName(), c.GetName(), id, offset)
+	return m
+}
+
+// removeBroadcastMemberNoLock should be protected by bcMutex, and the returned messages
+// are finished by all the members now.
+func (c *Channel) removeBroadcastMemberNoLock(m *broadcastMember) []*Message {
+	delete(c.bcMembers, m.id)
+	close(m.exitChan)
+	m.Lock()
+	for clientID := range m.clients {
+		delete(c.bcClients, clientID)
+	}
+	pending := m.pending
+	m.clearNoLock(0)
+	m.Unlock()
+
+	var done []*Message
+	for id := range pending {
+		bm, ok := c.bcMsgs[id]
+		if !ok {
+			continue
+		}
+		delete(bm.pending, m.id)
+		if len(bm.pending) == 0 {
+			delete(c.bcMsgs, id)
+			done = append(done, bm.msg)
+		}
+	}
+	return done
+}
+
+// AddBroadcastClient add the client to the member of the client id, and the member will be
+// created if not exist. Return true if the member is new created.
+func (c *Channel) AddBroadcastClient(clientID int64, memberID string, client Consumer) (bool, error) {
+	if memberID == "" {
+		return false, ErrBroadcastNoClientID
+	}
+	c.bcMutex.Lock()
+	m, ok := c.bcMembers[memberID]
+	if !ok {
+		// the new member only receive the messages after joined
+		m = c.newBroadcastMemberNoLock(memberID, c.backend.GetQueueCurrentRead().Offset())
+	}
+	m.Lock()
+	m.clients[clientID] = client
+	m.lastActive = time.Now().UnixNano()
+	m.Unlock()
+	c.bcClients[clientID] = m
+	c.bcMutex.Unlock()
+	if !ok {
+		c.notifyBroadcastChanged()
+	}
+	m.notify()
+	return !ok, nil
+}
+
+func (c *Channel) removeBroadcastClient(clientID int64) {
+	c.bcMutex.Lock()
+	defer c.bcMutex.Unlock()
+	m, ok := c.bcClients[clientID]
+	if !ok {
+		return
+	}
+	delete(c.bcClients, clientID)
+	m.Lock()
+	delete(m.clients, clientID)
+	m.lastActive = time.Now().UnixNano()
+	m.Unlock()
+	m.notify()
+}
+
+func (c *Channel) getBroadcastClientMember(clientID int64) *broadcastMember {
+	if !c.IsBroadcast() {
+		return nil
+	}
+	c.bcMutex.Lock()
+	m := c.bcClients[clientID]
+	c.bcMutex.Unlock()
+	return m
+}
+
+// GetBroadcastMsgChan return the messages chan of the member which the client belonged to.
+func (c *Channel) GetBroadcastMsgChan(clientID int64) (chan *Message, bool) {
+	m := c.getBroadcastClientMember(clientID)
+	if m == nil {
+		return nil, false
+	}
+	return m.msgChan, true
+}
+
+// GetBroadcastMemberOffsets return the offset of each member, used to save in the channel meta.
+func (c *Channel) GetBroadcastMemberOffsets() map[string]int64 {
+	if !c.IsBroadcast() {
+		return nil
+	}
+	confirmed := c.GetConfirmed().Offset()
+	offsets := make(map[string]int64)
+	c.bcMutex.Lock()
+	for id, m := range c.bcMembers {
+		m.Lock()
+		offset := m.offsetNoLock()
+		m.Unlock()
+		if offset < confirmed {
+			offset = confirmed
+		}
+		offsets[id] = int64(offset)
+	}
+	c.bcMutex.Unlock()
+	return offsets
+}
+
+func (c *Channel) GetBroadcastMemberStats() []BroadcastMemberStats {
+	if !c.IsBroadcast() {
+		return nil
+	}
+	confirmed := c.GetConfirmed().Offset()
+	c.bcMutex.Lock()
+	stats := make([]BroadcastMemberStats, 0, len(c.bcMembers))
+	for id, m := range c.bcMembers {
+		m.Lock()
+		offset := m.offsetNoLock()
+		if offset < confirmed {
+			offset = confirmed
+		}
+		stats = append(stats, BroadcastMemberStats{
+			ClientID:   id,
+			ClientNum:  len(m.clients),
+			Offset:     int64(offset),
+			Pending:    len(m.pending),
+			InFlight:   len(m.inFlight),
+			Finished:   m.finished,
+			LastActive: m.lastActive,
+		})
+		m.Unlock()
+	}
+	c.bcMutex.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ClientID < stats[j].ClientID
+	})
+	return stats
+}
+
+func (c *Channel) getBroadcastPendingCnt() int {
+	c.bcMutex.Lock()
+	n := len(c.bcMsgs)
+	c.bcMutex.Unlock()
+	return n
+}
+
+// dispatchBroadcast send the copy of the message to all the members, return false if no
+// any member to receive the message or too many messages waiting the slow members, so the
+// messages in memory will not grow without limit.
+func (c *Channel) dispatchBroadcast(msg *Message) bool {
+	if !c.IsBroadcast() {
+		// the reader will be reset to the confirmed after the broadcast disabled
+		return true
+	}
+	c.bcMutex.Lock()
+	if len(c.bcMembers) == 0 || int64(len(c.bcMsgs)) >= c.option.MaxConfirmWin {
+		c.bcMutex.Unlock()
+		return false
+	}
+	bm := &broadcastMsg{
+		msg:     msg,
+		pending: make(map[string]struct{}, len(c.bcMembers)),
+	}
+	for id, m := range c.bcMembers {
+		m.Lock()
+		if msg.DelayedType != ChannelDelayed && msg.Offset < m.skipBefore {
+			m.Unlock()
+			continue
+		}
+		copyMsg := msg.GetCopy()
+		copyMsg.bcMember = id
+		m.pushNoLock(copyMsg)
+		m.Unlock()
+		bm.pending[id] = struct{}{}
+	}
+	if len(bm.pending) > 0 {
+		c.bcMsgs[msg.ID] = bm
+	}
+	c.bcMutex.Unlock()
+	if len(bm.pending) == 0 {
+		c.confirmBroadcastMsg(msg)
+	}
+	return true
+}
+
+func (c *Channel) broadcastMemberPump(m *broadcastMember) {
+	// the clients of the member will exit while the chan is closed
+	defer close(m.msgChan)
+	for {
+		var msgChan chan *Message
+		m.Lock()
+		msg := m.popNoLock(c.option.MsgTimeout)
+		requeued := m.requeued
+		m.Unlock()
+		if msg != nil {
+			msgChan = m.msgChan
+		}
+		select {
+		case msgChan <- msg:
+			continue
+		case <-m.notifyChan:
+		case <-m.exitChan:
+			return
+		case <-c.exitChan:
+			return
+		}
+		if msg != nil {
+			// not sent, put it back and try again
+			m.Lock()
+			if m.inFlight[msg.ID] == msg {
+				delete(m.inFlight, msg.ID)
+				m.unpopNoLock(msg, requeued)
+			}
+			m.Unlock()
+		}
+	}
+}
+
+func (c *Channel) confirmBroadcastMsg(msg *Message) (BackendOffset, int64, bool) {
+	if msg.DelayedType == ChannelDelayed {
+		return c.ConfirmDelayedMessage(msg)
+	}
+	return c.ConfirmBackendQueue(msg)
+}
+
+// confirmBroadcastMember mark the message finished by the member, and the message will be
+// confirmed in the channel if all the members finished.
+func (c *Channel) confirmBroadcastMember(memberID string, id MessageID) (BackendOffset, int64, bool) {
+	var done *Message
+	c.bcMutex.Lock()
+	if bm, ok := c.bcMsgs[id]; ok {
+		delete(bm.pending, memberID)
+		if len(bm.pending) == 0 {
+			delete(c.bcMsgs, id)
+			done = bm.msg
+		}
+	}
+	c.bcMutex.Unlock()
+	if done == nil {
+		curConfirm := c.GetConfirmed()
+		return curConfirm.Offset(), curConfirm.TotalMsgCnt(), false
+	}
+	c.notifyBroadcastChanged()
+	return c.confirmBroadcastMsg(done)
+}
+
+// confirmBroadcastCopy is used while the copied message is confirmed without sending to client.
+func (c *Channel) confirmBroadcastCopy(msg *Message) (BackendOffset, int64, bool) {
+	c.bcMutex.Lock()
+	m := c.bcMembers[msg.bcMember]
+	c.bcMutex.Unlock()
+	if m != nil {
+		m.Lock()
+		if m.removeNoLock(msg.ID) != nil {
+			m.finished++
+		}
+		m.Unlock()
+	}
+	return c.confirmBroadcastMember(msg.bcMember, msg.ID)
+}
+
+func (c *Channel) startBroadcastInFlight(msg *Message, client Consumer, clientAddr string, timeout time.Duration) (bool, error) {
+	c.bcMutex.Lock()
+	m := c.bcMembers[msg.bcMember]
+	c.bcMutex.Unlock()
+	if m == nil {
+		return false, ErrMsgNotInFlight
+	}
+	now := time.Now()
+	m.Lock()
+	if m.inFlight[msg.ID] != msg {
+		// the message is requeued or the member is reset
+		m.Unlock()
+		return false, ErrMsgNotInFlight
+	}
+	msg.belongedConsumer = client
+	msg.deliveryTS = now
+	msg.pri = now.Add(timeout).UnixNano()
+	msg.Attempts++
+	m.Unlock()
+
+	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "START", msg.TraceID, msg, clientAddr, now.UnixNano()-msg.Timestamp)
+	}
+	return true, nil
+}
+
+func (c *Channel) finishBroadcastMessage(m *broadcastMember, clientID int64, clientAddr string,
+	id MessageID) (BackendOffset, int64, bool, *Message, error) {
+	m.Lock()
+	msg, ok := m.inFlight[id]
+	if !ok {
+		m.Unlock()
+		return 0, 0, false, nil, ErrMsgNotInFlight
+	}
+	if msg.GetClientID() != clientID {
+		m.Unlock()
+		return 0, 0, false, nil, fmt.Errorf("client does not own message : %v vs %v",
+			msg.GetClientID(), clientID)
+	}
+	m.removeNoLock(id)
+	m.finished++
+	m.Unlock()
+
+	ackCost := time.Now().UnixNano() - msg.deliveryTS.UnixNano()
+	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "FIN", msg.TraceID, msg, clientAddr, ackCost)
+	}
+	c.channelStatsInfo.UpdateDelivery2ACKStats(ackCost / int64(time.Millisecond))
+	if msg.belongedConsumer != nil {
+		msg.belongedConsumer.FinishedMessage()
+		msg.belongedConsumer = nil
+	}
+	offset, cnt, changed := c.confirmBroadcastMember(m.id, id)
+	return offset, cnt, changed, msg, nil
+}
+
+// forceFinishBroadcast finish the message for all the members, return false if the message
+// is not waiting in the broadcast channel.
+func (c *Channel) forceFinishBroadcast(id MessageID) (BackendOffset, int64, bool, *Message, bool) {
+	c.bcMutex.Lock()
+	bm, ok := c.bcMsgs[id]
+	if ok {
+		delete(c.bcMsgs, id)
+		for memberID := range bm.pending {
+			m, exist := c.bcMembers[memberID]
+			if !exist {
+				continue
+			}
+			m.Lock()
+			if msg := m.removeNoLock(id); msg != nil && msg.belongedConsumer != nil {
+				msg.belongedConsumer.RequeuedMessage()
+				msg.belongedConsumer = nil
+			}
+			m.Unlock()
+		}
+	}
+	c.bcMutex.Unlock()
+	if !ok {
+		return 0, 0, false, nil, false
+	}
+	c.notifyBroadcastChanged()
+	offset, cnt, changed := c.confirmBroadcastMsg(bm.msg)
+	return offset, cnt, changed, bm.msg, true
+}
+
+func (c *Channel) requeueBroadcastMessage(m *broadcastMember, clientID int64, clientAddr string,
+	id MessageID, timeout time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	msg, ok := m.inFlight[id]
+	if !ok {
+		return ErrMsgNotInFlight
+	}
+	if msg.IsDeferred() {
+		return ErrMsgDeferred
+	}
+	if msg.GetClientID() != clientID {
+		return fmt.Errorf("client does not own message %v: %v vs %v", id,
+			msg.GetClientID(), clientID)
+	}
+	if msg.belongedConsumer != nil {
+		msg.belongedConsumer.RequeuedMessage()
+		msg.belongedConsumer = nil
+	}
+	atomic.AddUint64(&c.requeueCount, 1)
+	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DEBUG {
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "REQ", msg.TraceID, msg, clientAddr, 0)
+	}
+	if timeout <= 0 {
+		delete(m.inFlight, id)
+		m.requeueNoLock(msg)
+		return nil
+	}
+	if timeout > c.option.MaxReqTimeout {
+		timeout = c.option.MaxReqTimeout
+	}
+	// the deferred message will be requeued while timeout
+	msg.pri = time.Now().Add(timeout).UnixNano()
+	atomic.StoreInt32(&msg.deferredCnt, 1)
+	return nil
+}
+
+func (c *Channel) touchBroadcastMessage(m *broadcastMember, clientID int64, id MessageID, clientMsgTimeout time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	msg, ok := m.inFlight[id]
+	if !ok || msg.IsDeferred() {
+		return ErrMsgNotInFlight
+	}
+	if msg.GetClientID() != clientID {
+		return fmt.Errorf("client does not own message : %v vs %v",
+			msg.GetClientID(), clientID)
+	}
+	newTimeout := time.Now().Add(clientMsgTimeout)
+	if newTimeout.Sub(msg.deliveryTS) >= c.option.MaxMsgTimeout {
+		newTimeout = msg.deliveryTS.Add(c.option.MaxMsgTimeout)
+	}
+	msg.pri = newTimeout.UnixNano()
+	return nil
+}
+
+func (c *Channel) requeueBroadcastClientMessages(m *broadcastMember, clientID int64) int {
+	m.Lock()
+	defer m.Unlock()
+	cnt := 0
+	for id, msg := range m.inFlight {
+		if msg.GetClientID() != clientID || msg.IsDeferred() {
+			continue
+		}
+		if msg.belongedConsumer != nil {
+			msg.belongedConsumer.RequeuedMessage()
+			msg.belongedConsumer = nil
+		}
+		delete(m.inFlight, id)
+		m.requeueNoLock(msg)
+		cnt++
+	}
+	return cnt
+}
+
+// processBroadcastInFlight requeue the timeout messages of the members and remove the members
+// without any client for too long.
+func (c *Channel) processBroadcastInFlight(tnow int64) bool {
+	memberTimeout := int64(c.option.BroadcastMemberTimeout)
+	var done []*Message
+	c.bcMutex.Lock()
+	members := make([]*broadcastMember, 0, len(c.bcMembers))
+	for _, m := range c.bcMembers {
+		m.Lock()
+		expired := memberTimeout > 0 && len(m.clients) == 0 && tnow-m.lastActive > memberTimeout
+		m.Unlock()
+		if expired {
+			nsqLog.Logf("channel %v-%v broadcast member %v removed since no client for %v",
+				c.GetTopicName(), c.GetName(), m.id, c.option.BroadcastMemberTimeout)
+			done = append(done, c.removeBroadcastMemberNoLock(m)...)
+			continue
+		}
+		members = append(members, m)
+	}
+	c.bcMutex.Unlock()
+	if len(done) > 0 {
+		c.notifyBroadcastChanged()
+	}
+	for _, msg := range done {
+		c.confirmBroadcastMsg(msg)
+	}
+
+	dirty := false
+	for _, m := range members {
+		m.Lock()
+		for id, msg := range m.inFlight {
+			if msg.pri > tnow {
+				continue
+			}
+			dirty = true
+			delete(m.inFlight, id)
+			if !msg.IsDeferred() {
+				atomic.AddUint64(&c.timeoutCount, 1)
+				if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DEBUG {
+					nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "TIMEOUT", msg.TraceID, msg, m.id, tnow-msg.deliveryTS.UnixNano())
+				}
+			}
+			if msg.belongedConsumer != nil {
+				msg.belongedConsumer.TimedOutMessage()
+				msg.belongedConsumer = nil
+			}
+			m.requeueNoLock(msg)
+		}
+		m.Unlock()
+	}
+	return dirty || len(done) > 0
+}
+
+// resetBroadcastState clear the waiting messages of the members since the reader is reset,
+// the messages finished by the member will be skipped after reset if keepOffset.
+func (c *Channel) resetBroadcastState(keepOffset bool) {
+	c.bcMutex.Lock()
+	defer c.bcMutex.Unlock()
+	for _, m := range c.bcMembers {
+		m.Lock()
+		var offset BackendOffset
+		if keepOffset {
+			offset = m.offsetNoLock()
+		}
+		m.clearNoLock(offset)
+		m.Unlock()
+		m.notify()
+	}
+	if len(c.bcMsgs) > 0 {
+		c.bcMsgs = make(map[MessageID]*broadcastMsg)
+		c.notifyBroadcastChanged()
+	}
+}
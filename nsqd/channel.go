@@ -81,8 +81,15 @@ type Channel struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	requeueCount      uint64
 	timeoutCount      uint64
+	deadLetterCount   uint64
+	filteredCount     uint64
 	deferredCount     int64
 	deferredFromDelay int64
+	// the stats for the priority lanes
+	priorityDispatched [priorityLaneNum]uint64
+	priorityBuffered   [priorityLaneNum]int64
+	msgRateLimit       int64
+	byteRateLimit      int64
 
 	sync.RWMutex
 
@@ -92,7 +99,7 @@ type Channel struct {
 	nsqdNotify INsqdNotify
 	option     *Options
 
-	backend BackendQueueReader
+	backend channelQueueReader
 
 	requeuedMsgChan        chan *Message
 	waitingRequeueChanMsgs map[MessageID]*Message
@@ -140,6 +147,25 @@ type Channel struct {
 	Ext             int32
 
 	requireOrder int32
+	// the message will be moved to the dead letter topic if exceed, 0 means never
+	maxAttempts uint32
+	// the ext filter saved in the channel meta
+	extFilter atomic.Value
+	// check if the message should be skipped for the uncommitted transaction
+	txnChecker atomic.Value
+	// the requeue backoff policy saved in the channel meta
+	requeuePolicy atomic.Value
+	// the priority lanes enabled in the channel meta
+	priorityLaneEnabled int32
+	// create the snapshot of the topic data for the cursor of the high lane
+	newSnapshot func(end BackendQueueEnd) *DiskQueueSnapshot
+	// the members of the broadcast channel
+	broadcast int32
+	bcMutex   sync.Mutex
+	bcMembers map[string]*broadcastMember
+	bcClients map[int64]*broadcastMember
+	bcMsgs    map[MessageID]*broadcastMsg
+	bcChanged chan bool
 	// 1 - reset
 	// 2 - reset and clear confirmed
 	needResetReader        int32
@@ -160,6 +186,14 @@ type Channel struct {
 func NewChannel(topicName string, part int, topicOrdered bool, channelName string, chEnd BackendQueueEnd, opt *Options,
 	deleteCallback func(*Channel), moreDataCallback func(*Channel), consumeDisabled int32,
 	notify INsqdNotify, ext int32, queueStart BackendQueueEnd) *Channel {
+	return newChannel(topicName, part, topicOrdered, channelName, chEnd, opt, deleteCallback, moreDataCallback,
+		consumeDisabled, notify, ext, queueStart, nil)
+}
+
+// the channel will read from the topic storage, nil means the disk queue files
+func newChannel(topicName string, part int, topicOrdered bool, channelName string, chEnd BackendQueueEnd, opt *Options,
+	deleteCallback func(*Channel), moreDataCallback func(*Channel), consumeDisabled int32,
+	notify INsqdNotify, ext int32, queueStart BackendQueueEnd, storage topicQueueWriter) *Channel {
 
 	c := &Channel{
 		topicName:          topicName,
@@ -183,6 +217,10 @@ func NewChannel(topicName string, part int, topicOrdered bool, channelName strin
 		nsqdNotify:         notify,
 		consumeDisabled:    consumeDisabled,
 		Ext:                ext,
+		bcMembers:          make(map[string]*broadcastMember),
+		bcClients:          make(map[int64]*broadcastMember),
+		bcMsgs:             make(map[MessageID]*broadcastMsg),
+		bcChanged:          make(chan bool, 1),
 	}
 
 	if topicOrdered {
@@ -222,15 +260,24 @@ func NewChannel(topicName string, part int, topicOrdered bool, channelName strin
 	// backend names, for uniqueness, automatically include the topic...
 	backendReaderName := getBackendReaderName(c.topicName, c.topicPart, channelName)
 	backendName := getBackendName(c.topicName, c.topicPart)
-	c.backend = newDiskQueueReader(backendName, backendReaderName,
-		path.Join(opt.DataPath, c.topicName),
-		opt.MaxBytesPerFile,
-		int32(minValidMsgLength),
-		int32(opt.MaxMsgSize)+minValidMsgLength,
-		syncEvery,
-		opt.SyncTimeout,
-		chEnd,
-		false)
+	if storage != nil {
+		c.backend = storage.newReader(backendReaderName, opt, syncEvery, chEnd)
+		c.newSnapshot = storage.newSnapshot
+	} else {
+		d := newDiskQueueReader(backendName, backendReaderName,
+			path.Join(opt.DataPath, c.topicName),
+			opt.MaxBytesPerFile,
+			int32(minValidMsgLength),
+			int32(opt.MaxMsgSize)+minValidMsgLength,
+			syncEvery,
+			opt.SyncTimeout,
+			chEnd,
+			false).(*diskQueueReader)
+		if opt.Archiver != nil {
+			d.SetArchiver(opt.Archiver)
+		}
+		c.backend = d
+	}
 
 	if queueStart != nil {
 		// The old closed channel (on slave) may have the invalid read start if the
@@ -390,6 +437,15 @@ func (c *Channel) GetDelayedQueue() *DelayQueue {
 	return dq
 }
 
+func (c *Channel) setTxnChecker(f func(msg *Message) bool) {
+	c.txnChecker.Store(f)
+}
+
+func (c *Channel) isTxnSkipped(msg *Message) bool {
+	f, _ := c.txnChecker.Load().(func(msg *Message) bool)
+	return f != nil && f(msg)
+}
+
 func (c *Channel) SetExt(isExt bool) {
 	if isExt {
 		atomic.StoreInt32(&c.Ext, 1)
@@ -429,22 +485,17 @@ func (c *Channel) SetConsumeOffset(offset BackendOffset, cnt int64, force bool)
 		return ErrConsumeDisabled
 	}
 
-	_, ok := c.backend.(*diskQueueReader)
-	if ok {
-		select {
-		case c.readerChanged <- resetChannelData{offset, cnt, true}:
-		default:
-			nsqLog.Logf("ignored the reader reset: %v:%v", offset, cnt)
-			if offset > 0 && cnt > 0 {
-				select {
-				case c.readerChanged <- resetChannelData{offset, cnt, true}:
-				case <-time.After(time.Millisecond * 10):
-					nsqLog.Logf("ignored the reader reset finally: %v:%v", offset, cnt)
-				}
+	select {
+	case c.readerChanged <- resetChannelData{offset, cnt, true}:
+	default:
+		nsqLog.Logf("ignored the reader reset: %v:%v", offset, cnt)
+		if offset > 0 && cnt > 0 {
+			select {
+			case c.readerChanged <- resetChannelData{offset, cnt, true}:
+			case <-time.After(time.Millisecond * 10):
+				nsqLog.Logf("ignored the reader reset finally: %v:%v", offset, cnt)
 			}
 		}
-	} else {
-		return ErrNotDiskQueueReader
 	}
 	return nil
 }
@@ -475,6 +526,63 @@ func (c *Channel) IsOrdered() bool {
 	return atomic.LoadInt32(&c.requireOrder) == 1
 }
 
+func (c *Channel) SetMaxAttempts(n uint32) {
+	atomic.StoreUint32(&c.maxAttempts, n)
+}
+
+func (c *Channel) GetMaxAttempts() uint32 {
+	return atomic.LoadUint32(&c.maxAttempts)
+}
+
+func (c *Channel) GetDeadLetterCount() uint64 {
+	return atomic.LoadUint64(&c.deadLetterCount)
+}
+
+func (c *Channel) isExceedMaxAttempts(msg *Message) bool {
+	maxAttempts := c.GetMaxAttempts()
+	return maxAttempts > 0 && uint32(msg.Attempts) >= maxAttempts
+}
+
+// deadLetterInFlightNoLock notify to write the message to the dead letter topic, the message
+// will be kept in flight until finished after written. If failed, the message will be
+// requeued as normal, and moved to the dead letter again while requeued next time.
+func (c *Channel) deadLetterInFlightNoLock(msg *Message, tnow int64) {
+	if msg.index != -1 {
+		c.inFlightPQ.Remove(msg.index)
+	}
+	msg.pri = tnow + int64(c.option.MsgTimeout)
+	c.inFlightPQ.Push(msg)
+	nsqLog.Logf("channel %v message %v attempts %v exceed max %v, move to dead letter",
+		c.GetName(), msg.ID, msg.Attempts, c.GetMaxAttempts())
+	nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "DEAD_LETTER", msg.TraceID, msg, "", 0)
+	err := c.nsqdNotify.DeadLetter(c, msg.GetCopy())
+	if err != nil {
+		nsqLog.LogWarningf("channel %v message %v move to dead letter failed: %v", c.GetName(), msg.ID, err)
+		c.requeueDeadLetterFailedNoLock(msg)
+	}
+}
+
+func (c *Channel) requeueDeadLetterFailedNoLock(msg *Message) {
+	delete(c.inFlightMessages, msg.ID)
+	if msg.index != -1 {
+		c.inFlightPQ.Remove(msg.index)
+	}
+	c.doRequeue(msg, "")
+}
+
+// RequeueDeadLetterFailed requeue the message waiting the dead letter in flight if failed to
+// write to the dead letter topic, so the message will not be stuck in flight.
+func (c *Channel) RequeueDeadLetterFailed(id MessageID) {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	msg, ok := c.inFlightMessages[id]
+	// the message delivered to the client again should not be changed
+	if !ok || msg.belongedConsumer != nil || msg.IsDeferred() || !c.isExceedMaxAttempts(msg) {
+		return
+	}
+	c.requeueDeadLetterFailedNoLock(msg)
+}
+
 func (c *Channel) initPQ() {
 	pqSize := int(math.Max(1, float64(c.option.MemQueueSize)/10))
 	if c.topicOrdered {
@@ -517,11 +625,7 @@ func (c *Channel) IsWaitingMoreDiskData() bool {
 	if c.IsPaused() || c.IsConsumeDisabled() || c.IsSkipped() {
 		return false
 	}
-	d, ok := c.backend.(*diskQueueReader)
-	if ok {
-		return d.isReadToEnd()
-	}
-	return false
+	return c.backend.isReadToEnd()
 }
 
 // waiting more data is indicated all msgs are consumed
@@ -530,11 +634,7 @@ func (c *Channel) IsWaitingMoreData() bool {
 	if c.IsPaused() || c.IsConsumeDisabled() || c.IsSkipped() {
 		return false
 	}
-	d, ok := c.backend.(*diskQueueReader)
-	if ok {
-		return d.IsWaitingMoreData()
-	}
-	return false
+	return c.backend.IsWaitingMoreData()
 }
 
 func (c *Channel) exit(deleted bool) error {
@@ -597,10 +697,7 @@ func (c *Channel) Flush() error {
 	if c.ephemeral {
 		return nil
 	}
-	d, ok := c.backend.(*diskQueueReader)
-	if ok {
-		d.Flush()
-	}
+	c.backend.Flush()
 	return nil
 }
 
@@ -609,10 +706,7 @@ func (c *Channel) Depth() int64 {
 }
 
 func (c *Channel) DepthSize() int64 {
-	if d, ok := c.backend.(*diskQueueReader); ok {
-		return d.DepthSize()
-	}
-	return 0
+	return c.backend.DepthSize()
 }
 
 func (c *Channel) DepthTimestamp() int64 {
@@ -729,6 +823,9 @@ func (c *Channel) UpdateQueueEnd(end BackendQueueEnd, forceReload bool) error {
 
 // TouchMessage resets the timeout for an in-flight message
 func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout time.Duration) error {
+	if m := c.getBroadcastClientMember(clientID); m != nil {
+		return c.touchBroadcastMessage(m, clientID, id, clientMsgTimeout)
+	}
 	c.inFlightMutex.Lock()
 	msg, ok := c.inFlightMessages[id]
 	if !ok {
@@ -772,19 +869,13 @@ func (c *Channel) ConfirmBackendQueueOnSlave(offset BackendOffset, cnt int64, al
 			nsqLog.LogDebugf("confirm offset less than current: %v, %v", offset, c.GetConfirmed())
 		}
 		if allowBackward {
-			d, ok := c.backend.(*diskQueueReader)
-			if ok {
-				newConfirmed, err = d.ResetReadToOffset(offset, cnt)
-				nsqLog.LogDebugf("topic %v channel (%v) reset to backward: %v", c.GetTopicName(), c.GetName(), newConfirmed)
-			}
+			newConfirmed, err = c.backend.ResetReadToOffset(offset, cnt)
+			nsqLog.LogDebugf("topic %v channel (%v) reset to backward: %v", c.GetTopicName(), c.GetName(), newConfirmed)
 		}
 	} else {
 		if allowBackward {
-			d, ok := c.backend.(*diskQueueReader)
-			if ok {
-				newConfirmed, err = d.ResetReadToOffset(offset, cnt)
-				nsqLog.LogDebugf("topic %v channel (%v) reset to backward: %v", c.GetTopicName(), c.GetName(), newConfirmed)
-			}
+			newConfirmed, err = c.backend.ResetReadToOffset(offset, cnt)
+			nsqLog.LogDebugf("topic %v channel (%v) reset to backward: %v", c.GetTopicName(), c.GetName(), newConfirmed)
 		} else {
 			_, err = c.backend.SkipReadToOffset(offset, cnt)
 			c.confirmedMsgs.DeleteLower(int64(offset))
@@ -832,6 +923,9 @@ func (c *Channel) ConfirmDelayedMessage(msg *Message) (BackendOffset, int64, boo
 // and we keep all the newer confirmed messages so we can confirm later.
 // indicated weather the confirmed offset is changed
 func (c *Channel) ConfirmBackendQueue(msg *Message) (BackendOffset, int64, bool) {
+	if msg.bcMember != "" {
+		return c.confirmBroadcastCopy(msg)
+	}
 	c.confirmMutex.Lock()
 	defer c.confirmMutex.Unlock()
 	curConfirm := c.GetConfirmed()
@@ -965,6 +1059,14 @@ func (c *Channel) FinishMessageForce(clientID int64, clientAddr string,
 // FinishMessage successfully discards an in-flight message
 func (c *Channel) internalFinishMessage(clientID int64, clientAddr string,
 	id MessageID, forceFin bool) (BackendOffset, int64, bool, *Message, error) {
+	if forceFin && c.IsBroadcast() {
+		offset, cnt, changed, msg, ok := c.forceFinishBroadcast(id)
+		if ok {
+			return offset, cnt, changed, msg, nil
+		}
+	} else if m := c.getBroadcastClientMember(clientID); m != nil {
+		return c.finishBroadcastMessage(m, clientID, clientAddr, id)
+	}
 	c.inFlightMutex.Lock()
 	defer c.inFlightMutex.Unlock()
 	if forceFin {
@@ -1088,6 +1190,10 @@ func (c *Channel) ShouldRequeueToEnd(clientID int64, clientAddr string, id Messa
 	if msg.GetClientID() != clientID || msg.IsDeferred() {
 		return nil, false
 	}
+	// will be moved to the dead letter topic while requeue
+	if c.isExceedMaxAttempts(msg) {
+		return nil, false
+	}
 
 	if nsqLog.Level() >= levellogger.LOG_DEBUG || c.IsTraced() {
 		nsqLog.LogDebugf("channel %v check requeue to end, timeout:%v, msg timestamp:%v, depth ts:%v, msg attempt:%v, waiting :%v",
@@ -1212,8 +1318,22 @@ func (c *Channel) ShouldRequeueToEnd(clientID int64, clientAddr string, id Messa
 //     and requeue a message
 //
 func (c *Channel) RequeueMessage(clientID int64, clientAddr string, id MessageID, timeout time.Duration, byClient bool) error {
+	if m := c.getBroadcastClientMember(clientID); m != nil {
+		return c.requeueBroadcastMessage(m, clientID, clientAddr, id, timeout)
+	}
 	c.inFlightMutex.Lock()
 	defer c.inFlightMutex.Unlock()
+	if byClient {
+		msg, ok := c.inFlightMessages[id]
+		if ok && msg.GetClientID() == clientID && !msg.IsDeferred() && c.isExceedMaxAttempts(msg) {
+			if msg.belongedConsumer != nil {
+				msg.belongedConsumer.RequeuedMessage()
+				msg.belongedConsumer = nil
+			}
+			c.deadLetterInFlightNoLock(msg, time.Now().UnixNano())
+			return nil
+		}
+	}
 	if timeout == 0 {
 		// remove from inflight first
 		msg, err := c.popInFlightMessage(clientID, id, false)
@@ -1294,6 +1414,14 @@ func (c *Channel) RequeueClientMessages(clientID int64, clientAddr string) {
 	if c.IsConsumeDisabled() {
 		return
 	}
+	if m := c.getBroadcastClientMember(clientID); m != nil {
+		cnt := c.requeueBroadcastClientMessages(m, clientID)
+		if cnt > 0 {
+			nsqLog.Logf("client: %v requeued %v broadcast messages of member %v",
+				clientID, cnt, m.id)
+		}
+		return
+	}
 	idList := make([]MessageID, 0)
 	c.inFlightMutex.Lock()
 	for id, msg := range c.inFlightMessages {
@@ -1349,6 +1477,7 @@ func (c *Channel) RemoveClient(clientID int64, clientTag string) {
 	if clientTag != "" {
 		c.RemoveTagClientMsgChannel(clientTag)
 	}
+	c.removeBroadcastClient(clientID)
 
 	c.Lock()
 	defer c.Unlock()
@@ -1366,6 +1495,9 @@ func (c *Channel) RemoveClient(clientID int64, clientTag string) {
 }
 
 func (c *Channel) StartInFlightTimeout(msg *Message, client Consumer, clientAddr string, timeout time.Duration) (bool, error) {
+	if msg.bcMember != "" {
+		return c.startBroadcastInFlight(msg, client, clientAddr, timeout)
+	}
 	now := time.Now()
 	msg.belongedConsumer = client
 	msg.deliveryTS = now
@@ -1439,11 +1571,7 @@ func (c *Channel) GetChannelEnd() BackendQueueEnd {
 }
 
 func (c *Channel) GetChannelWaitingConfirmCnt() int64 {
-	d, ok := c.backend.(*diskQueueReader)
-	if ok {
-		return d.GetQueueCurrentRead().TotalMsgCnt() - d.GetQueueConfirmed().TotalMsgCnt()
-	}
-	return 0
+	return c.backend.GetQueueCurrentRead().TotalMsgCnt() - c.backend.GetQueueConfirmed().TotalMsgCnt()
 }
 
 // doRequeue performs the low level operations to requeue a message
@@ -1488,6 +1616,14 @@ func (c *Channel) pushInFlightMessage(msg *Message) (*Message, error) {
 	return nil, nil
 }
 
+// IsInFlightForClient check if the message is in flight and can be finished by the client
+func (c *Channel) IsInFlightForClient(clientID int64, id MessageID) bool {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	msg, ok := c.inFlightMessages[id]
+	return ok && msg.GetClientID() == clientID && !msg.IsDeferred()
+}
+
 // popInFlightMessage atomically removes a message from the in-flight dictionary
 func (c *Channel) popInFlightMessage(clientID int64, id MessageID, force bool) (*Message, error) {
 	msg, ok := c.inFlightMessages[id]
@@ -1600,6 +1736,8 @@ func (c *Channel) drainChannelWaiting(clearConfirmed bool, lastDataNeedRead *boo
 	}
 	c.confirmMutex.Unlock()
 	atomic.StoreInt64(&c.waitingProcessMsgTs, 0)
+	// the members keep the offset if the reader is reset to the confirmed
+	c.resetBroadcastState(!clearConfirmed)
 
 	if c.Exiting() {
 		return nil
@@ -1687,8 +1825,7 @@ func (c *Channel) resetChannelReader(resetOffset resetChannelData, lastDataNeedR
 			atomic.StoreInt32(&c.needResetReader, 1)
 		}
 	} else {
-		d := c.backend.(*diskQueueReader)
-		_, err = d.ResetReadToOffset(resetOffset.Offset, resetOffset.Cnt)
+		_, err = c.backend.ResetReadToOffset(resetOffset.Offset, resetOffset.Cnt)
 		if err != nil {
 			nsqLog.Warningf("failed to reset reader to %v, %v", resetOffset, err)
 		} else {
@@ -1720,6 +1857,9 @@ func (c *Channel) messagePump() {
 	lastDataNeedRead := false
 	readBackendWait := false
 	backendErr := 0
+	lanes := newPriorityLanes(c, priorityReadAhead)
+	defer lanes.Close()
+	var limiter channelRateLimiter
 LOOP:
 	for {
 		// do an extra check for closed exit before we select on all the memory/backend/exitChan
@@ -1761,6 +1901,7 @@ LOOP:
 					needClearConfirm = true
 				}
 				c.drainChannelWaiting(needClearConfirm, &lastDataNeedRead, origReadChan)
+				lanes.Clear()
 				lastMsg = Message{}
 			}
 			readChan = origReadChan
@@ -1837,6 +1978,14 @@ LOOP:
 				nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "READ_REQ", msg.TraceID, msg, "0", 0)
 			}
 		default:
+			if c.isPriorityLaneEnabled() && !c.IsConsumeDisabled() {
+				lanes.ScanAhead(c.backend.GetQueueCurrentRead(), c.GetChannelEnd())
+			}
+			// drain the buffered messages before reading more
+			if lanes.ShouldDrain(readChan == nil) && !c.IsConsumeDisabled() {
+				msg = lanes.Pop()
+				break
+			}
 			select {
 			case <-c.exitChan:
 				goto exit
@@ -1852,11 +2001,14 @@ LOOP:
 					if data.Err == ErrReadQueueCountMissing {
 						time.Sleep(time.Second)
 					} else {
-						// TODO: fix corrupt file from other replica.
-						// and should handle the confirm offset, since some skipped data
+						if backendErr == 0 && IsDataCorruption(data.Err) {
+							// the corrupt data will be fixed from other replica.
+							c.nsqdNotify.NotifyDataCorrupted(c.GetTopicName(), c.GetTopicPart(), data.Err)
+						}
+						// TODO: should handle the confirm offset, since some skipped data
 						// may never be confirmed any more
 						if backendErr > 10 {
-							_, skipErr := c.backend.(*diskQueueReader).SkipToNext()
+							_, skipErr := c.backend.SkipToNext()
 							if skipErr != nil {
 							}
 							nsqLog.Warningf("channel %v skip to next because of backend error: %v", c.GetName(), backendErr)
@@ -1892,9 +2044,7 @@ LOOP:
 					nsqLog.Warningf("read a message with less message ID: %v vs %v, raw data: %v", msg.ID, lastMsg.ID, data)
 					nsqLog.Warningf("last raw data: %v", lastDataResult)
 					time.Sleep(time.Millisecond * 5)
-					if diskQ, ok := c.backend.(*diskQueueReader); ok {
-						diskQ.ResetLastReadOne(data.Offset, data.CurCnt-1, int32(data.MovedSize))
-					}
+					c.backend.ResetLastReadOne(data.Offset, data.CurCnt-1, int32(data.MovedSize))
 					lastMsg = *msg
 					lastDataResult = data
 					continue LOOP
@@ -1915,6 +2065,16 @@ LOOP:
 				}
 				lastMsg = *msg
 				isSkipped = false
+				if lanes.IsScanned(msg) {
+					// dispatched by the high lane already
+					msg = nil
+					continue LOOP
+				}
+				if c.isPriorityLaneEnabled() {
+					lanes.Push(msg)
+					msg = nil
+					continue LOOP
+				}
 			case <-c.tryReadBackend:
 				atomic.StoreInt32(&c.needNotifyRead, 0)
 				readBackendWait = false
@@ -1923,6 +2083,7 @@ LOOP:
 			case resetOffset := <-c.readerChanged:
 				nsqLog.Infof("got reader reset notify:%v ", resetOffset)
 				c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+				lanes.Clear()
 				continue LOOP
 			case <-waitEndUpdated:
 				continue LOOP
@@ -1946,7 +2107,11 @@ LOOP:
 		}
 
 		//let timer sync to update backend in replicas' channels
-		if c.IsSkipped() || c.shouldSkipZanTest(msg) {
+		filtered := c.isFilteredOut(msg)
+		if c.IsSkipped() || c.shouldSkipZanTest(msg) || filtered || c.isTxnSkipped(msg) {
+			if filtered {
+				atomic.AddUint64(&c.filteredCount, 1)
+			}
 			if msg.DelayedType == ChannelDelayed {
 				c.ConfirmDelayedMessage(msg)
 			} else {
@@ -1958,11 +2123,54 @@ LOOP:
 
 		atomic.StoreInt32(&c.waitingDeliveryState, 1)
 		//atomic.StoreInt32(&msg.deferredCnt, 0)
+		for {
+			// check the limit again after waiting since the limit may be changed or removed
+			msgRate, byteRate := c.GetRateLimit()
+			wait := limiter.reserve(time.Now(), msgRate, byteRate, len(msg.Body))
+			if wait <= 0 {
+				break
+			}
+			if wait > rateLimitCheckInterval {
+				wait = rateLimitCheckInterval
+			}
+			select {
+			case <-time.After(wait):
+			case resetOffset := <-c.readerChanged:
+				nsqLog.Infof("got reader reset notify while waiting rate limit:%v ", resetOffset)
+				c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+				lanes.Clear()
+				continue LOOP
+			case <-c.exitChan:
+				goto exit
+			}
+			if c.IsConsumeDisabled() {
+				continue LOOP
+			}
+		}
 		if c.IsOrdered() {
 			atomic.StoreInt32(&c.needNotifyRead, 1)
 			readBackendWait = true
 		}
 
+		if c.IsBroadcast() {
+			// wait the member if no any member of the broadcast channel, or wait the slow members
+			// if too many messages not finished
+			for !c.dispatchBroadcast(msg) {
+				select {
+				case <-c.bcChanged:
+				case resetOffset := <-c.readerChanged:
+					nsqLog.Infof("got reader reset notify while dispatch broadcast message:%v ", resetOffset)
+					c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+					lanes.Clear()
+					continue LOOP
+				case <-c.exitChan:
+					goto exit
+				}
+			}
+			msg = nil
+			continue
+		}
+
 		var msgTag string
 		var extParsed bool
 		if c.IsExt() {
@@ -1998,6 +2206,7 @@ LOOP:
 				case resetOffset := <-c.readerChanged:
 					nsqLog.Infof("got reader reset notify while dispatch message:%v ", resetOffset)
 					c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+					lanes.Clear()
 					continue
 				case <-c.exitChan:
 					goto exit
@@ -2018,6 +2227,7 @@ LOOP:
 		case resetOffset := <-c.readerChanged:
 			nsqLog.Infof("got reader reset notify while dispatch message:%v ", resetOffset)
 			c.resetChannelReader(resetOffset, &lastDataNeedRead, origReadChan, &lastMsg, &needReadBackend, &readBackendWait)
+			lanes.Clear()
 		case <-c.exitChan:
 			goto exit
 		}
@@ -2090,11 +2300,7 @@ func (c *Channel) GetChannelDebugStats() string {
 	}
 	c.inFlightMutex.Unlock()
 	debugStr += "\n"
-	d, ok := c.backend.(*diskQueueReader)
-	var curRead BackendQueueEnd
-	if ok {
-		curRead = d.GetQueueCurrentRead()
-	}
+	curRead := c.backend.GetQueueCurrentRead()
 	c.confirmMutex.Lock()
 	debugStr += fmt.Sprintf("channel end : %v,current read:%v, current confirm %v, confirmed %v messages: %s\n",
 		c.GetChannelEnd(), curRead,
@@ -2193,7 +2399,23 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 		requeuedCnt++
 		msgCopy := *msg
 		atomic.StoreInt32(&msg.deferredCnt, 0)
-		c.doRequeue(msg, strconv.Itoa(int(msg.GetClientID())))
+		backoff := time.Duration(0)
+		if !msgCopy.IsDeferred() {
+			backoff = c.getRequeueBackoff(msg)
+		}
+		if c.isExceedMaxAttempts(msg) {
+			c.inFlightMessages[msg.ID] = msg
+			c.deadLetterInFlightNoLock(msg, tnow)
+		} else if backoff > 0 && !c.isTooMuchDeferredInMem(atomic.LoadInt64(&c.deferredCount)) {
+			// wait the backoff of the requeue policy before delivery again
+			c.inFlightMessages[msg.ID] = msg
+			atomic.AddInt64(&c.deferredCount, 1)
+			msg.pri = tnow + int64(backoff)
+			atomic.AddInt32(&msg.deferredCnt, 1)
+			c.inFlightPQ.Push(msg)
+		} else {
+			c.doRequeue(msg, strconv.Itoa(int(msg.GetClientID())))
+		}
 		c.inFlightMutex.Unlock()
 
 		if msgCopy.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_INFO {
@@ -2213,6 +2435,12 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 	}
 
 exit:
+	if c.IsBroadcast() {
+		if c.processBroadcastInFlight(tnow) {
+			dirty = true
+		}
+		flightCnt += c.getBroadcastPendingCnt()
+	}
 	// try requeue the messages that waiting.
 	stopScan := false
 	c.inFlightMutex.Lock()
@@ -2353,8 +2581,7 @@ exit:
 		c.tagMsgChansMutex.RUnlock()
 		e := c.GetChannelEnd()
 		if c.GetConfirmed().Offset() < e.Offset() && tagChLen == 0 {
-			d, ok := c.backend.(*diskQueueReader)
-			if ok && d.GetQueueCurrentRead() == e {
+			if c.backend.GetQueueCurrentRead() == e {
 				noReadDataFromDisk = true
 			}
 		}
@@ -0,0 +1,73 @@
+package nsqd
+
+import (
+	"sync/atomic"
+)
+
+// The ext filter of the channel is saved in the channel meta and used for all the clients
+// of the channel. The messages not matched are confirmed by messagePump without sending,
+// while the filter in IDENTIFY is still used by the client.
+
+type channelExtFilter struct {
+	data   ExtFilterData
+	filter IExtFilter
+}
+
+// SetExtFilter change the filter of the channel, the filter will be removed if the type is 0.
+// The filter is only used while the channel is ext.
+func (c *Channel) SetExtFilter(data ExtFilterData) error {
+	if data.Type == 0 {
+		c.extFilter.Store(&channelExtFilter{})
+		return nil
+	}
+	filter, err := NewExtFilter(data)
+	if err != nil {
+		return err
+	}
+	c.extFilter.Store(&channelExtFilter{data: data, filter: filter})
+	return nil
+}
+
+func (c *Channel) getExtFilter() *channelExtFilter {
+	f, _ := c.extFilter.Load().(*channelExtFilter)
+	return f
+}
+
+// GetExtFilter return the filter of the channel, nil if no filter.
+func (c *Channel) GetExtFilter() *ExtFilterData {
+	f := c.getExtFilter()
+	if f == nil || f.filter == nil {
+		return nil
+	}
+	data := f.data
+	return &data
+}
+
+func (c *Channel) GetFilteredCount() uint64 {
+	return atomic.LoadUint64(&c.filteredCount)
+}
+
+// isFilteredOut return true if the message should not be sent to the clients of the channel
+func (c *Channel) isFilteredOut(msg *Message) bool {
+	f := c.getExtFilter()
+	if f == nil || f.filter == nil || !c.IsExt() {
+		return false
+	}
+	matched := f.filter.Match(msg)
+	if f.data.Inverse {
+		matched = !matched
+	}
+	return !matched
+}
+
+func (c *Channel) SetExtFilterFromMeta(meta *ChannelMetaInfo) {
+	var data ExtFilterData
+	if meta.ExtFilter != nil {
+		data = *meta.ExtFilter
+	}
+	err := c.SetExtFilter(data)
+	if err != nil {
+		nsqLog.LogWarningf("channel %v-%v set filter %v from meta failed: %v",
+			c.GetTopicName(), c.GetName(), data, err)
+	}
+}
@@ -2,10 +2,14 @@ package nsqd
 
 import (
 	//"github.com/youzan/nsq/internal/levellogger"
+	"fmt"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/youzan/nsq/internal/ext"
 )
 
 type fakeConsumer struct {
@@ -111,7 +115,7 @@ func TestChannelBackendMaxMsgSize(t *testing.T) {
 	topicName := "test_channel_backend_maxmsgsize" + strconv.Itoa(int(time.Now().Unix()))
 	topic := nsqd.GetTopicIgnPart(topicName)
 
-	equal(t, topic.backend.maxMsgSize, int32(opts.MaxMsgSize+minValidMsgLength))
+	equal(t, topic.backend.(*diskQueueWriter).maxMsgSize, int32(opts.MaxMsgSize+minValidMsgLength))
 }
 
 func TestInFlightWorker(t *testing.T) {
@@ -190,6 +194,576 @@ func TestChannelEmpty(t *testing.T) {
 	equal(t, channel.Depth(), int64(0))
 }
 
+func TestChannelDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	opts.MsgTimeout = 100 * time.Millisecond
+	opts.QueueScanRefreshInterval = 100 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	deadLetters := make(chan *Message, 10)
+	nsqd.SetDeadLetterCB(func(ch *Channel, msg *Message) error {
+		dlqMsg, err := NewDeadLetterMessage(ch, msg)
+		if err != nil {
+			return err
+		}
+		deadLetters <- dlqMsg
+		_, _, _, _, err = ch.FinishMessageForce(0, "", msg.ID, true)
+		return err
+	})
+
+	topicName := "test_channel_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	channel.SetMaxAttempts(2)
+	equal(t, IsValidDeadLetterChannel(topicName, "channel"), true)
+	equal(t, IsValidDeadLetterChannel(topicName, "channel#ephemeral"), false)
+
+	// the first attempt should be requeued as normal
+	msg := NewMessage(topic.nextMsgID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(1), "", time.Minute)
+	err := channel.RequeueMessage(1, "", msg.ID, 0, true)
+	equal(t, err, nil)
+	equal(t, channel.GetDeadLetterCount(), uint64(0))
+
+	// requeue by client after max attempts
+	msg = NewMessage(topic.nextMsgID(), []byte("test"))
+	msg.Attempts = 1
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(1), "", time.Minute)
+	err = channel.RequeueMessage(1, "", msg.ID, 0, true)
+	equal(t, err, nil)
+	dlqMsg := <-deadLetters
+	equal(t, dlqMsg.Attempts, uint16(2))
+	equal(t, dlqMsg.Body, msg.Body)
+
+	info, redriveMsg, err := ParseDeadLetterMessage(dlqMsg, false)
+	equal(t, err, nil)
+	equal(t, info.Topic, topicName)
+	equal(t, info.Partition, topic.GetTopicPart())
+	equal(t, info.Channel, "channel")
+	equal(t, info.OrigID, msg.ID)
+	equal(t, redriveMsg.Attempts, uint16(0))
+	equal(t, redriveMsg.Body, msg.Body)
+	_, _, err = ParseDeadLetterMessage(msg, false)
+	equal(t, err, ErrNotDeadLetterMessage)
+
+	// timeout after max attempts
+	msg = NewMessage(topic.nextMsgID(), []byte("test2"))
+	msg.Attempts = 2
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(1), "", opts.MsgTimeout)
+	select {
+	case dlqMsg = <-deadLetters:
+		equal(t, dlqMsg.Body, msg.Body)
+	case <-time.After(4*opts.MsgTimeout + opts.QueueScanInterval):
+		t.Fatal("timeout message should be moved to dead letter")
+	}
+	time.Sleep(time.Millisecond * 100)
+	channel.inFlightMutex.Lock()
+	equal(t, len(channel.inFlightMessages), 0)
+	channel.inFlightMutex.Unlock()
+	equal(t, channel.GetDeadLetterCount(), uint64(2))
+
+	// the message should be requeued as normal if failed to write the dead letter
+	nsqd.SetDeadLetterCB(func(ch *Channel, msg *Message) error {
+		return ErrDeadLetterTopicNotExt
+	})
+	msg = NewMessage(topic.nextMsgID(), []byte("test3"))
+	msg.Attempts = 2
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(1), "", time.Minute)
+	err = channel.RequeueMessage(1, "", msg.ID, 0, true)
+	equal(t, err, nil)
+	for {
+		select {
+		case outputMsg := <-channel.clientMsgChan:
+			if outputMsg.ID != msg.ID {
+				continue
+			}
+			equal(t, outputMsg.Body, msg.Body)
+		case <-time.After(time.Second * 3):
+			t.Fatal("failed dead letter message should be requeued")
+		}
+		break
+	}
+	equal(t, channel.GetDeadLetterCount(), uint64(2))
+	nsqd.SetDeadLetterCB(nil)
+	equal(t, nsqd.DeadLetter(channel, msg), ErrDeadLetterNotConfigured)
+}
+
+func TestChannelPriorityLanes(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	equal(t, ParsePriorityLane("HIGH"), PriorityHigh)
+	equal(t, ParsePriorityLane("low"), PriorityLow)
+	equal(t, ParsePriorityLane("unknown"), PriorityNormal)
+
+	topicName := "test_channel_priority_lanes" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName, 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 100, Ext: true}, nil)
+	channel := topic.GetChannel("channel")
+	// the priority lanes should be enabled by the channel meta
+	equal(t, channel.isPriorityLaneEnabled(), false)
+	equal(t, channel.GetPriorityLaneStats() == nil, true)
+	channel.SetPriorityLane(true)
+	equal(t, channel.isPriorityLaneEnabled(), true)
+	for _, meta := range topic.GetChannelMeta() {
+		equal(t, meta.PriorityLane, true)
+	}
+
+	newMsg := func(priority string) *Message {
+		if priority == "" {
+			return NewMessageWithExt(0, []byte("normal"), ext.JSON_HEADER_EXT_VER, []byte("{}"))
+		}
+		header := fmt.Sprintf(`{"%v":"%v"}`, PriorityHeader, priority)
+		return NewMessageWithExt(0, []byte(priority), ext.JSON_HEADER_EXT_VER, []byte(header))
+	}
+	msgs := []*Message{newMsg("low"), newMsg(""), newMsg("low"), newMsg("high")}
+	equal(t, GetMessagePriority(msgs[0]), PriorityLow)
+	equal(t, GetMessagePriority(msgs[1]), PriorityNormal)
+	equal(t, GetMessagePriority(msgs[3]), PriorityHigh)
+	// the sync count is large and the channel is paused while writing, so the partial
+	// batch will not be flushed to the channel, otherwise the first message may be
+	// dispatched alone
+	channel.Pause()
+	_, _, _, _, _, err := topic.PutMessages(msgs)
+	equal(t, err, nil)
+	topic.ForceFlush()
+	channel.UnPause()
+
+	// the messages in the same lane should keep the order
+	expected := []string{"high", "normal", "low", "low"}
+	for _, body := range expected {
+		select {
+		case outputMsg := <-channel.clientMsgChan:
+			equal(t, string(outputMsg.Body), body)
+		case <-time.After(time.Second * 3):
+			t.Fatal("timeout waiting the message")
+		}
+	}
+	stats := channel.GetPriorityLaneStats()
+	equal(t, len(stats), int(priorityLaneNum))
+	equal(t, stats[PriorityHigh].Dispatched, uint64(1))
+	equal(t, stats[PriorityNormal].Dispatched, uint64(1))
+	equal(t, stats[PriorityLow].Dispatched, uint64(2))
+	equal(t, stats[PriorityLow].Buffered, int64(0))
+
+	// the high priority messages should be dispatched before the backlog beyond the read window,
+	// and all the messages should be dispatched only once
+	msgs = msgs[:0]
+	for i := 0; i < priorityReadAhead*4; i++ {
+		msgs = append(msgs, newMsg("low"))
+	}
+	for i := 0; i < priorityReadAhead; i++ {
+		msgs = append(msgs, newMsg("high"))
+	}
+	channel.Pause()
+	_, _, _, _, _, err = topic.PutMessages(msgs)
+	equal(t, err, nil)
+	topic.ForceFlush()
+	channel.UnPause()
+	dispatched := make(map[MessageID]bool)
+	for i := range msgs {
+		select {
+		case outputMsg := <-channel.clientMsgChan:
+			if i < priorityReadAhead {
+				equal(t, string(outputMsg.Body), "high")
+			} else {
+				equal(t, string(outputMsg.Body), "low")
+			}
+			equal(t, dispatched[outputMsg.ID], false)
+			dispatched[outputMsg.ID] = true
+		case <-time.After(time.Second * 3):
+			t.Fatal("timeout waiting the message")
+		}
+	}
+	select {
+	case outputMsg := <-channel.clientMsgChan:
+		t.Fatalf("unexpected message dispatched again: %v", outputMsg.ID)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPriorityLanesDrain(t *testing.T) {
+	c := &Channel{}
+	pl := newPriorityLanes(c, 3)
+	newMsg := func(priority string) *Message {
+		header := fmt.Sprintf(`{"%v":"%v"}`, PriorityHeader, priority)
+		return NewMessageWithExt(0, []byte(priority), ext.JSON_HEADER_EXT_VER, []byte(header))
+	}
+	equal(t, pl.ShouldDrain(true), false)
+	pl.Push(newMsg("low"))
+	equal(t, pl.ShouldDrain(false), false)
+	pl.Push(newMsg("normal"))
+	pl.Push(newMsg("high"))
+	// drain the full lanes and no more message should be read until drained
+	equal(t, pl.ShouldDrain(false), true)
+	equal(t, string(pl.Pop().Body), "high")
+	equal(t, pl.ShouldDrain(false), true)
+	equal(t, string(pl.Pop().Body), "normal")
+	equal(t, pl.ShouldDrain(false), true)
+	equal(t, string(pl.Pop().Body), "low")
+	equal(t, pl.ShouldDrain(false), false)
+
+	// drain while no more data ready
+	pl.Push(newMsg("low"))
+	equal(t, pl.ShouldDrain(true), true)
+	pl.Clear()
+	equal(t, pl.Len(), 0)
+	equal(t, pl.ShouldDrain(false), false)
+	equal(t, c.priorityBuffered[PriorityLow], int64(0))
+	equal(t, c.priorityDispatched[PriorityHigh], uint64(1))
+
+	// the scanned message should be ignored only once by the channel reader
+	msg := newMsg("high")
+	msg.ID = 1
+	pl.scanned[msg.ID] = true
+	equal(t, pl.IsScanned(msg), true)
+	equal(t, pl.IsScanned(msg), false)
+	pl.scanned[msg.ID] = true
+	pl.Clear()
+	equal(t, pl.IsScanned(msg), false)
+}
+
+func TestChannelRateLimiter(t *testing.T) {
+	var l channelRateLimiter
+	now := time.Now()
+	equal(t, l.reserve(now, 0, 0, 100), time.Duration(0))
+	// the full bucket allow the burst in one second
+	for i := 0; i < 10; i++ {
+		equal(t, l.reserve(now, 10, 0, 100), time.Duration(0))
+	}
+	equal(t, l.reserve(now, 10, 0, 100), time.Second/10)
+	equal(t, l.reserve(now.Add(time.Second/5), 10, 0, 100), time.Duration(0))
+
+	l = channelRateLimiter{}
+	equal(t, l.reserve(now, 0, 1000, 600), time.Duration(0))
+	equal(t, l.reserve(now, 0, 1000, 600), time.Second/5)
+	// the larger wait of the message and the byte limit should be used
+	l = channelRateLimiter{}
+	equal(t, l.reserve(now, 1, 1000, 100), time.Duration(0))
+	equal(t, l.reserve(now, 1, 1000, 100), time.Second)
+	// the waiting message should not take the tokens until enough
+	equal(t, l.reserve(now.Add(time.Second/2), 1, 1000, 100), time.Second/2)
+	equal(t, l.reserve(now.Add(time.Second), 1, 1000, 100), time.Duration(0))
+
+	// the message larger than the byte rate should be allowed after the bucket is full
+	l = channelRateLimiter{}
+	equal(t, l.reserve(now, 0, 10, 100), time.Duration(0))
+	equal(t, l.reserve(now, 0, 10, 100), time.Second*10)
+	equal(t, l.reserve(now.Add(time.Second*10), 0, 10, 100), time.Duration(0))
+	// the removed limit should be used immediately while waiting
+	equal(t, l.reserve(now.Add(time.Second*10), 0, 0, 100), time.Duration(0))
+}
+
+func TestChannelRateLimitMeta(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_rate_limit" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.IsRateLimited(), false)
+	channel.SetRateLimit(100, -1)
+	equal(t, channel.IsRateLimited(), true)
+	equal(t, topic.SaveChannelMeta(), nil)
+	channel.SetRateLimit(0, 0)
+	equal(t, topic.LoadChannelMeta(), nil)
+	msgRate, byteRate := channel.GetRateLimit()
+	equal(t, msgRate, int64(100))
+	equal(t, byteRate, int64(0))
+	equal(t, NewChannelStats(channel, nil, 0).MsgRateLimit, int64(100))
+}
+
+func TestRequeuePolicyDelay(t *testing.T) {
+	invalid := []RequeuePolicy{
+		{Type: "unknown", BaseMs: 100},
+		{Type: RequeuePolicyFixed},
+		{Type: RequeuePolicyExponential, BaseMs: 100, Factor: 0.5},
+		{Type: RequeuePolicyExponential, BaseMs: 100, Jitter: 1.5},
+		{Type: RequeuePolicySteps},
+		{Type: RequeuePolicySteps, StepsMs: []int64{100, -1}},
+	}
+	for _, p := range invalid {
+		equal(t, p.Validate(), ErrInvalidRequeuePolicy)
+	}
+	p := RequeuePolicy{Type: RequeuePolicyFixed, BaseMs: 100}
+	equal(t, p.Validate(), nil)
+	equal(t, p.GetDelay(1), 100*time.Millisecond)
+	equal(t, p.GetDelay(10), 100*time.Millisecond)
+
+	p = RequeuePolicy{Type: RequeuePolicyExponential, BaseMs: 100, MaxMs: 1000}
+	equal(t, p.Validate(), nil)
+	equal(t, p.GetDelay(0), 100*time.Millisecond)
+	equal(t, p.GetDelay(1), 100*time.Millisecond)
+	equal(t, p.GetDelay(2), 200*time.Millisecond)
+	equal(t, p.GetDelay(4), 800*time.Millisecond)
+	equal(t, p.GetDelay(5), time.Second)
+	equal(t, p.GetDelay(60000), time.Second)
+	p.Factor = 3
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.GetDelay(2)
+		equal(t, d <= 300*time.Millisecond && d >= 150*time.Millisecond, true)
+	}
+
+	p = RequeuePolicy{Type: RequeuePolicySteps, StepsMs: []int64{0, 1000, 5000}}
+	equal(t, p.Validate(), nil)
+	equal(t, p.GetDelay(1), time.Duration(0))
+	equal(t, p.GetDelay(2), time.Second)
+	equal(t, p.GetDelay(3), 5*time.Second)
+	equal(t, p.GetDelay(100), 5*time.Second)
+}
+
+func TestChannelRequeuePolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_requeue_policy" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.GetRequeuePolicy() == nil, true)
+	equal(t, channel.SetRequeuePolicy(&RequeuePolicy{Type: RequeuePolicyFixed}), ErrInvalidRequeuePolicy)
+	policy := &RequeuePolicy{Type: RequeuePolicySteps, StepsMs: []int64{10000, 20000}}
+	equal(t, channel.SetRequeuePolicy(policy), nil)
+	equal(t, topic.SaveChannelMeta(), nil)
+	equal(t, channel.SetRequeuePolicy(nil), nil)
+	equal(t, channel.GetRequeuePolicy() == nil, true)
+	equal(t, topic.LoadChannelMeta(), nil)
+	equal(t, channel.GetRequeuePolicy(), policy)
+	equal(t, NewChannelStats(channel, nil, 0).RequeuePolicy, policy)
+
+	msg := NewMessage(topic.nextMsgID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(1), "", time.Minute)
+	equal(t, channel.GetRequeueTimeout(2, msg.ID), time.Duration(0))
+	equal(t, channel.GetRequeueTimeout(1, msg.ID), 10*time.Second)
+
+	// the timeout message should wait the backoff before requeue
+	tnow := time.Now().Add(2 * time.Minute).UnixNano()
+	channel.processInFlightQueue(tnow)
+	channel.inFlightMutex.Lock()
+	inFlight, ok := channel.inFlightMessages[msg.ID]
+	channel.inFlightMutex.Unlock()
+	equal(t, ok, true)
+	equal(t, inFlight.IsDeferred(), true)
+	equal(t, inFlight.pri, tnow+int64(10*time.Second))
+	equal(t, atomic.LoadUint64(&channel.timeoutCount), uint64(1))
+	channel.processInFlightQueue(tnow + int64(11*time.Second))
+	channel.inFlightMutex.Lock()
+	_, ok = channel.inFlightMessages[msg.ID]
+	channel.inFlightMutex.Unlock()
+	equal(t, ok, false)
+	equal(t, atomic.LoadInt64(&channel.deferredCount), int64(0))
+}
+
+func TestChannelExtFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_ext_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName, 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.GetExtFilter() == nil, true)
+	err := channel.SetExtFilter(ExtFilterData{Type: 1, FilterExtKey: "region"})
+	equal(t, err, ErrInvalidFilter)
+	err = channel.SetExtFilter(ExtFilterData{Type: 1, FilterExtKey: "region", FilterData: "east"})
+	equal(t, err, nil)
+	equal(t, topic.SaveChannelMeta(), nil)
+	channel.SetExtFilter(ExtFilterData{})
+	equal(t, channel.GetExtFilter() == nil, true)
+	equal(t, topic.LoadChannelMeta(), nil)
+	equal(t, channel.GetExtFilter().FilterData, "east")
+
+	msgs := []*Message{
+		NewMessageWithExt(0, []byte("west"), ext.JSON_HEADER_EXT_VER, []byte(`{"region":"west"}`)),
+		NewMessageWithExt(0, []byte("east"), ext.JSON_HEADER_EXT_VER, []byte(`{"region":"east"}`)),
+	}
+	_, _, _, _, _, err = topic.PutMessages(msgs)
+	equal(t, err, nil)
+	topic.ForceFlush()
+	select {
+	case outputMsg := <-channel.clientMsgChan:
+		equal(t, string(outputMsg.Body), "east")
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout waiting the message")
+	}
+	equal(t, channel.GetFilteredCount(), uint64(1))
+	equal(t, NewChannelStats(channel, nil, 0).FilteredCount, uint64(1))
+}
+
+func TestChannelBroadcast(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_broadcast" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName, 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1}, nil)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.SetBroadcast(true), nil)
+	_, err := channel.AddBroadcastClient(1, "", NewFakeConsumer(1))
+	equal(t, err, ErrBroadcastNoClientID)
+	clients := map[string]*fakeConsumer{"a": NewFakeConsumer(1), "b": NewFakeConsumer(2)}
+	for id, c := range clients {
+		created, err := channel.AddBroadcastClient(c.GetID(), id, c)
+		equal(t, err, nil)
+		equal(t, created, true)
+	}
+	start := channel.GetConfirmed()
+
+	recvAndStart := func(member string) *Message {
+		msgChan, ok := channel.GetBroadcastMsgChan(clients[member].GetID())
+		equal(t, ok, true)
+		select {
+		case msg := <-msgChan:
+			shouldSend, err := channel.StartInFlightTimeout(msg, clients[member], "", opts.MsgTimeout)
+			equal(t, err, nil)
+			equal(t, shouldSend, true)
+			return msg
+		case <-time.After(time.Second * 3):
+			t.Fatal("timeout waiting the message")
+		}
+		return nil
+	}
+	topic.PutMessage(NewMessage(0, []byte("test1")))
+	topic.PutMessage(NewMessage(0, []byte("test2")))
+	topic.ForceFlush()
+	for _, body := range []string{"test1", "test2"} {
+		msg := recvAndStart("a")
+		equal(t, string(msg.Body), body)
+		_, _, changed, _, err := channel.FinishMessage(1, "", msg.ID)
+		equal(t, err, nil)
+		equal(t, changed, false)
+	}
+	// the confirmed offset should wait all the members
+	equal(t, channel.GetConfirmed(), start)
+	msg := recvAndStart("b")
+	equal(t, channel.RequeueMessage(2, "", msg.ID, 0, true), nil)
+	msg = recvAndStart("b")
+	next := msg.Body
+	if string(msg.Body) != "test1" {
+		// the next message may be already popped before the requeue
+		equal(t, string(msg.Body), "test2")
+		_, _, changed, _, err := channel.FinishMessage(2, "", msg.ID)
+		equal(t, err, nil)
+		equal(t, changed, false)
+		msg = recvAndStart("b")
+	}
+	equal(t, string(msg.Body), "test1")
+	equal(t, msg.Attempts, uint16(2))
+	_, _, changed, _, err := channel.FinishMessage(2, "", msg.ID)
+	equal(t, err, nil)
+	equal(t, changed, true)
+	if string(next) == "test1" {
+		msg = recvAndStart("b")
+		channel.FinishMessage(2, "", msg.ID)
+	}
+	end := channel.GetConfirmed()
+	equal(t, end, channel.GetChannelEnd())
+	offsets := channel.GetBroadcastMemberOffsets()
+	equal(t, offsets["a"], int64(end.Offset()))
+	equal(t, offsets["b"], int64(end.Offset()))
+
+	// the member without client keep blocking the confirmed until timeout
+	channel.RemoveClient(2, "")
+	topic.PutMessage(NewMessage(0, []byte("test3")))
+	topic.ForceFlush()
+	msg = recvAndStart("a")
+	channel.FinishMessage(1, "", msg.ID)
+	equal(t, channel.GetConfirmed(), end)
+	stats := NewChannelStats(channel, nil, 0)
+	equal(t, stats.Broadcast, true)
+	equal(t, len(stats.BroadcastMembers), 2)
+	equal(t, stats.BroadcastMembers[1].ClientNum, 0)
+	equal(t, stats.BroadcastMembers[1].Pending, 1)
+	channel.option.BroadcastMemberTimeout = time.Millisecond
+	time.Sleep(time.Millisecond * 10)
+	channel.processInFlightQueue(time.Now().UnixNano())
+	equal(t, len(channel.GetBroadcastMemberStats()), 1)
+	equal(t, channel.GetConfirmed(), channel.GetChannelEnd())
+
+	equal(t, topic.SaveChannelMeta(), nil)
+	equal(t, channel.SetBroadcast(false), nil)
+	equal(t, len(channel.GetBroadcastMemberOffsets()), 0)
+	equal(t, topic.LoadChannelMeta(), nil)
+	equal(t, channel.IsBroadcast(), true)
+	equal(t, channel.GetBroadcastMemberOffsets()["a"], int64(channel.GetConfirmed().Offset()))
+}
+
+func TestChannelBroadcastSlowMember(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.MaxConfirmWin = 2
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_broadcast_slow" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName, 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1}, nil)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.SetBroadcast(true), nil)
+	clients := map[string]*fakeConsumer{"a": NewFakeConsumer(1), "b": NewFakeConsumer(2)}
+	for id, c := range clients {
+		_, err := channel.AddBroadcastClient(c.GetID(), id, c)
+		equal(t, err, nil)
+	}
+	recvAndFinish := func(member string, wait time.Duration) *Message {
+		msgChan, ok := channel.GetBroadcastMsgChan(clients[member].GetID())
+		equal(t, ok, true)
+		select {
+		case msg := <-msgChan:
+			_, err := channel.StartInFlightTimeout(msg, clients[member], "", opts.MsgTimeout)
+			equal(t, err, nil)
+			_, _, _, _, err = channel.FinishMessage(clients[member].GetID(), "", msg.ID)
+			equal(t, err, nil)
+			return msg
+		case <-time.After(wait):
+		}
+		return nil
+	}
+	for i := 0; i < 4; i++ {
+		topic.PutMessage(NewMessage(0, []byte("test"+strconv.Itoa(i))))
+	}
+	topic.ForceFlush()
+	for i := 0; i < 2; i++ {
+		msg := recvAndFinish("a", time.Second*3)
+		equal(t, string(msg.Body), "test"+strconv.Itoa(i))
+	}
+	// the slow member should block the dispatch after too many messages waiting it
+	equal(t, recvAndFinish("a", time.Millisecond*100) == nil, true)
+	stats := channel.GetBroadcastMemberStats()
+	equal(t, stats[1].ClientID, "b")
+	equal(t, stats[1].Pending, 2)
+	msg := recvAndFinish("b", time.Second*3)
+	equal(t, string(msg.Body), "test0")
+	msg = recvAndFinish("a", time.Second*3)
+	equal(t, string(msg.Body), "test2")
+}
+
 func TestChannelHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -47,6 +47,10 @@ type IdentifyDataV2 struct {
 	DesiredTag          string        `json:"desired_tag,omitempty"`
 	ExtendSupport       bool          `json:"extend_support"`
 	ExtFilter           ExtFilterData `json:"ext_filter"`
+	// the member id in the consumer group, used to fence the ordered sub
+	ConsumerGroupMember string `json:"consumer_group_member,omitempty"`
+	// the producer id used to dedup the retried publish with the sequence number
+	ProducerID string `json:"producer_id,omitempty"`
 }
 
 type identifyEvent struct {
@@ -131,6 +135,9 @@ type ClientV2 struct {
 	isExtendSupport int32
 	TagMsgChannel   chan *Message
 	extFilter       ExtFilterData
+
+	consumerGroupMember string
+	producerID          string
 }
 
 func NewClientV2(id int64, conn net.Conn, opts *Options, tls *tls.Config) *ClientV2 {
@@ -275,6 +282,11 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 		c.SetExtendSupport()
 	}
 	c.SetExtFilter(data.ExtFilter)
+	c.SetConsumerGroupMember(data.ConsumerGroupMember)
+	err = c.SetProducerID(data.ProducerID)
+	if err != nil {
+		return err
+	}
 
 	c.metaLock.RLock()
 	ie := identifyEvent{
@@ -303,6 +315,8 @@ func (c *ClientV2) Stats() ClientStats {
 	clientID := c.ClientID
 	hostname := c.Hostname
 	userAgent := c.UserAgent
+	member := c.consumerGroupMember
+	producerID := c.producerID
 	var identity string
 	var identityURL string
 	if c.AuthState != nil {
@@ -335,6 +349,9 @@ func (c *ClientV2) Stats() ClientStats {
 		AuthIdentity:    identity,
 		AuthIdentityURL: identityURL,
 		DesiredTag:      c.GetDesiredTag(),
+
+		ConsumerGroupMember: member,
+		ProducerID:          producerID,
 	}
 	if stats.TLS {
 		p := prettyConnectionState{c.tlsConn.ConnectionState()}
@@ -588,6 +605,34 @@ func (c *ClientV2) SetExtFilter(filter ExtFilterData) {
 	c.extFilter = filter
 }
 
+func (c *ClientV2) SetConsumerGroupMember(member string) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.consumerGroupMember = member
+}
+
+func (c *ClientV2) GetConsumerGroupMember() string {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.consumerGroupMember
+}
+
+func (c *ClientV2) SetProducerID(id string) error {
+	if id != "" && !IsValidProducerID(id) {
+		return ErrInvalidProducerID
+	}
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	c.producerID = id
+	return nil
+}
+
+func (c *ClientV2) GetProducerID() string {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.producerID
+}
+
 func (c *ClientV2) GetOutputBufferTimeout() time.Duration {
 	return time.Duration(atomic.LoadInt64(&c.outputBufferTimeout))
 }
@@ -0,0 +1,182 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+// The message exceeded the max attempts of the channel will be moved to the dead letter topic
+// of the channel, the source of the message is saved in the json header so it can be redriven
+// back to the source channel later. The attempts and the ext headers of the message are kept.
+
+const deadLetterTopicSep = "__dlq_"
+
+const (
+	DeadLetterTopicKey   = "##dlq_topic"
+	DeadLetterPartKey    = "##dlq_partition"
+	DeadLetterChannelKey = "##dlq_channel"
+	DeadLetterOrigIDKey  = "##dlq_orig_id"
+	DeadLetterTsKey      = "##dlq_ts"
+)
+
+var (
+	ErrDeadLetterNotConfigured = errors.New("dead letter is not configured for channel")
+	ErrDeadLetterTopicNotExt   = errors.New("dead letter topic should support ext")
+	ErrNotDeadLetterMessage    = errors.New("not a dead letter message")
+	ErrDeadLetterExtNotSupport = errors.New("the message with ext can not be redriven to the topic without ext")
+)
+
+type DeadLetterInfo struct {
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Channel   string    `json:"channel"`
+	OrigID    MessageID `json:"orig_id"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+func GetDeadLetterTopicName(topicName string, channelName string) string {
+	return topicName + deadLetterTopicSep + channelName
+}
+
+func IsDeadLetterTopic(topicName string) bool {
+	return strings.Contains(topicName, deadLetterTopicSep)
+}
+
+// IsValidDeadLetterChannel check if the dead letter topic can be created for the channel
+func IsValidDeadLetterChannel(topicName string, channelName string) bool {
+	if protocol.IsEphemeral(channelName) || IsDeadLetterTopic(topicName) {
+		return false
+	}
+	return protocol.IsValidTopicName(GetDeadLetterTopicName(topicName, channelName))
+}
+
+func getJsonHeader(msg *Message) (map[string]json.RawMessage, error) {
+	header := make(map[string]json.RawMessage)
+	switch msg.ExtVer {
+	case ext.NO_EXT_VER:
+	case ext.TAG_EXT_VER:
+		tag, _ := json.Marshal(string(msg.ExtBytes))
+		header[ext.CLIENT_DISPATCH_TAG_KEY] = tag
+	case ext.JSON_HEADER_EXT_VER:
+		if len(msg.ExtBytes) > 0 {
+			err := json.Unmarshal(msg.ExtBytes, &header)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("unknown ext version")
+	}
+	return header, nil
+}
+
+// hasJsonHeaderKey is the fast check to avoid decoding the json header of the message
+// which has no the key.
+func hasJsonHeaderKey(msg *Message, key string) bool {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER || len(msg.ExtBytes) == 0 {
+		return false
+	}
+	return bytes.Contains(msg.ExtBytes, []byte(key))
+}
+
+func getJsonHeaderValueString(header map[string]json.RawMessage, key string) string {
+	var v string
+	json.Unmarshal(header[key], &v)
+	return v
+}
+
+// getJsonHeaderString return the string value of the key in the json header, empty if not exist
+// or not a string.
+func getJsonHeaderString(msg *Message, key string) string {
+	if !hasJsonHeaderKey(msg, key) {
+		return ""
+	}
+	header, err := getJsonHeader(msg)
+	if err != nil {
+		return ""
+	}
+	return getJsonHeaderValueString(header, key)
+}
+
+// NewDeadLetterMessage copy the message for the dead letter topic, the source info
+// will be added to the json header.
+func NewDeadLetterMessage(ch *Channel, msg *Message) (*Message, error) {
+	header, err := getJsonHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+	setStr := func(k string, v string) {
+		d, _ := json.Marshal(v)
+		header[k] = d
+	}
+	setStr(DeadLetterTopicKey, ch.GetTopicName())
+	setStr(DeadLetterPartKey, strconv.Itoa(ch.GetTopicPart()))
+	setStr(DeadLetterChannelKey, ch.GetName())
+	setStr(DeadLetterOrigIDKey, strconv.FormatUint(uint64(msg.ID), 10))
+	setStr(DeadLetterTsKey, strconv.FormatInt(time.Now().UnixNano(), 10))
+	extBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if len(extBytes) > ext.MaxExtLen {
+		return nil, errors.New("ext header too long for dead letter")
+	}
+	body := make([]byte, len(msg.Body))
+	copy(body, msg.Body)
+	newMsg := NewMessageWithExt(0, body, ext.JSON_HEADER_EXT_VER, extBytes)
+	newMsg.TraceID = msg.TraceID
+	newMsg.Timestamp = msg.Timestamp
+	newMsg.Attempts = msg.Attempts
+	return newMsg, nil
+}
+
+// ParseDeadLetterMessage return the source info of the dead letter message and the message
+// with the dead letter headers removed which can be redriven to the source topic.
+func ParseDeadLetterMessage(msg *Message, toExt bool) (*DeadLetterInfo, *Message, error) {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return nil, nil, ErrNotDeadLetterMessage
+	}
+	header, err := getJsonHeader(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	getStr := func(k string) string {
+		var v string
+		json.Unmarshal(header[k], &v)
+		delete(header, k)
+		return v
+	}
+	var info DeadLetterInfo
+	info.Topic = getStr(DeadLetterTopicKey)
+	info.Channel = getStr(DeadLetterChannelKey)
+	part, perr := strconv.Atoi(getStr(DeadLetterPartKey))
+	origID, ierr := strconv.ParseUint(getStr(DeadLetterOrigIDKey), 10, 64)
+	info.Timestamp, _ = strconv.ParseInt(getStr(DeadLetterTsKey), 10, 64)
+	if info.Topic == "" || info.Channel == "" || perr != nil || ierr != nil {
+		return nil, nil, ErrNotDeadLetterMessage
+	}
+	info.Partition = part
+	info.OrigID = MessageID(origID)
+
+	newMsg := NewMessage(0, msg.Body)
+	newMsg.TraceID = msg.TraceID
+	newMsg.Timestamp = msg.Timestamp
+	if len(header) > 0 {
+		if !toExt {
+			return &info, nil, ErrDeadLetterExtNotSupport
+		}
+		newMsg.ExtVer = ext.JSON_HEADER_EXT_VER
+		newMsg.ExtBytes, err = json.Marshal(header)
+		if err != nil {
+			return &info, nil, err
+		}
+	}
+	return &info, newMsg, nil
+}
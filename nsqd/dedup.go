@@ -0,0 +1,199 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+// The messages with the same dedup key in the json header will be written only once in the
+// dedup window of the topic. The recent keys are saved to the index file in the topic data path,
+// and the index will catch up the data written after the saved position while loading, so the
+// window survives restarts and leader moves.
+
+const (
+	DedupKeyHeader = "##dedup_key"
+
+	dedupIndexFileSuffix = ".dedup.dat"
+)
+
+type dedupIndexItem struct {
+	Key string    `json:"key"`
+	ID  MessageID `json:"id"`
+	Ts  int64     `json:"ts"`
+}
+
+type dedupIndexData struct {
+	// the queue end of the data which has been indexed
+	End   BackendOffset    `json:"end"`
+	Items []dedupIndexItem `json:"items"`
+}
+
+// GetDedupKey return the dedup key in the json header of the message
+func GetDedupKey(msg *Message) string {
+	return getJsonHeaderString(msg, DedupKeyHeader)
+}
+
+func (t *Topic) GetDedupWindow() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.dynamicConf.DedupWindow)) * time.Second
+}
+
+func (t *Topic) IsDedupEnabled() bool {
+	return t.IsExt() && t.GetDedupWindow() > 0
+}
+
+func (t *Topic) getDedupIndexFileName() string {
+	return path.Join(t.dataPath, t.fullName+dedupIndexFileSuffix)
+}
+
+func (t *Topic) readDedupIndex() (*dedupIndexData, error) {
+	data, err := ioutil.ReadFile(t.getDedupIndexFileName())
+	if err != nil {
+		return nil, err
+	}
+	var index dedupIndexData
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// loadDedupIndexNoLock load the saved index and catch up the data written after the index,
+// the recent data will be scanned if the index is not usable.
+func (t *Topic) loadDedupIndexNoLock(w *dedupWindow) error {
+	w.resetNoLock()
+	since := time.Now().Add(-1 * w.window).UnixNano()
+	handler := func(msg *Message, ret *ReadResult) {
+		if key := GetDedupKey(msg); key != "" {
+			w.addNoLock(key, msg.ID, msg.Timestamp)
+		}
+	}
+	index, err := t.readDedupIndex()
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.LogWarningf("topic %v failed to read the dedup index: %v", t.GetFullName(), err)
+	}
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	if index != nil && index.End <= t.backend.GetQueueReadEnd().Offset() &&
+		int64(index.End) >= t.GetQueueReadStart() && snap.ResetSeekTo(index.End) == nil {
+		for _, item := range index.Items {
+			if item.Ts >= since {
+				w.addNoLock(item.Key, item.ID, item.Ts)
+			}
+		}
+		err = t.scanSnapshot(snap, since, handler)
+	} else {
+		err = t.scanRecentMessages(since, handler)
+	}
+	if err != nil {
+		w.resetNoLock()
+		return err
+	}
+	w.loaded = true
+	nsqLog.Logf("topic %v dedup window loaded: %v keys", t.GetFullName(), len(w.keys))
+	return nil
+}
+
+// saveDedupIndex save the loaded dedup window to the index file, the keys may be written
+// after the saved end, which will be read again while loading.
+func (t *Topic) saveDedupIndex() error {
+	if !t.IsDedupEnabled() {
+		return nil
+	}
+	w := t.dedupWindow
+	w.Lock()
+	if !w.loaded || atomic.LoadInt32(&t.dedupInvalid) == 1 {
+		w.Unlock()
+		return nil
+	}
+	w.expireNoLock(time.Now().UnixNano())
+	index := dedupIndexData{
+		End:   t.backend.GetQueueReadEnd().Offset(),
+		Items: make([]dedupIndexItem, 0, len(w.items)),
+	}
+	for _, item := range w.items {
+		index.Items = append(index.Items, dedupIndexItem{Key: item.key, ID: w.keys[item.key], Ts: item.ts})
+	}
+	w.Unlock()
+	d, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	fileName := t.getDedupIndexFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err = ioutil.WriteFile(tmpFileName, d, 0644)
+	if err != nil {
+		return err
+	}
+	return util.AtomicRename(tmpFileName, fileName)
+}
+
+// invalidDedupIndex should be called while the topic data is truncated or reset, the index
+// will be rebuilt from the data while used next time.
+func (t *Topic) invalidDedupIndex() {
+	atomic.StoreInt32(&t.dedupInvalid, 1)
+	t.removeDedupIndex()
+}
+
+func (t *Topic) resetDedupWindow() {
+	t.dedupWindow.Lock()
+	t.dedupWindow.resetNoLock()
+	t.dedupWindow.Unlock()
+}
+
+func (t *Topic) removeDedupIndex() {
+	fileName := t.getDedupIndexFileName()
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.Infof("remove file %v failed:%v", fileName, err)
+	}
+}
+
+// LockDedup should be held while checking and writing the messages with the dedup key.
+func (t *Topic) LockDedup() {
+	t.dedupWindow.Lock()
+}
+
+func (t *Topic) UnlockDedup() {
+	t.dedupWindow.Unlock()
+}
+
+// GetDedupWrittenNoLock return the keys which have been written in the dedup window
+func (t *Topic) GetDedupWrittenNoLock(keys []string) (map[string]MessageID, error) {
+	w := t.dedupWindow
+	if atomic.CompareAndSwapInt32(&t.dedupInvalid, 1, 0) {
+		w.resetNoLock()
+	}
+	window := t.GetDedupWindow()
+	if w.window != window {
+		// the window changed, reload to make sure the keys in the new window are included
+		w.window = window
+		w.resetNoLock()
+	}
+	if !w.loaded {
+		if err := t.loadDedupIndexNoLock(w); err != nil {
+			nsqLog.LogErrorf("topic %v failed to load the dedup window: %v", t.GetFullName(), err)
+			return nil, err
+		}
+	}
+	w.expireNoLock(time.Now().UnixNano())
+	written := make(map[string]MessageID)
+	for _, k := range keys {
+		if id, ok := w.keys[k]; ok {
+			written[k] = id
+		}
+	}
+	return written, nil
+}
+
+func (t *Topic) MarkDedupWrittenNoLock(key string, id MessageID) {
+	t.dedupWindow.addNoLock(key, id, time.Now().UnixNano())
+}
@@ -9,12 +9,10 @@ import (
 	"os"
 	"path"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/absolute8511/bolt"
 	"github.com/youzan/nsq/internal/levellogger"
 )
 
@@ -156,14 +154,21 @@ func getDelayedMsgDBPrefixKey(dt int, ch string) []byte {
 	return msgKey
 }
 
-func deleteMsgIndex(msgData []byte, tx *bolt.Tx, isExt bool) error {
+func deleteMsgIndex(msgData []byte, tx delayedKVTx, isExt bool) error {
 	m, err := DecodeDelayedMessage(msgData, isExt)
 	if err != nil {
 		nsqLog.LogErrorf("failed to decode delayed message: %v, %v", msgData, err)
 		return err
 	}
-	msgIndexKey := getDelayedMsgDBIndexKey(int(m.DelayedType), m.DelayedChannel, m.DelayedOrigID)
+	msgIndexKey := getDelayedMsgDBIndexKeyOfMsg(m)
 	b := tx.Bucket(bucketDelayedMsgIndex)
+	if m.DelayedType == ChannelDelayed {
+		ts, _, ok := decodeDelayedMsgDBIndexValue(b.Get(msgIndexKey))
+		if ok && ts != m.DelayedTs {
+			// the index is replaced by the newer delayed message with the same original id
+			return nil
+		}
+	}
 	err = b.Delete(msgIndexKey)
 	if err != nil {
 		nsqLog.Infof("failed to delete delayed index : %v", msgIndexKey)
@@ -172,7 +177,7 @@ func deleteMsgIndex(msgData []byte, tx *bolt.Tx, isExt bool) error {
 	return nil
 }
 
-func deleteBucketKey(dt int, ch string, ts int64, id MessageID, tx *bolt.Tx, isExt bool) error {
+func deleteBucketKey(dt int, ch string, ts int64, id MessageID, tx delayedKVTx, isExt bool) error {
 	b := tx.Bucket(bucketDelayedMsg)
 	msgKey := getDelayedMsgDBKey(dt, ch, ts, id)
 	oldV := b.Get(msgKey)
@@ -224,7 +229,8 @@ type DelayQueue struct {
 
 	needFlush   int32
 	putBuffer   bytes.Buffer
-	kvStore     *bolt.DB
+	kvStore     delayedKVStore
+	engine      string
 	EnableTrace int32
 	SyncEvery   int64
 	lastSyncCnt int64
@@ -239,20 +245,16 @@ type DelayQueue struct {
 
 func NewDelayQueueForRead(topicName string, part int, dataPath string, opt *Options,
 	idGen MsgIDGenerator, isExt bool) (*DelayQueue, error) {
-	ro := &bolt.Options{
-		Timeout:  time.Second,
-		ReadOnly: true,
-	}
-	return newDelayQueue(topicName, part, dataPath, opt, idGen, isExt, ro)
+	return newDelayQueue(topicName, part, dataPath, opt, idGen, isExt, true)
 }
 
 func NewDelayQueue(topicName string, part int, dataPath string, opt *Options,
 	idGen MsgIDGenerator, isExt bool) (*DelayQueue, error) {
 
-	return newDelayQueue(topicName, part, dataPath, opt, idGen, isExt, nil)
+	return newDelayQueue(topicName, part, dataPath, opt, idGen, isExt, false)
 }
 func newDelayQueue(topicName string, part int, dataPath string, opt *Options,
-	idGen MsgIDGenerator, isExt bool, ro *bolt.Options) (*DelayQueue, error) {
+	idGen MsgIDGenerator, isExt bool, readOnly bool) (*DelayQueue, error) {
 	dataPath = path.Join(dataPath, "delayed_queue")
 	os.MkdirAll(dataPath, 0755)
 	q := &DelayQueue{
@@ -280,76 +282,35 @@ func newDelayQueue(topicName string, part int, dataPath string, opt *Options,
 		return nil, err
 	}
 	q.backend = queue.(*diskQueueWriter)
-	if ro == nil {
-		ro = &bolt.Options{
-			Timeout:  time.Second,
-			ReadOnly: false,
-		}
-	}
-	q.kvStore, err = bolt.Open(path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition)), 0644, ro)
+	q.engine, q.kvStore, err = resolveDelayedKVStore(q.getDBPath(), opt.DelayQueueEngine, readOnly)
 	if err != nil {
 		nsqLog.LogErrorf("topic(%v) failed to init delayed db: %v , %v ", q.fullName, err, backendName)
 		return nil, err
 	}
-	q.kvStore.NoSync = true
-	err = q.kvStore.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketDelayedMsg)
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(bucketDelayedMsgIndex)
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(bucketMeta)
-		return err
-	})
-	if err != nil {
-		nsqLog.LogErrorf("topic(%v) failed to init delayed db: %v , %v ", q.fullName, err, backendName)
-		if ro == nil || !ro.ReadOnly {
-			return nil, err
-		}
-	}
-
 	return q, nil
 }
 
+func (q *DelayQueue) getDBPath() string {
+	return path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition))
+}
+
+// GetKVEngine return the kv storage engine of the delayed queue
+func (q *DelayQueue) GetKVEngine() string {
+	return q.engine
+}
+
 func (q *DelayQueue) CheckConsistence() error {
 	// Perform consistency check.
-	return q.getStore().View(func(tx *bolt.Tx) error {
-		var count int
-		ch := tx.Check()
-		done := false
-		for !done {
-			select {
-			case err, ok := <-ch:
-				if !ok {
-					done = true
-					break
-				}
-				nsqLog.LogErrorf("topic(%v) failed to check delayed db: %v ", q.fullName, err)
-				if err != nil && strings.Contains(err.Error(), "unreachable unfreed") {
-					continue
-				}
-				count++
-			}
-		}
-
-		if count > 0 {
-			nsqLog.LogErrorf("topic(%v) failed to check delayed db, %d errors found ", q.fullName, count)
-			return errors.New("boltdb file corrupt")
-		}
-		return nil
-	})
+	err := q.getStore().CheckConsistence()
+	if err != nil {
+		nsqLog.LogErrorf("topic(%v) failed to check delayed db: %v ", q.fullName, err)
+	}
+	return err
 }
 
 func (q *DelayQueue) reOpenStore() error {
 	var err error
-	ro := &bolt.Options{
-		Timeout:  time.Second,
-		ReadOnly: false,
-	}
-	q.kvStore, err = bolt.Open(path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition)), 0644, ro)
+	q.kvStore, err = openDelayedKVStore(q.engine, getDelayedKVStorePath(q.getDBPath(), q.engine), false)
 	if err != nil {
 		nsqLog.LogErrorf("topic(%v) failed to open delayed db: %v ", q.fullName, err)
 		return err
@@ -358,30 +319,10 @@ func (q *DelayQueue) reOpenStore() error {
 	q.oldestMutex.Lock()
 	q.oldestChannelDelayedTs = make(map[string]int64)
 	q.oldestMutex.Unlock()
-
-	q.kvStore.NoSync = true
-	err = q.kvStore.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketDelayedMsg)
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(bucketDelayedMsgIndex)
-		if err != nil {
-			return err
-		}
-
-		_, err = tx.CreateBucketIfNotExists(bucketMeta)
-		return err
-	})
-	if err != nil {
-		nsqLog.LogErrorf("topic(%v) failed to init delayed db: %v", q.fullName, err)
-		return err
-	}
-
 	return nil
 }
 
-func (q *DelayQueue) getStore() *bolt.DB {
+func (q *DelayQueue) getStore() delayedKVStore {
 	q.dbLock.Lock()
 	d := q.kvStore
 	q.dbLock.Unlock()
@@ -497,82 +438,41 @@ func (q *DelayQueue) TotalDataSize() int64 {
 }
 
 func (q *DelayQueue) GetDBSize() (int64, error) {
-	totalSize := int64(0)
-	err := q.getStore().View(func(tx *bolt.Tx) error {
-		totalSize = tx.Size()
-		return nil
-	})
-	return totalSize, err
+	return q.getStore().Size()
 }
 
 func (q *DelayQueue) BackupKVStoreTo(w io.Writer) (int64, error) {
-	totalSize := int64(0)
-	err := q.getStore().View(func(tx *bolt.Tx) error {
-		buf := make([]byte, 8)
-		binary.BigEndian.PutUint64(buf, uint64(tx.Size()))
-		_, err := w.Write(buf)
-		if err != nil {
-			return err
-		}
-		totalSize = tx.Size() + 8
-		_, err = tx.WriteTo(w)
-		return err
-	})
-	return totalSize, err
+	return q.getStore().BackupTo(w)
 }
 
+// RestoreKVStoreFrom replace the kv store with the backup, the backup from the other
+// engine will be imported to the local engine.
 func (q *DelayQueue) RestoreKVStoreFrom(body io.Reader) error {
-	buf := make([]byte, 8)
-	n, err := body.Read(buf)
-	if err != nil {
-		return err
-	}
-	if n != len(buf) {
-		return errors.New("unexpected length for body length")
-	}
-	bodyLen := int64(binary.BigEndian.Uint64(buf))
-	tmpPath := path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition)+"-tmp.restore")
-	err = os.Remove(tmpPath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-	}
-	f, err := os.Create(tmpPath)
-	if err != nil {
-		return err
-	}
-	_, err = io.CopyN(f, body, bodyLen)
-	if err != nil {
-		f.Close()
-		return err
-	}
-	err = f.Sync()
-	if err != nil {
-		f.Close()
-		return err
-	}
-	err = f.Close()
+	kvPath := getDelayedKVStorePath(q.getDBPath(), q.engine)
+	tmpPath := kvPath + "-tmp.restore"
+	err := restoreDelayedKVStore(q.engine, tmpPath, body)
 	if err != nil {
 		return err
 	}
 
 	q.compactMutex.Lock()
 	defer q.compactMutex.Unlock()
-	kvPath := path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition))
 	q.dbLock.Lock()
 	defer q.dbLock.Unlock()
 	q.kvStore.Close()
-	err = os.Rename(tmpPath, kvPath)
-	if err != nil {
-		return err
+	err = os.RemoveAll(kvPath)
+	if err == nil {
+		err = os.Rename(tmpPath, kvPath)
 	}
-	err = q.reOpenStore()
 	if err != nil {
-		nsqLog.LogErrorf("topic(%v) failed to restore delayed db: %v , %v ", q.fullName, err, kvPath)
-		return err
+		nsqLog.LogErrorf("topic(%v) failed to replace delayed db: %v , %v ", q.fullName, err, kvPath)
 	}
-	return nil
+	openErr := q.reOpenStore()
+	if openErr != nil {
+		nsqLog.LogErrorf("topic(%v) failed to restore delayed db: %v , %v ", q.fullName, openErr, kvPath)
+		return openErr
+	}
+	return err
 }
 
 func (q *DelayQueue) PutDelayMessage(m *Message) (MessageID, BackendOffset, int32, BackendQueueEnd, error) {
@@ -673,10 +573,29 @@ func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64
 		return m.ID, offset, writeBytes, dend, err
 	}
 	msgKey := getDelayedMsgDBKey(int(m.DelayedType), m.DelayedChannel, m.DelayedTs, m.ID)
+	pubData := m.getDelayedPubData()
 
 	wstart := time.Now()
 	q.compactMutex.Lock()
-	err = q.getStore().Update(func(tx *bolt.Tx) error {
+	err = q.getStore().Update(func(tx delayedKVTx) error {
+		if pubData.ScheduleID != "" {
+			// replace or cancel the old message with the same schedule id
+			err := deleteScheduledMsg(pubData.ScheduleID, tx, q.IsExt())
+			if err != nil {
+				return err
+			}
+			if pubData.Cancel {
+				return tx.Bucket(bucketMeta).Put(syncedOffsetKey, []byte(strconv.Itoa(int(dend.Offset()))))
+			}
+		}
+		if pubData.Cancel {
+			// delete the channel delayed message, it may be consumed already
+			err := deleteBucketKey(ChannelDelayed, pubData.Channel, pubData.Ts, pubData.ID, tx, q.IsExt())
+			if err != nil && err != errBucketKeyNotFound {
+				return err
+			}
+			return tx.Bucket(bucketMeta).Put(syncedOffsetKey, []byte(strconv.Itoa(int(dend.Offset()))))
+		}
 		b := tx.Bucket(bucketDelayedMsg)
 		oldV := b.Get(msgKey)
 		exists := oldV != nil
@@ -694,8 +613,11 @@ func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64
 				}
 			}
 			b = tx.Bucket(bucketDelayedMsgIndex)
-			newIndexKey := getDelayedMsgDBIndexKey(int(m.DelayedType), m.DelayedChannel, m.DelayedOrigID)
+			newIndexKey := getDelayedMsgDBIndexKeyOfMsg(m)
 			d := getDelayedMsgDBIndexValue(m.DelayedTs, m.DelayedOrigID)
+			if pubData.ScheduleID != "" {
+				d = getDelayedMsgDBIndexValue(m.DelayedTs, m.ID)
+			}
 			err = b.Put(newIndexKey, d)
 			if err != nil {
 				return err
@@ -770,7 +692,7 @@ func (q *DelayQueue) exit(deleted bool) error {
 
 	if deleted {
 		q.getStore().Close()
-		os.RemoveAll(path.Join(q.dataPath, getDelayQueueDBName(q.tname, q.partition)))
+		os.RemoveAll(getDelayedKVStorePath(q.getDBPath(), q.engine))
 		return q.backend.Delete()
 	}
 
@@ -820,7 +742,7 @@ func (q *DelayQueue) emptyDelayedUntil(dt int, peekTs int64, id MessageID, ch st
 	// to avoid too much in batch, we should empty at most 10000 at each tx
 	for {
 		batched := 0
-		err := db.Update(func(tx *bolt.Tx) error {
+		err := db.Update(func(tx delayedKVTx) error {
 			b := tx.Bucket(bucketDelayedMsg)
 			c := b.Cursor()
 			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
@@ -880,7 +802,7 @@ func (q *DelayQueue) emptyAllDelayedType(dt int, ch string) error {
 	defer q.compactMutex.Unlock()
 	for {
 		batched := 0
-		err := db.Update(func(tx *bolt.Tx) error {
+		err := db.Update(func(tx delayedKVTx) error {
 			b := tx.Bucket(bucketDelayedMsg)
 			c := b.Cursor()
 			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
@@ -969,7 +891,7 @@ func (q *DelayQueue) PeekRecentTimeoutWithFilter(results []Message, peekTs int64
 		}
 	}
 	oldest = int64(0)
-	err := db.View(func(tx *bolt.Tx) error {
+	err := db.View(func(tx delayedKVTx) error {
 		b := tx.Bucket(bucketDelayedMsg)
 		c := b.Cursor()
 		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
@@ -1046,7 +968,7 @@ func (q *DelayQueue) PeekAll(results []Message) (int, error) {
 
 func (q *DelayQueue) GetSyncedOffset() (BackendOffset, error) {
 	var synced BackendOffset
-	err := q.getStore().View(func(tx *bolt.Tx) error {
+	err := q.getStore().View(func(tx delayedKVTx) error {
 		b := tx.Bucket(bucketMeta)
 		v := b.Get(syncedOffsetKey)
 		offset, err := strconv.Atoi(string(v))
@@ -1064,7 +986,7 @@ func (q *DelayQueue) GetSyncedOffset() (BackendOffset, error) {
 
 func (q *DelayQueue) GetCurrentDelayedCnt(dt int, channel string) (uint64, error) {
 	cnt := uint64(0)
-	err := q.getStore().View(func(tx *bolt.Tx) error {
+	err := q.getStore().View(func(tx delayedKVTx) error {
 		b := tx.Bucket(bucketMeta)
 		cntKey := []byte("counter_" + string(getDelayedMsgDBPrefixKey(dt, channel)))
 		cntBytes := b.Get(cntKey)
@@ -1081,7 +1003,7 @@ func (q *DelayQueue) ConfirmedMessage(msg *Message) error {
 	// confirmed message is finished by channel, this message has swap the
 	// delayed id and original id to make sure the map key of inflight is original id
 	q.compactMutex.Lock()
-	err := q.getStore().Update(func(tx *bolt.Tx) error {
+	err := q.getStore().Update(func(tx delayedKVTx) error {
 		return deleteBucketKey(int(msg.DelayedType), msg.DelayedChannel,
 			msg.DelayedTs, msg.DelayedOrigID, tx, q.IsExt())
 	})
@@ -1097,7 +1019,7 @@ func (q *DelayQueue) ConfirmedMessage(msg *Message) error {
 func (q *DelayQueue) IsChannelMessageDelayed(msgID MessageID, ch string) bool {
 	found := false
 	msgKey := getDelayedMsgDBIndexKey(ChannelDelayed, ch, msgID)
-	q.getStore().View(func(tx *bolt.Tx) error {
+	q.getStore().View(func(tx delayedKVTx) error {
 		b := tx.Bucket(bucketDelayedMsgIndex)
 		v := b.Get(msgKey)
 		if v != nil {
@@ -1146,7 +1068,7 @@ func (q *DelayQueue) GetOldestConsumedState(chList []string, includeOthers bool)
 			nsqLog.LogDebugf("peek prefix %v: channel %v", prefix, origCh)
 		}
 
-		err := db.View(func(tx *bolt.Tx) error {
+		err := db.View(func(tx delayedKVTx) error {
 			b := tx.Bucket(bucketDelayedMsg)
 			c := b.Cursor()
 			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
@@ -1280,7 +1202,7 @@ func (q *DelayQueue) TryCleanOldData(retentionSize int64, noRealClean bool, maxC
 	if !noRealClean {
 		err := q.compactStore(false)
 		if err != nil {
-			nsqLog.Errorf("topic %v failed to compact the bolt db: %v", q.fullName, err)
+			nsqLog.Errorf("topic %v failed to compact the delayed db: %v", q.fullName, err)
 			return nil, err
 		}
 	}
@@ -1289,17 +1211,16 @@ func (q *DelayQueue) TryCleanOldData(retentionSize int64, noRealClean bool, maxC
 
 func (q *DelayQueue) compactStore(force bool) error {
 	src := q.getStore()
-	origPath := src.Path()
 	if !force {
-		fi, err := os.Stat(origPath)
+		size, err := src.Size()
 		if err != nil {
 			return err
 		}
-		if fi.Size() < int64(CompactThreshold) {
+		if size < int64(CompactThreshold) {
 			return nil
 		}
 		cnt := uint64(0)
-		err = src.View(func(tx *bolt.Tx) error {
+		err = src.View(func(tx delayedKVTx) error {
 			b := tx.Bucket(bucketMeta)
 			prefix := []byte("counter_")
 			c := b.Cursor()
@@ -1318,155 +1239,7 @@ func (q *DelayQueue) compactStore(force bool) error {
 			return nil
 		}
 	}
-	tmpPath := fmt.Sprintf("%s-tmp.compact.%d", src.Path(), time.Now().UnixNano())
-	// Open destination database.
-	ro := &bolt.Options{
-		Timeout:  time.Second,
-		ReadOnly: false,
-	}
-	dst, err := bolt.Open(tmpPath, 0644, ro)
-	if err != nil {
-		return err
-	}
-	dst.NoSync = true
-	nsqLog.Infof("db %v begin compact", origPath)
-	defer nsqLog.Infof("db %v end compact", origPath)
 	q.compactMutex.Lock()
 	defer q.compactMutex.Unlock()
-	err = compactBolt(dst, src, time.Second*2)
-	if err != nil {
-		nsqLog.Infof("db %v compact failed: %v", origPath, err)
-		return err
-	}
-
-	q.dbLock.Lock()
-	defer q.dbLock.Unlock()
-	q.kvStore.Close()
-	err = os.Rename(tmpPath, origPath)
-	openErr := q.reOpenStore()
-	if openErr != nil {
-		nsqLog.Errorf("db %v failed to reopen while compacted : %v", origPath, openErr)
-	}
-	if err != nil {
-		nsqLog.Infof("db %v failed to rename compacted db: %v", origPath, err)
-		return err
-	}
-	if openErr != nil {
-		return openErr
-	}
-	return nil
-}
-
-func compactBolt(dst, src *bolt.DB, maxCompactTime time.Duration) error {
-	startT := time.Now()
-	defer dst.Close()
-	// commit regularly, or we'll run out of memory for large datasets if using one transaction.
-	var size int64
-	tx, err := dst.Begin(true)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	if err := walkBolt(src, func(keys [][]byte, k, v []byte, seq uint64) error {
-		// On each key/value, check if we have exceeded tx size.
-		sz := int64(len(k) + len(v))
-		if size+sz > TxMaxSize && TxMaxSize != 0 {
-			// Commit previous transaction.
-			if err := tx.Commit(); err != nil {
-				return err
-			}
-
-			if time.Since(startT) >= maxCompactTime {
-				return errors.New("compact timeout")
-			}
-			// Start new transaction.
-			tx, err = dst.Begin(true)
-			if err != nil {
-				return err
-			}
-			size = 0
-		}
-		size += sz
-
-		// Create bucket on the root transaction if this is the first level.
-		nk := len(keys)
-		if nk == 0 {
-			bkt, err := tx.CreateBucketIfNotExists(k)
-			if err != nil {
-				return err
-			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
-			}
-			return nil
-		}
-
-		// Create buckets on subsequent levels, if necessary.
-		b := tx.Bucket(keys[0])
-		if nk > 1 {
-			for _, k := range keys[1:] {
-				b = b.Bucket(k)
-			}
-		}
-
-		// If there is no value then this is a bucket call.
-		if v == nil {
-			bkt, err := b.CreateBucketIfNotExists(k)
-			if err != nil {
-				return err
-			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
-			}
-			return nil
-		}
-
-		// Otherwise treat it as a key/value pair.
-		return b.Put(k, v)
-	}); err != nil {
-		return err
-	}
-
-	err = tx.Commit()
-	if err == nil {
-		dst.Sync()
-	}
-	return err
-}
-
-// walkFunc is the type of the function called for keys (buckets and "normal"
-// values) discovered by Walk. keys is the list of keys to descend to the bucket
-// owning the discovered key/value pair k/v.
-type walkFunc func(keys [][]byte, k, v []byte, seq uint64) error
-
-// walk walks recursively the bolt database db, calling walkFn for each key it finds.
-func walkBolt(db *bolt.DB, walkFn walkFunc) error {
-	return db.View(func(tx *bolt.Tx) error {
-		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
-			return walkBucket(b, nil, name, nil, b.Sequence(), walkFn)
-		})
-	})
-}
-
-func walkBucket(b *bolt.Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFunc) error {
-	// Execute callback.
-	if err := fn(keypath, k, v, seq); err != nil {
-		return err
-	}
-
-	// If this is not a bucket then stop.
-	if v != nil {
-		return nil
-	}
-
-	// Iterate over each child key/value.
-	keypath = append(keypath, k)
-	return b.ForEach(func(k, v []byte) error {
-		if v == nil {
-			bkt := b.Bucket(k)
-			return walkBucket(bkt, keypath, k, nil, bkt.Sequence(), fn)
-		}
-		return walkBucket(b, keypath, k, v, b.Sequence(), fn)
-	})
+	return src.Compact()
 }
@@ -0,0 +1,214 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The delayed messages of the channel can be paged by the operators in the order of the
+// deliver time, and the selected messages can be redelivered, deleted or delayed again.
+// The messages already peeked into the memory of the channel are skipped while changing,
+// since they are waiting delivery (or in flight) and will be confirmed by the client.
+// The changes are written to the delayed queue by the cluster, so the replicas will be the same.
+
+var (
+	ErrNoDelayedQueue = errors.New("no delayed queue on the topic")
+)
+
+// DelayedMsgFilter is used to select the delayed messages of the channel
+type DelayedMsgFilter struct {
+	// the range of the deliver time in unix nano, no limit for the end if 0
+	StartTs int64
+	EndTs   int64
+	// no limit for the max attempts if 0
+	MinAttempts uint16
+	MaxAttempts uint16
+	// the original message ids, all the messages are selected if empty
+	IDs map[MessageID]bool
+	// the filter for the ext header of the message
+	Ext        IExtFilter
+	ExtInverse bool
+}
+
+func (f *DelayedMsgFilter) match(m *Message) bool {
+	if m.Attempts < f.MinAttempts {
+		return false
+	}
+	if f.MaxAttempts > 0 && m.Attempts > f.MaxAttempts {
+		return false
+	}
+	if len(f.IDs) > 0 && !f.IDs[m.DelayedOrigID] {
+		return false
+	}
+	if f.Ext != nil && f.Ext.Match(m) == f.ExtInverse {
+		return false
+	}
+	return true
+}
+
+// DelayedMsgCursor is the position of the delayed messages of the channel to continue the paging.
+type DelayedMsgCursor struct {
+	Ts int64     `json:"ts"`
+	ID MessageID `json:"id"`
+}
+
+// ScanChannelDelayed return at most cnt messages of the channel matched the filter, begin from the
+// cursor (or the start of the filter if the cursor is nil), and the cursor for the next page which is
+// nil if no more messages. The returned message id is the id in the delayed queue and the original id
+// is the DelayedOrigID. At most txMaxBatch messages will be scanned in each call to avoid holding
+// the transaction too long.
+func (q *DelayQueue) ScanChannelDelayed(ch string, cursor *DelayedMsgCursor, filter *DelayedMsgFilter,
+	cnt int) ([]Message, *DelayedMsgCursor, error) {
+	if ch == "" {
+		return nil, nil, errors.New("channel name should be given")
+	}
+	if filter == nil {
+		filter = &DelayedMsgFilter{}
+	}
+	start := DelayedMsgCursor{Ts: filter.StartTs}
+	if cursor != nil && cursor.Ts >= start.Ts {
+		start = *cursor
+	}
+	prefix := getDelayedMsgDBPrefixKey(ChannelDelayed, ch)
+	results := make([]Message, 0, cnt)
+	var next *DelayedMsgCursor
+	err := q.getStore().View(func(tx delayedKVTx) error {
+		scanned := 0
+		c := tx.Bucket(bucketDelayedMsg).Cursor()
+		for k, v := c.Seek(getDelayedMsgDBKey(ChannelDelayed, ch, start.Ts, start.ID)); k != nil &&
+			bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			_, delayedTs, delayedID, delayedCh, err := decodeDelayedMsgDBKey(k)
+			if err != nil {
+				nsqLog.Infof("decode key failed : %v, %v", k, err)
+				continue
+			}
+			if delayedCh != ch {
+				continue
+			}
+			if filter.EndTs > 0 && delayedTs >= filter.EndTs {
+				break
+			}
+			if len(results) >= cnt || scanned >= txMaxBatch {
+				next = &DelayedMsgCursor{Ts: delayedTs, ID: delayedID}
+				break
+			}
+			scanned++
+			if v == nil {
+				continue
+			}
+			buf := make([]byte, len(v))
+			copy(buf, v)
+			m, err := DecodeDelayedMessage(buf, q.IsExt())
+			if err != nil {
+				nsqLog.LogErrorf("topic %v failed to decode delayed message: %v, %v, %v",
+					q.fullName, v, k, err)
+				continue
+			}
+			if filter.match(m) {
+				results = append(results, *m)
+			}
+		}
+		return nil
+	})
+	return results, next, err
+}
+
+// NewDelayedDeleteMessage return the record to delete the channel delayed message returned by
+// ScanChannelDelayed, the record is written to the delayed queue like the schedule cancel, so the
+// delete will be replicated to the replicas by the commit log.
+func NewDelayedDeleteMessage(m *Message) *Message {
+	d := NewMessage(0, nil)
+	d.DelayedType = PubDelayed
+	d.DelayedTs = time.Now().UnixNano()
+	d.DelayedData, _ = json.Marshal(&delayedPubData{Cancel: true,
+		Channel: m.DelayedChannel, Ts: m.DelayedTs, ID: m.ID})
+	return d
+}
+
+func (q *DelayQueue) isDelayedMessageExist(m *Message) bool {
+	found := false
+	q.getStore().View(func(tx delayedKVTx) error {
+		found = tx.Bucket(bucketDelayedMsg).Get(getDelayedMsgDBKey(int(m.DelayedType), m.DelayedChannel, m.DelayedTs, m.ID)) != nil
+		return nil
+	})
+	return found
+}
+
+func (c *Channel) isDelayedMsgInMemory(id MessageID) bool {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	if _, ok := c.inFlightMessages[id]; ok {
+		return true
+	}
+	if _, ok := c.waitingRequeueChanMsgs[id]; ok {
+		return true
+	}
+	_, ok := c.waitingRequeueMsgs[id]
+	return ok
+}
+
+// changeDelayedMessages apply the change to the delayed messages of the channel which are not in
+// memory, and return the number of the changed messages.
+func (c *Channel) changeDelayedMessages(msgs []Message, change func(dq *DelayQueue, m *Message) error) (int, error) {
+	dq := c.GetDelayedQueue()
+	if dq == nil {
+		return 0, ErrNoDelayedQueue
+	}
+	changed := 0
+	for i := range msgs {
+		m := &msgs[i]
+		if m.DelayedType != ChannelDelayed || m.DelayedChannel != c.GetName() {
+			continue
+		}
+		if c.isDelayedMsgInMemory(m.DelayedOrigID) {
+			nsqLog.Logf("channel %v delayed message %v skipped since waiting delivery in memory",
+				c.GetName(), m.DelayedOrigID)
+			continue
+		}
+		if !dq.isDelayedMessageExist(m) {
+			// already confirmed
+			continue
+		}
+		err := change(dq, m)
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// DeleteDelayedMessages delete the delayed messages of the channel returned by ScanChannelDelayed.
+// The delete record is written by the put func, so it can be replicated like the other delayed messages.
+func (c *Channel) DeleteDelayedMessages(msgs []Message, put func(*Message) error) (int, error) {
+	return c.changeDelayedMessages(msgs, func(dq *DelayQueue, m *Message) error {
+		err := put(NewDelayedDeleteMessage(m))
+		if err == nil {
+			nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "DELAY_QUEUE_DELETE", m.TraceID, m, "", 0)
+		}
+		return err
+	})
+}
+
+// RedelayDelayedMessages change the deliver time of the delayed messages of the channel returned by
+// ScanChannelDelayed. The new delayed message is written by the put func before the old one deleted
+// by the delete record, so both can be replicated like the other delayed messages.
+func (c *Channel) RedelayDelayedMessages(msgs []Message, deliverAt time.Time, put func(*Message) error) (int, error) {
+	ts := deliverAt.UnixNano()
+	return c.changeDelayedMessages(msgs, func(dq *DelayQueue, m *Message) error {
+		if m.DelayedTs == ts {
+			return nil
+		}
+		newMsg := m.GetCopy()
+		newMsg.ID = 0
+		newMsg.DelayedTs = ts
+		err := put(newMsg)
+		if err != nil {
+			return err
+		}
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "DELAY_QUEUE_REDELAY", m.TraceID, newMsg, "", 0)
+		return put(NewDelayedDeleteMessage(m))
+	})
+}
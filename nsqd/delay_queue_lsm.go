@@ -0,0 +1,1013 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/absolute8511/goskiplist/skiplist"
+)
+
+// lsmKVStore is the log structured merge kv store for the delayed queue. The writes are appended
+// to the write ahead log and the sorted memtable, the full memtable is flushed to the immutable
+// sorted table file, and the tables are merged into one while there are too many tables or
+// compacting. The deleted keys are kept as the tombstones until merged, so the heavy deletes of
+// the delayed messages are cheap.
+//
+// all the files are in the store directory:
+//	MANIFEST: the current table files and log file in json
+//	xxxxxx.log: the write ahead log, each transaction is [4 bytes length][4 bytes crc32][entries]
+//	xxxxxx.sst: the sorted table, [blocks][index][footer], each block is [entries][4 bytes crc32]
+//
+// the entry is [1 byte flag][4 bytes key length][key][4 bytes value length][value], and the key
+// is prefixed with the bucket name as [1 byte bucket length][bucket][key].
+
+const (
+	lsmManifestName   = "MANIFEST"
+	lsmBlockSize      = 4096
+	lsmTableMagic     = uint64(0x6e73716c736d7462)
+	lsmFooterSize     = 8 + 4 + 4 + 8
+	lsmEntryTombstone = byte(1)
+)
+
+var (
+	lsmMemTableSize = 4 * 1024 * 1024
+	lsmMaxTables    = 8
+)
+
+var (
+	errLSMStoreClosed = errors.New("lsm store closed")
+	errLSMTxReadOnly  = errors.New("lsm transaction is read only")
+	errLSMCorrupt     = errors.New("lsm store data corrupt")
+)
+
+type lsmManifest struct {
+	NextFile int64    `json:"next_file"`
+	Log      string   `json:"log"`
+	Tables   []string `json:"tables"`
+}
+
+type lsmEntry struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+func getLSMKey(bucket []byte, k []byte) []byte {
+	ik := make([]byte, 1+len(bucket)+len(k))
+	ik[0] = byte(len(bucket))
+	copy(ik[1:], bucket)
+	copy(ik[1+len(bucket):], k)
+	return ik
+}
+
+func splitLSMKey(ik []byte) ([]byte, []byte, error) {
+	if len(ik) < 1 || len(ik) < 1+int(ik[0]) {
+		return nil, nil, errLSMCorrupt
+	}
+	return ik[1 : 1+int(ik[0])], ik[1+int(ik[0]):], nil
+}
+
+func encodeLSMEntry(buf *bytes.Buffer, k []byte, v []byte, deleted bool) {
+	var tmp [4]byte
+	flag := byte(0)
+	if deleted {
+		flag = lsmEntryTombstone
+	}
+	buf.WriteByte(flag)
+	binary.BigEndian.PutUint32(tmp[:], uint32(len(k)))
+	buf.Write(tmp[:])
+	buf.Write(k)
+	binary.BigEndian.PutUint32(tmp[:], uint32(len(v)))
+	buf.Write(tmp[:])
+	buf.Write(v)
+}
+
+func decodeLSMEntries(data []byte) ([]lsmEntry, error) {
+	var entries []lsmEntry
+	for len(data) > 0 {
+		if len(data) < 1+4 {
+			return nil, errLSMCorrupt
+		}
+		var e lsmEntry
+		e.deleted = data[0] == lsmEntryTombstone
+		data = data[1:]
+		var kv [2][]byte
+		for i := range kv {
+			if len(data) < 4 {
+				return nil, errLSMCorrupt
+			}
+			l := int(binary.BigEndian.Uint32(data[:4]))
+			data = data[4:]
+			if l < 0 || len(data) < l {
+				return nil, errLSMCorrupt
+			}
+			kv[i] = data[:l:l]
+			data = data[l:]
+		}
+		e.key = kv[0]
+		e.value = kv[1]
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// lsmMemTable is the sorted entries in memory, the writes of the transaction are also buffered in
+// the memtable before committed.
+type lsmMemTable struct {
+	list *skiplist.SkipList
+	size int
+}
+
+func newLSMMemTable() *lsmMemTable {
+	return &lsmMemTable{list: skiplist.NewStringMap()}
+}
+
+func (m *lsmMemTable) put(e *lsmEntry) {
+	m.list.Set(string(e.key), e)
+	m.size += len(e.key) + len(e.value) + 32
+}
+
+func (m *lsmMemTable) get(ik []byte) *lsmEntry {
+	v, ok := m.list.Get(string(ik))
+	if !ok {
+		return nil
+	}
+	return v.(*lsmEntry)
+}
+
+// seek return the first entry with the key not less than the given key
+func (m *lsmMemTable) seek(ik []byte) *lsmEntry {
+	_, v, ok := m.list.GetGreaterOrEqual(string(ik))
+	if !ok {
+		return nil
+	}
+	return v.(*lsmEntry)
+}
+
+func (m *lsmMemTable) forEach(fn func(e *lsmEntry) error) error {
+	it := m.list.Iterator()
+	for it.Next() {
+		if err := fn(it.Value().(*lsmEntry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type lsmBlockHandle struct {
+	firstKey []byte
+	offset   int64
+	length   int
+}
+
+// lsmTable is the immutable sorted table file, only the index of the blocks is kept in memory.
+type lsmTable struct {
+	fileName string
+	f        *os.File
+	size     int64
+	index    []lsmBlockHandle
+}
+
+// writeLSMTable write the sorted entries added by fill to the table file, the nil table will be
+// returned if no entry added.
+func writeLSMTable(fileName string, fill func(add func(k []byte, v []byte, deleted bool) error) error) (*lsmTable, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	var offset int64
+	var block bytes.Buffer
+	var index bytes.Buffer
+	var blockFirst []byte
+	var tmp [8]byte
+	cnt := 0
+	finishBlock := func() error {
+		if block.Len() == 0 {
+			return nil
+		}
+		binary.BigEndian.PutUint32(tmp[:4], crc32.ChecksumIEEE(block.Bytes()))
+		block.Write(tmp[:4])
+		if _, err := w.Write(block.Bytes()); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(tmp[:4], uint32(len(blockFirst)))
+		index.Write(tmp[:4])
+		index.Write(blockFirst)
+		binary.BigEndian.PutUint64(tmp[:8], uint64(offset))
+		index.Write(tmp[:8])
+		binary.BigEndian.PutUint32(tmp[:4], uint32(block.Len()))
+		index.Write(tmp[:4])
+		offset += int64(block.Len())
+		block.Reset()
+		return nil
+	}
+	err = fill(func(k []byte, v []byte, deleted bool) error {
+		if block.Len() == 0 {
+			blockFirst = append(blockFirst[:0], k...)
+		}
+		encodeLSMEntry(&block, k, v, deleted)
+		cnt++
+		if block.Len() >= lsmBlockSize {
+			return finishBlock()
+		}
+		return nil
+	})
+	if err == nil {
+		err = finishBlock()
+	}
+	if err == nil {
+		var footer [lsmFooterSize]byte
+		binary.BigEndian.PutUint64(footer[:8], uint64(offset))
+		binary.BigEndian.PutUint32(footer[8:12], uint32(index.Len()))
+		binary.BigEndian.PutUint32(footer[12:16], crc32.ChecksumIEEE(index.Bytes()))
+		binary.BigEndian.PutUint64(footer[16:24], lsmTableMagic)
+		w.Write(index.Bytes())
+		w.Write(footer[:])
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil || cnt == 0 {
+		os.Remove(fileName)
+		return nil, err
+	}
+	return openLSMTable(fileName)
+}
+
+func openLSMTable(fileName string) (*lsmTable, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	t := &lsmTable{fileName: fileName, f: f}
+	err = t.loadIndex()
+	if err != nil {
+		f.Close()
+		nsqLog.LogErrorf("failed to load the lsm table %v: %v", fileName, err)
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *lsmTable) loadIndex() error {
+	fi, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = fi.Size()
+	if t.size < lsmFooterSize {
+		return errLSMCorrupt
+	}
+	var footer [lsmFooterSize]byte
+	if _, err := t.f.ReadAt(footer[:], t.size-lsmFooterSize); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(footer[16:24]) != lsmTableMagic {
+		return errLSMCorrupt
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer[:8]))
+	indexLen := int64(binary.BigEndian.Uint32(footer[8:12]))
+	if indexOffset < 0 || indexOffset+indexLen+lsmFooterSize != t.size {
+		return errLSMCorrupt
+	}
+	index := make([]byte, indexLen)
+	if _, err := t.f.ReadAt(index, indexOffset); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(index) != binary.BigEndian.Uint32(footer[12:16]) {
+		return errLSMCorrupt
+	}
+	for len(index) > 0 {
+		if len(index) < 4 {
+			return errLSMCorrupt
+		}
+		l := int(binary.BigEndian.Uint32(index[:4]))
+		if len(index) < 4+l+8+4 {
+			return errLSMCorrupt
+		}
+		var h lsmBlockHandle
+		h.firstKey = index[4 : 4+l]
+		h.offset = int64(binary.BigEndian.Uint64(index[4+l : 4+l+8]))
+		h.length = int(binary.BigEndian.Uint32(index[4+l+8 : 4+l+8+4]))
+		if h.length < 4 || h.offset+int64(h.length) > indexOffset {
+			return errLSMCorrupt
+		}
+		t.index = append(t.index, h)
+		index = index[4+l+8+4:]
+	}
+	return nil
+}
+
+func (t *lsmTable) readBlock(i int) ([]lsmEntry, error) {
+	h := t.index[i]
+	buf := make([]byte, h.length)
+	if _, err := t.f.ReadAt(buf, h.offset); err != nil {
+		return nil, err
+	}
+	data := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, errLSMCorrupt
+	}
+	return decodeLSMEntries(data)
+}
+
+// findBlock return the last block with the first key not greater than the key, -1 if
+// the key is less than all the keys in the table.
+func (t *lsmTable) findBlock(ik []byte) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return bytes.Compare(t.index[i].firstKey, ik) > 0
+	}) - 1
+}
+
+func (t *lsmTable) get(ik []byte) (*lsmEntry, error) {
+	b := t.findBlock(ik)
+	if b < 0 {
+		return nil, nil
+	}
+	entries, err := t.readBlock(b)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].key, ik) >= 0
+	})
+	if i < len(entries) && bytes.Equal(entries[i].key, ik) {
+		return &entries[i], nil
+	}
+	return nil, nil
+}
+
+func (t *lsmTable) close() error {
+	return t.f.Close()
+}
+
+type lsmTableIter struct {
+	t       *lsmTable
+	block   int
+	entries []lsmEntry
+	pos     int
+	err     error
+}
+
+func (it *lsmTableIter) load(b int) {
+	it.entries = nil
+	it.pos = 0
+	it.block = b
+	if b >= len(it.t.index) || it.err != nil {
+		return
+	}
+	it.entries, it.err = it.t.readBlock(b)
+	if it.err == nil && len(it.entries) == 0 {
+		it.err = errLSMCorrupt
+	}
+	if it.err != nil {
+		it.entries = nil
+	}
+}
+
+func (it *lsmTableIter) seek(ik []byte) {
+	b := it.t.findBlock(ik)
+	if b < 0 {
+		b = 0
+	}
+	it.load(b)
+	for it.entries != nil {
+		it.pos = sort.Search(len(it.entries), func(i int) bool {
+			return bytes.Compare(it.entries[i].key, ik) >= 0
+		})
+		if it.pos < len(it.entries) {
+			return
+		}
+		it.load(it.block + 1)
+	}
+}
+
+func (it *lsmTableIter) current() *lsmEntry {
+	if it.entries == nil {
+		return nil
+	}
+	return &it.entries[it.pos]
+}
+
+func (it *lsmTableIter) next() {
+	if it.entries == nil {
+		return
+	}
+	it.pos++
+	if it.pos >= len(it.entries) {
+		it.load(it.block + 1)
+	}
+}
+
+// lsmTx see the data in the writes of the transaction, the memtable and the tables from
+// the newest to the oldest.
+type lsmTx struct {
+	writes *lsmMemTable
+	mem    *lsmMemTable
+	// the oldest table first
+	tables []*lsmTable
+}
+
+func (tx *lsmTx) get(ik []byte) *lsmEntry {
+	if tx.writes != nil {
+		if e := tx.writes.get(ik); e != nil {
+			return e
+		}
+	}
+	if e := tx.mem.get(ik); e != nil {
+		return e
+	}
+	for i := len(tx.tables) - 1; i >= 0; i-- {
+		e, err := tx.tables[i].get(ik)
+		if err != nil {
+			nsqLog.LogErrorf("failed to read the lsm table %v: %v", tx.tables[i].fileName, err)
+			continue
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (tx *lsmTx) Bucket(name []byte) delayedKVBucket {
+	return &lsmBucket{tx: tx, prefix: getLSMKey(name, nil)}
+}
+
+type lsmBucket struct {
+	tx     *lsmTx
+	prefix []byte
+}
+
+func (b *lsmBucket) Get(k []byte) []byte {
+	e := b.tx.get(getLSMKey(b.prefix[1:], k))
+	if e == nil || e.deleted {
+		return nil
+	}
+	return e.value
+}
+
+func (b *lsmBucket) Put(k []byte, v []byte) error {
+	if b.tx.writes == nil {
+		return errLSMTxReadOnly
+	}
+	b.tx.writes.put(&lsmEntry{key: getLSMKey(b.prefix[1:], k), value: append([]byte{}, v...)})
+	return nil
+}
+
+func (b *lsmBucket) Delete(k []byte) error {
+	if b.tx.writes == nil {
+		return errLSMTxReadOnly
+	}
+	b.tx.writes.put(&lsmEntry{key: getLSMKey(b.prefix[1:], k), deleted: true})
+	return nil
+}
+
+func (b *lsmBucket) Cursor() delayedKVCursor {
+	return newLSMCursor(b.tx, b.prefix)
+}
+
+// lsmCursor merge the sorted data in the transaction, the memory data is searched again
+// for each step, so the writes while iterating is safe.
+type lsmCursor struct {
+	tx     *lsmTx
+	prefix []byte
+	// the newest table first
+	iters []*lsmTableIter
+	last  []byte
+	err   error
+}
+
+func newLSMCursor(tx *lsmTx, prefix []byte) *lsmCursor {
+	c := &lsmCursor{tx: tx, prefix: prefix}
+	for i := len(tx.tables) - 1; i >= 0; i-- {
+		c.iters = append(c.iters, &lsmTableIter{t: tx.tables[i]})
+	}
+	return c
+}
+
+func (c *lsmCursor) Seek(seek []byte) ([]byte, []byte) {
+	ik := make([]byte, 0, len(c.prefix)+len(seek))
+	ik = append(append(ik, c.prefix...), seek...)
+	for _, it := range c.iters {
+		it.seek(ik)
+	}
+	return c.find(ik)
+}
+
+func (c *lsmCursor) Next() ([]byte, []byte) {
+	if c.last == nil {
+		return nil, nil
+	}
+	// the next key of the last is the last followed by 0
+	from := make([]byte, len(c.last)+1)
+	copy(from, c.last)
+	return c.find(from)
+}
+
+// find the first not deleted entry with the key not less than from
+func (c *lsmCursor) find(from []byte) ([]byte, []byte) {
+	for {
+		var found *lsmEntry
+		choose := func(e *lsmEntry) {
+			// the newer is chosen first, so only replace with the less key
+			if e != nil && (found == nil || bytes.Compare(e.key, found.key) < 0) {
+				found = e
+			}
+		}
+		if c.tx.writes != nil {
+			choose(c.tx.writes.seek(from))
+		}
+		choose(c.tx.mem.seek(from))
+		for _, it := range c.iters {
+			for e := it.current(); e != nil && bytes.Compare(e.key, from) < 0; e = it.current() {
+				it.next()
+			}
+			if it.err != nil && c.err == nil {
+				c.err = it.err
+				nsqLog.LogErrorf("failed to read the lsm table %v: %v", it.t.fileName, it.err)
+			}
+			choose(it.current())
+		}
+		if found == nil || !bytes.HasPrefix(found.key, c.prefix) {
+			c.last = nil
+			return nil, nil
+		}
+		if found.deleted {
+			from = make([]byte, len(found.key)+1)
+			copy(from, found.key)
+			continue
+		}
+		c.last = found.key
+		return found.key[len(c.prefix):], found.value
+	}
+}
+
+type lsmKVStore struct {
+	sync.RWMutex
+	dir      string
+	readOnly bool
+	closed   bool
+	mem      *lsmMemTable
+	// the oldest table first
+	tables   []*lsmTable
+	log      *os.File
+	logName  string
+	logSize  int64
+	nextFile int64
+	// only one merge at the same time, and the tables will not be removed while backup
+	mergeMutex sync.Mutex
+	merging    int32
+}
+
+func openLSMDelayedKVStore(dir string, readOnly bool) (delayedKVStore, error) {
+	return openLSMKVStore(dir, readOnly)
+}
+
+func openLSMKVStore(dir string, readOnly bool) (*lsmKVStore, error) {
+	if readOnly {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &lsmKVStore{
+		dir:      dir,
+		readOnly: readOnly,
+		mem:      newLSMMemTable(),
+	}
+	var m lsmManifest
+	data, err := ioutil.ReadFile(path.Join(dir, lsmManifestName))
+	if err == nil {
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			nsqLog.LogErrorf("failed to decode the lsm manifest %v: %v", dir, err)
+			return nil, errLSMCorrupt
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.nextFile = m.NextFile
+	for _, name := range m.Tables {
+		t, err := openLSMTable(path.Join(dir, name))
+		if err != nil {
+			s.closeTables()
+			return nil, err
+		}
+		s.tables = append(s.tables, t)
+	}
+	if m.Log != "" {
+		err = s.replayLog(path.Join(dir, m.Log))
+		if err != nil {
+			s.closeTables()
+			return nil, err
+		}
+	}
+	if readOnly {
+		return s, nil
+	}
+	// remove the files left while crashed
+	used := map[string]bool{lsmManifestName: true, m.Log: true}
+	for _, name := range m.Tables {
+		used[name] = true
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if !used[fi.Name()] {
+			nsqLog.Infof("remove the unused lsm file %v in %v", fi.Name(), dir)
+			os.Remove(path.Join(dir, fi.Name()))
+		}
+	}
+	s.logName = m.Log
+	if s.logName == "" {
+		s.logName = s.newFileName(".log")
+		err = s.saveManifest(s.tables, s.logName)
+		if err != nil {
+			s.closeTables()
+			return nil, err
+		}
+	}
+	s.log, err = os.OpenFile(path.Join(dir, s.logName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	fi, err := s.log.Stat()
+	if err != nil {
+		s.log.Close()
+		s.closeTables()
+		return nil, err
+	}
+	s.logSize = fi.Size()
+	return s, nil
+}
+
+func (s *lsmKVStore) newFileName(ext string) string {
+	return fmt.Sprintf("%06d%s", atomic.AddInt64(&s.nextFile, 1), ext)
+}
+
+func (s *lsmKVStore) saveManifest(tables []*lsmTable, logName string) error {
+	m := lsmManifest{
+		NextFile: atomic.LoadInt64(&s.nextFile),
+		Log:      logName,
+	}
+	for _, t := range tables {
+		m.Tables = append(m.Tables, path.Base(t.fileName))
+	}
+	data, _ := json.Marshal(&m)
+	return writeFileAtomic(path.Join(s.dir, lsmManifestName), bytes.NewReader(data))
+}
+
+// replayLog read the committed transactions in the log to the memtable, the partial
+// transaction at the end of the log will be truncated.
+func (s *lsmKVStore) replayLog(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	pos := 0
+	for pos+8 <= len(data) {
+		l := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if l < 0 || pos+8+l > len(data) {
+			break
+		}
+		payload := data[pos+8 : pos+8+l]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[pos+4:pos+8]) {
+			break
+		}
+		entries, err := decodeLSMEntries(payload)
+		if err != nil {
+			break
+		}
+		for i := range entries {
+			s.mem.put(&entries[i])
+		}
+		pos += 8 + l
+	}
+	if pos < len(data) {
+		nsqLog.LogWarningf("lsm log %v has the partial data at %v, total %v", fileName, pos, len(data))
+		if !s.readOnly {
+			return os.Truncate(fileName, int64(pos))
+		}
+	}
+	return nil
+}
+
+func (s *lsmKVStore) closeTables() {
+	for _, t := range s.tables {
+		t.close()
+	}
+}
+
+func (s *lsmKVStore) View(fn func(tx delayedKVTx) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return errLSMStoreClosed
+	}
+	return fn(&lsmTx{mem: s.mem, tables: s.tables})
+}
+
+func (s *lsmKVStore) Update(fn func(tx delayedKVTx) error) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return errLSMStoreClosed
+	}
+	if s.readOnly {
+		s.Unlock()
+		return errLSMTxReadOnly
+	}
+	tx := &lsmTx{writes: newLSMMemTable(), mem: s.mem, tables: s.tables}
+	err := fn(tx)
+	if err == nil {
+		err = s.commit(tx.writes)
+	}
+	needMerge := len(s.tables) >= lsmMaxTables
+	s.Unlock()
+	if needMerge && atomic.CompareAndSwapInt32(&s.merging, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&s.merging, 0)
+			err := s.mergeTables(false)
+			if err != nil && err != errLSMStoreClosed {
+				nsqLog.LogWarningf("failed to merge the lsm tables in %v: %v", s.dir, err)
+			}
+		}()
+	}
+	return err
+}
+
+func (s *lsmKVStore) commit(writes *lsmMemTable) error {
+	if writes.list.Len() == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	writes.forEach(func(e *lsmEntry) error {
+		encodeLSMEntry(&buf, e.key, e.value, e.deleted)
+		return nil
+	})
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[:4], uint32(len(data)-8))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(data[8:]))
+	n, err := s.log.Write(data)
+	if err != nil {
+		// remove the partial write, so the later writes can be replayed
+		s.log.Truncate(s.logSize)
+		return err
+	}
+	s.logSize += int64(n)
+	writes.forEach(func(e *lsmEntry) error {
+		s.mem.put(e)
+		return nil
+	})
+	if s.mem.size >= lsmMemTableSize {
+		// the data is safe in the log even if failed
+		err = s.flushMemTable()
+		if err != nil {
+			nsqLog.LogWarningf("failed to flush the lsm memtable in %v: %v", s.dir, err)
+		}
+	}
+	return nil
+}
+
+// flushMemTable write the memtable to the new table and switch to the new log, should be
+// called with lock.
+func (s *lsmKVStore) flushMemTable() error {
+	if s.mem.list.Len() == 0 {
+		return nil
+	}
+	// the tombstones are useless if no older tables
+	dropDeleted := len(s.tables) == 0
+	t, err := writeLSMTable(path.Join(s.dir, s.newFileName(".sst")), func(add func(k []byte, v []byte, deleted bool) error) error {
+		return s.mem.forEach(func(e *lsmEntry) error {
+			if dropDeleted && e.deleted {
+				return nil
+			}
+			return add(e.key, e.value, e.deleted)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	tables := append([]*lsmTable{}, s.tables...)
+	if t != nil {
+		tables = append(tables, t)
+	}
+	logName := s.newFileName(".log")
+	log, err := os.OpenFile(path.Join(s.dir, logName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err == nil {
+		err = s.saveManifest(tables, logName)
+		if err != nil {
+			log.Close()
+			os.Remove(path.Join(s.dir, logName))
+		}
+	}
+	if err != nil {
+		if t != nil {
+			t.close()
+			os.Remove(t.fileName)
+		}
+		return err
+	}
+	s.log.Close()
+	os.Remove(path.Join(s.dir, s.logName))
+	s.log = log
+	s.logName = logName
+	s.logSize = 0
+	s.tables = tables
+	s.mem = newLSMMemTable()
+	return nil
+}
+
+// mergeTables merge all the tables into one table without the tombstones, the tables flushed
+// while merging will be kept.
+func (s *lsmKVStore) mergeTables(force bool) error {
+	s.mergeMutex.Lock()
+	defer s.mergeMutex.Unlock()
+	s.RLock()
+	if s.closed {
+		s.RUnlock()
+		return errLSMStoreClosed
+	}
+	tables := append([]*lsmTable{}, s.tables...)
+	fileName := path.Join(s.dir, s.newFileName(".sst"))
+	s.RUnlock()
+	if len(tables) == 0 || (len(tables) == 1 && !force) {
+		return nil
+	}
+	c := newLSMCursor(&lsmTx{mem: newLSMMemTable(), tables: tables}, nil)
+	t, err := writeLSMTable(fileName, func(add func(k []byte, v []byte, deleted bool) error) error {
+		for k, v := c.Seek(nil); k != nil; k, v = c.Next() {
+			if err := add(k, v, false); err != nil {
+				return err
+			}
+		}
+		return c.err
+	})
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	var merged []*lsmTable
+	if t != nil {
+		merged = append(merged, t)
+	}
+	merged = append(merged, s.tables[len(tables):]...)
+	if !s.closed {
+		err = s.saveManifest(merged, s.logName)
+	} else {
+		err = errLSMStoreClosed
+	}
+	if err != nil {
+		s.Unlock()
+		if t != nil {
+			t.close()
+			os.Remove(t.fileName)
+		}
+		return err
+	}
+	s.tables = merged
+	s.Unlock()
+	for _, old := range tables {
+		old.close()
+		os.Remove(old.fileName)
+	}
+	return nil
+}
+
+func (s *lsmKVStore) Sync() error {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return errLSMStoreClosed
+	}
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Sync()
+}
+
+func (s *lsmKVStore) Close() error {
+	s.mergeMutex.Lock()
+	defer s.mergeMutex.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.log != nil {
+		err = s.log.Sync()
+		s.log.Close()
+	}
+	s.closeTables()
+	return err
+}
+
+func (s *lsmKVStore) Path() string {
+	return s.dir
+}
+
+func (s *lsmKVStore) Size() (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	size := s.logSize
+	for _, t := range s.tables {
+		size += t.size
+	}
+	return size, nil
+}
+
+func (s *lsmKVStore) CheckConsistence() error {
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tables {
+		for i := range t.index {
+			if _, err := t.readBlock(i); err != nil {
+				nsqLog.LogErrorf("lsm table %v block %v check failed: %v", t.fileName, i, err)
+				return errLSMCorrupt
+			}
+		}
+	}
+	return nil
+}
+
+// BackupTo write the engine independent dump of the data, the memtable is flushed first so the
+// writes will not be blocked while dumping the tables.
+func (s *lsmKVStore) BackupTo(w io.Writer) (int64, error) {
+	s.mergeMutex.Lock()
+	defer s.mergeMutex.Unlock()
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return 0, errLSMStoreClosed
+	}
+	// the read only store has no writes, so the memtable can be dumped directly
+	var err error
+	tx := &lsmTx{mem: s.mem}
+	if !s.readOnly {
+		err = s.flushMemTable()
+		tx.mem = newLSMMemTable()
+	}
+	tx.tables = append([]*lsmTable{}, s.tables...)
+	s.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	total, err := writeDelayedKVDumpHeader(w)
+	if err != nil {
+		return total, err
+	}
+	c := newLSMCursor(tx, nil)
+	for k, v := c.Seek(nil); k != nil; k, v = c.Next() {
+		bucket, key, err := splitLSMKey(k)
+		if err != nil {
+			return total, err
+		}
+		n, err := writeDelayedKVDumpRecord(w, bucket, key, v)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	if c.err != nil {
+		return total, c.err
+	}
+	n, err := writeDelayedKVDumpEnd(w)
+	return total + n, err
+}
+
+func (s *lsmKVStore) Compact() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return errLSMStoreClosed
+	}
+	err := s.flushMemTable()
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.mergeTables(true)
+}
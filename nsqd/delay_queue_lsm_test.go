@@ -0,0 +1,307 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func lsmTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%08d", i))
+}
+
+func checkDelayedKVStoreData(t *testing.T, store delayedKVStore, bucket []byte, expected map[string]string) {
+	keys := make([]string, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var got []string
+	err := store.View(func(tx delayedKVTx) error {
+		b := tx.Bucket(bucket)
+		for _, k := range keys {
+			test.Equal(t, expected[k], string(b.Get([]byte(k))))
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(nil); k != nil; k, v = c.Next() {
+			got = append(got, string(k))
+			test.Equal(t, expected[string(k)], string(v))
+		}
+		return nil
+	})
+	test.Nil(t, err)
+	test.Equal(t, len(keys), len(got))
+	for i := range keys {
+		test.Equal(t, keys[i], got[i])
+	}
+}
+
+func TestLSMKVStoreReadWrite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-lsm-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	oldMemSize := lsmMemTableSize
+	lsmMemTableSize = 1024 * 16
+	defer func() {
+		lsmMemTableSize = oldMemSize
+	}()
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	SetLogger(opts.Logger)
+
+	dir := path.Join(tmpDir, "test.lsm")
+	store, err := openLSMKVStore(dir, false)
+	test.Nil(t, err)
+	expected := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		err = store.Update(func(tx delayedKVTx) error {
+			k := lsmTestKey(i)
+			v := fmt.Sprintf("value-%v", i)
+			expected[string(k)] = v
+			err := tx.Bucket(bucketDelayedMsg).Put(k, []byte(v))
+			if err != nil {
+				return err
+			}
+			// the write should be seen in the transaction
+			test.Equal(t, v, string(tx.Bucket(bucketDelayedMsg).Get(k)))
+			test.Nil(t, tx.Bucket(bucketMeta).Get(k))
+			return tx.Bucket(bucketMeta).Put([]byte("synced_offset"), []byte(v))
+		})
+		test.Nil(t, err)
+	}
+	test.Equal(t, true, len(store.tables) > 0)
+	checkDelayedKVStoreData(t, store, bucketDelayedMsg, expected)
+
+	// delete while iterating
+	err = store.Update(func(tx delayedKVTx) error {
+		b := tx.Bucket(bucketDelayedMsg)
+		c := b.Cursor()
+		prefix := []byte("key-000001")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			delete(expected, string(k))
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	test.Nil(t, err)
+	test.Equal(t, 1900, len(expected))
+	checkDelayedKVStoreData(t, store, bucketDelayedMsg, expected)
+
+	// the failed transaction should be discarded
+	err = store.Update(func(tx delayedKVTx) error {
+		tx.Bucket(bucketDelayedMsg).Delete(lsmTestKey(1))
+		return errBucketKeyNotFound
+	})
+	test.Equal(t, errBucketKeyNotFound, err)
+	err = store.View(func(tx delayedKVTx) error {
+		return tx.Bucket(bucketDelayedMsg).Put(lsmTestKey(1), nil)
+	})
+	test.Equal(t, errLSMTxReadOnly, err)
+	checkDelayedKVStoreData(t, store, bucketDelayedMsg, expected)
+	checkDelayedKVStoreData(t, store, bucketMeta, map[string]string{"synced_offset": "value-1999"})
+
+	test.Nil(t, store.Close())
+	store, err = openLSMKVStore(dir, false)
+	test.Nil(t, err)
+	checkDelayedKVStoreData(t, store, bucketDelayedMsg, expected)
+	test.Nil(t, store.CheckConsistence())
+
+	sizeBefore, _ := store.Size()
+	err = store.Update(func(tx delayedKVTx) error {
+		for k := range expected {
+			if err := tx.Bucket(bucketDelayedMsg).Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	test.Nil(t, err)
+	expected = make(map[string]string)
+	checkDelayedKVStoreData(t, store, bucketDelayedMsg, expected)
+	test.Nil(t, store.Compact())
+	test.Equal(t, 1, len(store.tables))
+	sizeAfter, _ := store.Size()
+	t.Logf("size before %v, after %v", sizeBefore, sizeAfter)
+	test.Equal(t, true, sizeAfter < sizeBefore)
+	checkDelayedKVStoreData(t, store, bucketDelayedMsg, expected)
+	checkDelayedKVStoreData(t, store, bucketMeta, map[string]string{"synced_offset": "value-1999"})
+	test.Nil(t, store.Close())
+
+	store, err = openLSMKVStore(dir, true)
+	test.Nil(t, err)
+	checkDelayedKVStoreData(t, store, bucketMeta, map[string]string{"synced_offset": "value-1999"})
+	test.Equal(t, errLSMTxReadOnly, store.Update(func(tx delayedKVTx) error { return nil }))
+	store.Close()
+}
+
+func TestLSMKVStoreRandomOps(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-lsm-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	oldMemSize := lsmMemTableSize
+	oldMaxTables := lsmMaxTables
+	lsmMemTableSize = 1024 * 4
+	lsmMaxTables = 3
+	defer func() {
+		lsmMemTableSize = oldMemSize
+		lsmMaxTables = oldMaxTables
+	}()
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	SetLogger(opts.Logger)
+
+	dir := path.Join(tmpDir, "test.lsm")
+	store, err := openLSMKVStore(dir, false)
+	test.Nil(t, err)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	expected := make(map[string]string)
+	for round := 0; round < 30; round++ {
+		for i := 0; i < 100; i++ {
+			err = store.Update(func(tx delayedKVTx) error {
+				b := tx.Bucket(bucketDelayedMsgIndex)
+				for j := r.Intn(10); j >= 0; j-- {
+					k := lsmTestKey(r.Intn(1000))
+					if r.Intn(3) == 0 {
+						delete(expected, string(k))
+						if err := b.Delete(k); err != nil {
+							return err
+						}
+					} else {
+						v := fmt.Sprintf("v-%v-%v", round, r.Int())
+						expected[string(k)] = v
+						if err := b.Put(k, []byte(v)); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+			test.Nil(t, err)
+		}
+		checkDelayedKVStoreData(t, store, bucketDelayedMsgIndex, expected)
+		switch r.Intn(3) {
+		case 0:
+			test.Nil(t, store.Close())
+			store, err = openLSMKVStore(dir, false)
+			test.Nil(t, err)
+		case 1:
+			test.Nil(t, store.Compact())
+		}
+		checkDelayedKVStoreData(t, store, bucketDelayedMsgIndex, expected)
+		checkDelayedKVStoreData(t, store, bucketDelayedMsg, nil)
+	}
+	test.Nil(t, store.CheckConsistence())
+	store.Close()
+}
+
+func TestLSMKVStorePartialLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-lsm-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	SetLogger(opts.Logger)
+
+	dir := path.Join(tmpDir, "test.lsm")
+	store, err := openLSMKVStore(dir, false)
+	test.Nil(t, err)
+	expected := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		err = store.Update(func(tx delayedKVTx) error {
+			expected[string(lsmTestKey(i))] = "v"
+			return tx.Bucket(bucketMeta).Put(lsmTestKey(i), []byte("v"))
+		})
+		test.Nil(t, err)
+	}
+	logName := path.Join(dir, store.logName)
+	test.Nil(t, store.Close())
+	fi, err := os.Stat(logName)
+	test.Nil(t, err)
+	// the partial transaction while crashed
+	f, err := os.OpenFile(logName, os.O_WRONLY|os.O_APPEND, 0644)
+	test.Nil(t, err)
+	f.Write([]byte{0, 0, 0, 100, 1, 2})
+	f.Close()
+
+	store, err = openLSMKVStore(dir, false)
+	test.Nil(t, err)
+	fi2, err := os.Stat(logName)
+	test.Nil(t, err)
+	test.Equal(t, fi.Size(), fi2.Size())
+	checkDelayedKVStoreData(t, store, bucketMeta, expected)
+	err = store.Update(func(tx delayedKVTx) error {
+		expected[string(lsmTestKey(10))] = "v"
+		return tx.Bucket(bucketMeta).Put(lsmTestKey(10), []byte("v"))
+	})
+	test.Nil(t, err)
+	test.Nil(t, store.Close())
+	store, err = openLSMKVStore(dir, false)
+	test.Nil(t, err)
+	checkDelayedKVStoreData(t, store, bucketMeta, expected)
+	store.Close()
+}
+
+func TestDelayedKVStoreBackupAcrossEngines(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-lsm-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	SetLogger(opts.Logger)
+
+	expected := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		expected[string(lsmTestKey(i))] = fmt.Sprintf("value-%v", i)
+	}
+	engines := []string{DelayQueueEngineBolt, DelayQueueEngineLSM}
+	for _, from := range engines {
+		for _, to := range engines {
+			dbPath := path.Join(tmpDir, from+"-"+to)
+			src, err := openDelayedKVStore(from, getDelayedKVStorePath(dbPath, from), false)
+			test.Nil(t, err)
+			w := newDelayedKVBatchWriter(src)
+			for k, v := range expected {
+				test.Nil(t, w.put(bucketDelayedMsg, []byte(k), []byte(v)))
+			}
+			test.Nil(t, w.flush())
+			var buf bytes.Buffer
+			n, err := src.BackupTo(&buf)
+			test.Nil(t, err)
+			test.Equal(t, int64(buf.Len()), n)
+			test.Nil(t, src.Close())
+
+			restorePath := path.Join(tmpDir, "restored-"+from+"-"+to)
+			err = restoreDelayedKVStore(to, restorePath, &buf)
+			test.Nil(t, err)
+			dst, err := openDelayedKVStore(to, restorePath, false)
+			test.Nil(t, err)
+			checkDelayedKVStoreData(t, dst, bucketDelayedMsg, expected)
+			test.Nil(t, dst.Close())
+
+			// migrate while opened with the other engine
+			engine, store, err := resolveDelayedKVStore(dbPath, to, false)
+			test.Nil(t, err)
+			test.Equal(t, to, engine)
+			test.Equal(t, getDelayedKVStorePath(dbPath, to), store.Path())
+			checkDelayedKVStoreData(t, store, bucketDelayedMsg, expected)
+			test.Nil(t, store.Close())
+			if from != to {
+				_, err = os.Stat(getDelayedKVStorePath(dbPath, from))
+				test.Equal(t, true, os.IsNotExist(err))
+			}
+		}
+	}
+	_, _, err = resolveDelayedKVStore(path.Join(tmpDir, "unknown"), "unknown", false)
+	test.Equal(t, ErrUnknownDelayQueueEngine, err)
+}
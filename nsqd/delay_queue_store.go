@@ -0,0 +1,708 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absolute8511/bolt"
+)
+
+// the kv storage engines for the delayed queue. The engine can be changed for each
+// nsqd node, the old data will be migrated to the new engine while the delayed queue opened,
+// and the replica will import the data from the leader with different engine while restoring.
+const (
+	// the embedded bolt db, the default engine
+	DelayQueueEngineBolt = "bolt"
+	// the log structured merge store, better for the heavy write and delete
+	DelayQueueEngineLSM = "lsm"
+)
+
+var (
+	ErrUnknownDelayQueueEngine = errors.New("unknown delayed queue storage engine")
+	errInvalidDelayedKVDump    = errors.New("invalid delayed queue kv dump data")
+)
+
+// the header of the engine independent dump, the first 8 bytes of the bolt backup is
+// the db size which is never so large.
+var delayedKVDumpMagic = []byte{0xff, 'D', 'L', 'Y', 'K', 'V', 0, 1}
+
+// all the buckets used by the delayed queue, the buckets will be created while opened.
+var delayedKVBuckets = [][]byte{bucketDelayedMsg, bucketDelayedMsgIndex, bucketMeta}
+
+// delayedKVStore is the kv storage of the delayed queue, the keys in the buckets should be
+// iterated in order.
+type delayedKVStore interface {
+	View(fn func(tx delayedKVTx) error) error
+	Update(fn func(tx delayedKVTx) error) error
+	Sync() error
+	Close() error
+	// the file or the directory of the store
+	Path() string
+	Size() (int64, error)
+	CheckConsistence() error
+	// write all the data to the writer in the format which can be restored by
+	// restoreDelayedKVStore, return the written bytes.
+	BackupTo(w io.Writer) (int64, error)
+	// reclaim the space of the deleted data, the writes should be stopped by the caller.
+	Compact() error
+}
+
+type delayedKVTx interface {
+	Bucket(name []byte) delayedKVBucket
+}
+
+// the returned data is only valid in the transaction.
+type delayedKVBucket interface {
+	Get(k []byte) []byte
+	Put(k []byte, v []byte) error
+	Delete(k []byte) error
+	Cursor() delayedKVCursor
+}
+
+type delayedKVCursor interface {
+	Seek(seek []byte) ([]byte, []byte)
+	Next() ([]byte, []byte)
+}
+
+type delayedKVStoreFactory func(fileName string, readOnly bool) (delayedKVStore, error)
+
+type delayedKVEngine struct {
+	// appended to the db name of the delayed queue, so the data of different engines will not conflict
+	suffix string
+	open   delayedKVStoreFactory
+}
+
+var delayedKVEngines = make(map[string]delayedKVEngine)
+
+// registerDelayedKVEngine should be called in init, the registry is not protected by lock.
+func registerDelayedKVEngine(name string, suffix string, open delayedKVStoreFactory) {
+	delayedKVEngines[name] = delayedKVEngine{suffix: suffix, open: open}
+}
+
+func IsValidDelayQueueEngine(name string) bool {
+	_, ok := delayedKVEngines[name]
+	return ok
+}
+
+func init() {
+	registerDelayedKVEngine(DelayQueueEngineBolt, "", openBoltDelayedKVStore)
+	registerDelayedKVEngine(DelayQueueEngineLSM, ".lsm", openLSMDelayedKVStore)
+}
+
+func openDelayedKVStore(engine string, fileName string, readOnly bool) (delayedKVStore, error) {
+	e, ok := delayedKVEngines[engine]
+	if !ok {
+		return nil, ErrUnknownDelayQueueEngine
+	}
+	return e.open(fileName, readOnly)
+}
+
+func getDelayedKVStorePath(dbPath string, engine string) string {
+	return dbPath + delayedKVEngines[engine].suffix
+}
+
+func isPathExist(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// resolveDelayedKVStore open the kv store with the configured engine, the data in the other
+// engine will be migrated to the configured engine.
+func resolveDelayedKVStore(dbPath string, engine string, readOnly bool) (string, delayedKVStore, error) {
+	if engine == "" {
+		engine = DelayQueueEngineBolt
+	}
+	if !IsValidDelayQueueEngine(engine) {
+		return "", nil, ErrUnknownDelayQueueEngine
+	}
+	var olds []string
+	for name := range delayedKVEngines {
+		if name != engine && isPathExist(getDelayedKVStorePath(dbPath, name)) {
+			olds = append(olds, name)
+		}
+	}
+	if len(olds) > 0 && isPathExist(getDelayedKVStorePath(dbPath, engine)) {
+		// the migration is done since the renaming is the last step
+		for _, name := range olds {
+			if !readOnly {
+				nsqLog.LogWarningf("remove the migrated delayed queue data %v", getDelayedKVStorePath(dbPath, name))
+				os.RemoveAll(getDelayedKVStorePath(dbPath, name))
+			}
+		}
+		olds = nil
+	}
+	if len(olds) > 1 {
+		return "", nil, fmt.Errorf("delayed queue data found in more than one engine: %v", olds)
+	}
+	if len(olds) == 1 {
+		if readOnly {
+			engine = olds[0]
+		} else {
+			err := migrateDelayedKVStore(dbPath, olds[0], engine)
+			if err != nil {
+				nsqLog.LogErrorf("failed to migrate delayed queue %v from %v to %v, keep using the old engine: %v",
+					dbPath, olds[0], engine, err)
+				engine = olds[0]
+			}
+		}
+	}
+	store, err := openDelayedKVStore(engine, getDelayedKVStorePath(dbPath, engine), readOnly)
+	return engine, store, err
+}
+
+func migrateDelayedKVStore(dbPath string, from string, to string) error {
+	srcPath := getDelayedKVStorePath(dbPath, from)
+	dstPath := getDelayedKVStorePath(dbPath, to)
+	nsqLog.Infof("begin migrate the delayed queue %v from %v to %v", dbPath, from, to)
+	src, err := openDelayedKVStore(from, srcPath, false)
+	if err != nil {
+		return err
+	}
+	tmpPath := dstPath + "-tmp.migrate"
+	err = copyToNewDelayedKVStore(to, tmpPath, src)
+	src.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, dstPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	os.RemoveAll(srcPath)
+	nsqLog.Infof("finished migrate the delayed queue %v from %v to %v", dbPath, from, to)
+	return nil
+}
+
+// copyToNewDelayedKVStore create the new store at the path and copy all the data from the src store
+func copyToNewDelayedKVStore(engine string, fileName string, src delayedKVStore) error {
+	os.RemoveAll(fileName)
+	dst, err := openDelayedKVStore(engine, fileName, false)
+	if err != nil {
+		return err
+	}
+	err = copyDelayedKVStore(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		os.RemoveAll(fileName)
+	}
+	return err
+}
+
+func copyDelayedKVStore(dst delayedKVStore, src delayedKVStore) error {
+	w := newDelayedKVBatchWriter(dst)
+	err := src.View(func(tx delayedKVTx) error {
+		for _, name := range delayedKVBuckets {
+			b := tx.Bucket(name)
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			for k, v := c.Seek(nil); k != nil; k, v = c.Next() {
+				if v == nil {
+					continue
+				}
+				if err := w.put(name, k, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+type delayedKVRecord struct {
+	bucket []byte
+	key    []byte
+	value  []byte
+}
+
+// delayedKVBatchWriter write the data to the store in batches to avoid the large transaction
+type delayedKVBatchWriter struct {
+	store delayedKVStore
+	batch []delayedKVRecord
+	size  int
+}
+
+func newDelayedKVBatchWriter(store delayedKVStore) *delayedKVBatchWriter {
+	return &delayedKVBatchWriter{store: store}
+}
+
+func (w *delayedKVBatchWriter) put(bucket []byte, k []byte, v []byte) error {
+	rec := delayedKVRecord{bucket: bucket}
+	rec.key = append([]byte(nil), k...)
+	rec.value = append([]byte(nil), v...)
+	w.batch = append(w.batch, rec)
+	w.size += len(k) + len(v)
+	if w.size >= TxMaxSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *delayedKVBatchWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	err := w.store.Update(func(tx delayedKVTx) error {
+		for _, rec := range w.batch {
+			if err := tx.Bucket(rec.bucket).Put(rec.key, rec.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	w.batch = w.batch[:0]
+	w.size = 0
+	return err
+}
+
+// the engine independent dump is the magic header followed by the records, each record is
+// [1 byte bucket length][bucket][4 bytes key length][key][4 bytes value length][value],
+// and ended with the zero bucket length.
+func writeDelayedKVDumpHeader(w io.Writer) (int64, error) {
+	n, err := w.Write(delayedKVDumpMagic)
+	return int64(n), err
+}
+
+func writeDelayedKVDumpRecord(w io.Writer, bucket []byte, k []byte, v []byte) (int64, error) {
+	buf := make([]byte, 1+len(bucket)+4+len(k)+4+len(v))
+	buf[0] = byte(len(bucket))
+	pos := 1
+	pos += copy(buf[pos:], bucket)
+	binary.BigEndian.PutUint32(buf[pos:pos+4], uint32(len(k)))
+	pos += 4
+	pos += copy(buf[pos:], k)
+	binary.BigEndian.PutUint32(buf[pos:pos+4], uint32(len(v)))
+	pos += 4
+	copy(buf[pos:], v)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func writeDelayedKVDumpEnd(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte{0})
+	return int64(n), err
+}
+
+func isDelayedKVDumpHeader(header []byte) bool {
+	return bytes.Equal(header, delayedKVDumpMagic)
+}
+
+// importDelayedKVDump read the records after the header from the dump
+func importDelayedKVDump(r io.Reader, dst delayedKVStore) error {
+	w := newDelayedKVBatchWriter(dst)
+	lenBuf := make([]byte, 4)
+	var bucketLen [1]byte
+	for {
+		if _, err := io.ReadFull(r, bucketLen[:]); err != nil {
+			return err
+		}
+		if bucketLen[0] == 0 {
+			break
+		}
+		bucket := make([]byte, int(bucketLen[0]))
+		if _, err := io.ReadFull(r, bucket); err != nil {
+			return err
+		}
+		var kv [2][]byte
+		for i := range kv {
+			if _, err := io.ReadFull(r, lenBuf); err != nil {
+				return err
+			}
+			l := binary.BigEndian.Uint32(lenBuf)
+			if l > uint32(MAX_POSSIBLE_MSG_SIZE) {
+				return errInvalidDelayedKVDump
+			}
+			kv[i] = make([]byte, l)
+			if _, err := io.ReadFull(r, kv[i]); err != nil {
+				return err
+			}
+		}
+		if err := w.put(bucket, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return w.flush()
+}
+
+// restoreDelayedKVStore create the new store from the backup of any engine at the path.
+func restoreDelayedKVStore(engine string, fileName string, body io.Reader) error {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(body, header)
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(fileName)
+	if isDelayedKVDumpHeader(header) {
+		dst, err := openDelayedKVStore(engine, fileName, false)
+		if err != nil {
+			return err
+		}
+		err = importDelayedKVDump(body, dst)
+		if err == nil {
+			err = dst.Sync()
+		}
+		dst.Close()
+		if err != nil {
+			os.RemoveAll(fileName)
+		}
+		return err
+	}
+	// the raw bolt db file
+	bodyLen := int64(binary.BigEndian.Uint64(header))
+	boltPath := fileName
+	if engine != DelayQueueEngineBolt {
+		boltPath = fileName + ".bolt"
+	}
+	err = os.Remove(boltPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(boltPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, body, bodyLen)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil || engine == DelayQueueEngineBolt {
+		return err
+	}
+	defer os.Remove(boltPath)
+	src, err := openBoltDelayedKVStore(boltPath, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copyToNewDelayedKVStore(engine, fileName, src)
+}
+
+// boltDelayedKVStore is the delayed kv store on bolt db, the db will be reopened while compacting.
+type boltDelayedKVStore struct {
+	sync.RWMutex
+	fileName string
+	readOnly bool
+	db       *bolt.DB
+}
+
+func openBoltDB(fileName string, readOnly bool) (*bolt.DB, error) {
+	ro := &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: readOnly,
+	}
+	db, err := bolt.Open(fileName, 0644, ro)
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = true
+	if readOnly {
+		return db, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range delayedKVBuckets {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func openBoltDelayedKVStore(fileName string, readOnly bool) (delayedKVStore, error) {
+	db, err := openBoltDB(fileName, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &boltDelayedKVStore{fileName: fileName, readOnly: readOnly, db: db}, nil
+}
+
+type boltDelayedKVTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltDelayedKVTx) Bucket(name []byte) delayedKVBucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return &boltDelayedKVBucket{b: b}
+}
+
+type boltDelayedKVBucket struct {
+	b *bolt.Bucket
+}
+
+func (b *boltDelayedKVBucket) Get(k []byte) []byte {
+	return b.b.Get(k)
+}
+
+func (b *boltDelayedKVBucket) Put(k []byte, v []byte) error {
+	return b.b.Put(k, v)
+}
+
+func (b *boltDelayedKVBucket) Delete(k []byte) error {
+	return b.b.Delete(k)
+}
+
+func (b *boltDelayedKVBucket) Cursor() delayedKVCursor {
+	return b.b.Cursor()
+}
+
+func (s *boltDelayedKVStore) View(fn func(tx delayedKVTx) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltDelayedKVTx{tx: tx})
+	})
+}
+
+func (s *boltDelayedKVStore) Update(fn func(tx delayedKVTx) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltDelayedKVTx{tx: tx})
+	})
+}
+
+func (s *boltDelayedKVStore) Sync() error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.db.Sync()
+}
+
+func (s *boltDelayedKVStore) Close() error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.db.Close()
+}
+
+func (s *boltDelayedKVStore) Path() string {
+	return s.fileName
+}
+
+func (s *boltDelayedKVStore) Size() (int64, error) {
+	totalSize := int64(0)
+	err := s.View(func(tx delayedKVTx) error {
+		totalSize = tx.(*boltDelayedKVTx).tx.Size()
+		return nil
+	})
+	return totalSize, err
+}
+
+func (s *boltDelayedKVStore) CheckConsistence() error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.db.View(func(tx *bolt.Tx) error {
+		var count int
+		for err := range tx.Check() {
+			nsqLog.LogErrorf("db %v check failed: %v ", s.fileName, err)
+			if err != nil && strings.Contains(err.Error(), "unreachable unfreed") {
+				continue
+			}
+			count++
+		}
+		if count > 0 {
+			nsqLog.LogErrorf("db %v check failed, %d errors found ", s.fileName, count)
+			return errors.New("boltdb file corrupt")
+		}
+		return nil
+	})
+}
+
+// BackupTo write the raw bolt db file after the db size, so the backup can be
+// restored by the old version.
+func (s *boltDelayedKVStore) BackupTo(w io.Writer) (int64, error) {
+	totalSize := int64(0)
+	s.RLock()
+	defer s.RUnlock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(tx.Size()))
+		_, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		totalSize = tx.Size() + 8
+		_, err = tx.WriteTo(w)
+		return err
+	})
+	return totalSize, err
+}
+
+func (s *boltDelayedKVStore) Compact() error {
+	origPath := s.fileName
+	tmpPath := fmt.Sprintf("%s-tmp.compact.%d", origPath, time.Now().UnixNano())
+	// Open destination database.
+	ro := &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: false,
+	}
+	dst, err := bolt.Open(tmpPath, 0644, ro)
+	if err != nil {
+		return err
+	}
+	dst.NoSync = true
+	nsqLog.Infof("db %v begin compact", origPath)
+	defer nsqLog.Infof("db %v end compact", origPath)
+	s.RLock()
+	err = compactBolt(dst, s.db, time.Second*2)
+	s.RUnlock()
+	if err != nil {
+		nsqLog.Infof("db %v compact failed: %v", origPath, err)
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.db.Close()
+	err = os.Rename(tmpPath, origPath)
+	db, openErr := openBoltDB(origPath, s.readOnly)
+	if openErr != nil {
+		nsqLog.Errorf("db %v failed to reopen while compacted : %v", origPath, openErr)
+		return openErr
+	}
+	s.db = db
+	if err != nil {
+		nsqLog.Infof("db %v failed to rename compacted db: %v", origPath, err)
+		return err
+	}
+	return nil
+}
+
+func compactBolt(dst, src *bolt.DB, maxCompactTime time.Duration) error {
+	startT := time.Now()
+	defer dst.Close()
+	// commit regularly, or we'll run out of memory for large datasets if using one transaction.
+	var size int64
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := walkBolt(src, func(keys [][]byte, k, v []byte, seq uint64) error {
+		// On each key/value, check if we have exceeded tx size.
+		sz := int64(len(k) + len(v))
+		if size+sz > TxMaxSize && TxMaxSize != 0 {
+			// Commit previous transaction.
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+
+			if time.Since(startT) >= maxCompactTime {
+				return errors.New("compact timeout")
+			}
+			// Start new transaction.
+			tx, err = dst.Begin(true)
+			if err != nil {
+				return err
+			}
+			size = 0
+		}
+		size += sz
+
+		// Create bucket on the root transaction if this is the first level.
+		nk := len(keys)
+		if nk == 0 {
+			bkt, err := tx.CreateBucketIfNotExists(k)
+			if err != nil {
+				return err
+			}
+			if err := bkt.SetSequence(seq); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		// Create buckets on subsequent levels, if necessary.
+		b := tx.Bucket(keys[0])
+		if nk > 1 {
+			for _, k := range keys[1:] {
+				b = b.Bucket(k)
+			}
+		}
+
+		// If there is no value then this is a bucket call.
+		if v == nil {
+			bkt, err := b.CreateBucketIfNotExists(k)
+			if err != nil {
+				return err
+			}
+			if err := bkt.SetSequence(seq); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		// Otherwise treat it as a key/value pair.
+		return b.Put(k, v)
+	}); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		dst.Sync()
+	}
+	return err
+}
+
+// walkFunc is the type of the function called for keys (buckets and "normal"
+// values) discovered by Walk. keys is the list of keys to descend to the bucket
+// owning the discovered key/value pair k/v.
+type walkFunc func(keys [][]byte, k, v []byte, seq uint64) error
+
+// walk walks recursively the bolt database db, calling walkFn for each key it finds.
+func walkBolt(db *bolt.DB, walkFn walkFunc) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return walkBucket(b, nil, name, nil, b.Sequence(), walkFn)
+		})
+	})
+}
+
+func walkBucket(b *bolt.Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFunc) error {
+	// Execute callback.
+	if err := fn(keypath, k, v, seq); err != nil {
+		return err
+	}
+
+	// If this is not a bucket then stop.
+	if v != nil {
+		return nil
+	}
+
+	// Iterate over each child key/value.
+	keypath = append(keypath, k)
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			bkt := b.Bucket(k)
+			return walkBucket(bkt, keypath, k, nil, bkt.Sequence(), fn)
+		}
+		return walkBucket(b, keypath, k, v, b.Sequence(), fn)
+	})
+}
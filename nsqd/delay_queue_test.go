@@ -502,6 +502,98 @@ func TestDelayQueueConfirmMsg(t *testing.T) {
 
 }
 
+func TestDelayQueueScheduledMessage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-delay-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+
+	dq, err := NewDelayQueue("test", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	defer dq.Close()
+	replica, err := NewDelayQueue("test", 1, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	defer replica.Close()
+
+	put := func(msg *Message) {
+		_, offset, rawSize, _, err := dq.PutDelayMessage(msg)
+		test.Nil(t, err)
+		_, err = replica.PutMessageOnReplica(msg, offset, int64(rawSize))
+		test.Nil(t, err)
+	}
+	deliverAt := time.Now().Add(time.Hour)
+	msg := NewMessage(0, []byte("body1"))
+	msg.SetSchedule(deliverAt, "s1")
+	put(msg)
+	msg = NewMessage(0, []byte("body2"))
+	msg.SetSchedule(deliverAt, "s2")
+	put(msg)
+	msg = NewMessage(0, []byte("body3"))
+	msg.SetSchedule(deliverAt, "")
+	put(msg)
+	for _, q := range []*DelayQueue{dq, replica} {
+		cnt, _ := q.GetCurrentDelayedCnt(PubDelayed, "")
+		test.Equal(t, uint64(3), cnt)
+		m, err := q.GetScheduledMessage("s1")
+		test.Nil(t, err)
+		test.Equal(t, []byte("body1"), m.Body)
+		test.Equal(t, "s1", m.GetScheduleID())
+	}
+
+	// reschedule will replace the old one
+	m, _ := dq.GetScheduledMessage("s1")
+	newMsg := m.GetCopy()
+	newMsg.ID = 0
+	newMsg.SetSchedule(time.Now().Add(-time.Second), "s1")
+	put(newMsg)
+	// cancel s2
+	put(NewScheduleCancelMessage("s2"))
+	for _, q := range []*DelayQueue{dq, replica} {
+		cnt, _ := q.GetCurrentDelayedCnt(PubDelayed, "")
+		test.Equal(t, uint64(2), cnt)
+		m, err := q.GetScheduledMessage("s1")
+		test.Nil(t, err)
+		test.Equal(t, newMsg.DelayedTs, m.DelayedTs)
+		_, err = q.GetScheduledMessage("s2")
+		test.Equal(t, ErrScheduleNotFound, err)
+	}
+
+	ret := make([]Message, 10)
+	n, err := dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+	test.Equal(t, []byte("body1"), ret[0].Body)
+	ret[0].DelayedOrigID = ret[0].ID
+	test.Nil(t, dq.ConfirmedMessage(&ret[0]))
+	_, err = dq.GetScheduledMessage("s1")
+	test.Equal(t, ErrScheduleNotFound, err)
+	cnt, _ := dq.GetCurrentDelayedCnt(PubDelayed, "")
+	test.Equal(t, uint64(1), cnt)
+}
+
+func TestGetScheduleHeader(t *testing.T) {
+	deliverAt, sid, err := GetScheduleHeader(ext.JSON_HEADER_EXT_VER,
+		[]byte(`{"##deliver_at":"1600000000000","##schedule_id":"order-1"}`))
+	test.Nil(t, err)
+	test.Equal(t, int64(1600000000000), deliverAt)
+	test.Equal(t, "order-1", sid)
+	deliverAt, _, err = GetScheduleHeader(ext.JSON_HEADER_EXT_VER, []byte(`{"##deliver_at":1600000000000}`))
+	test.Nil(t, err)
+	test.Equal(t, int64(1600000000000), deliverAt)
+	deliverAt, _, err = GetScheduleHeader(ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`))
+	test.Nil(t, err)
+	test.Equal(t, int64(0), deliverAt)
+	_, _, err = GetScheduleHeader(ext.JSON_HEADER_EXT_VER, []byte(`{"##deliver_at":"abc"}`))
+	test.Equal(t, ErrInvalidDeliverAt, err)
+	_, _, err = GetScheduleHeader(ext.JSON_HEADER_EXT_VER, []byte(`{"##deliver_at":"1","##schedule_id":"a b"}`))
+	test.Equal(t, ErrInvalidScheduleID, err)
+}
+
 func TestDelayQueueBackupRestore(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-delay-%d", time.Now().UnixNano()))
 	if err != nil {
@@ -683,3 +775,233 @@ func TestDelayQueueCompactStore(t *testing.T) {
 		time.Sleep(time.Millisecond)
 	}
 }
+
+func TestDelayQueueLSMEngine(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-delay-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	SetLogger(opts.Logger)
+
+	// the bolt data should be migrated to lsm
+	dq, err := NewDelayQueue("test-lsm", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	test.Equal(t, DelayQueueEngineBolt, dq.GetKVEngine())
+	cnt := 10
+	for i := 0; i < cnt; i++ {
+		msg := NewMessage(0, []byte("body"))
+		msg.DelayedType = ChannelDelayed
+		msg.DelayedTs = time.Now().Add(time.Millisecond).UnixNano()
+		msg.DelayedChannel = "test"
+		msg.DelayedOrigID = MessageID(i + 1)
+		_, _, _, _, err := dq.PutDelayMessage(msg)
+		test.Nil(t, err)
+	}
+	var boltBackup bytes.Buffer
+	_, err = dq.BackupKVStoreTo(&boltBackup)
+	test.Nil(t, err)
+	dq.Close()
+
+	opts.DelayQueueEngine = DelayQueueEngineLSM
+	dq, err = NewDelayQueue("test-lsm", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	defer dq.Close()
+	test.Equal(t, DelayQueueEngineLSM, dq.GetKVEngine())
+	test.Nil(t, dq.CheckConsistence())
+	newCnt, _ := dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt, int(newCnt))
+	synced, err := dq.GetSyncedOffset()
+	test.Nil(t, err)
+	test.Equal(t, dq.backend.GetQueueWriteEnd().Offset(), synced)
+
+	ret := make([]Message, cnt)
+	n, err := dq.PeekRecentChannelTimeout(time.Now().UnixNano(), ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, cnt, n)
+	for _, m := range ret[:n/2] {
+		origID := m.DelayedOrigID
+		test.Equal(t, true, dq.IsChannelMessageDelayed(origID, "test"))
+		m.DelayedOrigID = m.ID
+		test.Nil(t, dq.ConfirmedMessage(&m))
+		test.Equal(t, false, dq.IsChannelMessageDelayed(origID, "test"))
+	}
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt-n/2, int(newCnt))
+	test.Nil(t, dq.compactStore(true))
+	n, err = dq.PeekRecentChannelTimeout(time.Now().UnixNano(), ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, cnt-cnt/2, n)
+
+	var lsmBackup bytes.Buffer
+	_, err = dq.BackupKVStoreTo(&lsmBackup)
+	test.Nil(t, err)
+	// the bolt backup from the old leader can be restored to lsm
+	err = dq.RestoreKVStoreFrom(&boltBackup)
+	test.Nil(t, err)
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt, int(newCnt))
+	err = dq.RestoreKVStoreFrom(&lsmBackup)
+	test.Nil(t, err)
+	newCnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "test")
+	test.Equal(t, cnt-cnt/2, int(newCnt))
+	n, err = dq.PeekRecentChannelTimeout(time.Now().UnixNano(), ret, "test")
+	test.Nil(t, err)
+	test.Equal(t, cnt-cnt/2, n)
+}
+
+func TestChannelDelayedInspect(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(fmt.Sprintf("test_delayed_inspect%v", time.Now().Unix()), 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+	channel := topic.GetChannel("ch")
+	dq, err := topic.GetOrCreateDelayedQueueNoLock(nil)
+	test.Nil(t, err)
+	test.Equal(t, dq, channel.GetDelayedQueue())
+
+	// all the changes are written as the delayed messages, so the replica can apply the same
+	type writtenMsg struct {
+		m      *Message
+		offset BackendOffset
+		size   int32
+	}
+	var written []writtenMsg
+	put := func(m *Message) error {
+		_, offset, size, _, err := dq.PutDelayMessage(m)
+		written = append(written, writtenMsg{m.GetCopy(), offset, size})
+		return err
+	}
+	base := time.Now().Add(time.Hour)
+	for i := 0; i < 20; i++ {
+		region := "east"
+		if i%2 == 1 {
+			region = "west"
+		}
+		msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(`{"region":"`+region+`"}`))
+		msg.DelayedType = ChannelDelayed
+		msg.DelayedTs = base.Add(time.Duration(i) * time.Second).UnixNano()
+		msg.DelayedChannel = "ch"
+		msg.DelayedOrigID = MessageID(i + 1)
+		msg.Attempts = uint16(i%3 + 1)
+		test.Nil(t, put(msg))
+	}
+	_, _, err = dq.ScanChannelDelayed("", nil, nil, 10)
+	test.NotNil(t, err)
+
+	// paging all the messages in order of the deliver time
+	var cursor *DelayedMsgCursor
+	var all []Message
+	for {
+		msgs, next, err := dq.ScanChannelDelayed("ch", cursor, nil, 6)
+		test.Nil(t, err)
+		all = append(all, msgs...)
+		if next == nil {
+			break
+		}
+		test.Equal(t, 6, len(msgs))
+		cursor = next
+	}
+	test.Equal(t, 20, len(all))
+	for i, m := range all {
+		test.Equal(t, MessageID(i+1), m.DelayedOrigID)
+		test.Equal(t, "ch", m.DelayedChannel)
+	}
+
+	extFilter, err := NewExtFilter(ExtFilterData{Type: 1, FilterExtKey: "region", FilterData: "east"})
+	test.Nil(t, err)
+	filter := &DelayedMsgFilter{
+		StartTs:     base.Add(time.Second * 2).UnixNano(),
+		EndTs:       base.Add(time.Second * 12).UnixNano(),
+		MinAttempts: 2,
+		Ext:         extFilter,
+	}
+	msgs, next, err := dq.ScanChannelDelayed("ch", nil, filter, 10)
+	test.Nil(t, err)
+	test.Nil(t, next)
+	// the index 2 to 11, even and attempts >= 2
+	var ids []MessageID
+	for _, m := range msgs {
+		ids = append(ids, m.DelayedOrigID)
+	}
+	test.Equal(t, []MessageID{3, 5, 9, 11}, ids)
+	filter.ExtInverse = true
+	filter.MaxAttempts = 2
+	msgs, _, err = dq.ScanChannelDelayed("ch", nil, filter, 10)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(msgs))
+	test.Equal(t, MessageID(8), msgs[0].DelayedOrigID)
+
+	selectIDs := func(ids ...MessageID) []Message {
+		f := &DelayedMsgFilter{IDs: make(map[MessageID]bool)}
+		for _, id := range ids {
+			f.IDs[id] = true
+		}
+		msgs, _, err := dq.ScanChannelDelayed("ch", nil, f, 10)
+		test.Nil(t, err)
+		return msgs
+	}
+	// redeliver immediately
+	now := time.Now()
+	changed, err := channel.RedelayDelayedMessages(selectIDs(1, 2), now, put)
+	test.Nil(t, err)
+	test.Equal(t, 24, len(written))
+	test.Equal(t, 2, changed)
+	cnt, _ := dq.GetCurrentDelayedCnt(ChannelDelayed, "ch")
+	test.Equal(t, uint64(20), cnt)
+	msgs = selectIDs(1, 2)
+	test.Equal(t, 2, len(msgs))
+	for _, m := range msgs {
+		test.Equal(t, now.UnixNano(), m.DelayedTs)
+		test.Equal(t, true, dq.IsChannelMessageDelayed(m.DelayedOrigID, "ch"))
+	}
+
+	// the message waiting delivery in memory should be skipped
+	channel.inFlightMutex.Lock()
+	channel.waitingRequeueMsgs[MessageID(4)] = &Message{ID: 4}
+	channel.inFlightMutex.Unlock()
+	changed, err = channel.DeleteDelayedMessages(selectIDs(3, 4), put)
+	test.Nil(t, err)
+	test.Equal(t, 1, changed)
+	test.Equal(t, 25, len(written))
+	cnt, _ = dq.GetCurrentDelayedCnt(ChannelDelayed, "ch")
+	test.Equal(t, uint64(19), cnt)
+	test.Equal(t, false, dq.IsChannelMessageDelayed(3, "ch"))
+	test.Equal(t, true, dq.IsChannelMessageDelayed(4, "ch"))
+	channel.inFlightMutex.Lock()
+	delete(channel.waitingRequeueMsgs, MessageID(4))
+	channel.inFlightMutex.Unlock()
+
+	// the replica should be the same after applying all the written messages
+	replicaDir, err := ioutil.TempDir("", "delayed-inspect-replica")
+	test.Nil(t, err)
+	defer os.RemoveAll(replicaDir)
+	replica, err := NewDelayQueue(topic.GetTopicName(), 0, replicaDir, opts, nil, true)
+	test.Nil(t, err)
+	defer replica.Close()
+	for _, w := range written {
+		_, err := replica.PutMessageOnReplica(w.m, w.offset, int64(w.size))
+		test.Nil(t, err)
+	}
+	cnt, _ = replica.GetCurrentDelayedCnt(ChannelDelayed, "ch")
+	test.Equal(t, uint64(19), cnt)
+	test.Equal(t, false, replica.IsChannelMessageDelayed(3, "ch"))
+	leaderAll, _, err := dq.ScanChannelDelayed("ch", nil, nil, 100)
+	test.Nil(t, err)
+	replicaAll, _, err := replica.ScanChannelDelayed("ch", nil, nil, 100)
+	test.Nil(t, err)
+	test.Equal(t, 19, len(replicaAll))
+	for i := range leaderAll {
+		test.Equal(t, leaderAll[i].ID, replicaAll[i].ID)
+		test.Equal(t, leaderAll[i].DelayedTs, replicaAll[i].DelayedTs)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/youzan/nsq/internal/levellogger"
 )
@@ -25,15 +27,27 @@ type DiskQueueSnapshot struct {
 	exitFlag int32
 
 	readFile *os.File
-	reader   *bufio.Reader
+	reader   segmentReader
+	// the mapping of the sealed segment being read if mmap read enabled
+	readMmap *segmentMmap
+	mmapRead int32
+	// the segments before the queue start can be read from archive if set
+	archive *segmentArchive
+	// the records will be read from the record store instead of the segment files if set
+	records recordStore
+	// the max size of the decompressed data
+	maxMsgSize int32
+	// the messages of the last batch record read
+	batchCache recordBatchCache
 }
 
 // newDiskQueue instantiates a new instance of DiskQueueSnapshot, retrieving metadata
 // from the filesystem and starting the read ahead goroutine
 func NewDiskQueueSnapshot(readFrom string, dataPath string, endInfo BackendQueueEnd) *DiskQueueSnapshot {
 	d := DiskQueueSnapshot{
-		readFrom: readFrom,
-		dataPath: dataPath,
+		readFrom:   readFrom,
+		dataPath:   dataPath,
+		maxMsgSize: MAX_POSSIBLE_MSG_SIZE,
 	}
 
 	d.UpdateQueueEnd(endInfo)
@@ -41,6 +55,55 @@ func NewDiskQueueSnapshot(readFrom string, dataPath string, endInfo BackendQueue
 	return &d
 }
 
+// segmentReader is the sequential reader of the opened segment
+type segmentReader interface {
+	io.Reader
+	Discard(n int) (int, error)
+}
+
+// SetMmapReadEnabled allow the sealed segments to be read through mmap
+func (d *DiskQueueSnapshot) SetMmapReadEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.mmapRead, 1)
+	} else {
+		atomic.StoreInt32(&d.mmapRead, 0)
+	}
+}
+
+// readRawRecordAt read the record at the position of the current segment without moving the reader
+func (d *DiskQueueSnapshot) readRawRecordAt(pos int64) ([]byte, error) {
+	if d.readMmap != nil {
+		return readRawRecordAt(d.readMmap.readAt, pos)
+	}
+	return readRawRecordAt(d.readFile.ReadAt, pos)
+}
+
+func (d *DiskQueueSnapshot) closeReadFile() {
+	d.batchCache.reset()
+	if d.readMmap != nil {
+		d.readMmap.close()
+		d.readMmap = nil
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+}
+
+// newSegmentReader create the reader for the opened segment, the sealed segment
+// will be mapped if mmap read enabled.
+func (d *DiskQueueSnapshot) newSegmentReader() segmentReader {
+	if atomic.LoadInt32(&d.mmapRead) == 1 && d.readPos.EndOffset.FileNum < d.endPos.EndOffset.FileNum {
+		m, err := newSegmentMmap(d.readFile)
+		if err == nil {
+			d.readMmap = m
+			return &mmapSegmentReader{m: m, pos: d.readPos.EndOffset.Pos}
+		}
+		nsqLog.LogDebugf("DISKQUEUE snapshot(%s): mmap segment %v failed: %v", d.readFrom, d.readPos, err)
+	}
+	return bufio.NewReader(d.readFile)
+}
+
 func (d *DiskQueueSnapshot) getCurrentFileEnd(offset diskQueueOffset) (int64, error) {
 	curFileName := d.fileName(offset.FileNum)
 	f, err := os.Stat(curFileName)
@@ -68,6 +131,14 @@ func (d *DiskQueueSnapshot) SetQueueStart(start BackendQueueEnd) {
 	}
 }
 
+// SetArchiver allow seeking to the position before the queue start, the
+// archived segments will be fetched on demand.
+func (d *DiskQueueSnapshot) SetArchiver(archiver SegmentArchiver) {
+	d.Lock()
+	d.archive = newSegmentArchive(archiver, d.readFrom, d.dataPath)
+	d.Unlock()
+}
+
 func (d *DiskQueueSnapshot) GetQueueReadStart() BackendQueueEnd {
 	d.Lock()
 	defer d.Unlock()
@@ -102,10 +173,7 @@ func (d *DiskQueueSnapshot) exit() error {
 	d.Lock()
 
 	d.exitFlag = 1
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 	d.Unlock()
 	return nil
 }
@@ -137,15 +205,15 @@ func (d *DiskQueueSnapshot) stepOffset(allowBackward bool, cur diskQueueEndInfo,
 func (d *DiskQueueSnapshot) SkipToNext() error {
 	d.Lock()
 	defer d.Unlock()
+	if d.records != nil {
+		return d.recordSkipToNext()
+	}
 	if d.readPos.EndOffset.FileNum >= d.endPos.EndOffset.FileNum {
 		return ErrReadEndOfQueue
 	}
 
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
-	_, _, endPos, err := getQueueFileOffsetMeta(d.fileName(d.readPos.EndOffset.FileNum))
+	d.closeReadFile()
+	_, _, endPos, err := d.getSegmentOffsetMeta(d.readPos.EndOffset.FileNum)
 	if err != nil {
 		return err
 	}
@@ -167,10 +235,10 @@ func (d *DiskQueueSnapshot) SeekTo(voffset BackendOffset) error {
 func (d *DiskQueueSnapshot) seekTo(voffset BackendOffset, allowBackward bool) error {
 	d.Lock()
 	defer d.Unlock()
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+	if d.records != nil {
+		return d.recordSeekTo(voffset, allowBackward)
 	}
+	d.closeReadFile()
 	var err error
 	newPos := d.endPos.EndOffset
 	if voffset > d.endPos.virtualEnd {
@@ -180,11 +248,29 @@ func (d *DiskQueueSnapshot) seekTo(voffset BackendOffset, allowBackward bool) er
 		newPos = d.endPos.EndOffset
 	} else {
 		if voffset < d.queueStart.Offset() {
-			nsqLog.LogWarningf("seek error : seek queue position cleaned : %v, %v", voffset, d.queueStart)
-			return ErrReadQueueAlreadyCleaned
+			if d.archive == nil {
+				nsqLog.LogWarningf("seek error : seek queue position cleaned : %v, %v", voffset, d.queueStart)
+				return ErrReadQueueAlreadyCleaned
+			}
+			if !allowBackward && voffset < d.readPos.virtualEnd {
+				return fmt.Errorf("can not step backward")
+			}
+			newPos, err = d.locateArchived(voffset)
+			if err != nil {
+				nsqLog.LogWarningf("seek error : seek archived position %v failed: %v, current start: %v", voffset, err, d.queueStart)
+				return err
+			}
+			d.readPos.EndOffset = newPos
+			d.readPos.virtualEnd = voffset
+			return nil
 		}
 
-		newPos, err = d.stepOffset(allowBackward, d.readPos, int64(voffset-d.readPos.virtualEnd), d.endPos)
+		cur := d.readPos
+		if cur.EndOffset.FileNum < d.queueStart.EndOffset.FileNum {
+			// reading the archived segments, step from the queue start
+			cur = d.queueStart
+		}
+		newPos, err = d.stepOffset(allowBackward, cur, int64(voffset-cur.virtualEnd), d.endPos)
 		if err != nil {
 			nsqLog.LogErrorf("internal skip error : %v, step from %v to : %v, current start: %v", err, d.readPos, voffset, d.queueStart)
 			return err
@@ -200,10 +286,7 @@ func (d *DiskQueueSnapshot) seekTo(voffset BackendOffset, allowBackward bool) er
 
 func (d *DiskQueueSnapshot) SeekToEnd() error {
 	d.Lock()
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 
 	d.readPos = d.endPos
 	d.Unlock()
@@ -213,6 +296,9 @@ func (d *DiskQueueSnapshot) SeekToEnd() error {
 func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 	d.Lock()
 	defer d.Unlock()
+	if d.records != nil {
+		return d.recordReadRaw(size)
+	}
 
 	result := make([]byte, size)
 	readOffset := int32(0)
@@ -223,7 +309,11 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 
 	CheckFileOpen:
 		if d.readFile == nil {
-			curFileName := d.fileName(d.readPos.EndOffset.FileNum)
+			var curFileName string
+			curFileName, err = d.segmentFileName(d.readPos.EndOffset.FileNum)
+			if err != nil {
+				return result, err
+			}
 			d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
 			if err != nil {
 				return result, err
@@ -232,12 +322,11 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 			if d.readPos.EndOffset.Pos > 0 {
 				_, err = d.readFile.Seek(d.readPos.EndOffset.Pos, 0)
 				if err != nil {
-					d.readFile.Close()
-					d.readFile = nil
+					d.closeReadFile()
 					return result, err
 				}
 			}
-			d.reader = bufio.NewReader(d.readFile)
+			d.reader = d.newSegmentReader()
 		}
 		stat, err = d.readFile.Stat()
 		if err != nil {
@@ -249,8 +338,7 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 				d.readPos.EndOffset.Pos = 0
 				nsqLog.Logf("DISKQUEUE snapshot(%s): readRaw() read end, try next: %v",
 					d.readFrom, d.readPos)
-				d.readFile.Close()
-				d.readFile = nil
+				d.closeReadFile()
 				goto CheckFileOpen
 			}
 		}
@@ -265,8 +353,7 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 		}
 		_, err = io.ReadFull(d.reader, result[readOffset:int64(readOffset)+currentRead])
 		if err != nil {
-			d.readFile.Close()
-			d.readFile = nil
+			d.closeReadFile()
 			return result, err
 		}
 
@@ -284,10 +371,7 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 			isEnd = d.readPos.EndOffset.Pos >= stat.Size()
 		}
 		if isEnd {
-			if d.readFile != nil {
-				d.readFile.Close()
-				d.readFile = nil
-			}
+			d.closeReadFile()
 			d.readPos.EndOffset.FileNum++
 			d.readPos.EndOffset.Pos = 0
 		}
@@ -295,11 +379,32 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 	return result, nil
 }
 
-// readOne performs a low level filesystem read for a single []byte
-// while advancing read positions and rolling files, if necessary
+// ReadOne read the next message, the compacted records will be skipped.
 func (d *DiskQueueSnapshot) ReadOne() ReadResult {
 	d.Lock()
 	defer d.Unlock()
+	for {
+		result := d.readOne()
+		if result.Err != ErrRecordCompacted {
+			return result
+		}
+	}
+}
+
+// ReadOneRecord read the next record, the compacted record will return
+// with the error ErrRecordCompacted and the read position moved over it.
+func (d *DiskQueueSnapshot) ReadOneRecord() ReadResult {
+	d.Lock()
+	defer d.Unlock()
+	return d.readOne()
+}
+
+// readOne performs a low level filesystem read for a single []byte
+// while advancing read positions and rolling files, if necessary
+func (d *DiskQueueSnapshot) readOne() ReadResult {
+	if d.records != nil {
+		return d.recordReadOne()
+	}
 
 	var result ReadResult
 	var msgSize int32
@@ -314,7 +419,11 @@ CheckFileOpen:
 
 	result.Offset = d.readPos.virtualEnd
 	if d.readFile == nil {
-		curFileName := d.fileName(d.readPos.EndOffset.FileNum)
+		var curFileName string
+		curFileName, result.Err = d.segmentFileName(d.readPos.EndOffset.FileNum)
+		if result.Err != nil {
+			return result
+		}
 		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
 		if result.Err != nil {
 			return result
@@ -325,13 +434,12 @@ CheckFileOpen:
 		if d.readPos.EndOffset.Pos > 0 {
 			_, result.Err = d.readFile.Seek(d.readPos.EndOffset.Pos, 0)
 			if result.Err != nil {
-				d.readFile.Close()
-				d.readFile = nil
+				d.closeReadFile()
 				return result
 			}
 		}
 
-		d.reader = bufio.NewReader(d.readFile)
+		d.reader = d.newSegmentReader()
 	}
 	if d.readPos.EndOffset.FileNum < d.endPos.EndOffset.FileNum {
 		stat, result.Err = d.readFile.Stat()
@@ -343,35 +451,47 @@ CheckFileOpen:
 			d.readPos.EndOffset.Pos = 0
 			nsqLog.Logf("DISKQUEUE(%s): readOne() read end, try next: %v",
 				d.readFrom, d.readPos.EndOffset.FileNum)
-			d.readFile.Close()
-			d.readFile = nil
+			d.closeReadFile()
 			goto CheckFileOpen
 		}
 	}
 
 	result.Err = binary.Read(d.reader, binary.BigEndian, &msgSize)
 	if result.Err != nil {
-		d.readFile.Close()
-		d.readFile = nil
+		d.closeReadFile()
 		return result
 	}
 
-	if msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
+	var recordFlags int32
+	msgSize, recordFlags, result.Err = parseRecordHeader(msgSize)
+	if result.Err != nil || msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
 		// this file is corrupt and we have no reasonable guarantee on
 		// where a new message should begin
-		d.readFile.Close()
-		d.readFile = nil
-		result.Err = fmt.Errorf("invalid message read size (%d)", msgSize)
+		d.closeReadFile()
+		result.Err = d.newCorruptionError(fmt.Errorf("invalid message read size (%d), flags: %v", msgSize, recordFlags))
 		return result
 	}
 
-	result.Data = make([]byte, msgSize)
-	_, result.Err = io.ReadFull(d.reader, result.Data)
+	compacted := recordFlags&recordFlagCompacted != 0
+	if compacted {
+		_, result.Err = d.reader.Discard(int(msgSize))
+	} else {
+		result.Data = make([]byte, msgSize)
+		_, result.Err = io.ReadFull(d.reader, result.Data)
+	}
 	if result.Err != nil {
-		d.readFile.Close()
-		d.readFile = nil
+		d.closeReadFile()
 		return result
 	}
+	if !compacted {
+		result.Data, result.Err = d.batchCache.decodeRecord(d.readPos.EndOffset.FileNum, d.readPos.EndOffset.Pos,
+			msgSize, recordFlags, result.Data, d.maxMsgSize, d.readRawRecordAt)
+		if result.Err != nil {
+			d.closeReadFile()
+			result.Err = d.newCorruptionError(result.Err)
+			return result
+		}
+	}
 
 	result.Offset = d.readPos.virtualEnd
 
@@ -394,17 +514,158 @@ CheckFileOpen:
 		}
 	}
 	if isEnd {
-		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
-		}
+		d.closeReadFile()
 
 		d.readPos.EndOffset.FileNum++
 		d.readPos.EndOffset.Pos = 0
 	}
+	if compacted && result.Err == nil {
+		result.Err = ErrRecordCompacted
+	}
 	return result
 }
 
+func (d *DiskQueueSnapshot) getTimeIndexRange() (diskQueueEndInfo, diskQueueEndInfo, *segmentArchive) {
+	d.Lock()
+	defer d.Unlock()
+	return d.queueStart, d.endPos, d.archive
+}
+
+// SearchByTimestamp seek to the first message with the timestamp (in nanosecond) not less than
+// the given using the time index of segments, and return the offset and the
+// total count before the message. ErrTimeIndexNotFound will be returned
+// if there is no time index for the searched segment (old data before the time index enabled).
+func (d *DiskQueueSnapshot) SearchByTimestamp(ts int64) (BackendOffset, int64, error) {
+	start, end, archive := d.getTimeIndexRange()
+	if d.records != nil {
+		// no time index for the record store, the caller should search by the commit log
+		return 0, 0, ErrTimeIndexNotFound
+	}
+	if start.EndOffset.FileNum > end.EndOffset.FileNum || start.Offset() >= end.Offset() {
+		return end.Offset(), end.TotalMsgCnt(), nil
+	}
+	startFileNum := start.EndOffset.FileNum
+	segNum := int(end.EndOffset.FileNum - startFileNum + 1)
+	if end.EndOffset.Pos == 0 {
+		// the end segment is empty
+		segNum--
+	}
+	// find the last segment with the first indexed timestamp less than ts, the segments
+	// without time index are treated as older data
+	i := sort.Search(segNum, func(i int) bool {
+		e, err := readFirstTimeIndex(d.fileName(startFileNum + int64(i)))
+		if err != nil {
+			return false
+		}
+		return e.Timestamp >= ts
+	})
+	if i > 0 {
+		i--
+	}
+	seg := startFileNum + int64(i)
+	var entries []timeIndexEntry
+	var err error
+	archived := false
+	if i == 0 && archive != nil {
+		// the searched time may be older than the local data
+		seg, archived = archive.searchTimeIndexSegment(startFileNum, ts)
+		if !archived {
+			seg = startFileNum
+		}
+	}
+	if archived {
+		entries, err = archive.readTimeIndex(seg)
+	} else {
+		entries, err = readTimeIndex(d.fileName(seg))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, ErrTimeIndexNotFound
+		}
+		return 0, 0, err
+	}
+	valid := entries[:0]
+	for _, e := range entries {
+		if (archived || e.Offset >= start.Offset()) && e.Offset < end.Offset() {
+			valid = append(valid, e)
+		}
+	}
+	searchFrom, found := searchTimeIndex(valid, ts)
+	if !found && !archived {
+		if seg != startFileNum || start.EndOffset.Pos != 0 {
+			return 0, 0, ErrTimeIndexNotFound
+		}
+		// all the messages in the queue are not older than ts
+		searchFrom.Offset = start.Offset()
+		searchFrom.Cnt = start.TotalMsgCnt()
+	}
+	err = d.ResetSeekTo(searchFrom.Offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset := searchFrom.Offset
+	cnt := searchFrom.Cnt
+	for offset < end.Offset() {
+		ret := d.ReadOneRecord()
+		if ret.Err == ErrRecordCompacted {
+			offset = ret.Offset + ret.MovedSize
+			cnt++
+			continue
+		}
+		if ret.Err != nil {
+			return 0, 0, ret.Err
+		}
+		msgTs, _ := getMsgTimestampFromData(ret.Data)
+		if msgTs >= ts {
+			break
+		}
+		offset = ret.Offset + ret.MovedSize
+		cnt++
+	}
+	err = d.ResetSeekTo(offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	return offset, cnt, nil
+}
+
+func (d *DiskQueueSnapshot) newCorruptionError(reason error) *DataCorruptionError {
+	return &DataCorruptionError{
+		Name:    d.readFrom,
+		FileNum: d.readPos.EndOffset.FileNum,
+		Pos:     d.readPos.EndOffset.Pos,
+		Offset:  d.readPos.virtualEnd,
+		Reason:  reason,
+	}
+}
+
+// locateArchived find the position in the archived segments or
+// the data before the queue start in the start segment.
+func (d *DiskQueueSnapshot) locateArchived(voffset BackendOffset) (diskQueueOffset, error) {
+	segStart := d.queueStart.Offset() - BackendOffset(d.queueStart.EndOffset.Pos)
+	if voffset >= segStart {
+		return diskQueueOffset{
+			FileNum: d.queueStart.EndOffset.FileNum,
+			Pos:     int64(voffset - segStart),
+		}, nil
+	}
+	return d.archive.locate(voffset, d.queueStart.EndOffset.FileNum-1)
+}
+
+func (d *DiskQueueSnapshot) segmentFileName(fileNum int64) (string, error) {
+	if d.archive != nil && fileNum < d.queueStart.EndOffset.FileNum {
+		return d.archive.segmentFile(fileNum, "")
+	}
+	return d.fileName(fileNum), nil
+}
+
+func (d *DiskQueueSnapshot) getSegmentOffsetMeta(fileNum int64) (int64, int64, int64, error) {
+	if d.archive != nil && fileNum < d.queueStart.EndOffset.FileNum {
+		return d.archive.getOffsetMeta(fileNum)
+	}
+	return getQueueFileOffsetMeta(d.fileName(fileNum))
+}
+
 func (d *DiskQueueSnapshot) fileName(fileNum int64) string {
 	return GetQueueFileName(d.dataPath, d.readFrom, fileNum)
 }
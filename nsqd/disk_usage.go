@@ -0,0 +1,17 @@
+// +build !windows
+
+package nsqd
+
+import (
+	"syscall"
+)
+
+// getDiskUsage return the total and the available bytes of the disk for the path
+func getDiskUsage(dir string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Blocks) * uint64(st.Bsize), uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,28 @@
+// +build windows
+
+package nsqd
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32DLL            = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpaceEx = kernel32DLL.NewProc("GetDiskFreeSpaceExW")
+)
+
+// getDiskUsage return the total and the available bytes of the disk for the path
+func getDiskUsage(dir string) (uint64, uint64, error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var avail, total, free uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&avail)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if r == 0 {
+		return 0, 0, err
+	}
+	return total, avail, nil
+}
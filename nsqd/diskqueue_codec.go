@@ -0,0 +1,566 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type CompressCodec int32
+
+const (
+	CompressNone CompressCodec = iota
+	CompressSnappy
+	CompressZstd
+)
+
+// the high bits of the 4-byte length prefix of each record on disk are
+// reserved as flags, since the max message size only need 28 bits.
+// If the checksum flag is set, the last 4 bytes of the record is the crc32 of
+// the length prefix and the payload, and the size in the length prefix include the checksum.
+// If the compacted flag is set, the record is removed by the compaction and the data of the
+// record is meaningless, the record keep the same size so the offset of the records after it
+// will not be changed.
+const (
+	recordFlagCompressed = 0x20000000
+	recordFlagChecksum   = 0x40000000
+	recordFlagCompacted  = -0x80000000
+	recordSizeMask       = 0x1FFFFFFF
+	recordKnownFlags     = recordFlagCompressed | recordFlagChecksum | recordFlagCompacted
+	recordChecksumSize   = 4
+)
+
+// The messages written together can be compressed as a batch. The first record of the
+// batch is the compressed record with the batch flag in the codec byte, and the compressed
+// data is all the messages with the 4-byte length prefix. Each of the other messages has a
+// small record referencing the message in the batch, the payload of the reference record is
+// the distance back to the batch record and the index of the message in the batch. So each
+// message still has its own offset in the queue, and the batch and its reference records
+// are always in the same segment file. The decompressed batch will never exceed the max message size.
+const (
+	compressBatchFlag   = 0x80
+	compressBatchRef    = 0x7f
+	batchRefPayloadSize = 1 + 4 + 4
+)
+
+var (
+	ErrUnknownCompressCodec   = errors.New("unknown compress codec")
+	ErrInvalidRecordFlags     = errors.New("invalid record flags")
+	ErrInvalidRecordSize      = errors.New("invalid record size")
+	ErrRecordChecksumMismatch = errors.New("record checksum mismatch")
+	ErrRecordCompacted        = errors.New("record is removed by compaction")
+	ErrRecordTooLarge         = errors.New("decompressed record exceed the max message size")
+	ErrInvalidRecordBatch     = errors.New("invalid compressed record batch")
+	errRecordBatchRef         = errors.New("record referencing the message in the batch")
+)
+
+var recordCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DataCorruptionError means the record on disk is damaged (bit flip or torn write),
+// the data should be fixed from other replicas.
+type DataCorruptionError struct {
+	Name    string
+	FileNum int64
+	Pos     int64
+	Offset  BackendOffset
+	Reason  error
+}
+
+func (e *DataCorruptionError) Error() string {
+	return fmt.Sprintf("diskqueue(%s) data corrupted at file %v pos %v (offset %v): %v",
+		e.Name, e.FileNum, e.Pos, e.Offset, e.Reason)
+}
+
+func IsDataCorruption(err error) bool {
+	_, ok := err.(*DataCorruptionError)
+	return ok
+}
+
+var (
+	// both encoder and decoder are safe for concurrent use with EncodeAll/DecodeAll
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+)
+
+func (c CompressCodec) String() string {
+	switch c {
+	case CompressNone:
+		return "none"
+	case CompressSnappy:
+		return "snappy"
+	case CompressZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", int32(c))
+	}
+}
+
+func ParseCompressCodec(s string) (CompressCodec, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return CompressNone, nil
+	case "snappy":
+		return CompressSnappy, nil
+	case "zstd":
+		return CompressZstd, nil
+	default:
+		return CompressNone, ErrUnknownCompressCodec
+	}
+}
+
+// compressed record payload format: 1-byte codec followed by the compressed data,
+// the data will be stored without compression if it is not smaller after compressed.
+func encodeRecordPayload(codec CompressCodec, data []byte) ([]byte, int32) {
+	payload := compressData(codec, data)
+	// store as raw if compress is useless for this data
+	if payload == nil || len(payload) >= len(data) {
+		return data, 0
+	}
+	payload[0] = byte(codec)
+	return payload, recordFlagCompressed
+}
+
+// compressData return the compressed data with 1 byte reserved for the codec
+func compressData(codec CompressCodec, data []byte) []byte {
+	switch codec {
+	case CompressSnappy:
+		buf := make([]byte, 1+snappy.MaxEncodedLen(len(data)))
+		encoded := snappy.Encode(buf[1:], data)
+		return buf[:1+len(encoded)]
+	case CompressZstd:
+		return zstdEncoder.EncodeAll(data, []byte{0})
+	default:
+		return nil
+	}
+}
+
+// encodeRecordBatch build the raw records (with the length prefix) for the messages written
+// together. The messages will be compressed as batches if the compression is enabled, and each
+// batch will not exceed the max size after decompressed. The records will be written without
+// compression if the batch can not be smaller after compressed. Each of the returned data is
+// a single record or a batch with its reference records, which should be written in one segment.
+func encodeRecordBatch(codec CompressCodec, withChecksum bool, datas [][]byte, maxSize int32) [][]byte {
+	raws := make([][]byte, 0, len(datas))
+	for len(datas) > 0 {
+		n, batchSize := 1, 4+len(datas[0])
+		for codec != CompressNone && n < len(datas) && batchSize+4+len(datas[n]) <= int(maxSize) {
+			batchSize += 4 + len(datas[n])
+			n++
+		}
+		if n == 1 {
+			raws = append(raws, encodeRecord(codec, withChecksum, datas[0]))
+			datas = datas[1:]
+			continue
+		}
+		raws = appendRecordBatch(raws, codec, withChecksum, datas[:n], batchSize)
+		datas = datas[n:]
+	}
+	return raws
+}
+
+func appendRecordBatch(raws [][]byte, codec CompressCodec, withChecksum bool, datas [][]byte, batchSize int) [][]byte {
+	block := make([]byte, 0, batchSize)
+	rawSize := 0
+	for _, data := range datas {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+		block = append(block, size[:]...)
+		block = append(block, data...)
+		rawSize += 4 + len(data)
+		if withChecksum {
+			rawSize += recordChecksumSize
+		}
+	}
+	payload := compressData(codec, block)
+	// each message in batch need one record, the first is the batch record and
+	// the others are the reference records.
+	batchRawSize := 4 + len(payload) + (len(datas)-1)*(4+batchRefPayloadSize)
+	if withChecksum {
+		batchRawSize += len(datas) * recordChecksumSize
+	}
+	if batchRawSize >= rawSize {
+		for _, data := range datas {
+			raws = append(raws, encodeRecord(CompressNone, withChecksum, data))
+		}
+		return raws
+	}
+	payload[0] = byte(codec) | compressBatchFlag
+	raw := appendRecord(make([]byte, 0, batchRawSize), recordFlagCompressed, withChecksum, payload)
+	for i := 1; i < len(datas); i++ {
+		var ref [batchRefPayloadSize]byte
+		ref[0] = compressBatchRef
+		binary.BigEndian.PutUint32(ref[1:5], uint32(len(raw)))
+		binary.BigEndian.PutUint32(ref[5:9], uint32(i))
+		raw = appendRecord(raw, recordFlagCompressed, withChecksum, ref[:])
+	}
+	return append(raws, raw)
+}
+
+func recordChecksum(header int32, payload []byte) uint32 {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(header))
+	return crc32.Update(crc32.Checksum(buf[:], recordCRCTable), recordCRCTable, payload)
+}
+
+// the record flags is needed to compute the checksum, so the checksum flag should be
+// set in the header before this.
+func recordChecksumBytes(header int32, payload []byte) []byte {
+	var buf [recordChecksumSize]byte
+	binary.BigEndian.PutUint32(buf[:], recordChecksum(header, payload))
+	return buf[:]
+}
+
+// verifyRecordChecksum check and strip the checksum if the record has one.
+func verifyRecordChecksum(size int32, flags int32, data []byte) ([]byte, error) {
+	if flags&recordFlagChecksum == 0 {
+		return data, nil
+	}
+	if len(data) < recordChecksumSize {
+		return nil, ErrInvalidRecordSize
+	}
+	payloadLen := len(data) - recordChecksumSize
+	expected := binary.BigEndian.Uint32(data[payloadLen:])
+	if recordChecksum(size|flags, data[:payloadLen]) != expected {
+		return nil, ErrRecordChecksumMismatch
+	}
+	return data[:payloadLen], nil
+}
+
+// decodeRecord verify the checksum and decompress the data read from disk, the
+// decompressed data should not exceed the max size. The record referencing the
+// message in batch can not be decoded without the batch record.
+func decodeRecord(size int32, flags int32, data []byte, maxSize int32) ([]byte, error) {
+	if flags&recordFlagCompacted != 0 {
+		return nil, ErrRecordCompacted
+	}
+	payload, err := verifyRecordChecksum(size, flags, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecordPayload(flags, payload, maxSize)
+}
+
+// CheckRawRecords verify all the records in the raw data (with the length prefix)
+// read from disk queue, records without checksum will only be checked for the size.
+func CheckRawRecords(data []byte) error {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return ErrInvalidRecordSize
+		}
+		size, flags, err := parseRecordHeader(int32(binary.BigEndian.Uint32(data[:4])))
+		if err != nil {
+			return err
+		}
+		if size <= 0 || int(size) > len(data)-4 {
+			return ErrInvalidRecordSize
+		}
+		_, err = verifyRecordChecksum(size, flags, data[4:4+size])
+		if err != nil {
+			return err
+		}
+		data = data[4+size:]
+	}
+	return nil
+}
+
+// encodeRecord build the whole record with the length prefix, the same as
+// the record written to the disk queue segment.
+func encodeRecord(codec CompressCodec, withChecksum bool, data []byte) []byte {
+	payload, flags := encodeRecordPayload(codec, data)
+	size := len(payload) + 4
+	if withChecksum {
+		size += recordChecksumSize
+	}
+	return appendRecord(make([]byte, 0, size), flags, withChecksum, payload)
+}
+
+func appendRecord(raw []byte, flags int32, withChecksum bool, payload []byte) []byte {
+	size := int32(len(payload))
+	if withChecksum {
+		flags |= recordFlagChecksum
+		size += recordChecksumSize
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(size|flags))
+	raw = append(raw, header[:]...)
+	raw = append(raw, payload...)
+	if withChecksum {
+		raw = append(raw, recordChecksumBytes(size|flags, payload)...)
+	}
+	return raw
+}
+
+// compactedRecordHeader is the length prefix of the compacted record replacing
+// the record with the data size.
+func compactedRecordHeader(size int32) int32 {
+	return size | recordFlagCompacted
+}
+
+// splitRawRecords split the raw data into the records with the length prefix
+func splitRawRecords(data []byte) ([][]byte, error) {
+	var records [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, ErrInvalidRecordSize
+		}
+		size, _, err := parseRecordHeader(int32(binary.BigEndian.Uint32(data[:4])))
+		if err != nil {
+			return nil, err
+		}
+		if size <= 0 || int(size) > len(data)-4 {
+			return nil, ErrInvalidRecordSize
+		}
+		records = append(records, data[:4+size])
+		data = data[4+size:]
+	}
+	return records, nil
+}
+
+// decodeFirstRawRecord decode the data of the first record in the raw data
+func decodeFirstRawRecord(data []byte, maxSize int32) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, ErrInvalidRecordSize
+	}
+	size, flags, err := parseRecordHeader(int32(binary.BigEndian.Uint32(data[:4])))
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 || int(size) > len(data)-4 {
+		return nil, ErrInvalidRecordSize
+	}
+	return decodeRecord(size, flags, data[4:4+size], maxSize)
+}
+
+// decodeRecordPayload return the first message if the payload is the batch
+func decodeRecordPayload(flags int32, payload []byte, maxSize int32) ([]byte, error) {
+	if flags&recordFlagCompressed == 0 {
+		return payload, nil
+	}
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("invalid compressed record size (%d)", len(payload))
+	}
+	if payload[0] == compressBatchRef {
+		return nil, errRecordBatchRef
+	}
+	if payload[0]&compressBatchFlag != 0 {
+		msgs, err := decodeRecordBatch(payload, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		return msgs[0], nil
+	}
+	return decompressData(CompressCodec(payload[0]), payload[1:], maxSize)
+}
+
+func decompressData(codec CompressCodec, data []byte, maxSize int32) ([]byte, error) {
+	switch codec {
+	case CompressSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > int(maxSize) {
+			return nil, ErrRecordTooLarge
+		}
+		return snappy.Decode(nil, data)
+	case CompressZstd:
+		var h zstd.Header
+		err := h.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(maxSize)
+		if h.HasFCS {
+			if h.FrameContentSize > n {
+				return nil, ErrRecordTooLarge
+			}
+			n = h.FrameContentSize
+		}
+		// the decoder will not decode more than the capacity
+		out, err := zstdDecoder.DecodeAll(data, make([]byte, 0, n))
+		if err == zstd.ErrDecoderSizeExceeded {
+			return nil, ErrRecordTooLarge
+		}
+		return out, err
+	default:
+		return nil, ErrUnknownCompressCodec
+	}
+}
+
+// decodeRecordBatch decompress the batch payload and split it into the messages
+func decodeRecordBatch(payload []byte, maxSize int32) ([][]byte, error) {
+	block, err := decompressData(CompressCodec(payload[0]&^compressBatchFlag), payload[1:], maxSize)
+	if err != nil {
+		return nil, err
+	}
+	var msgs [][]byte
+	for len(block) > 0 {
+		if len(block) < 4 {
+			return nil, ErrInvalidRecordBatch
+		}
+		size := int(binary.BigEndian.Uint32(block[:4]))
+		if size > len(block)-4 {
+			return nil, ErrInvalidRecordBatch
+		}
+		// limit the capacity so the messages will not overwrite each other
+		msgs = append(msgs, block[4:4+size:4+size])
+		block = block[4+size:]
+	}
+	if len(msgs) == 0 {
+		return nil, ErrInvalidRecordBatch
+	}
+	return msgs, nil
+}
+
+// parseBatchRef return the distance back to the batch record and the message index in the batch
+func parseBatchRef(payload []byte) (int64, int, error) {
+	if len(payload) != batchRefPayloadSize || payload[0] != compressBatchRef {
+		return 0, 0, ErrInvalidRecordBatch
+	}
+	return int64(binary.BigEndian.Uint32(payload[1:5])), int(binary.BigEndian.Uint32(payload[5:9])), nil
+}
+
+// isRecordBatch return true if the record is the batch record, the batch record
+// should not be compacted since the messages after it are stored in it.
+func isRecordBatch(flags int32, payload []byte) bool {
+	return flags&recordFlagCompressed != 0 && len(payload) > 0 &&
+		payload[0] != compressBatchRef && payload[0]&compressBatchFlag != 0
+}
+
+// rawRecordBatchRef return the distance back to the batch record if the raw record (with the
+// length prefix) is the reference record, which can not be read without the batch record.
+func rawRecordBatchRef(raw []byte) (int64, bool) {
+	if len(raw) < 4+batchRefPayloadSize {
+		return 0, false
+	}
+	_, flags, err := parseRecordHeader(int32(binary.BigEndian.Uint32(raw[:4])))
+	if err != nil || flags&recordFlagCompressed == 0 || flags&recordFlagCompacted != 0 {
+		return 0, false
+	}
+	back, _, err := parseBatchRef(raw[4 : 4+batchRefPayloadSize])
+	return back, err == nil
+}
+
+// recordBatchCache keep the messages of the last batch record read in the segment, so
+// the following messages in the batch can be read without decompressing the batch again.
+type recordBatchCache struct {
+	fileNum int64
+	pos     int64
+	msgs    [][]byte
+}
+
+// decodeRecord decode the record at the position of the segment file, the batch record
+// referenced will be read by readRaw if it is not the last batch read.
+func (c *recordBatchCache) decodeRecord(fileNum int64, pos int64, size int32, flags int32, data []byte,
+	maxSize int32, readRaw func(pos int64) ([]byte, error)) ([]byte, error) {
+	if flags&recordFlagCompacted != 0 {
+		return nil, ErrRecordCompacted
+	}
+	payload, err := verifyRecordChecksum(size, flags, data)
+	if err != nil {
+		return nil, err
+	}
+	if flags&recordFlagCompressed == 0 || len(payload) < 1 {
+		return decodeRecordPayload(flags, payload, maxSize)
+	}
+	if payload[0] == compressBatchRef {
+		back, index, err := parseBatchRef(payload)
+		if err != nil {
+			return nil, err
+		}
+		if back <= 0 || back > pos {
+			return nil, ErrInvalidRecordBatch
+		}
+		if c.msgs == nil || c.fileNum != fileNum || c.pos != pos-back {
+			err = c.readBatch(fileNum, pos-back, maxSize, readRaw)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if index <= 0 || index >= len(c.msgs) {
+			return nil, ErrInvalidRecordBatch
+		}
+		return c.msgs[index], nil
+	}
+	if payload[0]&compressBatchFlag != 0 {
+		msgs, err := decodeRecordBatch(payload, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		c.fileNum, c.pos, c.msgs = fileNum, pos, msgs
+		return msgs[0], nil
+	}
+	return decodeRecordPayload(flags, payload, maxSize)
+}
+
+func (c *recordBatchCache) readBatch(fileNum int64, pos int64, maxSize int32, readRaw func(pos int64) ([]byte, error)) error {
+	c.msgs = nil
+	raw, err := readRaw(pos)
+	if err != nil {
+		return err
+	}
+	if len(raw) < 4 {
+		return ErrInvalidRecordSize
+	}
+	size, flags, err := parseRecordHeader(int32(binary.BigEndian.Uint32(raw[:4])))
+	if err != nil {
+		return err
+	}
+	if size <= 0 || int(size) != len(raw)-4 || flags&recordFlagCompacted != 0 {
+		return ErrInvalidRecordBatch
+	}
+	payload, err := verifyRecordChecksum(size, flags, raw[4:])
+	if err != nil {
+		return err
+	}
+	if !isRecordBatch(flags, payload) {
+		return ErrInvalidRecordBatch
+	}
+	msgs, err := decodeRecordBatch(payload, maxSize)
+	if err != nil {
+		return err
+	}
+	c.fileNum, c.pos, c.msgs = fileNum, pos, msgs
+	return nil
+}
+
+func (c *recordBatchCache) reset() {
+	c.msgs = nil
+}
+
+// readRawRecordAt read the whole record (with the length prefix) at the position of the segment file
+func readRawRecordAt(readAt func(p []byte, off int64) (int, error), pos int64) ([]byte, error) {
+	var header [4]byte
+	_, err := readAt(header[:], pos)
+	if err != nil {
+		return nil, err
+	}
+	size, _, err := parseRecordHeader(int32(binary.BigEndian.Uint32(header[:])))
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 || size > MAX_POSSIBLE_MSG_SIZE {
+		return nil, ErrInvalidRecordSize
+	}
+	raw := make([]byte, 4+size)
+	copy(raw, header[:])
+	_, err = readAt(raw[4:], pos+4)
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// parseRecordHeader split the 4-byte length prefix into the data size on disk and the record flags
+func parseRecordHeader(header int32) (int32, int32, error) {
+	flags := header &^ recordSizeMask
+	if flags&^recordKnownFlags != 0 {
+		return 0, 0, ErrInvalidRecordFlags
+	}
+	return header & recordSizeMask, flags, nil
+}
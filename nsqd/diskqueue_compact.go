@@ -0,0 +1,276 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+// The compaction for the keyed topic keep only the newest message of each key.
+// The removed records are rewritten as the compacted records with the same size and
+// the data of them are skipped while writing (the segment file become sparse), so the
+// offset and the count of all the messages are not changed, the commit log and the
+// consume positions of channels are still valid after compaction. The batch record is
+// never removed since the messages after it in the batch are stored in it.
+
+const compactTmpSuffix = ".compact.tmp"
+
+var ErrCompactNotSupported = errors.New("compaction is not supported by the storage engine")
+
+// compactKeyFunc return the compaction key of the message data, the message without key
+// will never be removed.
+type compactKeyFunc func(data []byte) (string, bool)
+
+type segmentRecordReader struct {
+	r   *bufio.Reader
+	pos int64
+	end int64
+}
+
+func newSegmentRecordReader(f *os.File, pos int64, end int64) (*segmentRecordReader, error) {
+	if pos > 0 {
+		_, err := f.Seek(pos, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &segmentRecordReader{r: bufio.NewReader(f), pos: pos, end: end}, nil
+}
+
+// next return the record position, the record header and the payload,
+// the payload of the compacted record is not read. io.EOF if reach the end.
+func (sr *segmentRecordReader) next() (int64, int32, []byte, error) {
+	if sr.pos >= sr.end {
+		return 0, 0, nil, io.EOF
+	}
+	var header int32
+	err := binary.Read(sr.r, binary.BigEndian, &header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	size, flags, err := parseRecordHeader(header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if size <= 0 || size > MAX_POSSIBLE_MSG_SIZE || sr.pos+4+int64(size) > sr.end {
+		return 0, 0, nil, ErrInvalidRecordSize
+	}
+	pos := sr.pos
+	sr.pos += 4 + int64(size)
+	if flags&recordFlagCompacted != 0 {
+		_, err = sr.r.Discard(int(size))
+		return pos, header, nil, err
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(sr.r, payload)
+	return pos, header, payload, err
+}
+
+func readRecordKey(data []byte, getKey compactKeyFunc) (string, bool) {
+	if data == nil {
+		return "", false
+	}
+	return getKey(data)
+}
+
+func (d *diskQueueWriter) segmentEnd(fileNum int64, end diskQueueEndInfo) (int64, error) {
+	if fileNum == end.EndOffset.FileNum {
+		return end.EndOffset.Pos, nil
+	}
+	stat, err := os.Stat(d.fileName(fileNum))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// CompactByKey remove the old messages which have the newer message with the same key
+// in the queue before the end, only the rolled segments will be rewritten.
+// return the data size removed by this compaction.
+func (d *diskQueueWriter) CompactByKey(endInfo BackendQueueEnd, getKey compactKeyFunc) (int64, error) {
+	e, ok := endInfo.(*diskQueueEndInfo)
+	if !ok || e == nil {
+		return 0, ErrOffsetTypeMismatch
+	}
+	end := *e
+	d.RLock()
+	start := d.diskQueueStart
+	if end.EndOffset.GreatThan(&d.diskReadEnd.EndOffset) {
+		end = d.diskReadEnd
+	}
+	d.RUnlock()
+
+	// find the newest position of each key and the segments having the old messages
+	newest := make(map[string]diskQueueOffset)
+	needCompact := make(map[int64]bool)
+	for fileNum := start.EndOffset.FileNum; fileNum <= end.EndOffset.FileNum; fileNum++ {
+		pos := int64(0)
+		if fileNum == start.EndOffset.FileNum {
+			pos = start.EndOffset.Pos
+		}
+		segEnd, err := d.segmentEnd(fileNum, end)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		if pos >= segEnd {
+			continue
+		}
+		err = d.scanSegment(fileNum, pos, segEnd, func(recPos int64, header int32, payload []byte, data []byte) error {
+			if payload == nil {
+				return nil
+			}
+			key, ok := readRecordKey(data, getKey)
+			if !ok {
+				return nil
+			}
+			if old, ok := newest[key]; ok {
+				needCompact[old.FileNum] = true
+			}
+			newest[key] = diskQueueOffset{FileNum: fileNum, Pos: recPos}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	total := int64(0)
+	for fileNum := start.EndOffset.FileNum; fileNum < end.EndOffset.FileNum; fileNum++ {
+		if !needCompact[fileNum] {
+			continue
+		}
+		removed, err := d.compactSegment(fileNum, end, func(recPos int64, key string) bool {
+			n := newest[key]
+			return n.FileNum != fileNum || n.Pos != recPos
+		}, getKey)
+		if err != nil {
+			nsqLog.LogWarningf("DISKQUEUE(%s): compact segment %v failed: %v", d.name, fileNum, err)
+			continue
+		}
+		total += removed
+	}
+	return total, nil
+}
+
+// scanSegment read all the records between the position and the end of the segment,
+// the decoded data will be nil if the record is compacted or can not be decoded.
+func (d *diskQueueWriter) scanSegment(fileNum int64, pos int64, end int64,
+	fn func(recPos int64, header int32, payload []byte, data []byte) error) error {
+	f, err := os.Open(d.fileName(fileNum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sr, err := newSegmentRecordReader(f, pos, end)
+	if err != nil {
+		return err
+	}
+	var batchCache recordBatchCache
+	readRaw := func(pos int64) ([]byte, error) {
+		return readRawRecordAt(f.ReadAt, pos)
+	}
+	for {
+		recPos, header, payload, err := sr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if payload != nil {
+			size, flags, _ := parseRecordHeader(header)
+			data, _ = batchCache.decodeRecord(fileNum, recPos, size, flags, payload, d.maxMsgSize, readRaw)
+		}
+		err = fn(recPos, header, payload, data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compactSegment rewrite the rolled segment to the temp file and replace the old one,
+// the readers opened the old segment can still read the old data.
+func (d *diskQueueWriter) compactSegment(fileNum int64, end diskQueueEndInfo,
+	shouldRemove func(recPos int64, key string) bool, getKey compactKeyFunc) (int64, error) {
+	fName := d.fileName(fileNum)
+	segEnd, err := d.segmentEnd(fileNum, end)
+	if err != nil {
+		return 0, err
+	}
+	tmpName := fName + compactTmpSuffix
+	out, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpName)
+	writer := bufio.NewWriter(out)
+	removed := int64(0)
+	var buf [4]byte
+	err = d.scanSegment(fileNum, 0, segEnd, func(recPos int64, header int32, payload []byte, data []byte) error {
+		size, flags, _ := parseRecordHeader(header)
+		remove := payload == nil
+		if !remove && !isRecordBatch(flags, payload) {
+			key, ok := readRecordKey(data, getKey)
+			remove = ok && shouldRemove(recPos, key)
+			if remove {
+				header = compactedRecordHeader(size)
+				removed += int64(size)
+			}
+		}
+		binary.BigEndian.PutUint32(buf[:], uint32(header))
+		_, err := writer.Write(buf[:])
+		if err != nil {
+			return err
+		}
+		if !remove {
+			_, err = writer.Write(payload)
+			return err
+		}
+		// skip the data of the compacted record to make the file sparse
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+		_, err = out.Seek(int64(size), io.SeekCurrent)
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = out.Truncate(segEnd)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	d.cleanMutex.Lock()
+	defer d.cleanMutex.Unlock()
+	d.RLock()
+	cleaned := fileNum < d.diskQueueStart.EndOffset.FileNum
+	d.RUnlock()
+	if cleaned {
+		return 0, nil
+	}
+	err = util.AtomicRename(tmpName, fName)
+	if err != nil {
+		return 0, err
+	}
+	nsqLog.Logf("DISKQUEUE(%s): compacted segment %v, removed %v bytes", d.name, fName, removed)
+	return removed, nil
+}
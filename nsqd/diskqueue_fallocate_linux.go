@@ -0,0 +1,18 @@
+package nsqd
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE, allocate the disk blocks without changing the file size,
+// so the readers can still use the file size as the end of the sealed segment.
+const fallocKeepSize = 0x1
+
+func preallocateFile(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
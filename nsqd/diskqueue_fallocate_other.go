@@ -0,0 +1,11 @@
+// +build !linux
+
+package nsqd
+
+import (
+	"os"
+)
+
+func preallocateFile(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,15 @@
+// +build windows
+
+package nsqd
+
+import (
+	"os"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapNotSupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -34,6 +34,8 @@ var (
 	ErrInvalidReadable         = errors.New("readable data is invalid")
 	ErrReadEndChangeToOld      = errors.New("queue read end change to old without reload")
 	ErrExiting                 = errors.New("exiting")
+
+	errReadCompactedToEnd = errors.New("only compacted records left to read")
 )
 
 var FileNumV2Seq = 999990
@@ -101,6 +103,7 @@ type diskQueueReader struct {
 	dataPath        string
 	maxBytesPerFile int64 // currently this cannot change once created
 	minMsgSize      int32
+	maxMsgSize      int32
 	syncEvery       int64 // number of writes per fsync
 	exitFlag        int32
 	needSync        bool
@@ -109,10 +112,17 @@ type diskQueueReader struct {
 
 	readFile   *os.File
 	readBuffer *bytes.Buffer
+	// the mapping of the sealed segment being read, nil if reading by the read buffer
+	readMmap *segmentMmap
+	mmapRead int32
+	// the messages of the last batch record read
+	batchCache recordBatchCache
 
 	exitChan        chan int
 	autoSkipError   bool
 	waitingMoreData int32
+	// the cleaned segments can be read from archive if set
+	archive *segmentArchive
 }
 
 // newDiskQueue instantiates a new instance of diskQueueReader, retrieving metadata
@@ -127,6 +137,7 @@ func newDiskQueueReader(readFrom string, metaname string, dataPath string, maxBy
 		dataPath:        dataPath,
 		maxBytesPerFile: maxBytesPerFile,
 		minMsgSize:      minMsgSize,
+		maxMsgSize:      maxMsgSize,
 		exitChan:        make(chan int),
 		syncEvery:       syncEvery,
 		autoSkipError:   autoSkip,
@@ -155,6 +166,35 @@ func newDiskQueueReader(readFrom string, metaname string, dataPath string, maxBy
 	return &d
 }
 
+// SetArchiver allow the reader to seek to the cleaned position, the
+// archived segments will be fetched on demand.
+func (d *diskQueueReader) SetArchiver(archiver SegmentArchiver) {
+	d.Lock()
+	d.archive = newSegmentArchive(archiver, d.readFrom, d.dataPath)
+	d.Unlock()
+}
+
+// SetMmapReadEnabled allow the sealed segments to be read through mmap
+func (d *diskQueueReader) SetMmapReadEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.mmapRead, 1)
+	} else {
+		atomic.StoreInt32(&d.mmapRead, 0)
+	}
+}
+
+func (d *diskQueueReader) closeReadFile() {
+	d.batchCache.reset()
+	if d.readMmap != nil {
+		d.readMmap.close()
+		d.readMmap = nil
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+}
+
 func getQueueSegmentEnd(dataRoot string, readFrom string, offset diskQueueOffset) (int64, error) {
 	curFileName := GetQueueFileName(dataRoot, readFrom, offset.FileNum)
 	f, err := os.Stat(curFileName)
@@ -232,10 +272,7 @@ func (d *diskQueueReader) exit(deleted bool) error {
 	d.exitFlag = 1
 	close(d.exitChan)
 	nsqLog.Logf("diskqueue(%s) exiting ", d.readerMetaName)
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 	d.sync()
 	if deleted {
 		d.skipToEndofQueue()
@@ -308,10 +345,7 @@ func (d *diskQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (Ba
 	if d.exitFlag == 1 {
 		return nil, ErrExiting
 	}
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 	d.readBuffer.Reset()
 
 	old := d.confirmedQueueInfo.Offset()
@@ -332,10 +366,7 @@ func (d *diskQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (Ba
 func (d *diskQueueReader) ResetLastReadOne(offset BackendOffset, cnt int64, lastMoved int32) {
 	d.Lock()
 	defer d.Unlock()
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 	if d.readQueueInfo.EndOffset.Pos < int64(lastMoved) {
 		return
 	}
@@ -432,6 +463,9 @@ func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 		if d.queueEndInfo.EndOffset.GreatThan(&d.readQueueInfo.EndOffset) {
 			dataRead := d.readOne()
 			rerr := dataRead.Err
+			if rerr == errReadCompactedToEnd {
+				return ReadResult{}, false
+			}
 			if rerr != nil {
 				nsqLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v",
 					d.readerMetaName, d.readQueueInfo, d.fileName(d.readQueueInfo.EndOffset.FileNum), dataRead.Err, d.queueEndInfo)
@@ -632,9 +666,8 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 		d.updateDepth()
 		return nil
 	}
-	if voffset != d.readQueueInfo.Offset() && d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+	if voffset != d.readQueueInfo.Offset() {
+		d.closeReadFile()
 	}
 	d.readBuffer.Reset()
 
@@ -676,6 +709,10 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 
 		newPos, err = stepOffset(d.dataPath, d.readFrom, d.readQueueInfo,
 			voffset-d.readQueueInfo.Offset(), d.queueEndInfo)
+		if err == ErrReadQueueAlreadyCleaned && d.archive != nil {
+			nsqLog.Logf("internal skip to cleaned position %v, try locate from archive before: %v", voffset, newPos)
+			newPos, err = d.archive.locate(voffset, newPos.FileNum)
+		}
 		if err != nil {
 			nsqLog.LogErrorf("internal skip error : %v, skipping to : %v", err, voffset)
 			if os.IsNotExist(err) {
@@ -693,7 +730,7 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 						break
 					}
 					// check offset meta
-					_, metaStartPos, metaEndPos, innerErr := getQueueFileOffsetMeta(d.fileName(newPos.FileNum))
+					_, metaStartPos, metaEndPos, innerErr := d.getSegmentOffsetMeta(newPos.FileNum)
 					if innerErr != nil {
 						if os.IsNotExist(innerErr) {
 							nsqLog.Logf("check segment offset meta not exist, try next: %v ", newPos)
@@ -744,13 +781,10 @@ func (d *diskQueueReader) skipToNextFile() error {
 	if d.confirmedQueueInfo.EndOffset.FileNum >= d.queueEndInfo.EndOffset.FileNum {
 		return d.skipToEndofQueue()
 	}
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 	d.readBuffer.Reset()
 	for {
-		cnt, _, end, err := getQueueFileOffsetMeta(d.fileName(d.confirmedQueueInfo.EndOffset.FileNum))
+		cnt, _, end, err := d.getSegmentOffsetMeta(d.confirmedQueueInfo.EndOffset.FileNum)
 		if err != nil {
 			nsqLog.LogErrorf("diskqueue(%s) failed to skip to next %v : %v",
 				d.readerMetaName, d.confirmedQueueInfo, err)
@@ -779,10 +813,7 @@ func (d *diskQueueReader) skipToNextFile() error {
 }
 
 func (d *diskQueueReader) skipToEndofQueue() error {
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
+	d.closeReadFile()
 	d.readBuffer.Reset()
 
 	d.readQueueInfo = d.queueEndInfo
@@ -826,9 +857,72 @@ func (d *diskQueueReader) ensureReadBuffer(dataNeed int64, currentRead int64, cu
 	return nil
 }
 
-// readOne performs a low level filesystem read for a single []byte
-// while advancing read positions and rolling files, if necessary
+// readRecordData read the data at the current position of the segment, the mapped
+// segment is copied directly without the read buffer.
+func (d *diskQueueReader) readRecordData(buf []byte, currentRead int64, currentFileEnd int64) error {
+	var err error
+	if d.readMmap != nil {
+		if currentRead+int64(len(buf)) > currentFileEnd {
+			err = ErrInvalidReadable
+		} else {
+			_, err = d.readMmap.readAt(buf, currentRead)
+		}
+	} else {
+		err = d.ensureReadBuffer(int64(len(buf)), currentRead, currentFileEnd)
+		if err != nil {
+			nsqLog.LogWarningf("DISKQUEUE(%s): ensure buffer error, current end %v", d.readerMetaName, currentFileEnd)
+			return err
+		}
+		_, err = io.ReadFull(d.readBuffer, buf)
+	}
+	if err != nil {
+		nsqLog.LogWarningf("DISKQUEUE(%s): read %v error %v", d.readerMetaName, d.readQueueInfo, err)
+		tmpStat, tmpErr := d.readFile.Stat()
+		if tmpErr != nil {
+			nsqLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
+		} else {
+			nsqLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
+		}
+	}
+	return err
+}
+
+// readRawRecordAt read the record at the position of the current segment without moving the read buffer
+func (d *diskQueueReader) readRawRecordAt(pos int64) ([]byte, error) {
+	if d.readMmap != nil {
+		return readRawRecordAt(d.readMmap.readAt, pos)
+	}
+	return readRawRecordAt(d.readFile.ReadAt, pos)
+}
+
+// readOne read the next message, the compacted records before the message will be
+// treated as a part of it, so the confirmed offset can be moved over them.
 func (d *diskQueueReader) readOne() ReadResult {
+	start := d.readQueueInfo
+	compactedSize := BackendOffset(0)
+	for {
+		result, compacted := d.readOneRecord()
+		if result.Err != nil || !compacted {
+			if result.Err == nil && compactedSize > 0 {
+				result.Offset = start.Offset()
+				result.MovedSize += compactedSize
+			}
+			return result
+		}
+		compactedSize += result.MovedSize
+		if !d.queueEndInfo.EndOffset.GreatThan(&d.readQueueInfo.EndOffset) {
+			// no message after the compacted records yet, read again after more data written
+			d.readQueueInfo = start
+			d.readBuffer.Reset()
+			d.closeReadFile()
+			return ReadResult{Offset: start.Offset(), Err: errReadCompactedToEnd}
+		}
+	}
+}
+
+// readOneRecord performs a low level filesystem read for a single []byte
+// while advancing read positions and rolling files, if necessary
+func (d *diskQueueReader) readOneRecord() (ReadResult, bool) {
 	var result ReadResult
 	var msgSize int32
 	var stat os.FileInfo
@@ -836,7 +930,7 @@ func (d *diskQueueReader) readOne() ReadResult {
 	if d.readQueueInfo.totalMsgCnt <= 0 && d.readQueueInfo.Offset() > 0 {
 		result.Err = ErrReadQueueCountMissing
 		nsqLog.Warningf("diskqueue(%v) read offset invalid: %v (this may happen while upgrade, wait to fix)", d.readerMetaName, d.readQueueInfo)
-		return result
+		return result, false
 	}
 
 CheckFileOpen:
@@ -844,9 +938,15 @@ CheckFileOpen:
 	result.Offset = d.readQueueInfo.Offset()
 	if d.readFile == nil {
 		curFileName := d.fileName(d.readQueueInfo.EndOffset.FileNum)
+		if d.archive != nil {
+			curFileName, result.Err = d.archive.segmentFile(d.readQueueInfo.EndOffset.FileNum, "")
+			if result.Err != nil {
+				return result, false
+			}
+		}
 		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0644)
 		if result.Err != nil {
-			return result
+			return result, false
 		}
 
 		if nsqLog.Level() >= levellogger.LOG_DEBUG {
@@ -863,24 +963,34 @@ CheckFileOpen:
 				} else {
 					nsqLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
 				}
-				d.readFile.Close()
-				d.readFile = nil
-				return result
+				d.closeReadFile()
+				return result, false
+			}
+		}
+		if atomic.LoadInt32(&d.mmapRead) == 1 && d.readQueueInfo.EndOffset.FileNum < d.queueEndInfo.EndOffset.FileNum {
+			var err error
+			d.readMmap, err = newSegmentMmap(d.readFile)
+			if err != nil {
+				nsqLog.LogDebugf("DISKQUEUE(%s): mmap %s failed: %v", d.readerMetaName, curFileName, err)
 			}
 		}
+	} else if d.readMmap != nil && d.readQueueInfo.EndOffset.FileNum >= d.queueEndInfo.EndOffset.FileNum {
+		// the queue end is reset back to the mapped segment, it may be written again
+		d.closeReadFile()
+		d.readBuffer.Reset()
+		goto CheckFileOpen
 	}
 	if d.readQueueInfo.EndOffset.FileNum < d.queueEndInfo.EndOffset.FileNum {
 		stat, result.Err = d.readFile.Stat()
 		if result.Err != nil {
-			return result
+			return result, false
 		}
 		if d.readQueueInfo.EndOffset.Pos >= stat.Size() {
 			d.readQueueInfo.EndOffset.FileNum++
 			d.readQueueInfo.EndOffset.Pos = 0
 			nsqLog.Logf("DISKQUEUE(%s): readOne() read end, try next: %v",
 				d.readerMetaName, d.readQueueInfo.EndOffset.FileNum)
-			d.readFile.Close()
-			d.readFile = nil
+			d.closeReadFile()
 			goto CheckFileOpen
 		}
 	}
@@ -888,8 +998,7 @@ CheckFileOpen:
 	defer func() {
 		if result.Err != nil {
 			d.readBuffer.Reset()
-			d.readFile.Close()
-			d.readFile = nil
+			d.closeReadFile()
 		}
 	}()
 
@@ -901,58 +1010,48 @@ CheckFileOpen:
 		if result.Err == nil {
 			currentFileEnd = stat.Size()
 		} else {
-			return result
+			return result, false
 		}
 	} else {
 		nsqLog.LogWarningf("DISKQUEUE(%s): read %v exceed current end %v", d.readerMetaName,
 			d.readQueueInfo, d.queueEndInfo)
 		result.Err = errors.New("exceed end of queue")
-		return result
+		return result, false
 	}
 
-	result.Err = d.ensureReadBuffer(4, d.readQueueInfo.EndOffset.Pos, currentFileEnd)
-	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): ensure buffer error, current end %v", d.readerMetaName, currentFileEnd)
-		return result
-	}
-	result.Err = binary.Read(d.readBuffer, binary.BigEndian, &msgSize)
+	var header [4]byte
+	result.Err = d.readRecordData(header[:], d.readQueueInfo.EndOffset.Pos, currentFileEnd)
 	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): read %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
-		tmpStat, tmpErr := d.readFile.Stat()
-		if tmpErr != nil {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
-		} else {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
-		}
-
-		return result
+		return result, false
 	}
+	msgSize = int32(binary.BigEndian.Uint32(header[:]))
 
-	if msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
+	var recordFlags int32
+	msgSize, recordFlags, result.Err = parseRecordHeader(msgSize)
+	if result.Err != nil || msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
 		// this file is corrupt and we have no reasonable guarantee on
 		// where a new message should begin
-		result.Err = fmt.Errorf("invalid message read size (%d)", msgSize)
-		return result
+		result.Err = d.newCorruptionError(fmt.Errorf("invalid message read size (%d), flags: %v", msgSize, recordFlags))
+		return result, false
 	}
 
 	result.Data = make([]byte, msgSize)
 
-	result.Err = d.ensureReadBuffer(int64(msgSize), d.readQueueInfo.EndOffset.Pos+4, currentFileEnd)
+	result.Err = d.readRecordData(result.Data, d.readQueueInfo.EndOffset.Pos+4, currentFileEnd)
 	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): ensure buffer error, current read end %v", d.readerMetaName, currentFileEnd)
-		return result
+		return result, false
 	}
-	_, result.Err = io.ReadFull(d.readBuffer, result.Data)
-	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): read %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
-		tmpStat, tmpErr := d.readFile.Stat()
-		if tmpErr != nil {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
-		} else {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
+	compacted := recordFlags&recordFlagCompacted != 0
+	if compacted {
+		result.Data = nil
+	} else {
+		result.Data, result.Err = d.batchCache.decodeRecord(d.readQueueInfo.EndOffset.FileNum, d.readQueueInfo.EndOffset.Pos,
+			msgSize, recordFlags, result.Data, d.maxMsgSize, d.readRawRecordAt)
+		if result.Err != nil {
+			nsqLog.LogWarningf("DISKQUEUE(%s): decode record at %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
+			result.Err = d.newCorruptionError(result.Err)
+			return result, false
 		}
-
-		return result
 	}
 
 	result.Offset = d.readQueueInfo.Offset()
@@ -990,10 +1089,7 @@ CheckFileOpen:
 		nsqLog.LogDebugf("should be end since next position is larger than maxfile size. %v", d.readQueueInfo)
 	}
 	if isEnd {
-		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
-		}
+		d.closeReadFile()
 		d.readBuffer.Reset()
 
 		d.readQueueInfo.EndOffset.FileNum++
@@ -1013,7 +1109,7 @@ CheckFileOpen:
 	if d.readQueueInfo.EndOffset.GreatThan(&d.queueEndInfo.EndOffset) {
 		nsqLog.LogWarningf("read exceed end: %v, %v", d.readQueueInfo, d.queueEndInfo)
 	}
-	return result
+	return result, compacted
 }
 
 // sync fsyncs the current writeFile and persists metadata
@@ -1134,6 +1230,13 @@ func GetQueueFileName(dataRoot string, base string, fileNum int64) string {
 	return fmt.Sprintf(path.Join(dataRoot, "%s.diskqueue.%06d.dat"), base, fileNum)
 }
 
+func (d *diskQueueReader) getSegmentOffsetMeta(fileNum int64) (int64, int64, int64, error) {
+	if d.archive != nil {
+		return d.archive.getOffsetMeta(fileNum)
+	}
+	return getQueueFileOffsetMeta(d.fileName(fileNum))
+}
+
 func (d *diskQueueReader) fileName(fileNum int64) string {
 	return GetQueueFileName(d.dataPath, d.readFrom, fileNum)
 }
@@ -1153,6 +1256,16 @@ func (d *diskQueueReader) checkTailCorruption() {
 	}
 }
 
+func (d *diskQueueReader) newCorruptionError(reason error) *DataCorruptionError {
+	return &DataCorruptionError{
+		Name:    d.readerMetaName,
+		FileNum: d.readQueueInfo.EndOffset.FileNum,
+		Pos:     d.readQueueInfo.EndOffset.Pos,
+		Offset:  d.readQueueInfo.Offset(),
+		Reason:  reason,
+	}
+}
+
 func (d *diskQueueReader) handleReadError() {
 	// should not change the bad file, just log it.
 	err := d.skipToNextFile()
@@ -1206,10 +1319,7 @@ func (d *diskQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReloa
 	}
 	if forceReload {
 		nsqLog.LogDebugf("read force reload at end %v ", endPos)
-		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
-		}
+		d.closeReadFile()
 		d.readBuffer.Reset()
 	}
 
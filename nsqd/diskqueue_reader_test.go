@@ -384,3 +384,61 @@ func TestDiskQueueSnapshotReader(t *testing.T) {
 	test.Equal(t, 100, len(data))
 	// remove some begin of queue, and test queue start
 }
+
+func TestDiskQueueReaderMmapRead(t *testing.T) {
+	dqName := "test_disk_queue_mmap" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqWriter.SetPreallocateEnabled(true)
+	dqWriter.SetMmapReadEnabled(true)
+
+	msgNum := 500
+	for i := 0; i < msgNum; i++ {
+		_, _, _, err := dqWriter.Put([]byte("test-" + strconv.Itoa(i)))
+		test.Nil(t, err)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd().(*diskQueueEndInfo)
+	test.Equal(t, true, end.EndOffset.FileNum > 2)
+	// the preallocated space should not change the segment size
+	stat, err := os.Stat(dqWriter.fileName(end.EndOffset.FileNum))
+	test.Nil(t, err)
+	test.Equal(t, end.EndOffset.Pos, stat.Size())
+
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, end, false).(*diskQueueReader)
+	defer dqReader.Close()
+	dqReader.SetMmapReadEnabled(true)
+	dqReader.ResetReadToOffset(0, 0)
+	mapped := 0
+	for i := 0; i < msgNum; i++ {
+		ret, ok := dqReader.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test-"+strconv.Itoa(i), string(ret.Data))
+		if dqReader.readMmap != nil {
+			mapped++
+		}
+	}
+	test.NotEqual(t, 0, mapped)
+	// the last segment is not sealed and should not be mapped
+	test.Nil(t, dqReader.readMmap)
+
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	snap.SetMmapReadEnabled(dqWriter.IsMmapReadEnabled())
+	for i := 0; i < msgNum; i++ {
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		test.Equal(t, "test-"+strconv.Itoa(i), string(ret.Data))
+	}
+	err = snap.ResetSeekTo(0)
+	test.Nil(t, err)
+	data, err := snap.ReadRaw(int32(end.Offset()))
+	test.Nil(t, err)
+	test.Equal(t, int(end.Offset()), len(data))
+	test.Nil(t, CheckRawRecords(data))
+}
@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime/debug"
+)
+
+var (
+	errMmapNotSupported = errors.New("mmap is not supported")
+	errMmapFault        = errors.New("fault while reading the mapped segment")
+)
+
+// segmentMmap is the read only mapping of the sealed segment file. The sealed segment
+// will never be appended, so the catching up readers can copy the data from the mapping
+// directly instead of the read syscalls and the read buffer.
+type segmentMmap struct {
+	data []byte
+}
+
+func newSegmentMmap(f *os.File) (*segmentMmap, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, errMmapNotSupported
+	}
+	data, err := mmapFile(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &segmentMmap{data: data}, nil
+}
+
+func (m *segmentMmap) size() int64 {
+	return int64(len(m.data))
+}
+
+// readAt copy the data at the offset, the fault while accessing the mapping (the file
+// is truncated by the rollback after mapped) will be returned as error instead of crash.
+func (m *segmentMmap) readAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			n = 0
+			err = errMmapFault
+		}
+	}()
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (m *segmentMmap) close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := munmapFile(m.data)
+	m.data = nil
+	return err
+}
+
+// mmapSegmentReader read the mapped segment sequentially from the position.
+type mmapSegmentReader struct {
+	m   *segmentMmap
+	pos int64
+}
+
+func (r *mmapSegmentReader) Read(p []byte) (int, error) {
+	n, err := r.m.readAt(p, r.pos)
+	r.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *mmapSegmentReader) Discard(n int) (int, error) {
+	left := r.m.size() - r.pos
+	if left < 0 {
+		left = 0
+	}
+	if int64(n) > left {
+		r.pos += left
+		return int(left), io.EOF
+	}
+	r.pos += int64(n)
+	return n, nil
+}
@@ -0,0 +1,111 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const (
+	timeIndexEntrySize = 24
+	// a new time index entry will be added after this bytes written since last entry,
+	// so the data need to be read while searching is limited.
+	timeIndexIntervalBytes = 1024 * 64
+	timeIndexFileSuffix    = ".timeindex.dat"
+)
+
+var ErrTimeIndexNotFound = errors.New("time index not found")
+
+// the sparse time index for each segment file, each entry is the timestamp of the message
+// and the virtual offset and the total message count before the message.
+type timeIndexEntry struct {
+	Timestamp int64
+	Offset    BackendOffset
+	Cnt       int64
+}
+
+func getTimeIndexFileName(dataFileName string) string {
+	return dataFileName + timeIndexFileSuffix
+}
+
+// the message timestamp is the first 8 bytes of the message data
+func getMsgTimestampFromData(data []byte) (int64, bool) {
+	if len(data) < 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(data[:8])), true
+}
+
+func encodeTimeIndexEntry(e timeIndexEntry) []byte {
+	var buf [timeIndexEntrySize]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(e.Timestamp))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(e.Offset))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(e.Cnt))
+	return buf[:]
+}
+
+func decodeTimeIndexEntry(buf []byte) timeIndexEntry {
+	return timeIndexEntry{
+		Timestamp: int64(binary.BigEndian.Uint64(buf[:8])),
+		Offset:    BackendOffset(binary.BigEndian.Uint64(buf[8:16])),
+		Cnt:       int64(binary.BigEndian.Uint64(buf[16:24])),
+	}
+}
+
+// readTimeIndex read all the entries of the segment, the partial entry
+// at the end (may happen while crashed) is ignored.
+func readTimeIndex(dataFileName string) ([]timeIndexEntry, error) {
+	buf, err := ioutil.ReadFile(getTimeIndexFileName(dataFileName))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]timeIndexEntry, 0, len(buf)/timeIndexEntrySize)
+	for len(buf) >= timeIndexEntrySize {
+		entries = append(entries, decodeTimeIndexEntry(buf[:timeIndexEntrySize]))
+		buf = buf[timeIndexEntrySize:]
+	}
+	return entries, nil
+}
+
+func readFirstTimeIndex(dataFileName string) (timeIndexEntry, error) {
+	f, err := os.Open(getTimeIndexFileName(dataFileName))
+	if err != nil {
+		return timeIndexEntry{}, err
+	}
+	defer f.Close()
+	var buf [timeIndexEntrySize]byte
+	_, err = io.ReadFull(f, buf[:])
+	if err != nil {
+		return timeIndexEntry{}, err
+	}
+	return decodeTimeIndexEntry(buf[:]), nil
+}
+
+// truncateTimeIndex remove all the entries not less than the end offset
+func truncateTimeIndex(dataFileName string, end BackendOffset) error {
+	entries, err := readTimeIndex(dataFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Offset >= end
+	})
+	return os.Truncate(getTimeIndexFileName(dataFileName), int64(i*timeIndexEntrySize))
+}
+
+// searchTimeIndex return the last entry with the timestamp less than ts
+func searchTimeIndex(entries []timeIndexEntry, ts int64) (timeIndexEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Timestamp >= ts
+	})
+	if i == 0 {
+		return timeIndexEntry{}, false
+	}
+	return entries[i-1], true
+}
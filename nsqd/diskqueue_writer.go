@@ -56,7 +56,14 @@ type diskQueueWriter struct {
 	diskReadEnd  diskQueueEndInfo
 	// the start of the queue , will be set to the cleaned offset
 	diskQueueStart diskQueueEndInfo
+	// the virtual offset of the data already fsynced to disk
+	syncedOffset int64
 	sync.RWMutex
+	// the waiters for the fsync will be serialized, and the waiter whose data
+	// is already covered by the previous fsync will return without sync again.
+	syncMutex sync.Mutex
+	// the rolled segment files can be removed by clean or rewritten by compaction
+	cleanMutex sync.Mutex
 
 	// instantiation time metadata
 	name            string
@@ -66,6 +73,18 @@ type diskQueueWriter struct {
 	maxMsgSize      int32
 	exitFlag        int32
 	needSync        bool
+	compressCodec   int32
+	checksumEnabled int32
+	// time index will be written only if enabled
+	timeIndexEnabled    int32
+	lastTimeIndexOffset BackendOffset
+	timeIndexFile       *os.File
+	// the rolled segments will be uploaded to archive before cleaned if set
+	archive *segmentArchive
+	// preallocate the disk space for the new segment
+	preallocate int32
+	// the readers created from this queue will read the sealed segments through mmap
+	mmapRead int32
 
 	writeFile    *os.File
 	bufferWriter *bufio.Writer
@@ -103,6 +122,8 @@ func newDiskQueueWriter(name string, dataPath string, maxBytesPerFile int64,
 		maxBytesPerFile: maxBytesPerFile,
 		minMsgSize:      minMsgSize,
 		maxMsgSize:      maxMsgSize,
+
+		lastTimeIndexOffset: -1,
 	}
 
 	// no need to lock here, nothing else could possibly be touching this instance
@@ -115,6 +136,7 @@ func newDiskQueueWriter(name string, dataPath string, maxBytesPerFile int64,
 		nsqLog.LogErrorf("diskqueue(%s) failed to init queue start- %s", d.name, err)
 		return &d, err
 	}
+	d.syncedOffset = int64(d.diskWriteEnd.Offset())
 
 	if !readOnly {
 		d.saveExtraMeta()
@@ -123,14 +145,101 @@ func newDiskQueueWriter(name string, dataPath string, maxBytesPerFile int64,
 	return &d, nil
 }
 
+func (d *diskQueueWriter) SetCompressCodec(codec CompressCodec) {
+	old := CompressCodec(atomic.SwapInt32(&d.compressCodec, int32(codec)))
+	if old != codec {
+		nsqLog.Logf("DISKQUEUE(%s): compress codec changed from %v to %v", d.name, old, codec)
+	}
+}
+
+func (d *diskQueueWriter) GetCompressCodec() CompressCodec {
+	return CompressCodec(atomic.LoadInt32(&d.compressCodec))
+}
+
+// SetChecksumEnabled enable the crc32 checksum for the new written records,
+// the old version can not read the records with checksum, so this should be
+// enabled only after all the nodes upgraded.
+func (d *diskQueueWriter) SetChecksumEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.checksumEnabled, 1)
+	} else {
+		atomic.StoreInt32(&d.checksumEnabled, 0)
+	}
+}
+
+func (d *diskQueueWriter) IsChecksumEnabled() bool {
+	return atomic.LoadInt32(&d.checksumEnabled) == 1
+}
+
+// SetPreallocateEnabled preallocate the disk space of MaxBytesPerFile while creating
+// the new segment file to reduce the fragmentation and fail early if no space left.
+func (d *diskQueueWriter) SetPreallocateEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.preallocate, 1)
+	} else {
+		atomic.StoreInt32(&d.preallocate, 0)
+	}
+}
+
+// SetMmapReadEnabled allow the readers and snapshots of this queue to read the
+// sealed segments through mmap
+func (d *diskQueueWriter) SetMmapReadEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.mmapRead, 1)
+	} else {
+		atomic.StoreInt32(&d.mmapRead, 0)
+	}
+}
+
+func (d *diskQueueWriter) IsMmapReadEnabled() bool {
+	return atomic.LoadInt32(&d.mmapRead) == 1
+}
+
+// SetTimeIndexEnabled enable the sparse time index for each segment file,
+// which can be used to search the message by timestamp.
+func (d *diskQueueWriter) SetTimeIndexEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&d.timeIndexEnabled, 1)
+	} else {
+		atomic.StoreInt32(&d.timeIndexEnabled, 0)
+	}
+}
+
+func (d *diskQueueWriter) IsTimeIndexEnabled() bool {
+	return atomic.LoadInt32(&d.timeIndexEnabled) == 1
+}
+
+// SetArchiver set the archive backend for the segments cleaned by retention
+func (d *diskQueueWriter) SetArchiver(archiver SegmentArchiver) {
+	d.Lock()
+	d.archive = newSegmentArchive(archiver, d.name, d.dataPath)
+	d.Unlock()
+}
+
+func (d *diskQueueWriter) getArchiver() SegmentArchiver {
+	d.RLock()
+	defer d.RUnlock()
+	if d.archive == nil {
+		return nil
+	}
+	return d.archive.archiver
+}
+
 func (d *diskQueueWriter) PutV2(data []byte) (BackendOffset, int32, diskQueueEndInfo, error) {
+	return d.PutV2WithCheck(data, 0)
+}
+
+// PutV2WithCheck will check the size written on disk (include the 4 bytes length) before write
+// if the checkSize is not 0, the size on disk may be different from the data size
+// since the data may be compressed.
+func (d *diskQueueWriter) PutV2WithCheck(data []byte, checkSize int64) (BackendOffset, int32, diskQueueEndInfo, error) {
 	d.Lock()
 
 	if d.exitFlag == 1 {
 		d.Unlock()
 		return 0, 0, diskQueueEndInfo{}, errors.New("exiting")
 	}
-	offset, writeBytes, dend, werr := d.writeOne(data, false, 0)
+	offset, writeBytes, dend, werr := d.writeOne(data, false, 0, checkSize)
 	var e diskQueueEndInfo
 	if dend != nil {
 		e = *dend
@@ -147,7 +256,15 @@ func (d *diskQueueWriter) PutRawV2(data []byte, msgCnt int32) (BackendOffset, in
 		d.Unlock()
 		return 0, 0, diskQueueEndInfo{}, errors.New("exiting")
 	}
-	offset, writeBytes, dend, werr := d.writeOne(data, true, msgCnt)
+	// avoid copy the damaged data from other replica
+	err := CheckRawRecords(data)
+	if err != nil {
+		nsqLog.LogErrorf("DISKQUEUE(%s): raw data check failed at %v: %v", d.name, d.diskWriteEnd, err)
+		d.Unlock()
+		return 0, 0, diskQueueEndInfo{}, &DataCorruptionError{Name: d.name, FileNum: d.diskWriteEnd.EndOffset.FileNum,
+			Pos: d.diskWriteEnd.EndOffset.Pos, Offset: d.diskWriteEnd.Offset(), Reason: err}
+	}
+	offset, writeBytes, dend, werr := d.writeOne(data, true, msgCnt, 0)
 	var e diskQueueEndInfo
 	if dend != nil {
 		e = *dend
@@ -157,6 +274,55 @@ func (d *diskQueueWriter) PutRawV2(data []byte, msgCnt int32) (BackendOffset, in
 	return offset, writeBytes, e, werr
 }
 
+// PutBatchV2 write the messages together, the messages will be compressed
+// as batches if the compression is enabled.
+func (d *diskQueueWriter) PutBatchV2(datas [][]byte, checkSize int64) (BackendOffset, []int32, diskQueueEndInfo, error) {
+	for _, data := range datas {
+		dataLen := int32(len(data))
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return 0, nil, diskQueueEndInfo{}, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+		}
+	}
+	raws := encodeRecordBatch(d.GetCompressCodec(), d.IsChecksumEnabled(), datas, d.maxMsgSize)
+	sizes := make([]int32, 0, len(datas))
+	cnts := make([]int32, 0, len(raws))
+	total := int64(0)
+	for _, raw := range raws {
+		records, err := splitRawRecords(raw)
+		if err != nil {
+			return 0, nil, diskQueueEndInfo{}, err
+		}
+		for _, r := range records {
+			sizes = append(sizes, int32(len(r)))
+		}
+		cnts = append(cnts, int32(len(records)))
+		total += int64(len(raw))
+	}
+	if checkSize > 0 && total != checkSize {
+		return 0, nil, diskQueueEndInfo{}, fmt.Errorf("message write size mismatch %v vs %v", checkSize, total)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return 0, nil, diskQueueEndInfo{}, errors.New("exiting")
+	}
+	var e diskQueueEndInfo
+	writeOffset := d.diskWriteEnd.Offset()
+	for i, raw := range raws {
+		// the batch is written as the raw data to keep it in the same segment
+		_, _, dend, err := d.writeOne(raw, true, cnts[i], 0)
+		if dend != nil {
+			e = *dend
+		}
+		d.needSync = true
+		if err != nil {
+			return writeOffset, nil, e, err
+		}
+	}
+	return writeOffset, sizes, e, nil
+}
+
 // Put writes a []byte to the queue
 func (d *diskQueueWriter) Put(data []byte) (BackendOffset, int32, int64, error) {
 	d.Lock()
@@ -165,7 +331,7 @@ func (d *diskQueueWriter) Put(data []byte) (BackendOffset, int32, int64, error)
 		d.Unlock()
 		return 0, 0, 0, errors.New("exiting")
 	}
-	offset, writeBytes, dend, werr := d.writeOne(data, false, 0)
+	offset, writeBytes, dend, werr := d.writeOne(data, false, 0, 0)
 	var e diskQueueEndInfo
 	if dend != nil {
 		e = *dend
@@ -232,6 +398,7 @@ func (d *diskQueueWriter) ResetWriteWithQueueStart(queueStart BackendQueueEnd) e
 	d.diskQueueStart.totalMsgCnt = queueStart.TotalMsgCnt()
 	d.diskWriteEnd = d.diskQueueStart
 	d.diskReadEnd = d.diskWriteEnd
+	atomic.StoreInt64(&d.syncedOffset, int64(d.diskWriteEnd.Offset()))
 	nsqLog.Warningf("DISKQUEUE %v new queue start : %v:%v", d.name,
 		d.diskQueueStart, d.diskWriteEnd)
 	d.saveExtraMeta()
@@ -333,13 +500,55 @@ func (d *diskQueueWriter) prepareCleanByRetention(cleanEndInfo BackendQueueOffse
 	return &newStart, cleanStartFileNum, cleanFileNum, nil
 }
 
+// archiveBeforeClean upload the segments which will be cleaned, and return the clean end limited
+// to the first segment failed to upload, so the queue start will not be moved past it and
+// the upload will be retried at next clean.
+func (d *diskQueueWriter) archiveBeforeClean(archive *segmentArchive, cleanEndInfo BackendQueueOffset,
+	maxCleanOffset BackendOffset) (BackendQueueOffset, error) {
+	newStart, _, _, err := d.prepareCleanByRetention(cleanEndInfo, true, maxCleanOffset)
+	if err != nil || newStart == nil {
+		return cleanEndInfo, err
+	}
+	d.RLock()
+	startFileNum := d.diskQueueStart.EndOffset.FileNum
+	d.RUnlock()
+	endFileNum := newStart.(*diskQueueEndInfo).EndOffset.FileNum
+	for i := startFileNum; i < endFileNum; i++ {
+		fn := d.fileName(i)
+		err := archive.upload(i)
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to archive data file %v - %s", d.name, fn, err)
+			var limitEnd diskQueueEndInfo
+			limitEnd.EndOffset.FileNum = i
+			return &limitEnd, nil
+		}
+		nsqLog.Logf("DISKQUEUE(%s): archived data file: %v", d.name, fn)
+	}
+	return cleanEndInfo, nil
+}
+
 func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffset,
 	noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
+	d.cleanMutex.Lock()
+	defer d.cleanMutex.Unlock()
+	d.RLock()
+	archive := d.archive
+	d.RUnlock()
+	if archive != nil && !noRealClean {
+		var err error
+		cleanEndInfo, err = d.archiveBeforeClean(archive, cleanEndInfo, maxCleanOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
 	newStart, cleanStartFileNum, cleanFileNum, err := d.prepareCleanByRetention(cleanEndInfo, noRealClean, maxCleanOffset)
 	if err != nil {
 		return nil, err
 	}
 	cleanMetaFileNum := cleanFileNum - MAX_QUEUE_OFFSET_META_DATA_KEEP
+	if archive != nil {
+		archive.cleanCache(archiveCacheKeepTime)
+	}
 	for i := cleanStartFileNum; i < cleanFileNum; i++ {
 		fn := d.fileName(i)
 		innerErr := os.Remove(fn)
@@ -351,6 +560,7 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 		} else {
 			nsqLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
 		}
+		os.Remove(getTimeIndexFileName(fn))
 
 		//remove queue meta file
 		if i <= cleanMetaFileNum {
@@ -382,9 +592,13 @@ func (d *diskQueueWriter) closeCurrentFile() {
 		d.writeFile.Close()
 		d.writeFile = nil
 	}
+	d.closeTimeIndexFile()
 }
 
 func (d *diskQueueWriter) truncateDiskQueueToWriteEnd() {
+	if BackendOffset(atomic.LoadInt64(&d.syncedOffset)) > d.diskWriteEnd.Offset() {
+		atomic.StoreInt64(&d.syncedOffset, int64(d.diskWriteEnd.Offset()))
+	}
 	if d.writeFile != nil {
 		d.writeFile.Truncate(d.diskWriteEnd.EndOffset.Pos)
 		d.writeFile.Close()
@@ -399,9 +613,15 @@ func (d *diskQueueWriter) truncateDiskQueueToWriteEnd() {
 			tmpFile.Close()
 		}
 	}
+	d.closeTimeIndexFile()
+	err := truncateTimeIndex(d.fileName(d.diskWriteEnd.EndOffset.FileNum), d.diskWriteEnd.Offset())
+	if err != nil {
+		nsqLog.LogErrorf("truncate time index failed: %v", err)
+	}
 	cleanNum := d.diskWriteEnd.EndOffset.FileNum + 1
 	for {
 		fileName := d.fileName(cleanNum)
+		os.Remove(getTimeIndexFileName(fileName))
 		err := os.Rename(fileName, fileName+".rolldata")
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -497,6 +717,7 @@ func (d *diskQueueWriter) RemoveTo(destPath string) error {
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
 		}
+		util.AtomicRename(getTimeIndexFileName(fn), getTimeIndexFileName(destFile))
 	}
 	d.diskWriteEnd.EndOffset.FileNum++
 	d.diskWriteEnd.EndOffset.Pos = 0
@@ -561,6 +782,9 @@ func (d *diskQueueWriter) deleteAllFiles(deleted bool) error {
 			cleanStartFileNum = 0
 		}
 		os.Remove(d.extraMetaFileName())
+		if d.archive != nil {
+			d.archive.cleanCache(0)
+		}
 		for i := cleanStartFileNum; i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
 			fName := d.fileName(i) + ".offsetmeta.dat"
 			innerErr := os.Remove(fName)
@@ -590,6 +814,7 @@ func (d *diskQueueWriter) cleanOldData() error {
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			nsqLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
 		}
+		os.Remove(getTimeIndexFileName(fn))
 	}
 
 	d.diskWriteEnd.EndOffset.FileNum++
@@ -650,9 +875,31 @@ func (d *diskQueueWriter) internalGetQueueReadEnd() *diskQueueEndInfo {
 
 // writeOne performs a low level filesystem write for a single []byte
 // while advancing write positions and rolling files, if necessary
-func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (BackendOffset, int32, *diskQueueEndInfo, error) {
+func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32, checkSize int64) (BackendOffset, int32, *diskQueueEndInfo, error) {
 	var err error
 
+	dataLen := int32(len(data))
+	payload := data
+	var recordFlags int32
+	var checksum []byte
+	if !isRaw {
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return 0, 0, nil, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+		}
+		// raw data is copied from other queue, so it should be already compressed if needed
+		if codec := d.GetCompressCodec(); codec != CompressNone {
+			payload, recordFlags = encodeRecordPayload(codec, data)
+		}
+		if d.IsChecksumEnabled() {
+			recordFlags |= recordFlagChecksum
+			checksum = recordChecksumBytes(int32(len(payload)+recordChecksumSize)|recordFlags, payload)
+		}
+		// there are 4bytes data length on disk.
+		if checkSize > 0 && int64(len(payload)+len(checksum))+4 != checkSize {
+			return 0, 0, nil, fmt.Errorf("message write size mismatch %v vs %v", checkSize, len(payload)+len(checksum)+4)
+		}
+	}
+
 	if d.writeFile == nil {
 		curFileName := d.fileName(d.diskWriteEnd.EndOffset.FileNum)
 		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0644)
@@ -662,6 +909,16 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 
 		nsqLog.Logf("DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
 
+		if d.diskWriteEnd.EndOffset.Pos == 0 && atomic.LoadInt32(&d.preallocate) == 1 {
+			err = preallocateFile(d.writeFile, d.maxBytesPerFile)
+			if err != nil {
+				nsqLog.LogErrorf("DISKQUEUE(%s): preallocate %s failed: %v", d.name, curFileName, err)
+				d.writeFile.Close()
+				d.writeFile = nil
+				return 0, 0, nil, err
+			}
+		}
+
 		if d.diskWriteEnd.EndOffset.Pos > 0 {
 			_, err = d.writeFile.Seek(d.diskWriteEnd.EndOffset.Pos, 0)
 			if err != nil {
@@ -677,13 +934,8 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 		}
 	}
 
-	dataLen := int32(len(data))
 	if !isRaw {
-		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
-			return 0, 0, nil, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
-		}
-
-		err = binary.Write(d.bufferWriter, binary.BigEndian, dataLen)
+		err = binary.Write(d.bufferWriter, binary.BigEndian, int32(len(payload)+len(checksum))|recordFlags)
 		if err != nil {
 			d.sync()
 			if d.writeFile != nil {
@@ -694,7 +946,10 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 			return 0, 0, nil, err
 		}
 	}
-	_, err = d.bufferWriter.Write(data)
+	_, err = d.bufferWriter.Write(payload)
+	if err == nil && len(checksum) > 0 {
+		_, err = d.bufferWriter.Write(checksum)
+	}
 	if err != nil {
 		d.sync()
 		if d.writeFile != nil {
@@ -706,10 +961,13 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 	}
 
 	writeOffset := d.diskWriteEnd.Offset()
-	totalBytes := int64(dataLen)
+	totalBytes := int64(len(payload) + len(checksum))
 	if !isRaw {
 		totalBytes += 4
 	}
+	if d.IsTimeIndexEnabled() {
+		d.maybeWriteTimeIndex(writeOffset, data, isRaw)
+	}
 	d.diskWriteEnd.EndOffset.Pos += totalBytes
 	d.diskWriteEnd.virtualEnd += BackendOffset(totalBytes)
 	if !isRaw {
@@ -729,6 +987,7 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 			d.writeFile.Close()
 			d.writeFile = nil
 		}
+		d.closeTimeIndexFile()
 		d.saveFileOffsetMeta()
 		nsqLog.LogDebugf("DISKQUEUE(%s): new file write, last file: %v", d.name, d.diskWriteEnd)
 
@@ -740,6 +999,58 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 	return writeOffset, int32(totalBytes), &d.diskWriteEnd, err
 }
 
+// the time index entry is written without buffer, so it may exceed the data end on disk,
+// the reader should ignore the entries exceed the queue end.
+func (d *diskQueueWriter) maybeWriteTimeIndex(writeOffset BackendOffset, data []byte, isRaw bool) {
+	// always index the first message in the segment
+	if d.diskWriteEnd.EndOffset.Pos != 0 && d.lastTimeIndexOffset >= 0 &&
+		writeOffset-d.lastTimeIndexOffset < timeIndexIntervalBytes {
+		return
+	}
+	msgData := data
+	if isRaw {
+		// only index the first message in the raw data
+		var err error
+		msgData, err = decodeFirstRawRecord(data, d.maxMsgSize)
+		if err == ErrRecordCompacted || err == errRecordBatchRef {
+			return
+		}
+		if err != nil {
+			nsqLog.LogWarningf("DISKQUEUE(%s): decode raw data for time index failed: %v", d.name, err)
+			return
+		}
+	}
+	ts, ok := getMsgTimestampFromData(msgData)
+	if !ok {
+		return
+	}
+	if d.timeIndexFile == nil {
+		fName := getTimeIndexFileName(d.fileName(d.diskWriteEnd.EndOffset.FileNum))
+		f, err := os.OpenFile(fName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			nsqLog.LogErrorf("DISKQUEUE(%s): open time index %v failed: %v", d.name, fName, err)
+			return
+		}
+		d.timeIndexFile = f
+	}
+	e := timeIndexEntry{Timestamp: ts, Offset: writeOffset, Cnt: d.diskWriteEnd.TotalMsgCnt()}
+	_, err := d.timeIndexFile.Write(encodeTimeIndexEntry(e))
+	if err != nil {
+		nsqLog.LogErrorf("DISKQUEUE(%s): write time index failed: %v", d.name, err)
+		d.closeTimeIndexFile()
+		return
+	}
+	d.lastTimeIndexOffset = writeOffset
+}
+
+func (d *diskQueueWriter) closeTimeIndexFile() {
+	if d.timeIndexFile != nil {
+		d.timeIndexFile.Close()
+		d.timeIndexFile = nil
+	}
+	d.lastTimeIndexOffset = -1
+}
+
 func (d *diskQueueWriter) Flush() error {
 	d.Lock()
 	defer d.Unlock()
@@ -788,6 +1099,9 @@ func (d *diskQueueWriter) sync() error {
 			return err
 		}
 	}
+	if d.timeIndexFile != nil {
+		d.timeIndexFile.Sync()
+	}
 
 	if d.diskReadEnd.EndOffset.GreatThan(&d.diskWriteEnd.EndOffset) {
 		nsqLog.LogWarningf("DISKQUEUE(%s): old read is greater: %v, %v", d.name,
@@ -802,9 +1116,42 @@ func (d *diskQueueWriter) sync() error {
 	}
 
 	d.needSync = false
+	atomic.StoreInt64(&d.syncedOffset, int64(d.diskWriteEnd.Offset()))
 	return nil
 }
 
+// SyncTo make sure the data before the offset is fsynced to disk.
+// The concurrent callers will share one fsync (group commit), since
+// the fsync will cover all the data written before it.
+func (d *diskQueueWriter) SyncTo(offset BackendOffset) error {
+	if BackendOffset(atomic.LoadInt64(&d.syncedOffset)) >= offset {
+		return nil
+	}
+	d.syncMutex.Lock()
+	defer d.syncMutex.Unlock()
+	if BackendOffset(atomic.LoadInt64(&d.syncedOffset)) >= offset {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	if offset > d.diskWriteEnd.Offset() {
+		// the data has been rollbacked
+		return ErrInvalidOffset
+	}
+	if !d.needSync {
+		atomic.StoreInt64(&d.syncedOffset, int64(d.diskWriteEnd.Offset()))
+		return nil
+	}
+	return d.sync()
+}
+
+func (d *diskQueueWriter) GetSyncedOffset() BackendOffset {
+	return BackendOffset(atomic.LoadInt64(&d.syncedOffset))
+}
+
 func (d *diskQueueWriter) initQueueReadStart() error {
 	// first try read from meta file
 	err := d.loadExtraMeta()
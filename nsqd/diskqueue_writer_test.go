@@ -2,9 +2,13 @@ package nsqd
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,6 +16,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	_ "github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/test"
 )
@@ -181,6 +186,582 @@ func TestDiskQueueWriterRoll(t *testing.T) {
 	equal(t, int64(dqObj.diskWriteEnd.Offset()), 10*(ml+4))
 }
 
+func TestDiskQueueWriterCompress(t *testing.T) {
+	dqName := "test_disk_queue_compress" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte(strings.Repeat(`{"key":"value","num":12345},`, 100))
+	smallMsg := []byte("test")
+	var offsets []BackendOffset
+	var sizes []int32
+	for _, codec := range []CompressCodec{CompressNone, CompressSnappy, CompressZstd} {
+		dqWriter.SetCompressCodec(codec)
+		for _, m := range [][]byte{msg, smallMsg} {
+			offset, wsize, _, err := dqWriter.PutV2(m)
+			test.Nil(t, err)
+			offsets = append(offsets, offset)
+			sizes = append(sizes, wsize)
+		}
+	}
+	dqWriter.Flush()
+	// compressed size should be less than raw, and the small one should keep raw
+	test.Equal(t, int32(len(msg)+4), sizes[0])
+	test.Equal(t, true, sizes[2] < sizes[0])
+	test.Equal(t, true, sizes[4] < sizes[0])
+	test.Equal(t, int32(len(smallMsg)+4), sizes[3])
+	test.Equal(t, int32(len(smallMsg)+4), sizes[5])
+
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, offsets[5]+BackendOffset(sizes[5]), end.Offset())
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024*1024, 4, 1<<20, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	for i := range offsets {
+		expected := msg
+		if i%2 == 1 {
+			expected = smallMsg
+		}
+		ret, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Nil(t, ret.Err)
+		test.Equal(t, expected, ret.Data)
+		test.Equal(t, offsets[i], ret.Offset)
+		test.Equal(t, BackendOffset(sizes[i]), ret.MovedSize)
+
+		snapRet := snap.ReadOne()
+		test.Nil(t, snapRet.Err)
+		test.Equal(t, expected, snapRet.Data)
+		test.Equal(t, offsets[i], snapRet.Offset)
+	}
+
+	// the size check on replica should use the size on disk
+	dqWriter.SetCompressCodec(CompressSnappy)
+	_, _, _, err = dqWriter.PutV2WithCheck(msg, int64(len(msg)+4))
+	test.NotNil(t, err)
+	_, _, _, err = dqWriter.PutV2WithCheck(msg, int64(sizes[2]))
+	test.Nil(t, err)
+}
+
+func TestDiskQueueWriterCompressBatch(t *testing.T) {
+	dqName := "test_disk_queue_compress_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<12, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqWriter.SetCompressCodec(CompressZstd)
+	dqWriter.SetChecksumEnabled(true)
+
+	var msgs [][]byte
+	rawSize := 0
+	for i := 0; i < 20; i++ {
+		msg := []byte(fmt.Sprintf(`{"key":"value","num":%v}`, i) + strings.Repeat("a", 200))
+		msgs = append(msgs, msg)
+		rawSize += len(msg) + 4 + recordChecksumSize
+	}
+	offset, sizes, end, err := dqWriter.PutBatchV2(msgs, 0)
+	test.Nil(t, err)
+	test.Equal(t, len(msgs), len(sizes))
+	test.Equal(t, int64(len(msgs)), end.TotalMsgCnt())
+	total := int64(0)
+	for _, s := range sizes {
+		total += int64(s)
+	}
+	test.Equal(t, offset+BackendOffset(total), end.Offset())
+	// the messages should be compressed together
+	test.Equal(t, true, total < int64(rawSize)/2)
+	// the size check on replica should use the total size on disk
+	_, _, _, err = dqWriter.PutBatchV2(msgs, total+1)
+	test.NotNil(t, err)
+	dqWriter.Flush()
+
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024*1024, 4, 1<<12, 1, 2*time.Second, nil, true).(*diskQueueReader)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(&end, false)
+	snap := dqWriter.newSnapshot(&end)
+	defer snap.Close()
+	offsets := make([]BackendOffset, 0, len(msgs))
+	nextOffset := offset
+	for i, msg := range msgs {
+		offsets = append(offsets, nextOffset)
+		ret, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Nil(t, ret.Err)
+		test.Equal(t, msg, ret.Data)
+		test.Equal(t, nextOffset, ret.Offset)
+		test.Equal(t, BackendOffset(sizes[i]), ret.MovedSize)
+		test.Equal(t, int64(i+1), ret.CurCnt)
+
+		snapRet := snap.ReadOne()
+		test.Nil(t, snapRet.Err)
+		test.Equal(t, msg, snapRet.Data)
+		test.Equal(t, nextOffset, snapRet.Offset)
+		nextOffset += BackendOffset(sizes[i])
+	}
+	// read from the middle of the batch
+	test.Nil(t, snap.ResetSeekTo(offsets[10]))
+	snapRet := snap.ReadOne()
+	test.Nil(t, snapRet.Err)
+	test.Equal(t, msgs[10], snapRet.Data)
+	_, err = dqReader.ResetReadToOffset(offsets[5], 5)
+	test.Nil(t, err)
+	ret, _ := dqReader.TryReadOne()
+	test.Nil(t, ret.Err)
+	test.Equal(t, msgs[5], ret.Data)
+
+	// the batch copied as raw data should be the same
+	test.Nil(t, snap.ResetSeekTo(offset))
+	raw, err := snap.ReadRaw(int32(total))
+	test.Nil(t, err)
+	test.Nil(t, CheckRawRecords(raw))
+	copyName := dqName + "_copy"
+	copyQueue, _ := NewDiskQueueWriter(copyName, tmpDir, 1024*1024, 4, 1<<12, 1)
+	defer copyQueue.Close()
+	copyWriter := copyQueue.(*diskQueueWriter)
+	_, _, copyEnd, err := copyWriter.PutRawV2(raw, int32(len(msgs)))
+	test.Nil(t, err)
+	copyWriter.Flush()
+	copySnap := copyWriter.newSnapshot(&copyEnd)
+	defer copySnap.Close()
+	for _, msg := range msgs {
+		snapRet := copySnap.ReadOne()
+		test.Nil(t, snapRet.Err)
+		test.Equal(t, msg, snapRet.Data)
+	}
+
+	// the record store should read the batch copied from the segment
+	store := newMemRecordStore(dqName, tmpDir, 1024*1024)
+	recordWriter, err := newRecordQueueWriter(dqName, tmpDir, store, 4, 1<<12)
+	test.Nil(t, err)
+	defer recordWriter.Close()
+	_, _, recordEnd, err := recordWriter.PutRawV2(raw, int32(len(msgs)))
+	test.Nil(t, err)
+	test.Equal(t, copyEnd.Offset(), recordEnd.Offset())
+	r := recordWriter.newReader(dqName, NewOptions(), 1, &recordEnd).(*recordQueueReader)
+	defer r.Close()
+	_, err = r.ResetReadToOffset(offsets[3], 3)
+	test.Nil(t, err)
+	for _, msg := range msgs[3:] {
+		ret, ok := r.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, msg, ret.Data)
+	}
+
+	// the record store should encode the batch the same as the disk queue, and the
+	// reference records should be evicted with the batch record
+	ringName := dqName + "_ring"
+	ringStore := newMemRecordStore(ringName, tmpDir, total+total/2)
+	ringWriter, err := newRecordQueueWriter(ringName, tmpDir, ringStore, 4, 1<<12)
+	test.Nil(t, err)
+	defer ringWriter.Close()
+	ringWriter.SetCompressCodec(CompressZstd)
+	ringWriter.SetChecksumEnabled(true)
+	ringOffset, ringSizes, ringEnd, err := ringWriter.PutBatchV2(msgs, total)
+	test.Nil(t, err)
+	test.Equal(t, offset, ringOffset)
+	test.Equal(t, sizes, ringSizes)
+	test.Equal(t, end.Offset(), ringEnd.Offset())
+	_, _, ringEnd, err = ringWriter.PutBatchV2(msgs, total)
+	test.Nil(t, err)
+	ringStart, _ := ringStore.bounds()
+	test.Equal(t, true, ringStart.Offset() > ringOffset)
+	test.Equal(t, true, ringStart.Offset() <= ringEnd.Offset()-BackendOffset(total))
+	r2 := ringWriter.newReader(ringName, NewOptions(), 1, &ringEnd).(*recordQueueReader)
+	defer r2.Close()
+	_, err = r2.ResetReadToOffset(ringStart.Offset(), ringStart.TotalMsgCnt())
+	test.Nil(t, err)
+	var ringMsgs [][]byte
+	for {
+		ret, ok := r2.TryReadOne()
+		if !ok {
+			break
+		}
+		test.Nil(t, ret.Err)
+		ringMsgs = append(ringMsgs, ret.Data)
+	}
+	test.Equal(t, ringEnd.TotalMsgCnt()-ringStart.TotalMsgCnt(), int64(len(ringMsgs)))
+	test.Equal(t, msgs, ringMsgs[len(ringMsgs)-len(msgs):])
+	// the clean should keep the batch record if the reference records are kept
+	newStart, err := ringWriter.CleanOldDataByRetention(&diskQueueEndInfo{virtualEnd: ringStart.Offset() + BackendOffset(sizes[0])},
+		false, 0)
+	test.Nil(t, err)
+	test.Equal(t, ringStart.Offset(), newStart.Offset())
+}
+
+func TestDecompressRecordLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1<<20)
+	for _, codec := range []CompressCodec{CompressSnappy, CompressZstd} {
+		payload, flags := encodeRecordPayload(codec, data)
+		test.Equal(t, int32(recordFlagCompressed), flags)
+		test.Equal(t, true, len(payload) < len(data)/10)
+		decoded, err := decodeRecordPayload(flags, payload, int32(len(data)))
+		test.Nil(t, err)
+		test.Equal(t, data, decoded)
+		_, err = decodeRecordPayload(flags, payload, int32(len(data)-1))
+		test.Equal(t, ErrRecordTooLarge, err)
+	}
+	// the zstd data without the content size in header should also be limited
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	test.Nil(t, err)
+	_, err = w.Write(data)
+	test.Nil(t, err)
+	test.Nil(t, w.Close())
+	payload := append([]byte{byte(CompressZstd)}, buf.Bytes()...)
+	decoded, err := decodeRecordPayload(recordFlagCompressed, payload, int32(len(data)))
+	test.Nil(t, err)
+	test.Equal(t, data, decoded)
+	_, err = decodeRecordPayload(recordFlagCompressed, payload, int32(len(data)-1))
+	test.NotNil(t, err)
+
+	// the batch should be split by the max size
+	msgs := [][]byte{data[:100], data[:200], data[:300]}
+	raws := encodeRecordBatch(CompressSnappy, false, msgs, 4+100+4+200)
+	test.Equal(t, 2, len(raws))
+	batch, err := splitRawRecords(raws[0])
+	test.Nil(t, err)
+	test.Equal(t, 2, len(batch))
+	_, err = decodeFirstRawRecord(batch[0], 4+100+4+200-1)
+	test.Equal(t, ErrRecordTooLarge, err)
+	_, err = decodeFirstRawRecord(batch[1], 4+100+4+200)
+	test.Equal(t, errRecordBatchRef, err)
+}
+
+func TestDiskQueueWriterChecksum(t *testing.T) {
+	dqName := "test_disk_queue_checksum" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte(strings.Repeat(`{"key":"value","num":12345},`, 10))
+	// old record without checksum should be readable
+	_, wsize, _, err := dqWriter.PutV2(msg)
+	test.Nil(t, err)
+	test.Equal(t, int32(len(msg)+4), wsize)
+	dqWriter.SetChecksumEnabled(true)
+	offset1, wsize1, _, err := dqWriter.PutV2(msg)
+	test.Nil(t, err)
+	test.Equal(t, int32(len(msg)+4+recordChecksumSize), wsize1)
+	dqWriter.SetCompressCodec(CompressSnappy)
+	offset2, wsize2, _, err := dqWriter.PutV2(msg)
+	test.Nil(t, err)
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, offset2+BackendOffset(wsize2), end.Offset())
+
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	for i := 0; i < 3; i++ {
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		test.Equal(t, msg, ret.Data)
+	}
+	test.Nil(t, snap.ResetSeekTo(offset1))
+	raw, err := snap.ReadRaw(wsize1 + wsize2)
+	test.Nil(t, err)
+	test.Nil(t, CheckRawRecords(raw))
+	// flip one bit in the last record
+	fileName := dqWriter.fileName(0)
+	data, err := ioutil.ReadFile(fileName)
+	test.Nil(t, err)
+	data[int64(offset2)+int64(wsize2)-6] ^= 0x01
+	err = ioutil.WriteFile(fileName, data, 0644)
+	test.Nil(t, err)
+	raw[len(raw)-6] ^= 0x01
+	test.Equal(t, ErrRecordChecksumMismatch, CheckRawRecords(raw))
+	// the damaged data should not be copied
+	_, _, _, err = dqWriter.PutRawV2(raw, 2)
+	test.Equal(t, true, IsDataCorruption(err))
+
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024*1024, 4, 1<<20, 1, 2*time.Second, nil, false)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	for i := 0; i < 2; i++ {
+		ret, hasData := dqReader.TryReadOne()
+		test.Equal(t, true, hasData)
+		test.Nil(t, ret.Err)
+		test.Equal(t, msg, ret.Data)
+	}
+	ret, hasData := dqReader.TryReadOne()
+	test.Equal(t, true, hasData)
+	test.Equal(t, true, IsDataCorruption(ret.Err))
+	test.Equal(t, ErrRecordChecksumMismatch, ret.Err.(*DataCorruptionError).Reason)
+	test.Equal(t, offset2, ret.Err.(*DataCorruptionError).Offset)
+
+	test.Nil(t, snap.ResetSeekTo(offset2))
+	snapRet := snap.ReadOne()
+	test.Equal(t, true, IsDataCorruption(snapRet.Err))
+}
+
+func TestDiskQueueWriterTimeIndex(t *testing.T) {
+	dqName := "test_disk_queue_time_index" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*200, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqWriter.SetTimeIndexEnabled(true)
+
+	msg := make([]byte, 1024)
+	baseTs := time.Now().UnixNano()
+	var offsets []BackendOffset
+	for i := 0; i < 1000; i++ {
+		binary.BigEndian.PutUint64(msg[:8], uint64(baseTs+int64(i)*int64(time.Millisecond)))
+		offset, _, _, err := dqWriter.PutV2(msg)
+		test.Nil(t, err)
+		offsets = append(offsets, offset)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, end.(*diskQueueEndInfo).EndOffset.FileNum > 3)
+	entries, err := readTimeIndex(dqWriter.fileName(1))
+	test.Nil(t, err)
+	test.Equal(t, true, len(entries) > 1)
+	test.Equal(t, true, entries[0].Offset < entries[1].Offset)
+
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	snap.SetQueueStart(dqWriter.GetQueueReadStart())
+	for _, i := range []int{0, 1, 63, 64, 65, 200, 555, 999} {
+		offset, cnt, err := snap.SearchByTimestamp(baseTs + int64(i)*int64(time.Millisecond))
+		test.Nil(t, err)
+		test.Equal(t, offsets[i], offset)
+		test.Equal(t, int64(i), cnt)
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		test.Equal(t, offsets[i], ret.Offset)
+	}
+	// search between two messages should return the next one
+	offset, cnt, err := snap.SearchByTimestamp(baseTs + int64(100)*int64(time.Millisecond) - 1)
+	test.Nil(t, err)
+	test.Equal(t, offsets[100], offset)
+	test.Equal(t, int64(100), cnt)
+	// search before all messages and after all messages
+	offset, cnt, err = snap.SearchByTimestamp(baseTs - 1)
+	test.Nil(t, err)
+	test.Equal(t, offsets[0], offset)
+	test.Equal(t, int64(0), cnt)
+	offset, cnt, err = snap.SearchByTimestamp(baseTs + int64(time.Hour))
+	test.Nil(t, err)
+	test.Equal(t, end.Offset(), offset)
+	test.Equal(t, end.TotalMsgCnt(), cnt)
+
+	// the time index should be truncated while reset the write end
+	_, err = dqWriter.ResetWriteEndV2(offsets[500], 500)
+	test.Nil(t, err)
+	end = dqWriter.GetQueueWriteEnd()
+	fileNum := end.(*diskQueueEndInfo).EndOffset.FileNum
+	entries, err = readTimeIndex(dqWriter.fileName(fileNum))
+	test.Nil(t, err)
+	for _, e := range entries {
+		test.Equal(t, true, e.Offset < offsets[500])
+	}
+	_, err = os.Stat(getTimeIndexFileName(dqWriter.fileName(fileNum + 1)))
+	test.Equal(t, true, os.IsNotExist(err))
+	snap.UpdateQueueEnd(end)
+	offset, cnt, err = snap.SearchByTimestamp(baseTs + int64(600)*int64(time.Millisecond))
+	test.Nil(t, err)
+	test.Equal(t, offsets[500], offset)
+	test.Equal(t, int64(500), cnt)
+}
+
+func TestDiskQueueWriterArchive(t *testing.T) {
+	dqName := "test_disk_queue_archive" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	archiver, err := NewLocalDirArchiver(path.Join(tmpDir, "archive"))
+	test.Nil(t, err)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*10, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqWriter.SetTimeIndexEnabled(true)
+	dqWriter.SetArchiver(archiver)
+
+	msg := make([]byte, 1024)
+	baseTs := time.Now().UnixNano()
+	var offsets []BackendOffset
+	for i := 0; i < 100; i++ {
+		binary.BigEndian.PutUint64(msg[:8], uint64(baseTs+int64(i)*int64(time.Millisecond)))
+		offset, _, _, err := dqWriter.PutV2(msg)
+		test.Nil(t, err)
+		offsets = append(offsets, offset)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	snap.SetQueueStart(dqWriter.GetQueueReadStart())
+	err = snap.SeekTo(offsets[50])
+	test.Nil(t, err)
+	_, err = dqWriter.CleanOldDataByRetention(snap.GetCurrentReadQueueOffset(), false, 0)
+	test.Nil(t, err)
+	start := dqWriter.GetQueueReadStart()
+	test.Equal(t, true, start.Offset() > offsets[1])
+	_, err = os.Stat(dqWriter.fileName(0))
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(tmpDir, "archive", getArchiveKey(dqName, dqWriter.fileName(0))))
+	test.Nil(t, err)
+
+	snap = NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	snap.SetQueueStart(start)
+	err = snap.ResetSeekTo(offsets[1])
+	test.Equal(t, ErrReadQueueAlreadyCleaned, err)
+	snap.SetArchiver(archiver)
+	err = snap.ResetSeekTo(offsets[1])
+	test.Nil(t, err)
+	for i := 1; i < len(offsets); i++ {
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		test.Equal(t, offsets[i], ret.Offset)
+		ts, _ := getMsgTimestampFromData(ret.Data)
+		test.Equal(t, baseTs+int64(i)*int64(time.Millisecond), ts)
+	}
+	// seek from the archived to the local data
+	err = snap.ResetSeekTo(offsets[2])
+	test.Nil(t, err)
+	err = snap.SeekTo(offsets[60])
+	test.Nil(t, err)
+	ret := snap.ReadOne()
+	test.Nil(t, ret.Err)
+	test.Equal(t, offsets[60], ret.Offset)
+
+	offset, cnt, err := snap.SearchByTimestamp(baseTs + int64(5)*int64(time.Millisecond))
+	test.Nil(t, err)
+	test.Equal(t, offsets[5], offset)
+	test.Equal(t, int64(5), cnt)
+
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024*10, 4, 1<<20, 1, 2*time.Second, end, true).(*diskQueueReader)
+	defer dqReader.Close()
+	dqReader.SetArchiver(archiver)
+	_, err = dqReader.ResetReadToOffset(offsets[3], 3)
+	test.Nil(t, err)
+	for i := 3; i < 30; i++ {
+		ret, _ := dqReader.TryReadOne()
+		test.Nil(t, ret.Err)
+		test.Equal(t, offsets[i], ret.Offset)
+	}
+
+	// cached segments should be removed after expired
+	dqWriter.archive.cleanCache(0)
+	_, err = os.Stat(dqWriter.archive.cacheFileName(0))
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+type failedArchiver struct {
+	SegmentArchiver
+	failed int32
+}
+
+func (a *failedArchiver) Upload(key string, localFile string) error {
+	if atomic.LoadInt32(&a.failed) == 1 {
+		return errors.New("upload failed")
+	}
+	return a.SegmentArchiver.Upload(key, localFile)
+}
+
+func TestDiskQueueWriterArchiveFailed(t *testing.T) {
+	dqName := "test_disk_queue_archive_failed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	localArchiver, err := NewLocalDirArchiver(path.Join(tmpDir, "archive"))
+	test.Nil(t, err)
+	archiver := &failedArchiver{SegmentArchiver: localArchiver, failed: 1}
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*10, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+	dqWriter.SetArchiver(archiver)
+
+	msg := make([]byte, 1024)
+	var offsets []BackendOffset
+	for i := 0; i < 100; i++ {
+		offset, _, _, err := dqWriter.PutV2(msg)
+		test.Nil(t, err)
+		offsets = append(offsets, offset)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	snap.SetQueueStart(dqWriter.GetQueueReadStart())
+	err = snap.SeekTo(offsets[50])
+	test.Nil(t, err)
+	// the queue start should not be moved if failed to upload
+	_, err = dqWriter.CleanOldDataByRetention(snap.GetCurrentReadQueueOffset(), false, 0)
+	test.Nil(t, err)
+	test.Equal(t, offsets[0], dqWriter.GetQueueReadStart().Offset())
+	_, err = os.Stat(dqWriter.fileName(0))
+	test.Nil(t, err)
+
+	atomic.StoreInt32(&archiver.failed, 0)
+	_, err = dqWriter.CleanOldDataByRetention(snap.GetCurrentReadQueueOffset(), false, 0)
+	test.Nil(t, err)
+	test.Equal(t, true, dqWriter.GetQueueReadStart().Offset() > offsets[1])
+	_, err = os.Stat(dqWriter.fileName(0))
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(tmpDir, "archive", getArchiveKey(dqName, dqWriter.fileName(0))))
+	test.Nil(t, err)
+}
+
+func TestDiskQueueWriterGroupCommitSync(t *testing.T) {
+	dqName := "test_disk_queue_group_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*1024, 4, 1<<20, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte("test group commit sync")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				offset, wsize, _, err := dqWriter.PutV2(msg)
+				test.Nil(t, err)
+				test.Nil(t, dqWriter.SyncTo(offset+BackendOffset(wsize)))
+				test.Equal(t, true, dqWriter.GetSyncedOffset() >= offset+BackendOffset(wsize))
+			}
+		}()
+	}
+	wg.Wait()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, end.Offset(), dqWriter.GetSyncedOffset())
+	test.Equal(t, false, dqWriter.needSync)
+
+	// the synced offset should be rollbacked with the write end
+	rollSize := BackendOffset(len(msg) + 4)
+	_, err = dqWriter.RollbackWriteV2(end.Offset()-rollSize, 1)
+	test.Nil(t, err)
+	test.Equal(t, end.Offset()-rollSize, dqWriter.GetSyncedOffset())
+	test.Equal(t, ErrInvalidOffset, dqWriter.SyncTo(end.Offset()))
+	offset, wsize, _, err := dqWriter.PutV2(msg)
+	test.Nil(t, err)
+	test.Equal(t, end.Offset(), offset+BackendOffset(wsize))
+	test.Equal(t, end.Offset()-rollSize, dqWriter.GetSyncedOffset())
+	test.Nil(t, dqWriter.SyncTo(end.Offset()))
+	test.Equal(t, end.Offset(), dqWriter.GetSyncedOffset())
+}
+
 func TestDiskQueueWriterRollbackAndResetWrite(t *testing.T) {
 	//l := newTestLogger(t)
 	//nsqLog.Logger = l
@@ -784,6 +1365,288 @@ func benchmarkDiskQueueWriterPut(size int64, syncEvery int64, b *testing.B) {
 	}
 	b.StopTimer()
 }
+func testRecordQueueStorage(t *testing.T, newStore func(name string, dataPath string) (recordStore, error)) {
+	dqName := "test_record_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	store, err := newStore(dqName, tmpDir)
+	test.Nil(t, err)
+	dq, err := newRecordQueueWriter(dqName, tmpDir, store, 0, 1<<10)
+	test.Nil(t, err)
+	defer dq.Close()
+	dq.SetChecksumEnabled(true)
+
+	msg := []byte("test")
+	var ends []diskQueueEndInfo
+	for i := 0; i < 10; i++ {
+		_, _, end, err := dq.PutV2(msg)
+		test.Nil(t, err)
+		ends = append(ends, end)
+	}
+	dq.Flush()
+	test.Equal(t, int64(10), dq.GetQueueReadEnd().TotalMsgCnt())
+
+	r := newRecordQueueReader(dqName, dqName, tmpDir, store, 1, nil)
+	defer r.Close()
+	r.ResetReadToOffset(0, 0)
+	r.UpdateQueueEnd(dq.GetQueueReadEnd(), false)
+	test.Equal(t, int64(10), r.Depth())
+	for i := 0; i < 10; i++ {
+		ret, ok := r.TryReadOne()
+		test.Equal(t, true, ok)
+		test.Nil(t, ret.Err)
+		test.Equal(t, msg, ret.Data)
+		test.Equal(t, int64(i+1), ret.CurCnt)
+	}
+	_, ok := r.TryReadOne()
+	test.Equal(t, false, ok)
+
+	snap := dq.newSnapshot(dq.GetQueueReadEnd())
+	err = snap.SeekTo(ends[4].Offset())
+	test.Nil(t, err)
+	ret := snap.ReadOne()
+	test.Nil(t, ret.Err)
+	test.Equal(t, ends[4].Offset(), ret.Offset)
+	test.Equal(t, msg, ret.Data)
+	// seek to the middle of the record should fail
+	err = snap.SeekTo(ends[4].Offset() + 1)
+	test.NotNil(t, err)
+
+	end, err := dq.RollbackWriteV2(ends[7].Offset(), 2)
+	test.Nil(t, err)
+	test.Equal(t, ends[7], end)
+	_, err = dq.CleanOldDataByRetention(&ends[2], false, ends[7].Offset())
+	test.Nil(t, err)
+	test.Equal(t, ends[2].Offset(), dq.GetQueueReadStart().Offset())
+	test.Equal(t, int64(8), dq.GetQueueReadEnd().TotalMsgCnt())
+}
+
+func TestRecordQueueMemoryStorage(t *testing.T) {
+	testRecordQueueStorage(t, func(name string, dataPath string) (recordStore, error) {
+		return newMemRecordStore(name, dataPath, 1024), nil
+	})
+}
+
+func TestRecordQueueKVStorage(t *testing.T) {
+	testRecordQueueStorage(t, func(name string, dataPath string) (recordStore, error) {
+		return newBoltRecordStore(name, dataPath)
+	})
+}
+
+func TestResolveBackendStorage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opt := NewOptions()
+	// the ephemeral topic should use the node default storage if not specified
+	storage, err := resolveBackendStorage(tmpDir, getBackendName("test#ephemeral", 0), "", opt)
+	test.Nil(t, err)
+	test.Equal(t, BackendStorageFiles, storage)
+	storage, err = resolveBackendStorage(tmpDir, getBackendName("test_memory", 0), BackendStorageMemory, opt)
+	test.Nil(t, err)
+	test.Equal(t, BackendStorageMemory, storage)
+	// the saved storage can not be changed
+	storage, err = resolveBackendStorage(tmpDir, getBackendName("test_memory", 0), BackendStorageKV, opt)
+	test.Nil(t, err)
+	test.Equal(t, BackendStorageMemory, storage)
+	_, err = resolveBackendStorage(tmpDir, getBackendName("test_unknown", 0), "unknown", opt)
+	test.Equal(t, ErrUnknownBackendStorage, err)
+}
+
+func TestRecordQueueMemoryStorageEvict(t *testing.T) {
+	dqName := "test_record_queue_evict" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	store := newMemRecordStore(dqName, tmpDir, 100)
+	dq, err := newRecordQueueWriter(dqName, tmpDir, store, 0, 1<<10)
+	test.Nil(t, err)
+	defer dq.Close()
+	for i := 0; i < 20; i++ {
+		_, _, _, err := dq.PutV2(make([]byte, 16))
+		test.Nil(t, err)
+	}
+	dq.Flush()
+	start, end := store.bounds()
+	test.Equal(t, true, start.Offset() > 0)
+	test.Equal(t, true, int64(end.Offset()-start.Offset()) <= 100)
+
+	// the reader at the cleaned position should jump to the oldest data
+	r := newRecordQueueReader(dqName, dqName, tmpDir, store, 1, nil)
+	defer r.Close()
+	r.ResetReadToOffset(0, 0)
+	r.UpdateQueueEnd(dq.GetQueueReadEnd(), false)
+	ret, ok := r.TryReadOne()
+	test.Equal(t, true, ok)
+	test.Nil(t, ret.Err)
+	test.Equal(t, start.Offset(), ret.Offset)
+}
+
+func TestDiskQueueCompactByKey(t *testing.T) {
+	dqName := "test_disk_queue_compact" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 100, 0, 1<<10, 1)
+	dq := queue.(*diskQueueWriter)
+	defer dq.Close()
+
+	getKey := func(data []byte) (string, bool) {
+		i := bytes.IndexByte(data, ':')
+		if i < 0 {
+			return "", false
+		}
+		return string(data[:i]), true
+	}
+	msgNum := 30
+	for i := 0; i < msgNum; i++ {
+		var data []byte
+		if i%5 == 4 {
+			data = []byte("nokey-" + strconv.Itoa(i))
+		} else {
+			data = []byte(fmt.Sprintf("k%v:%02d", i%3, i))
+		}
+		_, _, _, err := dq.PutV2(data)
+		test.Nil(t, err)
+	}
+	dq.Flush()
+	end := dq.GetQueueReadEnd().(*diskQueueEndInfo)
+	test.Equal(t, true, end.EndOffset.FileNum > 1)
+	oldSize := make(map[int64]int64)
+	for i := int64(0); i < end.EndOffset.FileNum; i++ {
+		stat, err := os.Stat(dq.fileName(i))
+		test.Nil(t, err)
+		oldSize[i] = stat.Size()
+	}
+
+	removed, err := dq.CompactByKey(end, getKey)
+	test.Nil(t, err)
+	test.Equal(t, true, removed > 0)
+	for i := int64(0); i < end.EndOffset.FileNum; i++ {
+		stat, err := os.Stat(dq.fileName(i))
+		test.Nil(t, err)
+		test.Equal(t, oldSize[i], stat.Size())
+	}
+	// compact again should remove nothing
+	removed, err = dq.CompactByKey(end, getKey)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), removed)
+
+	// the channel reader skip the compacted records and keep the count
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 100, 0, 1<<10, 1, 2*time.Second, nil, true).(*diskQueueReader)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	dqReader.ResetReadToOffset(0, 0)
+	var readList []string
+	nextOffset := BackendOffset(0)
+	for {
+		ret, ok := dqReader.TryReadOne()
+		if !ok {
+			break
+		}
+		test.Nil(t, ret.Err)
+		test.Equal(t, nextOffset, ret.Offset)
+		nextOffset = ret.Offset + ret.MovedSize
+		readList = append(readList, string(ret.Data))
+		dqReader.ConfirmRead(nextOffset, ret.CurCnt)
+	}
+	test.Equal(t, end.Offset(), nextOffset)
+	test.Equal(t, end.TotalMsgCnt(), dqReader.GetQueueConfirmed().TotalMsgCnt())
+	test.Equal(t, true, len(readList) < msgNum)
+	keys := make(map[string]bool)
+	for _, d := range readList {
+		if k, ok := getKey([]byte(d)); ok {
+			keys[k] = true
+		}
+	}
+	test.Equal(t, 3, len(keys))
+	test.Equal(t, "nokey-29", readList[len(readList)-1])
+	// the newest message of each key should be kept
+	test.Equal(t, []string{"k2:26", "k0:27", "k1:28"}, readList[len(readList)-4:len(readList)-1])
+
+	// the snapshot can read all the records including the compacted
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	snap.SetQueueStart(dq.GetQueueReadStart())
+	test.Nil(t, snap.SeekTo(0))
+	cnt := 0
+	compacted := 0
+	for {
+		ret := snap.ReadOneRecord()
+		if ret.Err == io.EOF {
+			break
+		}
+		if ret.Err == ErrRecordCompacted {
+			compacted++
+		} else {
+			test.Nil(t, ret.Err)
+		}
+		cnt++
+	}
+	test.Equal(t, msgNum, cnt)
+	test.Equal(t, msgNum-len(readList), compacted)
+	test.Nil(t, snap.ResetSeekTo(0))
+	ret := snap.ReadOne()
+	test.Nil(t, ret.Err)
+	test.Equal(t, readList[0], string(ret.Data))
+}
+
+func TestDiskQueueCompactByKeyWithBatch(t *testing.T) {
+	dqName := "test_disk_queue_compact_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 50, 0, 1<<10, 1)
+	dq := queue.(*diskQueueWriter)
+	defer dq.Close()
+	dq.SetCompressCodec(CompressSnappy)
+
+	getKey := func(data []byte) (string, bool) {
+		i := bytes.IndexByte(data, ':')
+		if i < 0 {
+			return "", false
+		}
+		return string(data[:i]), true
+	}
+	// each batch is in its own segment and the later one has the same keys
+	for b := 0; b < 3; b++ {
+		var msgs [][]byte
+		for i := 0; i < 5; i++ {
+			msgs = append(msgs, []byte(fmt.Sprintf("k%v:%v-%v", i, b, strings.Repeat("v", 50))))
+		}
+		_, sizes, _, err := dq.PutBatchV2(msgs, 0)
+		test.Nil(t, err)
+		test.Equal(t, true, sizes[1] < int32(len(msgs[1])))
+	}
+	dq.Flush()
+	end := dq.GetQueueReadEnd().(*diskQueueEndInfo)
+	test.Equal(t, int64(3), end.EndOffset.FileNum)
+
+	removed, err := dq.CompactByKey(end, getKey)
+	test.Nil(t, err)
+	test.Equal(t, true, removed > 0)
+
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 50, 0, 1<<10, 1, 2*time.Second, nil, true).(*diskQueueReader)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	dqReader.ResetReadToOffset(0, 0)
+	var readList []string
+	for {
+		ret, ok := dqReader.TryReadOne()
+		if !ok {
+			break
+		}
+		test.Nil(t, ret.Err)
+		readList = append(readList, string(ret.Data))
+		dqReader.ConfirmRead(ret.Offset+ret.MovedSize, ret.CurCnt)
+	}
+	test.Equal(t, end.TotalMsgCnt(), dqReader.GetQueueConfirmed().TotalMsgCnt())
+	// the batch records should be kept while the other old messages in batch are removed
+	test.Equal(t, 7, len(readList))
+	test.Equal(t, fmt.Sprintf("k0:0-%v", strings.Repeat("v", 50)), readList[0])
+	test.Equal(t, fmt.Sprintf("k0:1-%v", strings.Repeat("v", 50)), readList[1])
+	test.Equal(t, fmt.Sprintf("k4:2-%v", strings.Repeat("v", 50)), readList[6])
+}
 
 // you might want to run this like
 // $ go test -bench=DiskQueueReaderGet -benchtime 0.1s
@@ -24,10 +24,12 @@ import (
 //	"filter_ext_key":"xx",
 //	"filter_data":"glob rule",
 // }
+// {
+//	"ver":5,
+//	"filter_data":"region == \"east\" and (level >= 3 or exists(vip))",
+// }
 // ver is used to extend other filter type
-// currently support equal, regexp, glob
-// TODO: maybe support multi ext key rule chains
-// such as, filter if match_rule1(ext_key1) and match_rule2(ext_key2) or match_rule3(ext_key3)
+// currently support equal, regexp, glob, multi equal and the expression on multi ext keys
 var (
 	ErrNotSupportedFilter = errors.New("the filter type not supported")
 	ErrInvalidFilter      = errors.New("invalid filter rule")
@@ -146,6 +148,10 @@ func (f *extMultiFilter) Match(msg *Message) bool {
 func NewExtFilter(filter ExtFilterData) (IExtFilter, error) {
 	var cf IExtFilter
 	var err error
+	if filter.Type == 5 {
+		// the expression contains the keys
+		return NewExtExprFilter(filter.FilterData)
+	}
 	if filter.FilterExtKey == "" {
 		return nil, ErrInvalidFilter
 	}
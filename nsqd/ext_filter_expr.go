@@ -0,0 +1,531 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/youzan/nsq/internal/ext"
+)
+
+// The filter expression is compiled once and matched against the json header of the message,
+// the syntax is as below (the keywords are case insensitive):
+//
+//	expr   := or
+//	or     := and { ("or" | "||") and }
+//	and    := not { ("and" | "&&") not }
+//	not    := ("not" | "!") not | "(" expr ")" | cond
+//	cond   := key ("==" | "!=") value
+//	        | key (">" | ">=" | "<" | "<=") number
+//	        | key ["not"] "in" "(" value { "," value } ")"
+//	        | key "prefix" string
+//	        | "exists" "(" key ")"
+//	value  := string | number
+//
+// The key is the name of the header field, which can be quoted if it contains the chars other
+// than letters, digits and "_#.-:". The string value is quoted by the double or single quotes.
+// The number value matches both the number field and the string field of the number, such as:
+//
+//	region == "east" and (level >= 3 or biz in ("pay", "refund")) and not exists(##zan_test)
+
+const (
+	maxFilterExprLen   = 4096
+	maxFilterExprDepth = 32
+)
+
+type exprTokenType int
+
+const (
+	tokEOF exprTokenType = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokLParen
+	tokRParen
+	tokComma
+	tokOp
+)
+
+type exprToken struct {
+	typ exprTokenType
+	val string
+	pos int
+}
+
+func isExprIdentStart(c byte) bool {
+	return c == '_' || c == '#' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isExprIdentChar(c byte) bool {
+	return isExprIdentStart(c) || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == ':'
+}
+
+func isExprDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func tokenizeFilterExpr(s string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, exprToken{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, exprToken{tokRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, exprToken{tokComma, ",", i})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb bytes.Buffer
+			closed := false
+			for i < len(s) {
+				if s[i] == '\\' && i+1 < len(s) {
+					sb.WriteByte(s[i+1])
+					i += 2
+					continue
+				}
+				if s[i] == c {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(s[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string at %v", start)
+			}
+			tokens = append(tokens, exprToken{tokString, sb.String(), start})
+		case isExprDigit(c) || (c == '-' && i+1 < len(s) && isExprDigit(s[i+1])):
+			start := i
+			i++
+			for i < len(s) && (isExprDigit(s[i]) || s[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokNumber, s[start:i], start})
+		case isExprIdentStart(c):
+			start := i
+			for i < len(s) && isExprIdentChar(s[i]) {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokIdent, s[start:i], start})
+		case strings.ContainsRune("=!<>&|", rune(c)):
+			start := i
+			op := string(c)
+			if i+1 < len(s) {
+				two := s[i : i+2]
+				switch two {
+				case "==", "!=", ">=", "<=", "&&", "||":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("unknown operator %q at %v", op, start)
+			}
+			i += len(op)
+			tokens = append(tokens, exprToken{tokOp, op, start})
+		default:
+			return nil, fmt.Errorf("unexpected char %q at %v", c, i)
+		}
+	}
+	tokens = append(tokens, exprToken{tokEOF, "", len(s)})
+	return tokens, nil
+}
+
+type exprValue struct {
+	isNum bool
+	num   float64
+	str   string
+}
+
+// exprField is the decoded value of the header field
+type exprField struct {
+	isStr bool
+	str   string
+	isNum bool
+	num   float64
+}
+
+func getExprField(header map[string]json.RawMessage, key string) exprField {
+	raw, ok := header[key]
+	if !ok {
+		return exprField{}
+	}
+	var f exprField
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		f.isStr = true
+		f.str = str
+		if n, err := strconv.ParseFloat(str, 64); err == nil {
+			f.isNum = true
+			f.num = n
+		}
+		return f
+	}
+	var n float64
+	if json.Unmarshal(raw, &n) == nil {
+		f.isNum = true
+		f.num = n
+	}
+	return f
+}
+
+func (f exprField) equal(v exprValue) bool {
+	if v.isNum {
+		return f.isNum && f.num == v.num
+	}
+	return f.isStr && f.str == v.str
+}
+
+type exprNode interface {
+	eval(header map[string]json.RawMessage) bool
+}
+
+type exprAnd struct {
+	left, right exprNode
+}
+
+func (e *exprAnd) eval(h map[string]json.RawMessage) bool {
+	return e.left.eval(h) && e.right.eval(h)
+}
+
+type exprOr struct {
+	left, right exprNode
+}
+
+func (e *exprOr) eval(h map[string]json.RawMessage) bool {
+	return e.left.eval(h) || e.right.eval(h)
+}
+
+type exprNot struct {
+	x exprNode
+}
+
+func (e *exprNot) eval(h map[string]json.RawMessage) bool {
+	return !e.x.eval(h)
+}
+
+type exprCompare struct {
+	key string
+	op  string
+	val exprValue
+}
+
+func (e *exprCompare) eval(h map[string]json.RawMessage) bool {
+	f := getExprField(h, e.key)
+	switch e.op {
+	case "==":
+		return f.equal(e.val)
+	case "!=":
+		return !f.equal(e.val)
+	}
+	if !f.isNum {
+		return false
+	}
+	switch e.op {
+	case ">":
+		return f.num > e.val.num
+	case ">=":
+		return f.num >= e.val.num
+	case "<":
+		return f.num < e.val.num
+	case "<=":
+		return f.num <= e.val.num
+	}
+	return false
+}
+
+type exprIn struct {
+	key  string
+	vals []exprValue
+}
+
+func (e *exprIn) eval(h map[string]json.RawMessage) bool {
+	f := getExprField(h, e.key)
+	for _, v := range e.vals {
+		if f.equal(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type exprPrefix struct {
+	key    string
+	prefix string
+}
+
+func (e *exprPrefix) eval(h map[string]json.RawMessage) bool {
+	f := getExprField(h, e.key)
+	return f.isStr && strings.HasPrefix(f.str, e.prefix)
+}
+
+type exprExists struct {
+	key string
+}
+
+func (e *exprExists) eval(h map[string]json.RawMessage) bool {
+	_, ok := h[e.key]
+	return ok
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) errorf(t exprToken, format string, args ...interface{}) error {
+	return fmt.Errorf("invalid filter expression at %v: %v", t.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) isKeyword(t exprToken, words ...string) bool {
+	if t.typ == tokIdent {
+		for _, w := range words {
+			if strings.EqualFold(t.val, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *exprParser) isOp(t exprToken, ops ...string) bool {
+	if t.typ == tokOp {
+		for _, op := range ops {
+			if t.val == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(p.peek(), "or") || p.isOp(p.peek(), "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(p.peek(), "and") || p.isOp(p.peek(), "&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	t := p.peek()
+	if p.depth > maxFilterExprDepth {
+		return nil, p.errorf(t, "too deep")
+	}
+	if p.isKeyword(t, "not") || p.isOp(t, "!") {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{x}, nil
+	}
+	if t.typ == tokLParen {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.typ != tokRParen {
+			return nil, p.errorf(t, "expect )")
+		}
+		return x, nil
+	}
+	return p.parseCond()
+}
+
+func (p *exprParser) parseKey() (string, error) {
+	t := p.next()
+	if t.typ != tokIdent && t.typ != tokString {
+		return "", p.errorf(t, "expect key")
+	}
+	if t.val == "" {
+		return "", p.errorf(t, "empty key")
+	}
+	return t.val, nil
+}
+
+func (p *exprParser) parseValue() (exprValue, error) {
+	t := p.next()
+	switch t.typ {
+	case tokString:
+		return exprValue{str: t.val}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return exprValue{}, p.errorf(t, "invalid number %v", t.val)
+		}
+		return exprValue{isNum: true, num: n}, nil
+	}
+	return exprValue{}, p.errorf(t, "expect value")
+}
+
+func (p *exprParser) parseCond() (exprNode, error) {
+	if t := p.peek(); p.isKeyword(t, "exists") && p.tokens[p.pos+1].typ == tokLParen {
+		p.next()
+		p.next()
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.typ != tokRParen {
+			return nil, p.errorf(t, "expect )")
+		}
+		return &exprExists{key}, nil
+	}
+	key, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	t := p.next()
+	switch {
+	case p.isOp(t, "==", "!="):
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return &exprCompare{key: key, op: t.val, val: v}, nil
+	case p.isOp(t, ">", ">=", "<", "<="):
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if !v.isNum {
+			return nil, p.errorf(t, "expect number for %v", t.val)
+		}
+		return &exprCompare{key: key, op: t.val, val: v}, nil
+	case p.isKeyword(t, "prefix"):
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if v.isNum {
+			return nil, p.errorf(t, "expect string for prefix")
+		}
+		return &exprPrefix{key: key, prefix: v.str}, nil
+	case p.isKeyword(t, "in"):
+		return p.parseIn(key)
+	case p.isKeyword(t, "not") && p.isKeyword(p.peek(), "in"):
+		p.next()
+		in, err := p.parseIn(key)
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{in}, nil
+	}
+	return nil, p.errorf(t, "expect operator after key %v", key)
+}
+
+func (p *exprParser) parseIn(key string) (exprNode, error) {
+	if t := p.next(); t.typ != tokLParen {
+		return nil, p.errorf(t, "expect (")
+	}
+	in := &exprIn{key: key}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		in.vals = append(in.vals, v)
+		t := p.next()
+		if t.typ == tokRParen {
+			return in, nil
+		}
+		if t.typ != tokComma {
+			return nil, p.errorf(t, "expect , or )")
+		}
+	}
+}
+
+func parseFilterExpr(s string) (exprNode, error) {
+	if len(s) > maxFilterExprLen {
+		return nil, fmt.Errorf("filter expression too long: %v", len(s))
+	}
+	tokens, err := tokenizeFilterExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, p.errorf(t, "unexpected %v", t.val)
+	}
+	return node, nil
+}
+
+type extExprFilter struct {
+	root exprNode
+}
+
+func (f *extExprFilter) Match(msg *Message) bool {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return false
+	}
+	header, err := getJsonHeader(msg)
+	if err != nil {
+		return false
+	}
+	return f.root.eval(header)
+}
+
+// NewExtExprFilter compile the filter expression on the json header
+func NewExtExprFilter(expr string) (IExtFilter, error) {
+	root, err := parseFilterExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &extExprFilter{root: root}, nil
+}
@@ -0,0 +1,21 @@
+// +build gofuzz
+
+package nsqd
+
+import (
+	"github.com/youzan/nsq/internal/ext"
+)
+
+var fuzzFilterMsg = NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER,
+	[]byte(`{"region":"east","level":"5","score":3.5,"##zan_test":"true"}`))
+
+// Fuzz is the entry for go-fuzz to test the filter expression parser:
+// go-fuzz-build github.com/youzan/nsq/nsqd && go-fuzz -bin=nsqd-fuzz.zip -workdir=fuzz
+func Fuzz(data []byte) int {
+	f, err := NewExtExprFilter(string(data))
+	if err != nil {
+		return 0
+	}
+	f.Match(fuzzFilterMsg)
+	return 1
+}
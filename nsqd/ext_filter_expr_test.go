@@ -0,0 +1,123 @@
+package nsqd
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestExtExprFilterMatch(t *testing.T) {
+	msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER,
+		[]byte(`{"region":"east","level":"5","score":3.5,"biz":"pay","##zan_test":"true","a b":"x"}`))
+	cases := []struct {
+		expr    string
+		matched bool
+	}{
+		{`region == "east"`, true},
+		{`region == 'west'`, false},
+		{`region != "west"`, true},
+		{`missing != "west"`, true},
+		{`level >= 5 and level < 6`, true},
+		{`level == 5`, true},
+		{`level == "5"`, true},
+		{`score > 3 && score <= 3.5`, true},
+		{`score > 3.5`, false},
+		{`region > 1`, false},
+		{`biz in ("refund", "pay")`, true},
+		{`biz not in ("refund", "pay")`, false},
+		{`level in (1, 5)`, true},
+		{`region prefix "ea"`, true},
+		{`region prefix "we"`, false},
+		{`exists(##zan_test)`, true},
+		{`not exists(vip)`, true},
+		{`!exists(region)`, false},
+		{`"a b" == "x"`, true},
+		{`region == "west" or biz == "pay"`, true},
+		{`region == "west" || (biz == "pay" and not level < 3)`, true},
+		{`region == "east" and (biz == "refund" or exists(vip))`, false},
+		{`NOT region == "west" AND level >= 5 OR vip == "1"`, true},
+		{`exists == "x"`, false},
+	}
+	for _, c := range cases {
+		f, err := NewExtFilter(ExtFilterData{Type: 5, FilterData: c.expr})
+		test.Nil(t, err)
+		if f.Match(msg) != c.matched {
+			t.Errorf("expression %v should match: %v", c.expr, c.matched)
+		}
+	}
+	f, err := NewExtExprFilter(`exists(region)`)
+	test.Nil(t, err)
+	test.Equal(t, false, f.Match(NewMessage(0, []byte("body"))))
+	test.Equal(t, false, f.Match(NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte("{invalid"))))
+}
+
+func TestExtExprFilterInvalid(t *testing.T) {
+	invalid := []string{
+		``,
+		`region`,
+		`region = "east"`,
+		`region == `,
+		`region == east`,
+		`region > "1"`,
+		`region prefix 1`,
+		`(region == "east"`,
+		`region == "east")`,
+		`region == "east" and`,
+		`region in ()`,
+		`region in ("a" "b")`,
+		`region == "east`,
+		`exists(region`,
+		`level > 1.2.3`,
+		`region == "east" & level > 1`,
+		`region @ "east"`,
+	}
+	for _, expr := range invalid {
+		_, err := NewExtExprFilter(expr)
+		if err == nil {
+			t.Errorf("expression %v should be invalid", expr)
+		}
+	}
+	deep := ""
+	for i := 0; i < maxFilterExprDepth+1; i++ {
+		deep += "("
+	}
+	_, err := NewExtExprFilter(deep + `a == 1`)
+	test.NotNil(t, err)
+}
+
+// TestExtExprFilterFuzz make sure the parser never panic with the random input, see also
+// the Fuzz for go-fuzz.
+func TestExtExprFilterFuzz(t *testing.T) {
+	seeds := []string{
+		`region == "east" and (level >= 3 or biz in ("pay", "refund")) and not exists(##zan_test)`,
+		`a != 'b\'c' || !(x prefix "y") && n not in (1, -2.5)`,
+	}
+	alphabet := []byte(`()"'\,=!<>&|-. 09azAZ#_`)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(`{"a":"b","n":1,"region":"east"}`))
+	for i := 0; i < 20000; i++ {
+		data := []byte(seeds[r.Intn(len(seeds))])
+		for j := r.Intn(8); j >= 0; j-- {
+			pos := r.Intn(len(data) + 1)
+			switch r.Intn(3) {
+			case 0:
+				data = append(data[:pos], append([]byte{alphabet[r.Intn(len(alphabet))]}, data[pos:]...)...)
+			case 1:
+				if pos < len(data) {
+					data = append(data[:pos], data[pos+1:]...)
+				}
+			default:
+				if pos < len(data) {
+					data[pos] = byte(r.Intn(256))
+				}
+			}
+		}
+		f, err := NewExtExprFilter(string(data))
+		if err == nil {
+			f.Match(msg)
+		}
+	}
+}
@@ -62,6 +62,8 @@ type Message struct {
 	pri              int64
 	index            int
 	deferredCnt      int32
+	// the member id of the copied message in the broadcast channel
+	bcMember string
 	//for backend queue
 	Offset        BackendOffset
 	RawMoveSize   BackendOffset
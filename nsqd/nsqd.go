@@ -38,6 +38,8 @@ type errStore struct {
 var (
 	ErrTopicPartitionMismatch = errors.New("topic partition mismatch")
 	ErrTopicNotExist          = errors.New("topic does not exist")
+	ErrDiskHighWatermark      = errors.New("disk usage exceed the high watermark")
+	ErrDeadLetterBusy         = errors.New("too many messages waiting to be written to dead letter")
 )
 
 var DEFAULT_RETENTION_DAYS = 3
@@ -48,14 +50,32 @@ const (
 	FLUSH_DISTANCE = 4
 )
 
+// the dead letter messages are written by the fixed workers, and the message will be requeued
+// as normal if the waiting queue is full.
+const (
+	deadLetterWorkers   = 4
+	deadLetterQueueSize = 1024
+)
+
+type deadLetterReq struct {
+	ch  *Channel
+	msg *Message
+}
+
+var diskUsageCheckInterval = time.Second * 5
+
 type INsqdNotify interface {
 	NotifyDeleteTopic(*Topic)
 	NotifyStateChanged(v interface{}, needPersist bool)
 	ReqToEnd(*Channel, *Message, time.Duration) error
+	DeadLetter(*Channel, *Message) error
 	NotifyScanDelayed(*Channel)
+	NotifyDataCorrupted(topicName string, part int, err error)
 }
 
 type ReqToEndFunc func(*Channel, *Message, time.Duration) error
+type DeadLetterFunc func(*Channel, *Message) error
+type DataCorruptedFunc func(*Topic, error)
 
 type NSQD struct {
 	sync.RWMutex
@@ -81,10 +101,15 @@ type NSQD struct {
 	exiting          bool
 	pubLoopFunc      func(t *Topic)
 	reqToEndCB       ReqToEndFunc
+	deadLetterCB     DeadLetterFunc
+	deadLetterChan   chan deadLetterReq
+	dataCorruptedCB  DataCorruptedFunc
 	scanTriggerChan  chan *Channel
 	persistNotifyCh  chan struct{}
 	persistClosed    chan struct{}
 	persistWaitGroup util.WaitGroupWrapper
+	diskFull         int32
+	diskUsage        atomic.Value
 }
 
 func New(opts *Options) *NSQD {
@@ -114,10 +139,12 @@ func New(opts *Options) *NSQD {
 		scanTriggerChan:      make(chan *Channel, 1),
 		persistNotifyCh:      make(chan struct{}, 2),
 		persistClosed:        make(chan struct{}),
+		deadLetterChan:       make(chan deadLetterReq, deadLetterQueueSize),
 	}
 	n.SwapOpts(opts)
 
 	n.errValue.Store(errStore{})
+	n.diskUsage.Store(float64(0))
 
 	err = n.dl.Lock()
 	if err != nil {
@@ -160,6 +187,24 @@ func New(opts *Options) *NSQD {
 		opts.TLSRequired = TLSRequired
 	}
 
+	if opts.Archiver == nil && opts.ArchivePath != "" {
+		archiver, err := NewLocalDirArchiver(opts.ArchivePath)
+		if err != nil {
+			nsqLog.LogErrorf("FATAL: failed to init archive path %v: %v", opts.ArchivePath, err)
+			os.Exit(1)
+		}
+		opts.Archiver = archiver
+		nsqLog.Infof("using the archive path: %v", opts.ArchivePath)
+	}
+	if opts.BackendStorage != "" && !IsValidBackendStorage(opts.BackendStorage) {
+		nsqLog.LogErrorf("FATAL: unknown backend storage %v", opts.BackendStorage)
+		os.Exit(1)
+	}
+	if opts.DelayQueueEngine != "" && !IsValidDelayQueueEngine(opts.DelayQueueEngine) {
+		nsqLog.LogErrorf("FATAL: unknown delayed queue engine %v", opts.DelayQueueEngine)
+		os.Exit(1)
+	}
+
 	return n
 }
 
@@ -169,6 +214,18 @@ func (n *NSQD) SetReqToEndCB(reqToEndCB ReqToEndFunc) {
 	n.Unlock()
 }
 
+func (n *NSQD) SetDeadLetterCB(cb DeadLetterFunc) {
+	n.Lock()
+	n.deadLetterCB = cb
+	n.Unlock()
+}
+
+func (n *NSQD) SetDataCorruptedCB(cb DataCorruptedFunc) {
+	n.Lock()
+	n.dataCorruptedCB = cb
+	n.Unlock()
+}
+
 func (n *NSQD) SetPubLoop(loop func(t *Topic)) {
 	n.Lock()
 	n.pubLoopFunc = loop
@@ -198,6 +255,8 @@ func (n *NSQD) SetHealth(err error) {
 	n.errValue.Store(errStore{err: err})
 }
 
+// IsHealthy return false only if any error happened, the disk usage exceeding the high
+// watermark only refuse the publish and is reported in the health text.
 func (n *NSQD) IsHealthy() bool {
 	return n.GetError() == nil
 }
@@ -212,9 +271,73 @@ func (n *NSQD) GetHealth() string {
 	if err != nil {
 		return fmt.Sprintf("NOK - %s", err)
 	}
+	if n.IsDiskFull() {
+		return fmt.Sprintf("OK - %s (%.2f)", ErrDiskHighWatermark, n.GetDiskUsage())
+	}
 	return "OK"
 }
 
+// IsDiskQuotaErr return true if the publish is refused by the disk quota, the publish can be retried later.
+func IsDiskQuotaErr(err error) bool {
+	return err == ErrDiskHighWatermark || err == ErrTopicDiskQuotaExceeded
+}
+
+// IsDiskFull return true if the disk usage of the data path exceed the high watermark
+func (n *NSQD) IsDiskFull() bool {
+	return atomic.LoadInt32(&n.diskFull) == 1
+}
+
+// GetDiskUsage return the used ratio of the disk for the data path
+func (n *NSQD) GetDiskUsage() float64 {
+	return n.diskUsage.Load().(float64)
+}
+
+// CheckDiskQuota return the retryable error if the new messages should not be written to the topic
+func (n *NSQD) CheckDiskQuota(t *Topic) error {
+	if n.IsDiskFull() {
+		return ErrDiskHighWatermark
+	}
+	return t.CheckDiskQuota()
+}
+
+func (n *NSQD) checkDiskUsage() {
+	opts := n.GetOpts()
+	if opts.DiskHighWatermark <= 0 {
+		atomic.StoreInt32(&n.diskFull, 0)
+		return
+	}
+	total, avail, err := getDiskUsage(opts.DataPath)
+	if err != nil || total == 0 {
+		nsqLog.LogWarningf("failed to get the disk usage of %v: %v", opts.DataPath, err)
+		return
+	}
+	usage := float64(total-avail) / float64(total)
+	n.diskUsage.Store(usage)
+	if usage >= opts.DiskHighWatermark {
+		if atomic.CompareAndSwapInt32(&n.diskFull, 0, 1) {
+			nsqLog.LogErrorf("disk usage %.2f of %v exceed the high watermark %v, publish will be refused",
+				usage, opts.DataPath, opts.DiskHighWatermark)
+		}
+	} else if atomic.CompareAndSwapInt32(&n.diskFull, 1, 0) {
+		nsqLog.Logf("disk usage %.2f of %v back under the high watermark %v",
+			usage, opts.DataPath, opts.DiskHighWatermark)
+	}
+}
+
+func (n *NSQD) diskUsageLoop() {
+	ticker := time.NewTicker(diskUsageCheckInterval)
+	defer ticker.Stop()
+	n.checkDiskUsage()
+	for {
+		select {
+		case <-ticker.C:
+			n.checkDiskUsage()
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
 func (n *NSQD) GetStartTime() time.Time {
 	return n.startTime
 }
@@ -258,6 +381,10 @@ func (n *NSQD) GetTopicMapCopy() map[string]map[int]*Topic {
 
 func (n *NSQD) Start() {
 	n.waitGroup.Wrap(func() { n.queueScanLoop() })
+	n.waitGroup.Wrap(func() { n.diskUsageLoop() })
+	for i := 0; i < deadLetterWorkers; i++ {
+		n.waitGroup.Wrap(func() { n.deadLetterLoop() })
+	}
 	n.persistWaitGroup.Wrap(func() { n.persistLoop() })
 }
 
@@ -311,7 +438,7 @@ func (n *NSQD) LoadMetadata(disabled int32) {
 		if err != nil {
 			ordered = false
 		}
-		topic := n.internalGetTopic(topicName, part, ext, ordered, disabled)
+		topic := n.internalGetTopic(topicName, part, ext, ordered, "", disabled)
 
 		// old meta should also be loaded
 		channels, err := topicJs.Get("channels").Array()
@@ -495,20 +622,26 @@ func (n *NSQD) GetTopicIgnPart(topicName string) *Topic {
 }
 
 func (n *NSQD) GetTopicWithDisabled(topicName string, part int, ext bool, ordered bool) *Topic {
-	return n.internalGetTopic(topicName, part, ext, ordered, 1)
+	return n.internalGetTopic(topicName, part, ext, ordered, "", 1)
+}
+
+// GetTopicWithStorage is the same as GetTopicWithDisabled, and the new created
+// topic will use the given storage engine.
+func (n *NSQD) GetTopicWithStorage(topicName string, part int, ext bool, ordered bool, storage string) *Topic {
+	return n.internalGetTopic(topicName, part, ext, ordered, storage, 1)
 }
 
 // GetTopic performs a thread safe operation
 // to return a pointer to a Topic object (potentially new)
 func (n *NSQD) GetTopic(topicName string, part int, ordered bool) *Topic {
-	return n.internalGetTopic(topicName, part, false, false, 0)
+	return n.internalGetTopic(topicName, part, false, false, "", 0)
 }
 
 func (n *NSQD) GetTopicWithExt(topicName string, part int, ordered bool) *Topic {
-	return n.internalGetTopic(topicName, part, true, ordered, 0)
+	return n.internalGetTopic(topicName, part, true, ordered, "", 0)
 }
 
-func (n *NSQD) internalGetTopic(topicName string, part int, ext bool, ordered bool, disabled int32) *Topic {
+func (n *NSQD) internalGetTopic(topicName string, part int, ext bool, ordered bool, storage string, disabled int32) *Topic {
 	if part > MAX_TOPIC_PARTITION || part < 0 {
 		return nil
 	}
@@ -545,7 +678,7 @@ func (n *NSQD) internalGetTopic(topicName string, part int, ext bool, ordered bo
 		part = 0
 	}
 	var t *Topic
-	t = NewTopicWithExt(topicName, part, ext, ordered, n.GetOpts(), disabled, n,
+	t = NewTopicWithStorage(topicName, part, ext, ordered, storage, n.GetOpts(), disabled, n,
 		n.pubLoopFunc)
 	if t == nil {
 		nsqLog.Errorf("TOPIC(%s): create failed", topicName)
@@ -718,10 +851,70 @@ func (n *NSQD) ReqToEnd(ch *Channel, msg *Message, t time.Duration) error {
 	return nil
 }
 
+// DeadLetter queue the message to be written to the dead letter topic and finished in the channel,
+// the error is returned if the message can not be queued.
+func (n *NSQD) DeadLetter(ch *Channel, msg *Message) error {
+	n.RLock()
+	cb := n.deadLetterCB
+	n.RUnlock()
+	if cb == nil {
+		return ErrDeadLetterNotConfigured
+	}
+	select {
+	case n.deadLetterChan <- deadLetterReq{ch: ch, msg: msg}:
+		return nil
+	default:
+		return ErrDeadLetterBusy
+	}
+}
+
+func (n *NSQD) deadLetterLoop() {
+	for {
+		select {
+		case req := <-n.deadLetterChan:
+			n.RLock()
+			cb := n.deadLetterCB
+			n.RUnlock()
+			err := ErrDeadLetterNotConfigured
+			if cb != nil {
+				err = cb(req.ch, req.msg)
+			}
+			if err != nil {
+				nsqLog.LogWarningf("channel %v message %v write to dead letter failed: %v",
+					req.ch.GetName(), req.msg.ID, err)
+				// deliver again instead of keeping it in flight
+				req.ch.RequeueDeadLetterFailed(req.msg.ID)
+				continue
+			}
+			atomic.AddUint64(&req.ch.deadLetterCount, 1)
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
 func (n *NSQD) NotifyDeleteTopic(t *Topic) {
 	n.DeleteExistingTopic(t.GetTopicName(), t.GetTopicPart())
 }
 
+// NotifyDataCorrupted mark the topic need to be fixed and notify
+// the coordinator to fetch the damaged data again from other replicas.
+func (n *NSQD) NotifyDataCorrupted(topicName string, part int, err error) {
+	t, terr := n.GetExistingTopic(topicName, part)
+	if terr != nil {
+		nsqLog.LogWarningf("topic %v-%v data corrupted but topic not found: %v", topicName, part, err)
+		return
+	}
+	nsqLog.LogErrorf("topic %v data corrupted: %v", t.GetFullName(), err)
+	t.SetDataFixState(true)
+	n.RLock()
+	cb := n.dataCorruptedCB
+	n.RUnlock()
+	if cb != nil {
+		go cb(t, err)
+	}
+}
+
 func (n *NSQD) NotifyScanDelayed(ch *Channel) {
 	select {
 	case n.scanTriggerChan <- ch:
@@ -56,6 +56,8 @@ type Options struct {
 	MaxConfirmWin     int64         `flag:"max-confirm-win"`
 	ClientTimeout     time.Duration
 	ReqToEndThreshold time.Duration `flag:"req-to-end-threshold"`
+	// the member of broadcast channel without any client will be removed after timeout
+	BroadcastMemberTimeout time.Duration `flag:"broadcast-member-timeout"`
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
@@ -100,6 +102,29 @@ type Options struct {
 	AllowZanTestSkip      bool  `flag:"allow-zan-test-skip"`
 	DefaultCommitBuf      int32 `flag:"default-commit-buf" cfg:"default_commit_buf"`
 	MaxCommitBuf          int32 `flag:"max-commit-buf" cfg:"max_commit_buf"`
+
+	// the old segments will be uploaded to the archive before cleaned if set.
+	ArchivePath string `flag:"archive-path" cfg:"archive_path"`
+	// the archive backend, the local directory archiver will be used if ArchivePath is set.
+	Archiver SegmentArchiver
+	// the default storage engine for the new topics, the ephemeral topics use memory if not specified.
+	BackendStorage string `flag:"backend-storage" cfg:"backend_storage"`
+	// the kv storage engine of the delayed queue, the data in the other engine will be migrated while opened.
+	DelayQueueEngine string `flag:"delay-queue-engine" cfg:"delay_queue_engine"`
+	// the max bytes on disk for each topic partition, 0 means no limit.
+	TopicDiskQuota int64 `flag:"topic-disk-quota" cfg:"topic_disk_quota"`
+	// the used ratio of the disk for data path, the publish will be refused if exceeded, 0 to disable.
+	DiskHighWatermark float64 `flag:"disk-high-watermark" cfg:"disk_high_watermark"`
+	// preallocate the disk space of max-bytes-per-file for the new segment files.
+	SegmentPreallocate bool `flag:"segment-preallocate" cfg:"segment_preallocate"`
+	// read the sealed segment files through mmap for the consumers catching up the old data.
+	MmapRead bool `flag:"mmap-read" cfg:"mmap_read"`
+	// the window to detect the retried transaction which has been committed.
+	TxnWindow time.Duration `flag:"txn-window" cfg:"txn_window"`
+	// the recent sequences kept for each producer to detect the retried publish.
+	ProducerSeqWindow int `flag:"producer-seq-window" cfg:"producer_seq_window"`
+	// the producer state will be removed if no publish in the duration.
+	ProducerExpire time.Duration `flag:"producer-expire" cfg:"producer_expire"`
 }
 
 func NewOptions() *Options {
@@ -127,10 +152,12 @@ func NewOptions() *Options {
 		AuthHTTPAddresses:      make([]string, 0),
 		LookupPingInterval:     5 * time.Second,
 
-		MemQueueSize:    10000,
-		MaxBytesPerFile: 100 * 1024 * 1024,
-		SyncEvery:       2500,
-		SyncTimeout:     2 * time.Second,
+		MemQueueSize:     10000,
+		MaxBytesPerFile:  100 * 1024 * 1024,
+		SyncEvery:        2500,
+		SyncTimeout:      2 * time.Second,
+		BackendStorage:   BackendStorageFiles,
+		DelayQueueEngine: DelayQueueEngineBolt,
 
 		QueueScanInterval:        500 * time.Millisecond,
 		QueueScanRefreshInterval: 5 * time.Second,
@@ -146,6 +173,8 @@ func NewOptions() *Options {
 		ClientTimeout:     60 * time.Second,
 		ReqToEndThreshold: 15 * time.Minute,
 
+		BroadcastMemberTimeout: 5 * time.Minute,
+
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
@@ -170,6 +199,10 @@ func NewOptions() *Options {
 		Logger:   &levellogger.GLogger{},
 
 		RetentionDays: int32(DEFAULT_RETENTION_DAYS),
+
+		TxnWindow:         30 * time.Minute,
+		ProducerSeqWindow: 128,
+		ProducerExpire:    30 * time.Minute,
 	}
 
 	return opts
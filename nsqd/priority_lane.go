@@ -0,0 +1,261 @@
+package nsqd
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// The priority lanes are enabled by the channel meta for the ext channel. The messages read from
+// the backend are buffered in the priority lanes by messagePump until the lanes are full or no more
+// data ready, and then all the buffered messages are dispatched from the higher lane to the lower
+// lane before reading more, so the dispatch order of the messages in the same read window is always
+// the same. Besides the channel reader, the high lane has its own cursor scanning the data ahead of
+// the channel reader, so the high priority messages can be dispatched before the backlog, and the
+// messages scanned ahead are ignored while the channel reader reach them. Since the confirmed
+// offset is only updated after the message is consumed, the buffered messages will be read again
+// after the reader reset.
+
+const (
+	PriorityHeader = "##priority"
+
+	// max messages read ahead from the backend for the priority lanes
+	priorityReadAhead = 64
+	// max records read by the high lane cursor each time
+	priorityScanBatch = 1024
+	// max high priority messages scanned ahead and not reached by the channel reader
+	priorityScanAheadMax = 1024
+)
+
+type PriorityLane int
+
+const (
+	PriorityHigh PriorityLane = iota
+	PriorityNormal
+	PriorityLow
+	priorityLaneNum
+)
+
+var priorityLaneNames = [priorityLaneNum]string{"high", "normal", "low"}
+
+func (p PriorityLane) String() string {
+	if p < 0 || p >= priorityLaneNum {
+		return "unknown"
+	}
+	return priorityLaneNames[p]
+}
+
+// ParsePriorityLane return the lane for the priority header value, unknown value
+// will be dispatched in the normal lane.
+func ParsePriorityLane(v string) PriorityLane {
+	for i, name := range priorityLaneNames {
+		if strings.EqualFold(v, name) {
+			return PriorityLane(i)
+		}
+	}
+	return PriorityNormal
+}
+
+// GetMessagePriority return the lane of the message by the priority in the json header
+func GetMessagePriority(msg *Message) PriorityLane {
+	return ParsePriorityLane(getJsonHeaderString(msg, PriorityHeader))
+}
+
+type PriorityLaneStats struct {
+	Lane       string `json:"lane"`
+	Buffered   int64  `json:"buffered"`
+	Dispatched uint64 `json:"dispatched"`
+}
+
+// priorityLanes is only used in the messagePump goroutine, the counters of the
+// channel are updated for the stats.
+type priorityLanes struct {
+	c     *Channel
+	lanes [priorityLaneNum][]*Message
+	cnt   int
+	max   int
+	// draining the buffered messages and no more message should be pushed
+	draining bool
+	// the cursor of the high lane, the position is valid only if the snapshot is positioned
+	scanSnap       *DiskQueueSnapshot
+	scanPositioned bool
+	scanOffset     BackendOffset
+	// the high priority messages scanned ahead of the channel reader
+	scanned map[MessageID]bool
+}
+
+func newPriorityLanes(c *Channel, max int) *priorityLanes {
+	return &priorityLanes{
+		c:       c,
+		max:     max,
+		scanned: make(map[MessageID]bool),
+	}
+}
+
+func (pl *priorityLanes) Len() int {
+	return pl.cnt
+}
+
+// ShouldDrain return true if the buffered message should be dispatched instead of reading
+// more, the lanes will be drained once full or no more data ready.
+func (pl *priorityLanes) ShouldDrain(noMoreData bool) bool {
+	if pl.cnt == 0 {
+		pl.draining = false
+		return false
+	}
+	if noMoreData || pl.cnt >= pl.max {
+		pl.draining = true
+	}
+	return pl.draining
+}
+
+func (pl *priorityLanes) Push(msg *Message) {
+	p := GetMessagePriority(msg)
+	pl.lanes[p] = append(pl.lanes[p], msg)
+	pl.cnt++
+	atomic.AddInt64(&pl.c.priorityBuffered[p], 1)
+}
+
+// Pop return the oldest message in the highest lane, the messages in the same lane
+// are kept in the read order.
+func (pl *priorityLanes) Pop() *Message {
+	for p := range pl.lanes {
+		if len(pl.lanes[p]) == 0 {
+			continue
+		}
+		msg := pl.lanes[p][0]
+		pl.lanes[p][0] = nil
+		pl.lanes[p] = pl.lanes[p][1:]
+		if len(pl.lanes[p]) == 0 {
+			pl.lanes[p] = nil
+		}
+		pl.cnt--
+		atomic.AddInt64(&pl.c.priorityBuffered[p], -1)
+		atomic.AddUint64(&pl.c.priorityDispatched[p], 1)
+		return msg
+	}
+	return nil
+}
+
+// Clear drop all the buffered messages and the scanned messages, should be called while the
+// reader reset, and the high lane cursor will scan from the new position of the channel reader.
+func (pl *priorityLanes) Clear() {
+	for p := range pl.lanes {
+		pl.lanes[p] = nil
+		atomic.StoreInt64(&pl.c.priorityBuffered[p], 0)
+	}
+	pl.cnt = 0
+	pl.draining = false
+	pl.scanPositioned = false
+	if len(pl.scanned) > 0 {
+		pl.scanned = make(map[MessageID]bool)
+	}
+}
+
+// Close release the snapshot of the high lane cursor
+func (pl *priorityLanes) Close() {
+	if pl.scanSnap != nil {
+		pl.scanSnap.Close()
+		pl.scanSnap = nil
+	}
+	pl.scanPositioned = false
+}
+
+// IsScanned return true if the message read by the channel reader has been pushed to the
+// high lane by the cursor, the message should be ignored by the channel reader.
+func (pl *priorityLanes) IsScanned(msg *Message) bool {
+	if len(pl.scanned) == 0 || !pl.scanned[msg.ID] {
+		return false
+	}
+	delete(pl.scanned, msg.ID)
+	return true
+}
+
+// ScanAhead read the data after the channel reader until the channel end to find the high
+// priority messages, the data will be read again by the channel reader so the cursor only read
+// a batch each time and stop while too many messages scanned ahead.
+func (pl *priorityLanes) ScanAhead(readPos BackendQueueEnd, end BackendQueueEnd) {
+	if len(pl.lanes[PriorityHigh]) > 0 || len(pl.scanned) >= priorityScanAheadMax {
+		return
+	}
+	if readPos == nil || end == nil || pl.c.newSnapshot == nil {
+		return
+	}
+	start := readPos.Offset()
+	if pl.scanPositioned && pl.scanOffset > start {
+		start = pl.scanOffset
+	}
+	if start >= end.Offset() {
+		return
+	}
+	if pl.scanSnap == nil {
+		pl.scanSnap = pl.c.newSnapshot(end)
+	} else {
+		pl.scanSnap.UpdateQueueEnd(end)
+	}
+	if !pl.scanPositioned || start != pl.scanOffset {
+		if err := pl.scanSnap.ResetSeekTo(start); err != nil {
+			nsqLog.LogWarningf("channel %v priority cursor failed to seek to %v: %v", pl.c.GetName(), start, err)
+			pl.Close()
+			return
+		}
+		pl.scanOffset = start
+		pl.scanPositioned = true
+	}
+	for i := 0; i < priorityScanBatch && len(pl.scanned) < priorityScanAheadMax; i++ {
+		ret := pl.scanSnap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err != io.EOF {
+				nsqLog.LogWarningf("channel %v priority cursor failed to read at %v: %v", pl.c.GetName(), pl.scanOffset, ret.Err)
+				pl.Close()
+			}
+			return
+		}
+		pl.scanOffset = ret.Offset + ret.MovedSize
+		msg, err := decodeMessage(ret.Data, pl.c.IsExt())
+		if err != nil {
+			continue
+		}
+		if GetMessagePriority(msg) != PriorityHigh {
+			continue
+		}
+		msg.Offset = ret.Offset
+		msg.RawMoveSize = ret.MovedSize
+		msg.queueCntIndex = ret.CurCnt
+		pl.scanned[msg.ID] = true
+		pl.Push(msg)
+	}
+}
+
+// SetPriorityLane enable or disable the priority lanes of the channel, it only works for the
+// ext channel which is not ordered or broadcast.
+func (c *Channel) SetPriorityLane(enable bool) {
+	if enable {
+		atomic.StoreInt32(&c.priorityLaneEnabled, 1)
+	} else {
+		atomic.StoreInt32(&c.priorityLaneEnabled, 0)
+	}
+}
+
+func (c *Channel) IsPriorityLaneEnabled() bool {
+	return atomic.LoadInt32(&c.priorityLaneEnabled) == 1
+}
+
+func (c *Channel) isPriorityLaneEnabled() bool {
+	return c.IsPriorityLaneEnabled() && c.IsExt() && !c.IsOrdered() && !c.IsBroadcast()
+}
+
+func (c *Channel) GetPriorityLaneStats() []PriorityLaneStats {
+	if !c.isPriorityLaneEnabled() {
+		return nil
+	}
+	stats := make([]PriorityLaneStats, 0, priorityLaneNum)
+	for p := PriorityHigh; p < priorityLaneNum; p++ {
+		stats = append(stats, PriorityLaneStats{
+			Lane:       p.String(),
+			Buffered:   atomic.LoadInt64(&c.priorityBuffered[p]),
+			Dispatched: atomic.LoadUint64(&c.priorityDispatched[p]),
+		})
+	}
+	return stats
+}
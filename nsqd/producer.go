@@ -0,0 +1,190 @@
+package nsqd
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+// The idempotent producer register the producer id by IDENTIFY and publish with the increasing
+// sequence in the json header. The producer id and the sequence are written with the message,
+// so the recent sequences can be rebuilt from the topic data by the new leader after failover,
+// and the retried publish will return the result of the original publish.
+
+const (
+	ProducerIDKey  = "##producer_id"
+	ProducerSeqKey = "##producer_seq"
+
+	maxProducerIDLen = 128
+)
+
+var (
+	ErrInvalidProducerID     = errors.New("invalid producer id")
+	ErrProducerSeqOutOfOrder = errors.New("the producer sequence is out of order or older than the dedup window")
+)
+
+func IsValidProducerID(id string) bool {
+	return len(id) > 0 && len(id) <= maxProducerIDLen && protocol.IsValidChannelName(id)
+}
+
+type ProducerPubResult struct {
+	ID      MessageID
+	Offset  BackendOffset
+	RawSize int32
+}
+
+type producerSeqItem struct {
+	seq uint64
+	ProducerPubResult
+}
+
+type producerState struct {
+	lastTs int64
+	// the recent sequences in increasing order
+	items []producerSeqItem
+}
+
+type producerDedup struct {
+	sync.Mutex
+	window     int
+	expire     time.Duration
+	loaded     bool
+	lastExpire int64
+	producers  map[string]*producerState
+}
+
+func newProducerDedup(window int, expire time.Duration) *producerDedup {
+	if window <= 0 {
+		window = 1
+	}
+	return &producerDedup{
+		window:    window,
+		expire:    expire,
+		producers: make(map[string]*producerState),
+	}
+}
+
+func (d *producerDedup) addNoLock(pid string, seq uint64, r ProducerPubResult, ts int64) {
+	ps, ok := d.producers[pid]
+	if !ok {
+		ps = &producerState{}
+		d.producers[pid] = ps
+	}
+	if len(ps.items) > 0 && ps.items[len(ps.items)-1].seq >= seq {
+		return
+	}
+	ps.items = append(ps.items, producerSeqItem{seq: seq, ProducerPubResult: r})
+	if len(ps.items) > d.window {
+		ps.items = append(ps.items[:0], ps.items[len(ps.items)-d.window:]...)
+	}
+	ps.lastTs = ts
+}
+
+func (d *producerDedup) expireNoLock(now int64) {
+	// no need to check the expired producers for each publish
+	if now-d.lastExpire < int64(time.Second) {
+		return
+	}
+	d.lastExpire = now
+	expired := now - int64(d.expire)
+	for pid, ps := range d.producers {
+		if ps.lastTs < expired {
+			delete(d.producers, pid)
+		}
+	}
+}
+
+func (d *producerDedup) resetNoLock() {
+	d.loaded = false
+	d.producers = make(map[string]*producerState)
+}
+
+func getProducerSeq(msg *Message) (string, uint64, bool) {
+	if !hasJsonHeaderKey(msg, ProducerSeqKey) {
+		return "", 0, false
+	}
+	header, err := getJsonHeader(msg)
+	if err != nil {
+		return "", 0, false
+	}
+	pid := getJsonHeaderValueString(header, ProducerIDKey)
+	if pid == "" {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(getJsonHeaderValueString(header, ProducerSeqKey), 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return pid, seq, true
+}
+
+// loadProducersNoLock rebuild the recent sequences from the topic data
+func (t *Topic) loadProducersNoLock(d *producerDedup) error {
+	d.resetNoLock()
+	err := t.scanRecentMessages(time.Now().Add(-1*d.expire).UnixNano(), func(msg *Message, ret *ReadResult) {
+		pid, seq, ok := getProducerSeq(msg)
+		if !ok {
+			return
+		}
+		d.addNoLock(pid, seq, ProducerPubResult{
+			ID:      msg.ID,
+			Offset:  ret.Offset,
+			RawSize: int32(ret.MovedSize),
+		}, msg.Timestamp)
+	})
+	if err != nil {
+		d.resetNoLock()
+		return err
+	}
+	d.loaded = true
+	nsqLog.Logf("topic %v producers loaded: %v", t.GetFullName(), len(d.producers))
+	return nil
+}
+
+// LockProducer should be held while checking and writing the sequence of the producer.
+func (t *Topic) LockProducer() {
+	t.producers.Lock()
+}
+
+func (t *Topic) UnlockProducer() {
+	t.producers.Unlock()
+}
+
+// CheckProducerSeqNoLock return the result of the original publish if the sequence has been
+// written, nil if the sequence is new.
+func (t *Topic) CheckProducerSeqNoLock(producerID string, seq uint64) (*ProducerPubResult, error) {
+	d := t.producers
+	if !d.loaded {
+		if err := t.loadProducersNoLock(d); err != nil {
+			nsqLog.LogErrorf("topic %v failed to load the producers: %v", t.GetFullName(), err)
+			return nil, err
+		}
+	}
+	d.expireNoLock(time.Now().UnixNano())
+	ps, ok := d.producers[producerID]
+	if !ok || len(ps.items) == 0 || seq > ps.items[len(ps.items)-1].seq {
+		return nil, nil
+	}
+	i := sort.Search(len(ps.items), func(i int) bool {
+		return ps.items[i].seq >= seq
+	})
+	if i < len(ps.items) && ps.items[i].seq == seq {
+		r := ps.items[i].ProducerPubResult
+		return &r, nil
+	}
+	return nil, ErrProducerSeqOutOfOrder
+}
+
+func (t *Topic) MarkProducerSeqNoLock(producerID string, seq uint64, r ProducerPubResult) {
+	t.producers.addNoLock(producerID, seq, r, time.Now().UnixNano())
+}
+
+func (t *Topic) resetProducers() {
+	t.producers.Lock()
+	t.producers.resetNoLock()
+	t.producers.Unlock()
+}
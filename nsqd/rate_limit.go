@@ -0,0 +1,95 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The rate limit of the channel is enforced by messagePump for all the clients of the channel,
+// the message and the body bytes are both limited if set. The limit is not exact since the
+// message will be dispatched once the tokens are enough (allow the burst in one second).
+// The messagePump wait the tokens at most rateLimitCheckInterval each time, so the changed
+// limit and the reader reset can be handled while waiting.
+
+func (c *Channel) SetRateLimit(msgRate int64, byteRate int64) {
+	if msgRate < 0 {
+		msgRate = 0
+	}
+	if byteRate < 0 {
+		byteRate = 0
+	}
+	atomic.StoreInt64(&c.msgRateLimit, msgRate)
+	atomic.StoreInt64(&c.byteRateLimit, byteRate)
+}
+
+// GetRateLimit return the limit of the messages and the bytes per second, 0 means no limit.
+func (c *Channel) GetRateLimit() (int64, int64) {
+	return atomic.LoadInt64(&c.msgRateLimit), atomic.LoadInt64(&c.byteRateLimit)
+}
+
+func (c *Channel) IsRateLimited() bool {
+	msgRate, byteRate := c.GetRateLimit()
+	return msgRate > 0 || byteRate > 0
+}
+
+// the max duration to wait the tokens before checking the changed limit and the reader reset
+var rateLimitCheckInterval = time.Second
+
+// channelRateLimiter is the token bucket used in the messagePump goroutine, the limit
+// is passed for each message so the changed limit will be used immediately.
+type channelRateLimiter struct {
+	msgTokens  float64
+	byteTokens float64
+	last       time.Time
+}
+
+func refillTokens(tokens float64, rate int64, elapsed float64, burst float64) float64 {
+	tokens += elapsed * float64(rate)
+	if tokens > burst {
+		tokens = burst
+	}
+	return tokens
+}
+
+// reserve take the tokens for the message if enough and return 0, otherwise return the duration
+// to wait before the tokens are enough and the message should be reserved again after waiting.
+// The bucket can hold at least one message, so the large message will not wait forever.
+func (l *channelRateLimiter) reserve(now time.Time, msgRate int64, byteRate int64, size int) time.Duration {
+	if msgRate <= 0 && byteRate <= 0 {
+		l.last = time.Time{}
+		return 0
+	}
+	msgBurst := float64(msgRate)
+	byteBurst := float64(byteRate)
+	if byteBurst < float64(size) {
+		byteBurst = float64(size)
+	}
+	if l.last.IsZero() {
+		// start with the full bucket
+		l.msgTokens = msgBurst
+		l.byteTokens = byteBurst
+	} else if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.msgTokens = refillTokens(l.msgTokens, msgRate, elapsed, msgBurst)
+		l.byteTokens = refillTokens(l.byteTokens, byteRate, elapsed, byteBurst)
+	}
+	l.last = now
+	var wait float64
+	if msgRate > 0 && l.msgTokens < 1 {
+		wait = (1 - l.msgTokens) / float64(msgRate)
+	}
+	if byteRate > 0 && l.byteTokens < float64(size) {
+		if w := (float64(size) - l.byteTokens) / float64(byteRate); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return time.Duration(wait * float64(time.Second))
+	}
+	if msgRate > 0 {
+		l.msgTokens--
+	}
+	if byteRate > 0 {
+		l.byteTokens -= float64(size)
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+package nsqd
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// The requeue policy of the channel decide the delay of the message redelivery by the attempts
+// of the message, and is used while the client requeue the message without a timeout or the
+// message is timed out. So the backoff is the same for all the clients of the channel.
+// The delay is capped by MaxReqTimeout. While the client requeue, the long delay will be moved to
+// the delayed queue like the REQ with the long timeout. While the message is timed out, the delay
+// is kept in memory as the deferred message, and the message will be requeued without the delay if
+// there are too many deferred messages in memory.
+
+const (
+	RequeuePolicyFixed       = "fixed"
+	RequeuePolicyExponential = "exponential"
+	RequeuePolicySteps       = "steps"
+)
+
+var (
+	ErrInvalidRequeuePolicy = errors.New("invalid requeue policy")
+)
+
+type RequeuePolicy struct {
+	Type string `json:"type"`
+	// the delay of the first requeue in milliseconds for fixed and exponential
+	BaseMs int64 `json:"base_ms,omitempty"`
+	// the multiplier of the exponential delay for each attempt, 2 if not set
+	Factor float64 `json:"factor,omitempty"`
+	// the delay will be reduced randomly by at most this ratio (0-1)
+	Jitter float64 `json:"jitter,omitempty"`
+	// the delay in milliseconds for each attempt, and the last one is used for more attempts
+	StepsMs []int64 `json:"steps_ms,omitempty"`
+	// the max delay in milliseconds, no limit if 0
+	MaxMs int64 `json:"max_ms,omitempty"`
+}
+
+func (p *RequeuePolicy) Validate() error {
+	if p.MaxMs < 0 || p.Jitter < 0 || p.Jitter > 1 {
+		return ErrInvalidRequeuePolicy
+	}
+	switch p.Type {
+	case RequeuePolicyFixed:
+		if p.BaseMs <= 0 {
+			return ErrInvalidRequeuePolicy
+		}
+	case RequeuePolicyExponential:
+		if p.BaseMs <= 0 || (p.Factor != 0 && p.Factor < 1) {
+			return ErrInvalidRequeuePolicy
+		}
+	case RequeuePolicySteps:
+		if len(p.StepsMs) == 0 {
+			return ErrInvalidRequeuePolicy
+		}
+		for _, s := range p.StepsMs {
+			if s < 0 {
+				return ErrInvalidRequeuePolicy
+			}
+		}
+	default:
+		return ErrInvalidRequeuePolicy
+	}
+	return nil
+}
+
+// GetDelay return the requeue delay of the message which has been delivered attempts times.
+func (p *RequeuePolicy) GetDelay(attempts uint16) time.Duration {
+	n := 0
+	if attempts > 1 {
+		n = int(attempts) - 1
+	}
+	var ms float64
+	switch p.Type {
+	case RequeuePolicyFixed:
+		ms = float64(p.BaseMs)
+	case RequeuePolicyExponential:
+		factor := p.Factor
+		if factor == 0 {
+			factor = 2
+		}
+		ms = float64(p.BaseMs) * math.Pow(factor, float64(n))
+	case RequeuePolicySteps:
+		if n >= len(p.StepsMs) {
+			n = len(p.StepsMs) - 1
+		}
+		ms = float64(p.StepsMs[n])
+	}
+	if p.MaxMs > 0 && ms > float64(p.MaxMs) {
+		ms = float64(p.MaxMs)
+	}
+	// avoid overflow for too many attempts
+	if ms > float64(math.MaxInt64/int64(time.Millisecond)) {
+		ms = float64(math.MaxInt64 / int64(time.Millisecond))
+	}
+	if p.Jitter > 0 {
+		ms -= ms * p.Jitter * rand.Float64()
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// SetRequeuePolicy change the requeue policy of the channel, the policy will be removed if nil or
+// the type is empty.
+func (c *Channel) SetRequeuePolicy(p *RequeuePolicy) error {
+	if p == nil || p.Type == "" {
+		c.requeuePolicy.Store((*RequeuePolicy)(nil))
+		return nil
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	policy := *p
+	c.requeuePolicy.Store(&policy)
+	return nil
+}
+
+// GetRequeuePolicy return the requeue policy of the channel, nil if no policy.
+func (c *Channel) GetRequeuePolicy() *RequeuePolicy {
+	p, _ := c.requeuePolicy.Load().(*RequeuePolicy)
+	if p == nil {
+		return nil
+	}
+	policy := *p
+	return &policy
+}
+
+func (c *Channel) SetRequeuePolicyFromMeta(meta *ChannelMetaInfo) {
+	err := c.SetRequeuePolicy(meta.RequeuePolicy)
+	if err != nil {
+		nsqLog.LogWarningf("channel %v invalid requeue policy in meta: %v, %v", c.GetName(), meta.RequeuePolicy, err)
+	}
+}
+
+// getRequeueBackoff return the delay for the message by the requeue policy, 0 if no policy.
+func (c *Channel) getRequeueBackoff(msg *Message) time.Duration {
+	p, _ := c.requeuePolicy.Load().(*RequeuePolicy)
+	if p == nil || c.IsOrdered() {
+		return 0
+	}
+	d := p.GetDelay(msg.Attempts)
+	if d > c.option.MaxReqTimeout {
+		d = c.option.MaxReqTimeout
+	}
+	return d
+}
+
+// GetRequeueTimeout return the delay for the message in flight by the requeue policy while the
+// client requeue the message without the timeout.
+func (c *Channel) GetRequeueTimeout(clientID int64, id MessageID) time.Duration {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	msg, ok := c.inFlightMessages[id]
+	if !ok || msg.GetClientID() != clientID || msg.IsDeferred() {
+		return 0
+	}
+	return c.getRequeueBackoff(msg)
+}
@@ -0,0 +1,182 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/protocol"
+)
+
+// The scheduled message is the delayed pub message with the absolute delivery time and the
+// schedule id given by the client in the json header. The delayed queue index the scheduled
+// messages by the schedule id, and the message with the same schedule id will replace the old one,
+// so the client can reschedule it. The cancel is written to the delayed queue as a special record
+// without saving in the kv store, so it is replicated by the commit log like the other delayed messages.
+// The delete of the channel delayed message from the admin api is written as the cancel record
+// with the key of the deleted message in the same way.
+
+const (
+	ScheduleIDKey = "##schedule_id"
+	DeliverAtKey  = "##deliver_at"
+
+	maxScheduleIDLen = 128
+)
+
+var (
+	ErrInvalidScheduleID = errors.New("invalid schedule id")
+	ErrInvalidDeliverAt  = errors.New("invalid deliver time")
+	ErrScheduleNotFound  = errors.New("scheduled message not found")
+)
+
+// delayedPubData is saved in the DelayedData of the delayed pub message
+type delayedPubData struct {
+	ScheduleID string `json:"schedule_id,omitempty"`
+	Cancel     bool   `json:"cancel,omitempty"`
+	// the key of the channel delayed message deleted by the cancel record
+	Channel string    `json:"channel,omitempty"`
+	Ts      int64     `json:"ts,omitempty"`
+	ID      MessageID `json:"id,omitempty"`
+}
+
+func IsValidScheduleID(id string) bool {
+	return len(id) > 0 && len(id) <= maxScheduleIDLen && protocol.IsValidChannelName(id)
+}
+
+// GetScheduleHeader return the deliver time in unix milliseconds and the schedule id in the
+// json header, the deliver time is 0 if not scheduled.
+func GetScheduleHeader(extVer ext.ExtVer, extBytes []byte) (int64, string, error) {
+	if extVer != ext.JSON_HEADER_EXT_VER || len(extBytes) == 0 {
+		return 0, "", nil
+	}
+	if !strings.Contains(string(extBytes), DeliverAtKey) {
+		return 0, "", nil
+	}
+	header, err := getJsonHeader(&Message{ExtVer: extVer, ExtBytes: extBytes})
+	if err != nil {
+		return 0, "", err
+	}
+	raw, ok := header[DeliverAtKey]
+	if !ok {
+		return 0, "", nil
+	}
+	var deliverAt int64
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		deliverAt, err = strconv.ParseInt(str, 10, 64)
+	} else {
+		err = json.Unmarshal(raw, &deliverAt)
+	}
+	if err != nil || deliverAt <= 0 {
+		return 0, "", ErrInvalidDeliverAt
+	}
+	var scheduleID string
+	if raw, ok := header[ScheduleIDKey]; ok {
+		if json.Unmarshal(raw, &scheduleID) != nil || !IsValidScheduleID(scheduleID) {
+			return 0, "", ErrInvalidScheduleID
+		}
+	}
+	return deliverAt, scheduleID, nil
+}
+
+// SetSchedule change the message to the delayed pub message delivered at the given time.
+func (m *Message) SetSchedule(deliverAt time.Time, scheduleID string) {
+	m.DelayedType = PubDelayed
+	m.DelayedTs = deliverAt.UnixNano()
+	m.DelayedData = nil
+	if scheduleID != "" {
+		m.DelayedData, _ = json.Marshal(&delayedPubData{ScheduleID: scheduleID})
+	}
+}
+
+// GetScheduleID return the schedule id of the delayed pub message.
+func (m *Message) GetScheduleID() string {
+	return m.getDelayedPubData().ScheduleID
+}
+
+func (m *Message) getDelayedPubData() delayedPubData {
+	var d delayedPubData
+	if m.DelayedType == PubDelayed && len(m.DelayedData) > 0 {
+		json.Unmarshal(m.DelayedData, &d)
+	}
+	return d
+}
+
+// NewScheduleCancelMessage return the record to cancel the scheduled message in the delayed queue.
+func NewScheduleCancelMessage(scheduleID string) *Message {
+	m := NewMessage(0, nil)
+	m.DelayedType = PubDelayed
+	m.DelayedTs = time.Now().UnixNano()
+	m.DelayedData, _ = json.Marshal(&delayedPubData{ScheduleID: scheduleID, Cancel: true})
+	return m
+}
+
+// the scheduled message is indexed by the schedule id instead of the original id
+func getScheduledMsgDBIndexKey(scheduleID string) []byte {
+	return getDelayedMsgDBIndexKey(PubDelayed, scheduleID, 0)
+}
+
+func getDelayedMsgDBIndexKeyOfMsg(m *Message) []byte {
+	if sid := m.GetScheduleID(); sid != "" {
+		return getScheduledMsgDBIndexKey(sid)
+	}
+	return getDelayedMsgDBIndexKey(int(m.DelayedType), m.DelayedChannel, m.DelayedOrigID)
+}
+
+func decodeDelayedMsgDBIndexValue(v []byte) (int64, MessageID, bool) {
+	if len(v) < 1+8+8 {
+		return 0, 0, false
+	}
+	ts := int64(binary.BigEndian.Uint64(v[1 : 1+8]))
+	id := MessageID(binary.BigEndian.Uint64(v[1+8 : 1+8+8]))
+	return ts, id, true
+}
+
+// deleteScheduledMsg remove the scheduled message with the schedule id if any
+func deleteScheduledMsg(scheduleID string, tx delayedKVTx, isExt bool) error {
+	v := tx.Bucket(bucketDelayedMsgIndex).Get(getScheduledMsgDBIndexKey(scheduleID))
+	if v == nil {
+		return nil
+	}
+	ts, id, ok := decodeDelayedMsgDBIndexValue(v)
+	if !ok {
+		return tx.Bucket(bucketDelayedMsgIndex).Delete(getScheduledMsgDBIndexKey(scheduleID))
+	}
+	err := deleteBucketKey(PubDelayed, "", ts, id, tx, isExt)
+	if err == errBucketKeyNotFound {
+		return tx.Bucket(bucketDelayedMsgIndex).Delete(getScheduledMsgDBIndexKey(scheduleID))
+	}
+	return err
+}
+
+// GetScheduledMessage return the waiting scheduled message with the schedule id.
+func (q *DelayQueue) GetScheduledMessage(scheduleID string) (*Message, error) {
+	var msg *Message
+	err := q.getStore().View(func(tx delayedKVTx) error {
+		v := tx.Bucket(bucketDelayedMsgIndex).Get(getScheduledMsgDBIndexKey(scheduleID))
+		if v == nil {
+			return ErrScheduleNotFound
+		}
+		ts, id, ok := decodeDelayedMsgDBIndexValue(v)
+		if !ok {
+			return ErrScheduleNotFound
+		}
+		data := tx.Bucket(bucketDelayedMsg).Get(getDelayedMsgDBKey(PubDelayed, "", ts, id))
+		if data == nil {
+			return ErrScheduleNotFound
+		}
+		buf := make([]byte, len(data))
+		copy(buf, data)
+		m, err := DecodeDelayedMessage(buf, q.IsExt())
+		if err != nil {
+			return err
+		}
+		msg = m
+		return nil
+	})
+	return msg, err
+}
@@ -38,6 +38,7 @@ type TopicStats struct {
 	IsMultiOrdered       bool             `json:"is_multi_ordered"`
 	IsExt                bool             `json:"is_ext"`
 	StatsdName           string           `json:"statsd_name"`
+	DelayedPubCount      uint64           `json:"delayed_pub_count"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
@@ -67,6 +68,7 @@ func NewTopicStats(t *Topic, channels []ChannelStats, filterClients bool) TopicS
 		IsMultiOrdered:       t.IsOrdered(),
 		IsExt:                t.IsExt(),
 		StatsdName:           statsdName,
+		DelayedPubCount:      t.GetDelayedPubCnt(),
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
@@ -95,6 +97,21 @@ type ChannelStats struct {
 	DelayedQueueCount  uint64 `json:"delayed_queue_count"`
 	DelayedQueueRecent string `json:"delayed_queue_recent"`
 
+	MaxAttempts     uint32 `json:"max_attempts"`
+	DeadLetterCount uint64 `json:"dead_letter_count"`
+	MsgRateLimit    int64  `json:"msg_rate_limit"`
+	ByteRateLimit   int64  `json:"byte_rate_limit"`
+
+	ExtFilter     *ExtFilterData `json:"ext_filter,omitempty"`
+	FilteredCount uint64         `json:"filtered_count"`
+
+	RequeuePolicy *RequeuePolicy `json:"requeue_policy,omitempty"`
+
+	PriorityLanes []PriorityLaneStats `json:"priority_lanes,omitempty"`
+
+	Broadcast        bool                   `json:"broadcast"`
+	BroadcastMembers []BroadcastMemberStats `json:"broadcast_members,omitempty"`
+
 	E2eProcessingLatency    *quantile.Result `json:"e2e_processing_latency"`
 	MsgConsumeLatencyStats  []int64          `json:"msg_consume_latency_stats"`
 	MsgDeliveryLatencyStats []int64          `json:"msg_delivery_latency_stats"`
@@ -105,6 +122,7 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelSt
 	inflightCnt := len(c.inFlightMessages)
 	c.inFlightMutex.Unlock()
 	recentTs, dqCnt := c.GetDelayedQueueConsumedState()
+	msgRate, byteRate := c.GetRateLimit()
 
 	return ChannelStats{
 		ChannelName:    c.name,
@@ -120,6 +138,16 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelSt
 		RequeueCount:       atomic.LoadUint64(&c.requeueCount),
 		DeferredCount:      int(atomic.LoadInt64(&c.deferredCount)),
 		TimeoutCount:       atomic.LoadUint64(&c.timeoutCount),
+		MaxAttempts:        c.GetMaxAttempts(),
+		DeadLetterCount:    c.GetDeadLetterCount(),
+		MsgRateLimit:       msgRate,
+		ByteRateLimit:      byteRate,
+		ExtFilter:          c.GetExtFilter(),
+		FilteredCount:      c.GetFilteredCount(),
+		RequeuePolicy:      c.GetRequeuePolicy(),
+		PriorityLanes:      c.GetPriorityLaneStats(),
+		Broadcast:          c.IsBroadcast(),
+		BroadcastMembers:   c.GetBroadcastMemberStats(),
 		Clients:            clients,
 		ClientNum:          int64(clientNum),
 		Paused:             c.IsPaused(),
@@ -174,6 +202,9 @@ type ClientStats struct {
 	TLSVersion                    string `json:"tls_version"`
 	TLSNegotiatedProtocol         string `json:"tls_negotiated_protocol"`
 	TLSNegotiatedProtocolIsMutual bool   `json:"tls_negotiated_protocol_is_mutual"`
+
+	ConsumerGroupMember string `json:"consumer_group_member,omitempty"`
+	ProducerID          string `json:"producer_id,omitempty"`
 }
 
 type Topics []*Topic
@@ -566,6 +597,7 @@ func (n *NSQD) UpdateTopicHistoryStats() {
 		pubSize := t.TotalDataSize()
 		t.detailStats.historyStatsInfo.UpdateHourlySize(pubSize)
 		t.SaveHistoryStats()
+		t.saveDedupIndex()
 	}
 
 }
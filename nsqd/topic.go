@@ -10,10 +10,12 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/tidwall/gjson"
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/protocol"
@@ -32,9 +34,11 @@ var (
 	ErrWriteOffsetMismatch        = errors.New("write offset mismatch")
 	ErrOperationInvalidState      = errors.New("the operation is not allowed under current state")
 	ErrMessageInvalidDelayedState = errors.New("the message is invalid for delayed")
+	ErrUnknownDurabilityLevel     = errors.New("unknown durability level")
+	ErrTopicDiskQuotaExceeded     = errors.New("topic disk quota exceeded")
 )
 
-func writeMessageToBackend(writeExt bool, buf *bytes.Buffer, msg *Message, bq *diskQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
+func writeMessageToBackend(writeExt bool, buf *bytes.Buffer, msg *Message, bq topicQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
 	buf.Reset()
 	_, err := msg.WriteTo(buf, writeExt)
 	if err != nil {
@@ -43,17 +47,14 @@ func writeMessageToBackend(writeExt bool, buf *bytes.Buffer, msg *Message, bq *d
 	return bq.PutV2(buf.Bytes())
 }
 
-func writeMessageToBackendWithCheck(writeExt bool, buf *bytes.Buffer, msg *Message, checkSize int64, bq *diskQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
+func writeMessageToBackendWithCheck(writeExt bool, buf *bytes.Buffer, msg *Message, checkSize int64, bq topicQueueWriter) (BackendOffset, int32, diskQueueEndInfo, error) {
 	buf.Reset()
-	wsize, err := msg.WriteTo(buf, writeExt)
+	_, err := msg.WriteTo(buf, writeExt)
 	if err != nil {
 		return 0, 0, diskQueueEndInfo{}, err
 	}
-	// there are 4bytes data length on disk.
-	if checkSize > 0 && wsize+4 != checkSize {
-		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("message write size mismatch %v vs %v", checkSize, wsize+4)
-	}
-	return bq.PutV2(buf.Bytes())
+	// the size on disk should be checked by the backend, since the data may be compressed
+	return bq.PutV2WithCheck(buf.Bytes(), checkSize)
 }
 
 type MsgIDGenerator interface {
@@ -64,9 +65,46 @@ type MsgIDGenerator interface {
 type TopicDynamicConf struct {
 	AutoCommit   int32
 	RetentionDay int32
-	SyncEvery    int64
+	// the int64 fields used by atomic should be kept here to make sure 64-bit aligned on 32-bit platform
+	SyncEvery int64
+	// the max bytes on disk for the topic partition, 0 means using the default of nsqd
+	DiskQuota int64
+	// the window in seconds to dedup the messages by the dedup key in json header, 0 means no dedup
+	DedupWindow  int64
 	OrderedMulti bool
 	Ext          bool
+	// write crc32 checksum for the new data written to disk queue, all the replicas should be the same
+	Checksum bool
+	// the compress codec name for the new data written to disk queue
+	Compression string
+	// the durability level name to decide when the write can be acked
+	Durability string
+	// the json header key to compact the old messages with the same key, empty means no compaction
+	CompactKey string
+}
+
+type DurabilityLevel int32
+
+const (
+	// ack after the data is written to all the isr nodes without fsync
+	DurabilityNone DurabilityLevel = iota
+	// ack after the data is fsynced on the leader
+	DurabilityLeaderFsync
+	// ack after the data is fsynced on all the isr nodes
+	DurabilityAllISRFsync
+)
+
+func ParseDurabilityLevel(s string) (DurabilityLevel, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return DurabilityNone, nil
+	case "leader-fsync":
+		return DurabilityLeaderFsync, nil
+	case "all-isr-fsync":
+		return DurabilityAllISRFsync, nil
+	default:
+		return DurabilityNone, ErrUnknownDurabilityLevel
+	}
 }
 
 type PubInfo struct {
@@ -84,6 +122,19 @@ type ChannelMetaInfo struct {
 	Paused         bool   `json:"paused"`
 	Skipped        bool   `json:"skipped"`
 	ZanTestSkipped bool   `json:"zanTestSkipped"`
+	MaxAttempts    uint32 `json:"max_attempts,omitempty"`
+	// the consume rate limit per second, 0 means no limit
+	MsgRateLimit  int64 `json:"msg_rate_limit,omitempty"`
+	ByteRateLimit int64 `json:"byte_rate_limit,omitempty"`
+	// the messages not matched will be confirmed without sending to the clients
+	ExtFilter *ExtFilterData `json:"ext_filter,omitempty"`
+	// the backoff for the requeue without timeout and the timeout messages
+	RequeuePolicy *RequeuePolicy `json:"requeue_policy,omitempty"`
+	// dispatch the messages by the priority in the ext header
+	PriorityLane bool `json:"priority_lane,omitempty"`
+	// the consume offset of each member in the broadcast channel
+	Broadcast        bool             `json:"broadcast,omitempty"`
+	BroadcastMembers map[string]int64 `json:"broadcast_members,omitempty"`
 }
 
 func (cm *ChannelMetaInfo) IsZanTestSkipepd() bool {
@@ -98,7 +149,8 @@ type Topic struct {
 	partition   int
 	channelMap  map[string]*Channel
 	channelLock sync.RWMutex
-	backend     *diskQueueWriter
+	backend     topicQueueWriter
+	storage     string
 	dataPath    string
 	flushChan   chan int
 	exitFlag    int32
@@ -130,6 +182,14 @@ type Topic struct {
 	delayedQueue atomic.Value
 	isExt        int32
 	saveMutex    sync.Mutex
+	durability   int32
+	// the recent transactions written to the topic
+	txnWindow *txnWindow
+	// the recent sequences of the idempotent producers
+	producers *producerDedup
+	// the recent dedup keys written to the topic
+	dedupWindow  *dedupWindow
+	dedupInvalid int32
 }
 
 func (t *Topic) setExt() {
@@ -150,8 +210,15 @@ func NewTopic(topicName string, part int, opt *Options,
 	return NewTopicWithExt(topicName, part, false, false, opt, writeDisabled, notify, loopFunc)
 }
 
-// Topic constructor
 func NewTopicWithExt(topicName string, part int, ext bool, ordered bool, opt *Options,
+	writeDisabled int32,
+	notify INsqdNotify, loopFunc func(v *Topic)) *Topic {
+	return NewTopicWithStorage(topicName, part, ext, ordered, "", opt, writeDisabled, notify, loopFunc)
+}
+
+// Topic constructor, the storage engine is only used for the new topic,
+// empty storage means the default.
+func NewTopicWithStorage(topicName string, part int, ext bool, ordered bool, storage string, opt *Options,
 	writeDisabled int32,
 	notify INsqdNotify, loopFunc func(v *Topic)) *Topic {
 	if part > MAX_TOPIC_PARTITION {
@@ -171,6 +238,9 @@ func NewTopicWithExt(topicName string, part int, ext bool, ordered bool, opt *Op
 		quitChan:       make(chan struct{}),
 		pubLoopFunc:    loopFunc,
 	}
+	t.txnWindow = newTxnWindow(opt.TxnWindow)
+	t.producers = newProducerDedup(opt.ProducerSeqWindow, opt.ProducerExpire)
+	t.dedupWindow = newDedupWindow(0)
 	if ext {
 		t.setExt()
 	}
@@ -193,23 +263,25 @@ func NewTopicWithExt(topicName string, part int, ext bool, ordered bool, opt *Op
 	}
 
 	backendName := getBackendName(t.tname, t.partition)
-	queue, err := NewDiskQueueWriter(backendName,
-		t.dataPath,
-		opt.MaxBytesPerFile,
-		int32(minValidMsgLength),
-		int32(opt.MaxMsgSize)+minValidMsgLength,
-		opt.SyncEvery)
-
+	t.storage, err = resolveBackendStorage(t.dataPath, backendName, storage, opt)
+	if err != nil {
+		nsqLog.LogErrorf("topic(%v) failed to init storage %v: %v ", t.fullName, storage, err)
+		return nil
+	}
+	t.backend, err = backendStorages[t.storage](backendName, t.dataPath, opt)
 	if err != nil {
 		nsqLog.LogErrorf("topic(%v) failed to init disk queue: %v ", t.fullName, err)
 		if err == ErrNeedFixQueueStart {
 			t.SetDataFixState(true)
 		} else {
-			t.MarkAsRemoved()
+			if t.backend != nil {
+				t.MarkAsRemoved()
+			}
 			return nil
 		}
 	}
-	t.backend = queue.(*diskQueueWriter)
+	t.backend.SetTimeIndexEnabled(true)
+	t.backend.SetArchiver(opt.Archiver)
 
 	t.UpdateCommittedOffset(t.backend.GetQueueWriteEnd())
 	err = t.loadMagicCode()
@@ -247,6 +319,7 @@ func (t *Topic) GetOrCreateDelayedQueueNoLock(idGen MsgIDGenerator) (*DelayQueue
 	if t.delayedQueue.Load() == nil {
 		delayedQueue, err := NewDelayQueue(t.tname, t.partition, t.dataPath, t.option, idGen, t.IsExt())
 		if err == nil {
+			delayedQueue.backend.SetChecksumEnabled(t.dynamicConf.Checksum)
 			t.delayedQueue.Store(delayedQueue)
 			t.channelLock.RLock()
 			for _, ch := range t.channelMap {
@@ -371,10 +444,12 @@ func (t *Topic) MarkAsRemoved() (string, error) {
 	if err != nil {
 		nsqLog.Errorf("failed to mark the topic %v as removed %v failed: %v", t.GetFullName(), renamePath, err)
 	}
+	moveBackendStorageFile(t.dataPath, getBackendName(t.tname, t.partition), renamePath)
 	util.AtomicRename(t.getMagicCodeFileName(), path.Join(renamePath, "magic"+strconv.Itoa(t.partition)))
 	t.removeHistoryStat()
 	t.RemoveChannelMeta()
 	t.removeMagicCode()
+	t.removeDedupIndex()
 	if t.GetDelayedQueue() != nil {
 		t.GetDelayedQueue().Delete()
 	}
@@ -448,6 +523,12 @@ func (t *Topic) LoadChannelMeta() error {
 		if ch.IsZanTestSkipepd() {
 			channel.SkipZanTest()
 		} //else nothing maybe unskip
+		channel.SetMaxAttempts(ch.MaxAttempts)
+		channel.SetRateLimit(ch.MsgRateLimit, ch.ByteRateLimit)
+		channel.SetExtFilterFromMeta(ch)
+		channel.SetRequeuePolicyFromMeta(ch)
+		channel.SetPriorityLane(ch.PriorityLane)
+		channel.SetBroadcastFromMeta(ch)
 	}
 	return nil
 }
@@ -463,7 +544,14 @@ func (t *Topic) GetChannelMeta() []ChannelMetaInfo {
 				Paused:         channel.IsPaused(),
 				Skipped:        channel.IsSkipped(),
 				ZanTestSkipped: channel.IsZanTestSkipped(),
+				MaxAttempts:    channel.GetMaxAttempts(),
 			}
+			meta.MsgRateLimit, meta.ByteRateLimit = channel.GetRateLimit()
+			meta.ExtFilter = channel.GetExtFilter()
+			meta.RequeuePolicy = channel.GetRequeuePolicy()
+			meta.PriorityLane = channel.IsPriorityLaneEnabled()
+			meta.Broadcast = channel.IsBroadcast()
+			meta.BroadcastMembers = channel.GetBroadcastMemberOffsets()
 			channels = append(channels, meta)
 		}
 		channel.RUnlock()
@@ -484,7 +572,14 @@ func (t *Topic) SaveChannelMeta() error {
 				Paused:         channel.IsPaused(),
 				Skipped:        channel.IsSkipped(),
 				ZanTestSkipped: channel.IsZanTestSkipped(),
+				MaxAttempts:    channel.GetMaxAttempts(),
 			}
+			meta.MsgRateLimit, meta.ByteRateLimit = channel.GetRateLimit()
+			meta.ExtFilter = channel.GetExtFilter()
+			meta.RequeuePolicy = channel.GetRequeuePolicy()
+			meta.PriorityLane = channel.IsPriorityLaneEnabled()
+			meta.Broadcast = channel.IsBroadcast()
+			meta.BroadcastMembers = channel.GetBroadcastMemberOffsets()
 			channels = append(channels, meta)
 		}
 		channel.RUnlock()
@@ -579,10 +674,7 @@ func (t *Topic) GetDiskQueueSnapshot() *DiskQueueSnapshot {
 	if commit != nil && e.Offset() > commit.Offset() {
 		e = commit
 	}
-	start := t.backend.GetQueueReadStart()
-	d := NewDiskQueueSnapshot(getBackendName(t.tname, t.partition), t.dataPath, e)
-	d.SetQueueStart(start)
-	return d
+	return t.backend.newSnapshot(e)
 }
 
 func (t *Topic) BufferPoolGet(capacity int) *bytes.Buffer {
@@ -618,6 +710,21 @@ func (t *Topic) GetDynamicInfo() TopicDynamicConf {
 	return info
 }
 
+// GetBackendStorage return the storage engine of the topic data
+func (t *Topic) GetBackendStorage() string {
+	return t.storage
+}
+
+func (t *Topic) GetDurabilityLevel() DurabilityLevel {
+	return DurabilityLevel(atomic.LoadInt32(&t.durability))
+}
+
+// SyncTo wait until the data before the offset is fsynced to disk,
+// the concurrent writers will share the same fsync.
+func (t *Topic) SyncTo(offset BackendOffset) error {
+	return t.backend.SyncTo(offset)
+}
+
 func (t *Topic) IsOrdered() bool {
 	return atomic.LoadInt32(&t.isOrdered) == 1
 }
@@ -642,11 +749,31 @@ func (t *Topic) SetDynamicInfo(dynamicConf TopicDynamicConf, idGen MsgIDGenerato
 		if dynamicConf.Ext {
 			dq.setExt()
 		}
+		dq.backend.SetChecksumEnabled(dynamicConf.Checksum)
 	}
 	t.dynamicConf.Ext = dynamicConf.Ext
 	if dynamicConf.Ext {
 		t.setExt()
 	}
+	codec, err := ParseCompressCodec(dynamicConf.Compression)
+	if err != nil {
+		nsqLog.LogWarningf("topic %v compress codec %v invalid: %v", t.GetFullName(), dynamicConf.Compression, err)
+	} else {
+		t.dynamicConf.Compression = dynamicConf.Compression
+		t.backend.SetCompressCodec(codec)
+	}
+	t.dynamicConf.Checksum = dynamicConf.Checksum
+	t.backend.SetChecksumEnabled(dynamicConf.Checksum)
+	durability, err := ParseDurabilityLevel(dynamicConf.Durability)
+	if err != nil {
+		nsqLog.LogWarningf("topic %v durability level %v invalid: %v", t.GetFullName(), dynamicConf.Durability, err)
+	} else {
+		t.dynamicConf.Durability = dynamicConf.Durability
+		atomic.StoreInt32(&t.durability, int32(durability))
+	}
+	t.dynamicConf.CompactKey = dynamicConf.CompactKey
+	atomic.StoreInt64(&t.dynamicConf.DiskQuota, dynamicConf.DiskQuota)
+	atomic.StoreInt64(&t.dynamicConf.DedupWindow, dynamicConf.DedupWindow)
 	nsqLog.Logf("topic dynamic configure changed to %v", dynamicConf)
 	t.channelLock.RLock()
 	for _, ch := range t.channelMap {
@@ -726,6 +853,7 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			}
 			readEnd = curCommit
 		}
+		readEnd = t.capTxnPending(readEnd)
 
 		var ext int32
 		if t.IsExt() {
@@ -734,12 +862,13 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			ext = 0
 		}
 		start := t.backend.GetQueueReadStart()
-		channel = NewChannel(t.GetTopicName(), t.GetTopicPart(), t.IsOrdered(), channelName, readEnd,
+		channel = newChannel(t.GetTopicName(), t.GetTopicPart(), t.IsOrdered(), channelName, readEnd,
 			t.option, deleteCallback, t.flushForChannelMoreData, atomic.LoadInt32(&t.writeDisabled),
-			t.nsqdNotify, ext, start)
+			t.nsqdNotify, ext, start, t.backend)
 
 		channel.UpdateQueueEnd(readEnd, false)
 		channel.SetDelayedQueue(t.GetDelayedQueue())
+		channel.setTxnChecker(t.isTxnSkipped)
 		if t.IsWriteDisabled() {
 			channel.DisableConsume(true)
 		}
@@ -814,6 +943,10 @@ func (t *Topic) ResetBackendEndNoLock(vend BackendOffset, totalCnt int64) error
 	}
 	nsqLog.Logf("topic %v reset the backend from %v to : %v, %v", t.GetFullName(), old, vend, totalCnt)
 	dend, err := t.backend.ResetWriteEndV2(vend, totalCnt)
+	if vend < old.Offset() {
+		// the truncated messages may be in the dedup index
+		t.invalidDedupIndex()
+	}
 	if err != nil {
 		nsqLog.LogErrorf("reset backend to %v error: %v", vend, err)
 	} else {
@@ -865,6 +998,7 @@ func (t *Topic) flushForChannelMoreData(c *Channel) {
 		if curCommit != nil && e.Offset() > curCommit.Offset() {
 			e = curCommit
 		}
+		e = t.capTxnPending(e)
 		err := c.UpdateQueueEnd(e, false)
 		if err != nil {
 			if err != ErrExiting {
@@ -960,21 +1094,10 @@ func (t *Topic) PutMessagesOnReplica(msgs []*Message, offset BackendOffset, chec
 		return nil, ErrWriteOffsetMismatch
 	}
 
-	var dend diskQueueEndInfo
-	var err error
-	wsize := int32(0)
-	wsizeTotal := int32(0)
-	for _, m := range msgs {
-		_, _, wsize, dend, err = t.put(m, false, 0)
-		if err != nil {
-			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
-			return nil, err
-		}
-		wsizeTotal += wsize
-	}
-	if checkSize > 0 && int64(wsizeTotal) != checkSize {
+	_, _, _, dend, err := t.putBatch(msgs, false, checkSize)
+	if err != nil {
 		t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
-		return nil, fmt.Errorf("batch message size mismatch: %v vs %v", checkSize, wsizeTotal)
+		return nil, err
 	}
 
 	return &dend, nil
@@ -985,32 +1108,22 @@ func (t *Topic) PutMessagesNoLock(msgs []*Message) (MessageID, BackendOffset, in
 		return 0, 0, 0, 0, nil, ErrExiting
 	}
 
+	if len(msgs) == 0 {
+		return 0, BackendOffset(-1), 0, 0, &diskQueueEndInfo{}, nil
+	}
 	wend := t.backend.GetQueueWriteEnd()
-	firstMsgID := MessageID(0)
-	firstOffset := BackendOffset(-1)
-	firstCnt := int64(0)
-	var diskEnd diskQueueEndInfo
-	batchBytes := int32(0)
 	for _, m := range msgs {
 		if m.ID > 0 {
 			nsqLog.Logf("should not pass id in message while pub: %v", m.ID)
-			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
 			return 0, 0, 0, 0, nil, ErrInvalidMessageID
 		}
-		id, offset, bytes, end, err := t.put(m, true, 0)
-		if err != nil {
-			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
-			return firstMsgID, firstOffset, batchBytes, firstCnt, &diskEnd, err
-		}
-		diskEnd = end
-		batchBytes += bytes
-		if firstOffset == BackendOffset(-1) {
-			firstOffset = offset
-			firstMsgID = id
-			firstCnt = diskEnd.TotalMsgCnt()
-		}
 	}
-	return firstMsgID, firstOffset, batchBytes, firstCnt, &diskEnd, nil
+	firstOffset, firstCnt, batchBytes, diskEnd, err := t.putBatch(msgs, true, 0)
+	if err != nil {
+		t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
+		return 0, 0, 0, 0, nil, err
+	}
+	return msgs[0].ID, firstOffset, batchBytes, firstCnt, &diskEnd, nil
 }
 
 // PutMessages writes multiple Messages to the queue
@@ -1048,6 +1161,48 @@ func (t *Topic) put(m *Message, trace bool, checkSize int64) (MessageID, Backend
 	return m.ID, offset, writeBytes, dend, nil
 }
 
+// putBatch write the messages in one write so they can be compressed together,
+// return the offset and the count of the first message.
+func (t *Topic) putBatch(msgs []*Message, trace bool, checkSize int64) (BackendOffset, int64, int32, diskQueueEndInfo, error) {
+	datas := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		if m.ID <= 0 {
+			m.ID = t.nextMsgID()
+		}
+		t.putBuffer.Reset()
+		_, err := m.WriteTo(&t.putBuffer, t.IsExt())
+		if err != nil {
+			return 0, 0, 0, diskQueueEndInfo{}, err
+		}
+		datas = append(datas, append([]byte(nil), t.putBuffer.Bytes()...))
+	}
+	offset, sizes, dend, err := t.backend.PutBatchV2(datas, checkSize)
+	atomic.StoreInt32(&t.needFlush, 1)
+	if err != nil {
+		nsqLog.LogErrorf(
+			"TOPIC(%s) : failed to write messages to backend - %s",
+			t.GetFullName(), err)
+		return offset, 0, 0, dend, err
+	}
+
+	if atomic.LoadInt32(&t.dynamicConf.AutoCommit) == 1 {
+		t.UpdateCommittedOffset(&dend)
+	}
+
+	firstCnt := dend.TotalMsgCnt() - int64(len(msgs)) + 1
+	writeBytes := int32(0)
+	for i, m := range msgs {
+		if trace {
+			if m.TraceID != 0 || atomic.LoadInt32(&t.EnableTrace) == 1 || nsqLog.Level() >= levellogger.LOG_DETAIL {
+				nsqMsgTracer.TracePub(t.GetTopicName(), t.GetTopicPart(), "PUB", m.TraceID, m,
+					offset+BackendOffset(writeBytes), firstCnt+int64(i))
+			}
+		}
+		writeBytes += sizes[i]
+	}
+	return offset, firstCnt, writeBytes, dend, nil
+}
+
 func (t *Topic) updateChannelsEnd(forceReload bool) {
 	s := time.Now()
 	e := t.backend.GetQueueReadEnd()
@@ -1059,6 +1214,7 @@ func (t *Topic) updateChannelsEnd(forceReload bool) {
 		}
 		e = curCommit
 	}
+	e = t.capTxnPending(e)
 	t.channelLock.RLock()
 	if e != nil {
 		for _, channel := range t.channelMap {
@@ -1102,6 +1258,33 @@ func (t *Topic) TotalDataSize() int64 {
 	return int64(e.Offset())
 }
 
+// DiskDataSize return the data size kept in the topic queue (not cleaned yet)
+func (t *Topic) DiskDataSize() int64 {
+	e := t.backend.GetQueueWriteEnd()
+	if e == nil {
+		return 0
+	}
+	return int64(e.Offset()) - t.GetQueueReadStart()
+}
+
+func (t *Topic) GetDiskQuota() int64 {
+	quota := atomic.LoadInt64(&t.dynamicConf.DiskQuota)
+	if quota <= 0 {
+		quota = t.option.TopicDiskQuota
+	}
+	return quota
+}
+
+// CheckDiskQuota should be checked by the leader before writing the new messages,
+// the replicated data from leader should always be accepted.
+func (t *Topic) CheckDiskQuota() error {
+	quota := t.GetDiskQuota()
+	if quota > 0 && t.DiskDataSize() >= quota {
+		return ErrTopicDiskQuotaExceeded
+	}
+	return nil
+}
+
 // Delete empties the topic and all its channels and closes
 func (t *Topic) Delete() error {
 	return t.exit(true)
@@ -1150,6 +1333,8 @@ func (t *Topic) exit(deleted bool) error {
 		t.removeHistoryStat()
 		t.RemoveChannelMeta()
 		t.removeMagicCode()
+		t.removeDedupIndex()
+		removeBackendStorageFile(t.dataPath, getBackendName(t.tname, t.partition))
 		return t.backend.Delete()
 	}
 
@@ -1157,6 +1342,7 @@ func (t *Topic) exit(deleted bool) error {
 	t.flush(true)
 	nsqLog.Logf("[TRACE_DATA] exiting topic end: %v, cnt: %v", t.TotalDataSize(), t.TotalMessageCnt())
 	t.SaveChannelMeta()
+	t.saveDedupIndex()
 	t.channelLock.RLock()
 	// close all the channels
 	for _, channel := range t.channelMap {
@@ -1186,16 +1372,16 @@ func (t *Topic) DisableForSlave() {
 	t.channelLock.RLock()
 	for _, c := range t.channelMap {
 		c.DisableConsume(true)
-		d, ok := c.backend.(*diskQueueReader)
-		var curRead BackendQueueEnd
-		if ok {
-			curRead = d.GetQueueCurrentRead()
-		}
+		curRead := c.backend.GetQueueCurrentRead()
 
 		nsqLog.Logf("[TRACE_DATA] while disable channel : %v, %v, %v, %v, %v", c.GetName(),
 			c.GetConfirmed(), c.Depth(), c.backend.GetQueueReadEnd(), curRead)
 	}
 	t.channelLock.RUnlock()
+	t.resetTxnWindow()
+	t.resetProducers()
+	t.saveDedupIndex()
+	t.resetDedupWindow()
 	// notify de-register from lookup
 	t.nsqdNotify.NotifyStateChanged(t, false)
 }
@@ -1205,15 +1391,14 @@ func (t *Topic) EnableForMaster() {
 	t.channelLock.RLock()
 	for _, c := range t.channelMap {
 		c.DisableConsume(false)
-		d, ok := c.backend.(*diskQueueReader)
-		var curRead BackendQueueEnd
-		if ok {
-			curRead = d.GetQueueCurrentRead()
-		}
+		curRead := c.backend.GetQueueCurrentRead()
 		nsqLog.Logf("[TRACE_DATA] while enable channel : %v, %v, %v, %v, %v", c.GetName(),
 			c.GetConfirmed(), c.Depth(), c.backend.GetQueueReadEnd(), curRead)
 	}
 	t.channelLock.RUnlock()
+	t.resetTxnWindow()
+	t.resetProducers()
+	t.resetDedupWindow()
 	atomic.StoreInt32(&t.writeDisabled, 0)
 	// notify re-register to lookup
 	t.nsqdNotify.NotifyStateChanged(t, false)
@@ -1221,6 +1406,7 @@ func (t *Topic) EnableForMaster() {
 
 func (t *Topic) Empty() error {
 	nsqLog.Logf("TOPIC(%s): empty", t.GetFullName())
+	t.invalidDedupIndex()
 	return t.backend.Empty()
 }
 
@@ -1306,6 +1492,34 @@ func (t *Topic) AggregateChannelE2eProcessingLatency() *quantile.Quantile {
 	return latencyStream
 }
 
+// TryCompactData remove the old messages which have the newer message with the same
+// compact key in the json header, only the committed data will be compacted.
+func (t *Topic) TryCompactData() (int64, error) {
+	key := t.GetDynamicInfo().CompactKey
+	if key == "" || !t.IsExt() {
+		return 0, nil
+	}
+	dq, ok := t.backend.(*diskQueueWriter)
+	if !ok {
+		return 0, ErrCompactNotSupported
+	}
+	end := t.GetCommitted()
+	if end == nil {
+		return 0, nil
+	}
+	return dq.CompactByKey(end, func(data []byte) (string, bool) {
+		msg, err := decodeMessage(data, true)
+		if err != nil || msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+			return "", false
+		}
+		v := gjson.GetBytes(msg.ExtBytes, key)
+		if !v.Exists() {
+			return "", false
+		}
+		return v.String(), true
+	})
+}
+
 // maybe should return the cleaned offset to allow commit log clean
 func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
 	// clean the data that has been consumed and keep the retention policy
@@ -1334,7 +1548,7 @@ func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanO
 	if oldestPos.Offset() < maxCleanOffset || maxCleanOffset == BackendOffset(0) {
 		maxCleanOffset = oldestPos.Offset()
 	}
-	snapReader := NewDiskQueueSnapshot(getBackendName(t.tname, t.partition), t.dataPath, oldestPos)
+	snapReader := t.backend.newSnapshot(oldestPos)
 	snapReader.SetQueueStart(cleanStart)
 	err := snapReader.SeekTo(cleanStart.Offset())
 	if err != nil {
@@ -1414,6 +1628,7 @@ func (t *Topic) ResetBackendWithQueueStartNoLock(queueStartOffset int64, queueSt
 	queueStart.totalMsgCnt = queueStartCnt
 	nsqLog.Warningf("reset the topic %v backend with queue start: %v", t.GetFullName(), queueStart)
 	err := t.backend.ResetWriteWithQueueStart(queueStart)
+	t.invalidDedupIndex()
 	if err != nil {
 		return err
 	}
@@ -1447,6 +1662,16 @@ func (t *Topic) GetDelayedQueueConsumedState() (RecentKeyList, map[int]uint64, m
 	return dq.GetOldestConsumedState(chList, true)
 }
 
+// GetDelayedPubCnt return the count of the delayed pub messages waiting in the delayed queue.
+func (t *Topic) GetDelayedPubCnt() uint64 {
+	dq := t.GetDelayedQueue()
+	if dq == nil {
+		return 0
+	}
+	cnt, _ := dq.GetCurrentDelayedCnt(PubDelayed, "")
+	return cnt
+}
+
 func (t *Topic) UpdateDelayedQueueConsumedState(keyList RecentKeyList, cntList map[int]uint64, channelCntList map[string]uint64) error {
 	if t.IsOrdered() {
 		nsqLog.Infof("should never delayed queue in ordered topic: %v", t.GetFullName())
@@ -2,15 +2,18 @@ package nsqd
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	//"runtime"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/absolute8511/glog"
+	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/test"
 )
 
@@ -113,10 +116,10 @@ func TestTopicMarkRemoved(t *testing.T) {
 	topic.SaveHistoryStats()
 	topic1.ForceFlush()
 	topic1.SaveHistoryStats()
-	oldName := topic.backend.fileName(0)
-	oldMetaName := topic.backend.metaDataFileName()
-	oldName1 := topic1.backend.fileName(0)
-	oldMetaName1 := topic1.backend.metaDataFileName()
+	oldName := topic.backend.(*diskQueueWriter).fileName(0)
+	oldMetaName := topic.backend.(*diskQueueWriter).metaDataFileName()
+	oldName1 := topic1.backend.(*diskQueueWriter).fileName(0)
+	oldMetaName1 := topic1.backend.(*diskQueueWriter).metaDataFileName()
 	oldMagicFile := topic.getMagicCodeFileName()
 	oldMagicFile1 := topic1.getMagicCodeFileName()
 	oldHistoryFile := topic.getHistoryStatsFileName()
@@ -222,6 +225,92 @@ func TestDeleteLast(t *testing.T) {
 	test.Nil(t, err)
 }
 
+func TestTopicDiskQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.TopicDiskQuota = 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_disk_quota", 0, false)
+	test.Nil(t, nsqd.CheckDiskQuota(topic))
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(0, make([]byte, 100))
+		_, _, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	test.Equal(t, true, topic.DiskDataSize() >= opts.TopicDiskQuota)
+	test.Equal(t, ErrTopicDiskQuotaExceeded, nsqd.CheckDiskQuota(topic))
+	test.Equal(t, true, IsDiskQuotaErr(topic.CheckDiskQuota()))
+
+	// the quota of the topic should override the default
+	dynConf := topic.GetDynamicInfo()
+	dynConf.DiskQuota = 1024 * 1024
+	topic.SetDynamicInfo(dynConf, nil)
+	test.Nil(t, nsqd.CheckDiskQuota(topic))
+
+	newOpts := *opts
+	newOpts.DiskHighWatermark = 0.0000001
+	nsqd.SwapOpts(&newOpts)
+	nsqd.checkDiskUsage()
+	test.Equal(t, true, nsqd.IsDiskFull())
+	test.Equal(t, true, nsqd.IsHealthy())
+	test.Equal(t, true, strings.HasPrefix(nsqd.GetHealth(), "OK - "+ErrDiskHighWatermark.Error()))
+	test.Equal(t, ErrDiskHighWatermark, nsqd.CheckDiskQuota(topic))
+
+	nsqd.SwapOpts(opts)
+	nsqd.checkDiskUsage()
+	test.Equal(t, false, nsqd.IsDiskFull())
+	test.Equal(t, "OK", nsqd.GetHealth())
+	test.Nil(t, nsqd.CheckDiskQuota(topic))
+}
+
+func TestTopicChecksumConf(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_checksum_conf", 0, false)
+	test.Equal(t, false, topic.GetDynamicInfo().Checksum)
+	_, _, size1, _, err := topic.PutMessage(NewMessage(0, []byte("checksum")))
+	test.Nil(t, err)
+
+	dynConf := topic.GetDynamicInfo()
+	dynConf.Checksum = true
+	topic.SetDynamicInfo(dynConf, nil)
+	test.Equal(t, true, topic.GetDynamicInfo().Checksum)
+	_, _, size2, _, err := topic.PutMessage(NewMessage(0, []byte("checksum")))
+	test.Nil(t, err)
+	test.Equal(t, size1+recordChecksumSize, size2)
+	// the delayed queue should follow the topic
+	topic.Lock()
+	dq, err := topic.GetOrCreateDelayedQueueNoLock(nil)
+	topic.Unlock()
+	test.Nil(t, err)
+	test.Equal(t, true, dq.backend.IsChecksumEnabled())
+
+	topic.ForceFlush()
+	snap := topic.GetDiskQueueSnapshot()
+	test.Nil(t, snap.SeekTo(0))
+	for i := 0; i < 2; i++ {
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		msg, err := DecodeMessage(ret.Data, false)
+		test.Nil(t, err)
+		test.Equal(t, "checksum", string(msg.Body))
+	}
+
+	dynConf.Checksum = false
+	topic.SetDynamicInfo(dynConf, nil)
+	test.Equal(t, false, dq.backend.IsChecksumEnabled())
+	_, _, size3, _, err := topic.PutMessage(NewMessage(0, []byte("checksum")))
+	test.Nil(t, err)
+	test.Equal(t, size1, size3)
+}
+
 func TestTopicBackendMaxMsgSize(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -232,7 +321,7 @@ func TestTopicBackendMaxMsgSize(t *testing.T) {
 	topicName := "test_topic_backend_maxmsgsize" + strconv.Itoa(int(time.Now().Unix()))
 	topic := nsqd.GetTopic(topicName, 0, false)
 
-	test.Equal(t, topic.backend.maxMsgSize, int32(opts.MaxMsgSize+minValidMsgLength))
+	test.Equal(t, topic.backend.(*diskQueueWriter).maxMsgSize, int32(opts.MaxMsgSize+minValidMsgLength))
 }
 
 func TestTopicPutChannelWait(t *testing.T) {
@@ -315,7 +404,7 @@ func TestTopicCleanOldDataByRetentionSize(t *testing.T) {
 	}
 	topic.ForceFlush()
 
-	fileNum := topic.backend.diskWriteEnd.EndOffset.FileNum
+	fileNum := topic.backend.(*diskQueueWriter).diskWriteEnd.EndOffset.FileNum
 	test.Equal(t, int64(0), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
 
 	test.Equal(t, true, fileNum >= 4)
@@ -327,7 +416,7 @@ func TestTopicCleanOldDataByRetentionSize(t *testing.T) {
 	topic.TryCleanOldData(1, false, 0)
 	// should not clean not consumed data
 	test.Equal(t, int64(0), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
-	startFileName := topic.backend.fileName(0)
+	startFileName := topic.backend.(*diskQueueWriter).fileName(0)
 	fStat, err := os.Stat(startFileName)
 	test.Nil(t, err)
 	fileSize := fStat.Size()
@@ -339,11 +428,11 @@ func TestTopicCleanOldDataByRetentionSize(t *testing.T) {
 	}
 	topic.TryCleanOldData(1024*1024*2, false, 0)
 	test.Equal(t, int64(2), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
-	startFileName = topic.backend.fileName(0)
+	startFileName = topic.backend.(*diskQueueWriter).fileName(0)
 	_, err = os.Stat(startFileName)
 	test.NotNil(t, err)
 	test.Equal(t, true, os.IsNotExist(err))
-	startFileName = topic.backend.fileName(1)
+	startFileName = topic.backend.(*diskQueueWriter).fileName(1)
 	_, err = os.Stat(startFileName)
 	test.NotNil(t, err)
 	test.Equal(t, true, os.IsNotExist(err))
@@ -357,7 +446,7 @@ func TestTopicCleanOldDataByRetentionSize(t *testing.T) {
 	test.Equal(t, BackendOffset((fileNum-1)*fileSize), topic.backend.GetQueueReadStart().Offset())
 	test.Equal(t, (fileNum-1)*fileCnt, topic.backend.GetQueueReadStart().TotalMsgCnt())
 	for i := 0; i < int(fileNum)-1; i++ {
-		startFileName = topic.backend.fileName(int64(i))
+		startFileName = topic.backend.(*diskQueueWriter).fileName(int64(i))
 		_, err = os.Stat(startFileName)
 		test.NotNil(t, err)
 		test.Equal(t, true, os.IsNotExist(err))
@@ -390,7 +479,7 @@ func TestTopicCleanOldDataByRetentionDay(t *testing.T) {
 	}
 	topic.ForceFlush()
 
-	fileNum := topic.backend.diskWriteEnd.EndOffset.FileNum
+	fileNum := topic.backend.(*diskQueueWriter).diskWriteEnd.EndOffset.FileNum
 	test.Equal(t, int64(0), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
 
 	test.Equal(t, true, fileNum >= 4)
@@ -403,7 +492,7 @@ func TestTopicCleanOldDataByRetentionDay(t *testing.T) {
 	topic.TryCleanOldData(0, false, 0)
 	// should not clean not consumed data
 	test.Equal(t, int64(0), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
-	startFileName := topic.backend.fileName(0)
+	startFileName := topic.backend.(*diskQueueWriter).fileName(0)
 	fStat, err := os.Stat(startFileName)
 	test.Nil(t, err)
 	fileSize := fStat.Size()
@@ -416,11 +505,11 @@ func TestTopicCleanOldDataByRetentionDay(t *testing.T) {
 	topic.dynamicConf.RetentionDay = 2
 	topic.TryCleanOldData(0, false, 0)
 	test.Equal(t, int64(2), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
-	startFileName = topic.backend.fileName(0)
+	startFileName = topic.backend.(*diskQueueWriter).fileName(0)
 	_, err = os.Stat(startFileName)
 	test.NotNil(t, err)
 	test.Equal(t, true, os.IsNotExist(err))
-	startFileName = topic.backend.fileName(1)
+	startFileName = topic.backend.(*diskQueueWriter).fileName(1)
 	_, err = os.Stat(startFileName)
 	test.NotNil(t, err)
 	test.Equal(t, true, os.IsNotExist(err))
@@ -435,7 +524,7 @@ func TestTopicCleanOldDataByRetentionDay(t *testing.T) {
 	test.Equal(t, BackendOffset((fileNum-1)*fileSize), topic.backend.GetQueueReadStart().Offset())
 	test.Equal(t, (fileNum-1)*fileCnt, topic.backend.GetQueueReadStart().TotalMsgCnt())
 	for i := 0; i < int(fileNum)-1; i++ {
-		startFileName = topic.backend.fileName(int64(i))
+		startFileName = topic.backend.(*diskQueueWriter).fileName(int64(i))
 		_, err = os.Stat(startFileName)
 		test.NotNil(t, err)
 		test.Equal(t, true, os.IsNotExist(err))
@@ -486,7 +575,7 @@ func TestTopicCleanOldDataByRetentionDayWithResetStart(t *testing.T) {
 	}
 	topic.ForceFlush()
 
-	fileNum := topic.backend.diskWriteEnd.EndOffset.FileNum
+	fileNum := topic.backend.(*diskQueueWriter).diskWriteEnd.EndOffset.FileNum
 	test.Equal(t, int64(readStart.EndOffset.FileNum), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
 
 	test.Equal(t, true, fileNum == 2)
@@ -499,7 +588,7 @@ func TestTopicCleanOldDataByRetentionDayWithResetStart(t *testing.T) {
 	_, err = topic.TryCleanOldData(0, false, 0)
 	test.Equal(t, readStart, *(topic.backend.GetQueueReadStart().(*diskQueueEndInfo)))
 	test.Nil(t, err)
-	startFileName := topic.backend.fileName(readStart.EndOffset.FileNum)
+	startFileName := topic.backend.(*diskQueueWriter).fileName(readStart.EndOffset.FileNum)
 	fStat, err := os.Stat(startFileName)
 	test.Nil(t, err)
 	fileSize := fStat.Size()
@@ -509,7 +598,7 @@ func TestTopicCleanOldDataByRetentionDayWithResetStart(t *testing.T) {
 	_, err = topic.TryCleanOldData(0, false, 0)
 	test.Nil(t, err)
 	test.Equal(t, readStart, *(topic.backend.GetQueueReadStart().(*diskQueueEndInfo)))
-	startFileName = topic.backend.fileName(int64(fileNum))
+	startFileName = topic.backend.(*diskQueueWriter).fileName(int64(fileNum))
 	_, err = os.Stat(startFileName)
 	test.Nil(t, err)
 }
@@ -545,7 +634,7 @@ func TestTopicResetWithQueueStart(t *testing.T) {
 	}
 	topic.ForceFlush()
 
-	fileNum := topic.backend.diskWriteEnd.EndOffset.FileNum
+	fileNum := topic.backend.(*diskQueueWriter).diskWriteEnd.EndOffset.FileNum
 	test.Equal(t, int64(0), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
 
 	test.Equal(t, true, fileNum >= 4)
@@ -669,3 +758,232 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		topic.PutMessage(msg)
 	}
 }
+
+func TestTopicTxnWindowLoad(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_txn_window", 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+	keys := []string{
+		GetTxnSourceKey("src", 0, "ch", 1),
+		GetTxnSourceKey("src", 0, "ch", 2),
+	}
+	putTxn := func(txnID string, keys []string, commit bool) (MessageID, []*Message) {
+		msg := NewMessageWithExt(0, []byte("txn"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`))
+		test.Nil(t, SetTxnHeader(msg, txnID, keys))
+		msg2 := NewMessageWithExt(0, []byte("txn2"), ext.JSON_HEADER_EXT_VER, nil)
+		test.Nil(t, SetTxnHeader(msg2, txnID, nil))
+		msgs := []*Message{msg, msg2}
+		id, _, _, _, _, err := topic.PutMessages(msgs)
+		test.Nil(t, err)
+		if commit {
+			marker := NewTxnCommitMessage(txnID)
+			_, _, _, _, err = topic.PutMessage(marker)
+			test.Nil(t, err)
+			msgs = append(msgs, marker)
+		}
+		return id, msgs
+	}
+	id, committedMsgs := putTxn(NewTxnID(), keys, true)
+	// the transaction without the commit marker
+	uncommittedKeys := []string{GetTxnSourceKey("src", 0, "ch", 3)}
+	_, uncommittedMsgs := putTxn(NewTxnID(), uncommittedKeys, false)
+	topic.ForceFlush()
+
+	// the window should be rebuilt from the data after reset
+	topic.resetTxnWindow()
+	topic.LockTxn()
+	committed, err := topic.GetTxnCommittedNoLock(append(keys, uncommittedKeys...))
+	topic.UnlockTxn()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(committed))
+	test.Equal(t, id, committed[keys[0]])
+	test.Equal(t, id, committed[keys[1]])
+
+	test.Equal(t, false, topic.isTxnSkipped(committedMsgs[0]))
+	test.Equal(t, false, topic.isTxnSkipped(committedMsgs[1]))
+	// the commit marker should always be skipped
+	test.Equal(t, true, topic.isTxnSkipped(committedMsgs[2]))
+	test.Equal(t, true, topic.isTxnSkipped(uncommittedMsgs[0]))
+	test.Equal(t, true, topic.isTxnSkipped(uncommittedMsgs[1]))
+	test.Equal(t, false, topic.isTxnSkipped(NewMessageWithExt(0, []byte("normal"), ext.JSON_HEADER_EXT_VER, nil)))
+
+	abortedID := NewTxnID()
+	putTxn(abortedID, nil, false)
+	_, _, _, _, err = topic.PutMessage(NewTxnAbortMessage(abortedID))
+	test.Nil(t, err)
+	topic.ForceFlush()
+	var all []*Message
+	err = topic.scanRecentMessages(0, func(msg *Message, ret *ReadResult) {
+		msg.Offset = ret.Offset
+		all = append(all, msg)
+	})
+	test.Nil(t, err)
+	test.Equal(t, 8, len(all))
+	// the transactions older than the window are decided by the marker after the message
+	topic.txnWindow.Lock()
+	topic.txnWindow.resetNoLock()
+	topic.txnWindow.loaded = true
+	topic.txnWindow.Unlock()
+	for i, msg := range all {
+		// only the messages of the first transaction are committed
+		test.Equal(t, i >= 2, topic.isTxnSkipped(msg))
+	}
+	test.Equal(t, 3, len(topic.txnWindow.txns))
+}
+
+func TestTopicTxnVisibility(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_txn_visibility", 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+	channel := topic.GetChannel("ch")
+	recv := func() *Message {
+		select {
+		case msg := <-channel.clientMsgChan:
+			return msg
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	putTxn := func(txnID string, body string) MessageID {
+		msg := NewMessageWithExt(0, []byte(body), ext.JSON_HEADER_EXT_VER, nil)
+		test.Nil(t, SetTxnHeader(msg, txnID, []string{body}))
+		id, _, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		topic.ForceFlush()
+		return id
+	}
+
+	txnID := NewTxnID()
+	topic.LockTxn()
+	topic.PrepareTxnNoLock(txnID, []string{"committed"})
+	end := channel.GetChannelEnd()
+	id := putTxn(txnID, "committed")
+	// the channel should not read the pending transaction
+	test.Equal(t, end.Offset(), channel.GetChannelEnd().Offset())
+	test.Nil(t, recv())
+	_, _, _, _, err := topic.PutMessage(NewTxnCommitMessage(txnID))
+	test.Nil(t, err)
+	topic.CommitTxnNoLock(txnID, []string{"committed"}, id)
+	topic.UnlockTxn()
+	msg := recv()
+	test.NotNil(t, msg)
+	test.Equal(t, "committed", string(msg.Body))
+	channel.ConfirmBackendQueue(msg)
+
+	txnID = NewTxnID()
+	topic.LockTxn()
+	topic.PrepareTxnNoLock(txnID, []string{"aborted"})
+	putTxn(txnID, "aborted")
+	_, _, _, _, err = topic.PutMessage(NewTxnAbortMessage(txnID))
+	test.Nil(t, err)
+	topic.AbortTxnNoLock(txnID)
+	topic.UnlockTxn()
+	_, _, _, _, err = topic.PutMessage(NewMessageWithExt(0, []byte("normal"), ext.JSON_HEADER_EXT_VER, nil))
+	test.Nil(t, err)
+	topic.ForceFlush()
+	// the markers and the aborted transaction should be skipped
+	msg = recv()
+	test.NotNil(t, msg)
+	test.Equal(t, "normal", string(msg.Body))
+}
+
+func TestTopicProducerSeqLoad(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.ProducerSeqWindow = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_producer_seq", 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+	results := make([]ProducerPubResult, 0)
+	for seq := 1; seq <= 3; seq++ {
+		header := fmt.Sprintf(`{"%v":"p1","%v":"%v"}`, ProducerIDKey, ProducerSeqKey, seq)
+		msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(header))
+		id, offset, rawSize, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		results = append(results, ProducerPubResult{ID: id, Offset: offset, RawSize: rawSize})
+	}
+	topic.ForceFlush()
+
+	// the sequences should be rebuilt from the data after reset
+	topic.resetProducers()
+	topic.LockProducer()
+	defer topic.UnlockProducer()
+	ret, err := topic.CheckProducerSeqNoLock("p1", 3)
+	test.Nil(t, err)
+	test.Equal(t, results[2], *ret)
+	ret, err = topic.CheckProducerSeqNoLock("p1", 2)
+	test.Nil(t, err)
+	test.Equal(t, results[1], *ret)
+	// older than the window
+	_, err = topic.CheckProducerSeqNoLock("p1", 1)
+	test.Equal(t, ErrProducerSeqOutOfOrder, err)
+	ret, err = topic.CheckProducerSeqNoLock("p1", 4)
+	test.Nil(t, err)
+	test.Nil(t, ret)
+	ret, err = topic.CheckProducerSeqNoLock("p2", 1)
+	test.Nil(t, err)
+	test.Nil(t, ret)
+}
+
+func TestTopicDedupIndex(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_dedup_index", 0, false)
+	topic.SetDynamicInfo(TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true, DedupWindow: 600}, nil)
+	test.Equal(t, true, topic.IsDedupEnabled())
+	putWithKey := func(key string) MessageID {
+		header := fmt.Sprintf(`{"%v":"%v"}`, DedupKeyHeader, key)
+		msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(header))
+		test.Equal(t, key, GetDedupKey(msg))
+		id, _, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		topic.ForceFlush()
+		return id
+	}
+	id1 := putWithKey("k1")
+	topic.LockDedup()
+	written, err := topic.GetDedupWrittenNoLock([]string{"k1", "k2"})
+	topic.UnlockDedup()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(written))
+	test.Equal(t, id1, written["k1"])
+	test.Nil(t, topic.saveDedupIndex())
+
+	// the data written after the saved index should be loaded
+	id2 := putWithKey("k2")
+	topic.resetDedupWindow()
+	topic.LockDedup()
+	written, err = topic.GetDedupWrittenNoLock([]string{"k1", "k2", "k3"})
+	topic.UnlockDedup()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(written))
+	test.Equal(t, id1, written["k1"])
+	test.Equal(t, id2, written["k2"])
+
+	// rebuild from the data without the index
+	topic.invalidDedupIndex()
+	_, err = os.Stat(topic.getDedupIndexFileName())
+	test.Equal(t, true, os.IsNotExist(err))
+	topic.LockDedup()
+	written, err = topic.GetDedupWrittenNoLock([]string{"k1", "k2"})
+	topic.UnlockDedup()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(written))
+}
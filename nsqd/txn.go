@@ -0,0 +1,497 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/ext"
+)
+
+// The transaction commit the consumed messages (or the consume offset) of the source channel
+// and publish the new messages to the destination topics. The destination messages carry the
+// transaction id in the json header, and the commit marker of the transaction is written to each
+// destination after all the messages are written (or the abort marker if failed). The channels will
+// not read beyond the pending transaction, and the messages of the transaction without the commit
+// marker are skipped, so the messages are visible only after the transaction committed. The state of
+// the transaction older than the window is decided by looking for the marker after the message, since
+// the marker is written after all the messages of the transaction. The first message of each destination
+// carry the keys of the source messages, and the keys of the committed transaction in the recent
+// window are used to detect the retry of the same transaction (while the source messages redelivered
+// after failover), so only the source will be committed again.
+
+const (
+	TxnIDKey     = "##txn_id"
+	TxnSourceKey = "##txn_src"
+	TxnCommitKey = "##txn_commit"
+	TxnAbortKey  = "##txn_abort"
+)
+
+var (
+	ErrTxnPartialCommitted = errors.New("part of the transaction source has been committed by another transaction")
+	ErrTxnTopicNotExt      = errors.New("the destination topic of the transaction should support ext")
+)
+
+var txnSeq uint64
+
+// NewTxnID return the unique id for the transaction
+func NewTxnID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&txnSeq, 1), 36)
+}
+
+// GetTxnSourceKey return the key for the consumed message of the source channel
+func GetTxnSourceKey(topic string, part int, channel string, id MessageID) string {
+	return GetTopicFullName(topic, part) + ":" + channel + ":" + strconv.FormatUint(uint64(id), 10)
+}
+
+// GetTxnOffsetSourceKey return the key for the consume offset of the source channel
+func GetTxnOffsetSourceKey(topic string, part int, channel string, offset string) string {
+	return GetTopicFullName(topic, part) + ":" + channel + "@" + offset
+}
+
+// SetTxnHeader add the transaction id and the source keys (if any) to the json header of the message
+func SetTxnHeader(msg *Message, txnID string, keys []string) error {
+	header, err := getJsonHeader(msg)
+	if err != nil {
+		return err
+	}
+	header[TxnIDKey], _ = json.Marshal(txnID)
+	if len(keys) > 0 {
+		header[TxnSourceKey], _ = json.Marshal(strings.Join(keys, ","))
+	}
+	extBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if len(extBytes) > ext.MaxExtLen {
+		return errors.New("ext header too long for transaction")
+	}
+	msg.ExtVer = ext.JSON_HEADER_EXT_VER
+	msg.ExtBytes = extBytes
+	return nil
+}
+
+// NewTxnCommitMessage return the commit marker of the transaction, which will be skipped by the channels
+func NewTxnCommitMessage(txnID string) *Message {
+	header, _ := json.Marshal(map[string]string{TxnCommitKey: txnID})
+	return NewMessageWithExt(0, nil, ext.JSON_HEADER_EXT_VER, header)
+}
+
+// NewTxnAbortMessage return the abort marker of the transaction, which will be skipped by the channels
+func NewTxnAbortMessage(txnID string) *Message {
+	header, _ := json.Marshal(map[string]string{TxnAbortKey: txnID})
+	return NewMessageWithExt(0, nil, ext.JSON_HEADER_EXT_VER, header)
+}
+
+type txnHeader struct {
+	id     string
+	keys   []string
+	commit string
+	abort  string
+}
+
+func getTxnHeader(msg *Message) *txnHeader {
+	// all the transaction keys have the same prefix
+	if !hasJsonHeaderKey(msg, "##txn_") {
+		return nil
+	}
+	header, err := getJsonHeader(msg)
+	if err != nil {
+		return nil
+	}
+	var h txnHeader
+	h.id = getJsonHeaderValueString(header, TxnIDKey)
+	h.commit = getJsonHeaderValueString(header, TxnCommitKey)
+	h.abort = getJsonHeaderValueString(header, TxnAbortKey)
+	if h.id == "" && h.commit == "" && h.abort == "" {
+		return nil
+	}
+	if src := getJsonHeaderValueString(header, TxnSourceKey); src != "" {
+		h.keys = strings.Split(src, ",")
+	}
+	return &h
+}
+
+type dedupItem struct {
+	key string
+	ts  int64
+}
+
+// dedupWindow keep the keys written to the topic in the recent window, it should be
+// loaded from the topic data before used since it is not persisted.
+type dedupWindow struct {
+	sync.Mutex
+	window time.Duration
+	loaded bool
+	keys   map[string]MessageID
+	// the keys ordered by the written time, used for expiring
+	items []dedupItem
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{
+		window: window,
+		keys:   make(map[string]MessageID),
+	}
+}
+
+func (w *dedupWindow) addNoLock(key string, id MessageID, ts int64) {
+	if _, ok := w.keys[key]; !ok {
+		w.items = append(w.items, dedupItem{key: key, ts: ts})
+	}
+	w.keys[key] = id
+}
+
+func (w *dedupWindow) expireNoLock(now int64) {
+	expired := now - int64(w.window)
+	i := 0
+	for ; i < len(w.items); i++ {
+		if w.items[i].ts >= expired {
+			break
+		}
+		delete(w.keys, w.items[i].key)
+	}
+	if i > 0 {
+		w.items = append(w.items[:0], w.items[i:]...)
+	}
+}
+
+func (w *dedupWindow) resetNoLock() {
+	w.loaded = false
+	w.keys = make(map[string]MessageID)
+	w.items = nil
+}
+
+type txnState struct {
+	keys []string
+	// the first message of the transaction in the topic
+	id        MessageID
+	committed bool
+}
+
+// txnWindow keep the recent transactions written to the topic, the source keys of the
+// transaction are added to the dedup window only after the commit marker written.
+type txnWindow struct {
+	dedupWindow
+	txns     map[string]*txnState
+	txnItems []dedupItem
+	// serialize the transactions written to the topic
+	txnLock sync.Mutex
+	// the queue end before the messages of the pending transaction
+	pendingLock sync.Mutex
+	pending     BackendQueueEnd
+}
+
+func newTxnWindow(window time.Duration) *txnWindow {
+	return &txnWindow{
+		dedupWindow: dedupWindow{
+			window: window,
+			keys:   make(map[string]MessageID),
+		},
+		txns: make(map[string]*txnState),
+	}
+}
+
+func (w *txnWindow) prepareNoLock(txnID string, keys []string, id MessageID, ts int64) {
+	s, ok := w.txns[txnID]
+	if !ok {
+		s = &txnState{id: id}
+		w.txns[txnID] = s
+		w.txnItems = append(w.txnItems, dedupItem{key: txnID, ts: ts})
+	}
+	if len(keys) > 0 {
+		s.keys = keys
+		s.id = id
+	}
+}
+
+func (w *txnWindow) commitNoLock(txnID string, ts int64) {
+	s, ok := w.txns[txnID]
+	if !ok {
+		// the messages of the transaction are older than the window
+		w.prepareNoLock(txnID, nil, 0, ts)
+		s = w.txns[txnID]
+	}
+	s.committed = true
+	for _, k := range s.keys {
+		w.addNoLock(k, s.id, ts)
+	}
+}
+
+func (w *txnWindow) expireNoLock(now int64) {
+	w.dedupWindow.expireNoLock(now)
+	expired := now - int64(w.window)
+	i := 0
+	for ; i < len(w.txnItems); i++ {
+		if w.txnItems[i].ts >= expired {
+			break
+		}
+		delete(w.txns, w.txnItems[i].key)
+	}
+	if i > 0 {
+		w.txnItems = append(w.txnItems[:0], w.txnItems[i:]...)
+	}
+}
+
+func (w *txnWindow) resetNoLock() {
+	w.dedupWindow.resetNoLock()
+	w.txns = make(map[string]*txnState)
+	w.txnItems = nil
+}
+
+func (w *txnWindow) getPending() BackendQueueEnd {
+	w.pendingLock.Lock()
+	e := w.pending
+	w.pendingLock.Unlock()
+	return e
+}
+
+func (w *txnWindow) setPending(e BackendQueueEnd) {
+	w.pendingLock.Lock()
+	w.pending = e
+	w.pendingLock.Unlock()
+}
+
+// scanRecentMessages read the topic data written since the timestamp
+func (t *Topic) scanRecentMessages(since int64, handler func(msg *Message, ret *ReadResult)) error {
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	_, _, err := snap.SearchByTimestamp(since)
+	if err == ErrTimeIndexNotFound {
+		// no time index for the old data or the record storage, scan from the queue start
+		nsqLog.LogWarningf("topic %v no time index for the recent data, scan from the queue start", t.GetFullName())
+		err = snap.ResetSeekTo(snap.GetQueueReadStart().Offset())
+	}
+	if err != nil {
+		return err
+	}
+	return t.scanSnapshot(snap, since, handler)
+}
+
+// scanSnapshot read the messages from the current position of the snapshot to the end,
+// the messages older than the timestamp are ignored.
+func (t *Topic) scanSnapshot(snap *DiskQueueSnapshot, since int64, handler func(msg *Message, ret *ReadResult)) error {
+	for {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err == io.EOF {
+				return nil
+			}
+			return ret.Err
+		}
+		msg, err := DecodeMessage(ret.Data, t.IsExt())
+		if err != nil {
+			return err
+		}
+		if msg.Timestamp < since {
+			continue
+		}
+		handler(msg, &ret)
+	}
+}
+
+// loadTxnWindowNoLock rebuild the window from the topic data written in the window duration
+func (t *Topic) loadTxnWindowNoLock(w *txnWindow) error {
+	w.resetNoLock()
+	err := t.scanRecentMessages(time.Now().Add(-1*w.window).UnixNano(), func(msg *Message, ret *ReadResult) {
+		h := getTxnHeader(msg)
+		if h == nil {
+			return
+		}
+		if h.commit != "" {
+			w.commitNoLock(h.commit, msg.Timestamp)
+		} else if h.abort != "" {
+			w.prepareNoLock(h.abort, nil, 0, msg.Timestamp)
+		} else {
+			w.prepareNoLock(h.id, h.keys, msg.ID, msg.Timestamp)
+		}
+	})
+	if err != nil {
+		w.resetNoLock()
+		return err
+	}
+	w.loaded = true
+	nsqLog.Logf("topic %v transaction window loaded: %v transactions, %v keys", t.GetFullName(),
+		len(w.txns), len(w.keys))
+	return nil
+}
+
+func (t *Topic) checkTxnWindowLoadedNoLock() error {
+	w := t.txnWindow
+	if !w.loaded {
+		if err := t.loadTxnWindowNoLock(w); err != nil {
+			nsqLog.LogErrorf("topic %v failed to load the transaction window: %v", t.GetFullName(), err)
+			return err
+		}
+	}
+	w.expireNoLock(time.Now().UnixNano())
+	return nil
+}
+
+// LockTxn should be held while checking and writing the transaction messages to the topic,
+// so the same source can not be committed concurrently.
+func (t *Topic) LockTxn() {
+	t.txnWindow.txnLock.Lock()
+}
+
+func (t *Topic) UnlockTxn() {
+	t.txnWindow.txnLock.Unlock()
+}
+
+// GetTxnCommittedNoLock return the keys which have been committed to the topic in the
+// transaction window.
+func (t *Topic) GetTxnCommittedNoLock(keys []string) (map[string]MessageID, error) {
+	w := t.txnWindow
+	w.Lock()
+	defer w.Unlock()
+	if err := t.checkTxnWindowLoadedNoLock(); err != nil {
+		return nil, err
+	}
+	committed := make(map[string]MessageID)
+	for _, k := range keys {
+		if id, ok := w.keys[k]; ok {
+			committed[k] = id
+		}
+	}
+	return committed, nil
+}
+
+// PrepareTxnNoLock should be called before writing the messages of the transaction, the channels
+// will not read the messages written after it until the transaction committed or aborted.
+func (t *Topic) PrepareTxnNoLock(txnID string, keys []string) {
+	w := t.txnWindow
+	w.setPending(t.backend.GetQueueReadEnd())
+	w.Lock()
+	w.prepareNoLock(txnID, keys, 0, time.Now().UnixNano())
+	w.Unlock()
+}
+
+// CommitTxnNoLock should be called after the commit marker written, the id is the first
+// message of the transaction in the topic.
+func (t *Topic) CommitTxnNoLock(txnID string, keys []string, id MessageID) {
+	w := t.txnWindow
+	w.Lock()
+	w.prepareNoLock(txnID, keys, id, time.Now().UnixNano())
+	w.commitNoLock(txnID, time.Now().UnixNano())
+	w.Unlock()
+	t.endTxnPending()
+}
+
+// AbortTxnNoLock should be called if the transaction failed after the abort marker written (if
+// possible), the messages written without the commit marker will be skipped by the channels.
+func (t *Topic) AbortTxnNoLock(txnID string) {
+	nsqLog.Logf("topic %v transaction %v aborted", t.GetFullName(), txnID)
+	t.endTxnPending()
+}
+
+func (t *Topic) endTxnPending() {
+	if t.txnWindow.getPending() == nil {
+		return
+	}
+	t.txnWindow.setPending(nil)
+	t.backend.FlushBuffer()
+	t.updateChannelsEnd(false)
+}
+
+// capTxnPending return the end before the pending transaction if the given end is beyond it,
+// the given end should be got before calling, since the pending is set before writing.
+func (t *Topic) capTxnPending(e BackendQueueEnd) BackendQueueEnd {
+	pending := t.txnWindow.getPending()
+	if e != nil && pending != nil && e.Offset() > pending.Offset() {
+		return pending
+	}
+	return e
+}
+
+// isTxnSkipped return true for the markers and the messages of the transaction which is
+// not committed.
+func (t *Topic) isTxnSkipped(msg *Message) bool {
+	h := getTxnHeader(msg)
+	if h == nil {
+		return false
+	}
+	if h.commit != "" || h.abort != "" {
+		return true
+	}
+	if msg.DelayedType == ChannelDelayed {
+		// the delayed message has been checked while read from the topic
+		return false
+	}
+	w := t.txnWindow
+	w.Lock()
+	if err := t.checkTxnWindowLoadedNoLock(); err != nil {
+		w.Unlock()
+		return true
+	}
+	s, ok := w.txns[h.id]
+	w.Unlock()
+	if ok {
+		return !s.committed
+	}
+	// the transaction older than the window is unknown, look for the marker after the message
+	committed, err := t.isTxnCommittedAfter(h.id, msg.Offset, msg.Timestamp)
+	if err != nil {
+		nsqLog.LogErrorf("topic %v failed to check the transaction %v at %v: %v", t.GetFullName(),
+			h.id, msg.Offset, err)
+		return true
+	}
+	w.Lock()
+	w.prepareNoLock(h.id, nil, 0, time.Now().UnixNano())
+	if committed {
+		w.txns[h.id].committed = true
+	}
+	w.Unlock()
+	return !committed
+}
+
+// isTxnCommittedAfter return true if the commit marker of the transaction is found after the
+// message of the transaction. The transaction should be finished in the window, so we stop looking
+// at the data written after the window since the message.
+func (t *Topic) isTxnCommittedAfter(txnID string, offset BackendOffset, ts int64) (bool, error) {
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	if err := snap.ResetSeekTo(offset); err != nil {
+		return false, err
+	}
+	end := ts + int64(t.txnWindow.window)
+	for {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err == io.EOF {
+				return false, nil
+			}
+			return false, ret.Err
+		}
+		msg, err := DecodeMessage(ret.Data, t.IsExt())
+		if err != nil {
+			return false, err
+		}
+		if msg.Timestamp > end {
+			return false, nil
+		}
+		h := getTxnHeader(msg)
+		if h == nil {
+			continue
+		}
+		if h.commit == txnID {
+			return true, nil
+		}
+		if h.abort == txnID {
+			return false, nil
+		}
+	}
+}
+
+// resetTxnWindow should be called while the leader changed, since the data may
+// be written by other leader.
+func (t *Topic) resetTxnWindow() {
+	t.txnWindow.Lock()
+	t.txnWindow.resetNoLock()
+	t.txnWindow.Unlock()
+	t.txnWindow.setPending(nil)
+}
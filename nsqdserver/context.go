@@ -2,8 +2,11 @@ package nsqdserver
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -132,6 +135,25 @@ func (c *context) checkConsumeForMasterWrite(topic string, part int) bool {
 	return c.nsqdCoord.IsMineConsumeLeaderForTopic(topic, part)
 }
 
+// checkConsumerGroupAssigned check if the partition is assigned to the member while the channel is
+// consumed by the consumer group, no check if no consumer group for the channel.
+func (c *context) checkConsumerGroupAssigned(topic string, part int, channel string, member string) error {
+	if c.nsqdCoord == nil {
+		return nil
+	}
+	group, err := c.nsqdCoord.GetConsumerGroup(topic, channel)
+	if err == consistence.ErrConsumerGroupNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if member == "" || group.GetAssignedMember(part) != member {
+		return ErrPartitionNotAssigned
+	}
+	return nil
+}
+
 func (c *context) checkForMasterWrite(topic string, part int) bool {
 	if c.nsqdCoord == nil {
 		return true
@@ -178,13 +200,145 @@ func (c *context) PutMessage(topic *nsqd.Topic,
 	}
 	msg.TraceID = traceID
 
+	if topic.IsDedupEnabled() {
+		if key := nsqd.GetDedupKey(msg); key != "" {
+			return c.putMessageWithDedup(topic, msg, key)
+		}
+	}
+	return c.putMessageNoDedup(topic, msg)
+}
+
+func (c *context) putMessageNoDedup(topic *nsqd.Topic,
+	msg *nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	if err := c.nsqd.CheckDiskQuota(topic); err != nil {
+		return 0, 0, 0, nil, err
+	}
 	if c.nsqdCoord == nil {
 		return topic.PutMessage(msg)
 	}
 	return c.nsqdCoord.PutMessageToCluster(topic, msg)
 }
 
+// putMessageWithDedup ignore the message if the dedup key has been written in the dedup window,
+// the id of the written message will be returned for the duplicated one.
+func (c *context) putMessageWithDedup(topic *nsqd.Topic,
+	msg *nsqd.Message, key string) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	topic.LockDedup()
+	defer topic.UnlockDedup()
+	written, err := topic.GetDedupWrittenNoLock([]string{key})
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	if id, ok := written[key]; ok {
+		nsqd.NsqLogger().LogDebugf("topic %v message with dedup key %v ignored, written: %v",
+			topic.GetFullName(), key, id)
+		return id, 0, 0, nil, nil
+	}
+	id, offset, rawSize, dend, err := c.putMessageNoDedup(topic, msg)
+	if err != nil {
+		return id, offset, rawSize, dend, err
+	}
+	topic.MarkDedupWrittenNoLock(key, id)
+	return id, offset, rawSize, dend, nil
+}
+
+// PutMessageIdempotent put the message only if the sequence of the producer is new, the result
+// of the original publish will be returned for the duplicated sequence.
+func (c *context) PutMessageIdempotent(topic *nsqd.Topic, body []byte, extContent ext.IExtContent,
+	traceID uint64, producerID string, seq uint64) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	topic.LockProducer()
+	defer topic.UnlockProducer()
+	ret, err := topic.CheckProducerSeqNoLock(producerID, seq)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if ret != nil {
+		nsqd.NsqLogger().Logf("topic %v producer %v sequence %v duplicated, original message: %v",
+			topic.GetFullName(), producerID, seq, ret.ID)
+		return ret.ID, ret.Offset, ret.RawSize, nil
+	}
+	id, offset, rawSize, _, err := c.PutMessage(topic, body, extContent, traceID)
+	if err != nil {
+		return id, offset, rawSize, err
+	}
+	topic.MarkProducerSeqNoLock(producerID, seq, nsqd.ProducerPubResult{
+		ID:      id,
+		Offset:  offset,
+		RawSize: rawSize,
+	})
+	return id, offset, rawSize, nil
+}
+
 func (c *context) PutMessages(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	if topic.IsDedupEnabled() {
+		return c.putMessagesWithDedup(topic, msgs)
+	}
+	return c.putMessagesNoDedup(topic, msgs)
+}
+
+// putMessagesWithDedup ignore the messages with the dedup key written in the dedup window or
+// in the same batch before, the id of the first written message will be returned if all ignored.
+func (c *context) putMessagesWithDedup(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	keys := make([]string, 0, len(msgs))
+	hasKey := false
+	for _, m := range msgs {
+		k := nsqd.GetDedupKey(m)
+		hasKey = hasKey || k != ""
+		keys = append(keys, k)
+	}
+	if !hasKey {
+		return c.putMessagesNoDedup(topic, msgs)
+	}
+	topic.LockDedup()
+	defer topic.UnlockDedup()
+	written, err := topic.GetDedupWrittenNoLock(keys)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var dupID nsqd.MessageID
+	newMsgs := make([]*nsqd.Message, 0, len(msgs))
+	newKeys := make([]string, 0, len(msgs))
+	batchKeys := make(map[string]bool)
+	for i, m := range msgs {
+		k := keys[i]
+		if k != "" {
+			if id, ok := written[k]; ok {
+				if dupID == 0 {
+					dupID = id
+				}
+				continue
+			}
+			if batchKeys[k] {
+				continue
+			}
+			batchKeys[k] = true
+		}
+		newMsgs = append(newMsgs, m)
+		newKeys = append(newKeys, k)
+	}
+	if len(newMsgs) < len(msgs) {
+		nsqd.NsqLogger().LogDebugf("topic %v %v messages with dedup key ignored",
+			topic.GetFullName(), len(msgs)-len(newMsgs))
+	}
+	if len(newMsgs) == 0 {
+		return dupID, 0, 0, nil
+	}
+	id, offset, rawSize, err := c.putMessagesNoDedup(topic, newMsgs)
+	if err != nil {
+		return id, offset, rawSize, err
+	}
+	for i, m := range newMsgs {
+		if newKeys[i] != "" {
+			topic.MarkDedupWrittenNoLock(newKeys[i], m.ID)
+		}
+	}
+	return id, offset, rawSize, nil
+}
+
+func (c *context) putMessagesNoDedup(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	if err := c.nsqd.CheckDiskQuota(topic); err != nil {
+		return 0, 0, 0, err
+	}
 	if c.nsqdCoord == nil {
 		id, offset, rawSize, _, _, err := topic.PutMessages(msgs)
 		return id, offset, rawSize, err
@@ -192,6 +346,75 @@ func (c *context) PutMessages(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.Mes
 	return c.nsqdCoord.PutMessagesToCluster(topic, msgs)
 }
 
+// PutDelayedPubMessage put the message to the delayed queue of the topic, the message will
+// be moved to the topic by the delayed pub loop of the leader after the delay.
+func (c *context) PutDelayedPubMessage(topic *nsqd.Topic, body []byte, extContent ext.IExtContent,
+	traceID uint64, delay time.Duration) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	if delay <= 0 || delay > c.getOpts().MaxReqTimeout {
+		return 0, 0, 0, ErrInvalidPubDelay
+	}
+	return c.PutScheduledMessage(topic, body, extContent, traceID, time.Now().Add(delay), "")
+}
+
+// PutScheduledMessage put the message to the delayed queue delivered at the given time,
+// the waiting message with the same schedule id will be replaced.
+func (c *context) PutScheduledMessage(topic *nsqd.Topic, body []byte, extContent ext.IExtContent,
+	traceID uint64, deliverAt time.Time, scheduleID string) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	if topic.IsOrdered() {
+		return 0, 0, 0, ErrDelayedPubOrdered
+	}
+	var msg *nsqd.Message
+	if !topic.IsExt() {
+		msg = nsqd.NewMessage(0, body)
+	} else {
+		msg = nsqd.NewMessageWithExt(0, body, extContent.ExtVersion(), extContent.GetBytes())
+	}
+	msg.TraceID = traceID
+	msg.SetSchedule(deliverAt, scheduleID)
+	if err := c.nsqd.CheckDiskQuota(topic); err != nil {
+		return 0, 0, 0, err
+	}
+	id, offset, rawSize, _, err := c.PutMessageObj(topic, msg)
+	return id, offset, rawSize, err
+}
+
+func (c *context) getScheduledMessage(topic *nsqd.Topic, scheduleID string) (*nsqd.Message, error) {
+	if topic.IsOrdered() {
+		return nil, ErrDelayedPubOrdered
+	}
+	if !c.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		return nil, nsqd.ErrScheduleNotFound
+	}
+	return dq.GetScheduledMessage(scheduleID)
+}
+
+// CancelScheduledMessage write the cancel record to the delayed queue, so the cancel will be
+// replicated to the replicas by the commit log.
+func (c *context) CancelScheduledMessage(topic *nsqd.Topic, scheduleID string) error {
+	if _, err := c.getScheduledMessage(topic, scheduleID); err != nil {
+		return err
+	}
+	_, _, _, _, err := c.PutMessageObj(topic, nsqd.NewScheduleCancelMessage(scheduleID))
+	return err
+}
+
+// RescheduleMessage change the deliver time of the waiting scheduled message.
+func (c *context) RescheduleMessage(topic *nsqd.Topic, scheduleID string, deliverAt time.Time) (*nsqd.Message, error) {
+	old, err := c.getScheduledMessage(topic, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	newMsg := old.GetCopy()
+	newMsg.ID = 0
+	newMsg.SetSchedule(deliverAt, scheduleID)
+	newMsg.ID, _, _, _, err = c.PutMessageObj(topic, newMsg)
+	return newMsg, err
+}
+
 func (c *context) FinishMessageForce(ch *nsqd.Channel, msgID nsqd.MessageID) error {
 	if c.nsqdCoord == nil {
 		_, _, _, _, err := ch.FinishMessageForce(0, "", msgID, true)
@@ -278,6 +501,38 @@ func (c *context) EmptyChannelDelayedQueue(ch *nsqd.Channel) error {
 	return nil
 }
 
+// RedelayChannelMessages change the deliver time of the delayed messages of the channel, the
+// new delayed messages are written to the cluster like the requeued messages.
+func (c *context) RedelayChannelMessages(ch *nsqd.Channel, msgs []nsqd.Message, deliverAt time.Time) (int, error) {
+	topic, err := c.getExistingTopic(ch.GetTopicName(), ch.GetTopicPart())
+	if err != nil {
+		return 0, err
+	}
+	if !c.checkConsumeForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return 0, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	return ch.RedelayDelayedMessages(msgs, deliverAt, func(m *nsqd.Message) error {
+		_, _, _, _, err := c.PutMessageObj(topic, m)
+		return err
+	})
+}
+
+// DeleteChannelDelayedMessages delete the delayed messages of the channel, the delete records are
+// written to the cluster, so the messages are deleted on the replicas too.
+func (c *context) DeleteChannelDelayedMessages(ch *nsqd.Channel, msgs []nsqd.Message) (int, error) {
+	topic, err := c.getExistingTopic(ch.GetTopicName(), ch.GetTopicPart())
+	if err != nil {
+		return 0, err
+	}
+	if !c.checkConsumeForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return 0, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	return ch.DeleteDelayedMessages(msgs, func(m *nsqd.Message) error {
+		_, _, _, _, err := c.PutMessageObj(topic, m)
+		return err
+	})
+}
+
 func (c *context) SetChannelOffset(ch *nsqd.Channel, startFrom *ConsumeOffset, force bool) (int64, int64, error) {
 	var l *consistence.CommitLogData
 	var queueOffset int64
@@ -472,6 +727,357 @@ func (c *context) internalRequeueToEnd(ch *nsqd.Channel,
 	return err
 }
 
+// getDeadLetterTopic return the local partition of the dead letter topic for writing,
+// the same partition as the source is preferred. In cluster mode the dead letter topic
+// should be created with the partitions led by all the nodes of the source topic.
+func (c *context) getDeadLetterTopic(ch *nsqd.Channel) (*nsqd.Topic, error) {
+	dlqName := nsqd.GetDeadLetterTopicName(ch.GetTopicName(), ch.GetName())
+	if c.nsqdCoord == nil {
+		return c.getTopic(dlqName, ch.GetTopicPart(), true, false), nil
+	}
+	if c.checkForMasterWrite(dlqName, ch.GetTopicPart()) {
+		return c.getExistingTopic(dlqName, ch.GetTopicPart())
+	}
+	for part, t := range c.nsqd.GetTopicPartitions(dlqName) {
+		if c.checkForMasterWrite(dlqName, part) {
+			return t, nil
+		}
+	}
+	return nil, consistence.ErrNotTopicLeader.ToErrorType()
+}
+
+// CheckDeadLetterTopic check if the dead letter topic of the channel can be written on this node,
+// only checked on the leader since the replicas will not write the dead letter.
+func (c *context) CheckDeadLetterTopic(ch *nsqd.Channel) error {
+	if c.nsqdCoord != nil && !c.checkConsumeForMasterWrite(ch.GetTopicName(), ch.GetTopicPart()) {
+		return nil
+	}
+	dlqTopic, err := c.getDeadLetterTopic(ch)
+	if err != nil {
+		return err
+	}
+	if !dlqTopic.IsExt() {
+		return nsqd.ErrDeadLetterTopicNotExt
+	}
+	return nil
+}
+
+func (c *context) internalDeadLetter(ch *nsqd.Channel, msg *nsqd.Message) error {
+	if ch.Exiting() {
+		return nsqd.ErrExiting
+	}
+	if !c.checkConsumeForMasterWrite(ch.GetTopicName(), ch.GetTopicPart()) {
+		return consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	dlqTopic, err := c.getDeadLetterTopic(ch)
+	if err != nil {
+		return err
+	}
+	if !dlqTopic.IsExt() {
+		return nsqd.ErrDeadLetterTopicNotExt
+	}
+	dlqMsg, err := nsqd.NewDeadLetterMessage(ch, msg)
+	if err != nil {
+		return err
+	}
+	_, _, _, _, err = c.PutMessageObj(dlqTopic, dlqMsg)
+	if err != nil {
+		return err
+	}
+	nsqd.NsqLogger().Logf("channel %v message %v moved to dead letter topic %v",
+		ch.GetName(), msg.ID, dlqTopic.GetFullName())
+	return c.FinishMessageForce(ch, msg.ID)
+}
+
+// RedriveDeadLetter put the dead letter message back to the source channel by
+// the delayed queue of the source topic, so only the source channel will consume it again.
+func (c *context) RedriveDeadLetter(dlqMsg *nsqd.Message) (*nsqd.DeadLetterInfo, error) {
+	info, _, err := nsqd.ParseDeadLetterMessage(dlqMsg, true)
+	if err != nil {
+		return info, err
+	}
+	topic, err := c.getExistingTopic(info.Topic, info.Partition)
+	if err != nil {
+		return info, err
+	}
+	if topic.IsOrdered() {
+		return info, errors.New("ordered topic can not redrive the dead letter")
+	}
+	if _, err := topic.GetExistingChannel(info.Channel); err != nil {
+		return info, err
+	}
+	if !c.checkForMasterWrite(info.Topic, info.Partition) {
+		return info, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	_, newMsg, err := nsqd.ParseDeadLetterMessage(dlqMsg, topic.IsExt())
+	if err != nil {
+		return info, err
+	}
+	newMsg.DelayedType = nsqd.ChannelDelayed
+	newMsg.DelayedTs = time.Now().UnixNano()
+	newMsg.DelayedOrigID = info.OrigID
+	newMsg.DelayedChannel = info.Channel
+	_, _, _, _, err = c.PutMessageObj(topic, newMsg)
+	return info, err
+}
+
+const delayedPubBatchSize = 64
+
+// internalDelayedPub move the due delayed pub messages to the topic in the order of the
+// delayed time. The message is confirmed in the delayed queue after written, and the confirmed
+// state will be synced to the replicas with the delayed queue consumed state.
+func (c *context) internalDelayedPub(topic *nsqd.Topic) (int, error) {
+	if topic.IsOrdered() || topic.Exiting() {
+		return 0, nil
+	}
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		return 0, nil
+	}
+	if !c.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return 0, nil
+	}
+	msgs := make([]nsqd.Message, delayedPubBatchSize)
+	n, err := dq.PeekRecentDelayedPub(time.Now().UnixNano(), msgs)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		m := &msgs[i]
+		var newMsg *nsqd.Message
+		if !topic.IsExt() {
+			newMsg = nsqd.NewMessage(0, m.Body)
+		} else {
+			newMsg = nsqd.NewMessageWithExt(0, m.Body, m.ExtVer, m.ExtBytes)
+		}
+		newMsg.TraceID = m.TraceID
+		id, _, _, _, err := c.putMessageNoDedup(topic, newMsg)
+		if err != nil {
+			nsqd.NsqLogger().Logf("topic %v delayed pub message %v failed: %v", topic.GetFullName(), m.ID, err)
+			return i, err
+		}
+		nsqd.NsqLogger().LogDebugf("topic %v delayed pub message %v moved to topic: %v",
+			topic.GetFullName(), m.ID, id)
+		// the key of the delayed pub message is the id in delayed queue
+		m.DelayedOrigID = m.ID
+		err = dq.ConfirmedMessage(m)
+		if err != nil {
+			return i + 1, err
+		}
+	}
+	return n, nil
+}
+
+type TxnPubMessage struct {
+	Topic string `json:"topic"`
+	// -1 means the partition chosen by the source partition, so the retry of the
+	// transaction will write to the same partition
+	Partition int               `json:"partition"`
+	Body      []byte            `json:"body"`
+	Ext       map[string]string `json:"ext,omitempty"`
+	TraceID   uint64            `json:"trace_id,omitempty"`
+}
+
+// TxnRequest commit the source (finish the in flight messages or set the consume offset)
+// of the subscribed channel and publish the messages to the destination topics.
+type TxnRequest struct {
+	Fin    []uint64        `json:"fin,omitempty"`
+	Offset string          `json:"offset,omitempty"`
+	Pub    []TxnPubMessage `json:"pub,omitempty"`
+}
+
+type txnDest struct {
+	topic *nsqd.Topic
+	msgs  []*nsqd.Message
+	// the first message written to the topic
+	id nsqd.MessageID
+}
+
+func (c *context) getTopicPartitionNum(name string) int {
+	if c.nsqdCoord != nil {
+		num, err := c.nsqdCoord.GetTopicPartitionNum(name)
+		if err != nil {
+			return 0
+		}
+		return num
+	}
+	num := 0
+	for pid := range c.getPartitions(name) {
+		if pid+1 > num {
+			num = pid + 1
+		}
+	}
+	return num
+}
+
+// getTxnDestTopic return the leader partition of the destination topic, the partition for -1 is
+// chosen by the source partition, so the retry of the transaction will always write to the same
+// partition, and the retry will fail if the partition is not the local leader.
+func (c *context) getTxnDestTopic(name string, part int, srcPart int) (*nsqd.Topic, error) {
+	if part < 0 {
+		num := c.getTopicPartitionNum(name)
+		if num <= 0 {
+			return nil, nsqd.ErrTopicNotExist
+		}
+		part = srcPart % num
+	}
+	if !c.checkForMasterWrite(name, part) {
+		return nil, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	return c.getExistingTopic(name, part)
+}
+
+// CommitTxn publish the messages to the destination topics and commit the source channel.
+// The messages of each destination partition are written as one commit log entry, and the
+// commit marker is written to each destination after all the destinations written, the messages
+// are not visible to the channels until the marker written. The keys of the source are written
+// with the messages, so the source can be committed again without the duplicated messages if
+// the transaction is retried.
+func (c *context) CommitTxn(ch *nsqd.Channel, clientID int64, clientAddr string, req *TxnRequest) error {
+	if ch.Exiting() {
+		return nsqd.ErrExiting
+	}
+	if (len(req.Fin) == 0) == (req.Offset == "") {
+		return errors.New("one of the fin and offset should be given for the transaction")
+	}
+	if !c.checkConsumeForMasterWrite(ch.GetTopicName(), ch.GetTopicPart()) {
+		return consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	var keys []string
+	var offset ConsumeOffset
+	if req.Offset != "" {
+		if err := offset.FromString(req.Offset); err != nil {
+			return err
+		}
+		keys = append(keys, nsqd.GetTxnOffsetSourceKey(ch.GetTopicName(), ch.GetTopicPart(),
+			ch.GetName(), offset.ToString()))
+	} else {
+		for _, id := range req.Fin {
+			if !ch.IsInFlightForClient(clientID, nsqd.MessageID(id)) {
+				return fmt.Errorf("message %v not in flight for the client", id)
+			}
+			keys = append(keys, nsqd.GetTxnSourceKey(ch.GetTopicName(), ch.GetTopicPart(),
+				ch.GetName(), nsqd.MessageID(id)))
+		}
+	}
+
+	txnID := nsqd.NewTxnID()
+	destMap := make(map[string]*txnDest)
+	for _, pub := range req.Pub {
+		t, err := c.getTxnDestTopic(pub.Topic, pub.Partition, ch.GetTopicPart())
+		if err != nil {
+			return err
+		}
+		if !t.IsExt() {
+			return nsqd.ErrTxnTopicNotExt
+		}
+		if int64(len(pub.Body)) > c.getOpts().MaxMsgSize {
+			return fmt.Errorf("message too big %d > %d", len(pub.Body), c.getOpts().MaxMsgSize)
+		}
+		var extBytes []byte
+		if len(pub.Ext) > 0 {
+			extBytes, err = json.Marshal(pub.Ext)
+			if err != nil {
+				return err
+			}
+		}
+		msg := nsqd.NewMessageWithExt(0, pub.Body, ext.JSON_HEADER_EXT_VER, extBytes)
+		msg.TraceID = pub.TraceID
+		d, ok := destMap[t.GetFullName()]
+		// the first message of the destination carry the source keys
+		var srcKeys []string
+		if !ok {
+			srcKeys = keys
+			d = &txnDest{topic: t}
+			destMap[t.GetFullName()] = d
+		}
+		if err := nsqd.SetTxnHeader(msg, txnID, srcKeys); err != nil {
+			return err
+		}
+		d.msgs = append(d.msgs, msg)
+	}
+	// lock in order to avoid the deadlock between the transactions
+	names := make([]string, 0, len(destMap))
+	for name := range destMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		destMap[name].topic.LockTxn()
+		defer destMap[name].topic.UnlockTxn()
+	}
+	var prepared []*txnDest
+	committed := 0
+	defer func() {
+		// the messages written without the commit marker will be skipped, the abort marker
+		// makes the abort known for the channels reading after the transaction window.
+		for _, d := range prepared[committed:] {
+			_, _, _, err := c.putMessagesNoDedup(d.topic, []*nsqd.Message{nsqd.NewTxnAbortMessage(txnID)})
+			if err != nil {
+				nsqd.NsqLogger().LogWarningf("topic %v failed to write the abort marker of transaction %v: %v",
+					d.topic.GetFullName(), txnID, err)
+			}
+			d.topic.AbortTxnNoLock(txnID)
+		}
+	}()
+	for _, name := range names {
+		d := destMap[name]
+		committedKeys, err := d.topic.GetTxnCommittedNoLock(keys)
+		if err != nil {
+			return err
+		}
+		if len(committedKeys) == len(keys) {
+			nsqd.NsqLogger().Logf("channel %v transaction %v already published to %v, only commit the source",
+				ch.GetName(), keys, name)
+			continue
+		} else if len(committedKeys) > 0 {
+			nsqd.NsqLogger().LogWarningf("channel %v transaction %v partial committed to %v: %v",
+				ch.GetName(), keys, name, committedKeys)
+			return nsqd.ErrTxnPartialCommitted
+		}
+		d.topic.PrepareTxnNoLock(txnID, keys)
+		prepared = append(prepared, d)
+		// the transaction has its own dedup by the source keys, and the first message with
+		// the source keys should not be ignored by the dedup key
+		id, _, _, err := c.putMessagesNoDedup(d.topic, d.msgs)
+		if err != nil {
+			return err
+		}
+		d.id = id
+	}
+	// all the destinations are written, the destination committed by the marker will not be
+	// written again while retrying, so the retry can finish the partial committed transaction.
+	for _, d := range prepared {
+		_, _, _, err := c.putMessagesNoDedup(d.topic, []*nsqd.Message{nsqd.NewTxnCommitMessage(txnID)})
+		if err != nil {
+			return err
+		}
+		d.topic.CommitTxnNoLock(txnID, keys, d.id)
+		committed++
+	}
+
+	if req.Offset != "" {
+		_, _, err := c.SetChannelOffset(ch, &offset, true)
+		return err
+	}
+	for _, id := range req.Fin {
+		err := c.FinishMessage(ch, clientID, clientAddr, nsqd.MessageID(id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *context) internalDataCorrupted(topic *nsqd.Topic, err error) {
+	if c.nsqdCoord == nil {
+		nsqd.NsqLogger().LogErrorf("topic %v data corrupted without coordinator, need fix manually: %v",
+			topic.GetFullName(), err)
+		return
+	}
+	c.nsqdCoord.HandleLocalDataCorrupted(topic.GetTopicName(), topic.GetTopicPart(), err)
+}
+
 func (c *context) GreedyCleanTopicOldData(topic *nsqd.Topic) error {
 	if c.nsqdCoord != nil {
 		return c.nsqdCoord.GreedyCleanTopicOldData(topic)
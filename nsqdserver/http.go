@@ -83,10 +83,25 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/channel/emptydelayed", http_api.Decorate(s.doEmptyChannelDelayed, log, http_api.V1))
 	router.Handle("POST", "/channel/setoffset", http_api.Decorate(s.doSetChannelOffset, log, http_api.V1))
 	router.Handle("POST", "/channel/setorder", http_api.Decorate(s.doSetChannelOrder, log, http_api.V1))
+	router.Handle("POST", "/channel/setmaxattempts", http_api.Decorate(s.doSetChannelMaxAttempts, log, http_api.V1))
+	router.Handle("POST", "/channel/setratelimit", http_api.Decorate(s.doSetChannelRateLimit, log, http_api.V1))
+	router.Handle("POST", "/channel/setfilter", http_api.Decorate(s.doSetChannelFilter, log, http_api.V1))
+	router.Handle("POST", "/channel/setrequeuepolicy", http_api.Decorate(s.doSetChannelRequeuePolicy, log, http_api.V1))
+	router.Handle("POST", "/channel/setbroadcast", http_api.Decorate(s.doSetChannelBroadcast, log, http_api.V1))
+	router.Handle("POST", "/channel/setprioritylane", http_api.Decorate(s.doSetChannelPriorityLane, log, http_api.V1))
+	router.Handle("GET", "/deadletter/list", http_api.Decorate(s.doDeadLetterList, log, http_api.V1))
+	router.Handle("GET", "/deadletter/messages", http_api.Decorate(s.doDeadLetterMessages, log, http_api.V1))
+	router.Handle("POST", "/deadletter/redrive", http_api.Decorate(s.doDeadLetterRedrive, log, http_api.V1))
+	router.Handle("POST", "/schedule/cancel", http_api.Decorate(s.doCancelSchedule, log, http_api.V1))
+	router.Handle("POST", "/schedule/reschedule", http_api.Decorate(s.doReschedule, log, http_api.V1))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/delayqueue/enable", http_api.Decorate(s.doEnableDelayedQueue, log, http_api.V1))
 	router.Handle("GET", "/delayqueue/backupto", http_api.Decorate(s.doDelayedQueueBackupTo, log, http_api.V1Stream))
+	router.Handle("GET", "/delayqueue/messages", http_api.Decorate(s.doDelayedMessages, log, http_api.V1))
+	router.Handle("POST", "/delayqueue/redeliver", http_api.Decorate(s.doDelayedRedelay, log, http_api.V1))
+	router.Handle("POST", "/delayqueue/redelay", http_api.Decorate(s.doDelayedRedelay, log, http_api.V1))
+	router.Handle("POST", "/delayqueue/delete", http_api.Decorate(s.doDelayedDelete, log, http_api.V1))
 
 	router.Handle("POST", "/topic/greedyclean", http_api.Decorate(s.doGreedyCleanTopic, log, http_api.V1))
 	//router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, http_api.DeprecatedAPI, log, http_api.V1))
@@ -320,6 +335,18 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		return nil, http_api.Err{406, "MSG_EMPTY"}
 	}
 
+	var pubDelay time.Duration
+	if deferStr := params.Get("defer"); deferStr != "" {
+		deferMs, err := strconv.ParseInt(deferStr, 10, 64)
+		if err != nil || deferMs <= 0 || time.Duration(deferMs)*time.Millisecond > s.ctx.getOpts().MaxReqTimeout {
+			return nil, http_api.Err{400, "INVALID_DEFER"}
+		}
+		if topic.IsOrdered() {
+			return nil, http_api.Err{400, "INVALID_DEFER"}
+		}
+		pubDelay = time.Duration(deferMs) * time.Millisecond
+	}
+
 	if s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
 		var err error
 		var traceIDStr string
@@ -412,14 +439,26 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 				return nil, http_api.Err{400, ext.E_EXT_NOT_SUPPORT}
 			}
 		}
-		if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 {
+		deliverAt, scheduleID, err := nsqd.GetScheduleHeader(extContent.ExtVersion(), extContent.GetBytes())
+		if err != nil {
+			return nil, http_api.Err{400, ext.E_INVALID_JSON_HEADER}
+		}
+		if deliverAt > 0 && pubDelay > 0 {
+			return nil, http_api.Err{400, "INVALID_DEFER"}
+		}
+		if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 || pubDelay > 0 || deliverAt > 0 {
 			asyncAction = false
 		}
 
 		id := nsqd.MessageID(0)
 		offset := nsqd.BackendOffset(0)
 		rawSize := int32(0)
-		if asyncAction {
+		if pubDelay > 0 {
+			id, offset, rawSize, err = s.ctx.PutDelayedPubMessage(topic, body, extContent, traceID, pubDelay)
+		} else if deliverAt > 0 {
+			id, offset, rawSize, err = s.ctx.PutScheduledMessage(topic, body, extContent, traceID,
+				time.Unix(0, deliverAt*int64(time.Millisecond)), scheduleID)
+		} else if asyncAction {
 			err = internalPubAsync(nil, b, topic, extContent)
 		} else {
 			id, offset, rawSize, _, err = s.ctx.PutMessage(topic, body, extContent, traceID)
@@ -431,6 +470,9 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 					return nil, http_api.Err{400, FailedOnNotWritable}
 				}
 			}
+			if nsqd.IsDiskQuotaErr(err) {
+				return nil, http_api.Err{507, E_DISK_QUOTA}
+			}
 			return nil, http_api.Err{503, err.Error()}
 		}
 
@@ -538,6 +580,9 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 					return nil, http_api.Err{400, FailedOnNotWritable}
 				}
 			}
+			if nsqd.IsDiskQuotaErr(err) {
+				return nil, http_api.Err{507, E_DISK_QUOTA}
+			}
 			return nil, http_api.Err{503, err.Error()}
 		}
 	} else {
@@ -665,6 +710,200 @@ func (s *httpServer) doSetChannelOrder(w http.ResponseWriter, req *http.Request,
 	return nil, nil
 }
 
+func (s *httpServer) doSetChannelMaxAttempts(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	maxAttempts, err := strconv.ParseUint(reqParams.Get("max_attempts"), 10, 16)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_MAX_ATTEMPTS"}
+	}
+	if maxAttempts > 0 && !nsqd.IsValidDeadLetterChannel(topic.GetTopicName(), channelName) {
+		return nil, http_api.Err{400, "INVALID_DEAD_LETTER_CHANNEL"}
+	}
+	if maxAttempts > 0 {
+		// the message can not be moved if the dead letter topic is not ready
+		err = s.ctx.CheckDeadLetterTopic(channel)
+		if err != nil {
+			nsqd.NsqLogger().Logf("topic %v channel %v dead letter topic not ready: %v",
+				topic.GetFullName(), channelName, err)
+			return nil, http_api.Err{400, "DEAD_LETTER_TOPIC_NOT_READY"}
+		}
+	}
+	channel.SetMaxAttempts(uint32(maxAttempts))
+	nsqd.NsqLogger().Logf("topic %v channel %v set max attempts to %v by client: %v",
+		topic.GetFullName(), channelName, maxAttempts, req.RemoteAddr)
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+// doSetChannelRateLimit set the consume rate limit of the channel, the empty or 0 value
+// will remove the limit.
+func (s *httpServer) doSetChannelRateLimit(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	var msgRate, byteRate int64
+	if v := reqParams.Get("msg_rate"); v != "" {
+		msgRate, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || msgRate < 0 {
+			return nil, http_api.Err{400, "INVALID_MSG_RATE"}
+		}
+	}
+	if v := reqParams.Get("byte_rate"); v != "" {
+		byteRate, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || byteRate < 0 {
+			return nil, http_api.Err{400, "INVALID_BYTE_RATE"}
+		}
+	}
+	channel.SetRateLimit(msgRate, byteRate)
+	nsqd.NsqLogger().Logf("topic %v channel %v set rate limit to %v msgs/s, %v bytes/s by client: %v",
+		topic.GetFullName(), channelName, msgRate, byteRate, req.RemoteAddr)
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+// doSetChannelFilter set the ext filter of the channel by the json body, the filter
+// will be removed if the body is empty.
+func (s *httpServer) doSetChannelFilter(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	if !topic.IsExt() {
+		return nil, http_api.Err{400, "TOPIC_NOT_EXT"}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, s.ctx.getOpts().MaxBodySize))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	var filter nsqd.ExtFilterData
+	if len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &filter)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_FILTER"}
+		}
+	}
+	err = channel.SetExtFilter(filter)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v set filter to %v by client: %v",
+		topic.GetFullName(), channelName, filter, req.RemoteAddr)
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+// doSetChannelRequeuePolicy set the requeue policy of the channel by the json body, the policy
+// will be removed if the body is empty.
+func (s *httpServer) doSetChannelRequeuePolicy(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, s.ctx.getOpts().MaxBodySize))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	var policy *nsqd.RequeuePolicy
+	if len(bytes.TrimSpace(body)) > 0 {
+		policy = &nsqd.RequeuePolicy{}
+		err = json.Unmarshal(body, policy)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_REQUEUE_POLICY"}
+		}
+	}
+	err = channel.SetRequeuePolicy(policy)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v set requeue policy to %v by client: %v",
+		topic.GetFullName(), channelName, policy, req.RemoteAddr)
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+// doSetChannelBroadcast change the consume mode of the channel, and all the clients will be
+// closed to subscribe again in the new mode.
+func (s *httpServer) doSetChannelBroadcast(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	enable, err := strconv.ParseBool(reqParams.Get("broadcast"))
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_BROADCAST"}
+	}
+	if enable == channel.IsBroadcast() {
+		return nil, nil
+	}
+	err = channel.SetBroadcast(enable)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	for _, c := range channel.GetClients() {
+		c.Exit()
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v set broadcast to %v by client: %v",
+		topic.GetFullName(), channelName, enable, req.RemoteAddr)
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+// doSetChannelPriorityLane enable or disable the priority lanes of the ext channel
+func (s *httpServer) doSetChannelPriorityLane(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	enable, err := strconv.ParseBool(reqParams.Get("enable"))
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_OPTION"}
+	}
+	if enable && !channel.IsExt() {
+		return nil, http_api.Err{400, "CHANNEL_NOT_EXT"}
+	}
+	channel.SetPriorityLane(enable)
+	nsqd.NsqLogger().Logf("topic %v channel %v set priority lane to %v by client: %v",
+		topic.GetFullName(), channelName, enable, req.RemoteAddr)
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
 func (s *httpServer) doSetChannelOffset(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -1023,8 +1262,10 @@ func (s *httpServer) doMessageGet(w http.ResponseWriter, req *http.Request, ps h
 		_, realOffset, _, err = s.ctx.nsqdCoord.SearchLogByMsgID(topicName, topicPart, searchPos)
 	} else if searchMode == "virtual_offset" {
 		_, realOffset, _, err = s.ctx.nsqdCoord.SearchLogByMsgOffset(topicName, topicPart, searchPos)
+	} else if searchMode == "timestamp" {
+		_, realOffset, _, err = s.ctx.nsqdCoord.SearchLogByMsgTimestamp(topicName, topicPart, searchPos)
 	} else {
-		return nil, http_api.Err{400, "search mode should be one of id/count/virtual_offset"}
+		return nil, http_api.Err{400, "search mode should be one of id/count/virtual_offset/timestamp"}
 	}
 	if err != nil {
 		return nil, http_api.Err{404, err.Error()}
@@ -1056,6 +1297,236 @@ func (s *httpServer) doMessageGet(w http.ResponseWriter, req *http.Request, ps h
 	}{msg.ID, msg.TraceID, string(msg.Body), msg.Timestamp, msg.Attempts, ret.Offset, ret.CurCnt}, nil
 }
 
+type deadLetterTopicInfo struct {
+	Topic         string `json:"topic"`
+	Partition     int    `json:"partition"`
+	SourceChannel string `json:"source_channel"`
+	MessageCount  int64  `json:"message_count"`
+	StartOffset   int64  `json:"start_offset"`
+	EndOffset     int64  `json:"end_offset"`
+}
+
+func (s *httpServer) doDeadLetterList(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+	prefix := nsqd.GetDeadLetterTopicName(topicName, "")
+	dlqList := make([]deadLetterTopicInfo, 0)
+	for name, parts := range s.ctx.nsqd.GetTopicMapCopy() {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		for part, t := range parts {
+			snap := t.GetDiskQueueSnapshot()
+			start := snap.GetQueueReadStart()
+			end := t.GetCommitted()
+			snap.Close()
+			if end == nil {
+				continue
+			}
+			dlqList = append(dlqList, deadLetterTopicInfo{
+				Topic:         name,
+				Partition:     part,
+				SourceChannel: strings.TrimPrefix(name, prefix),
+				MessageCount:  end.TotalMsgCnt() - start.TotalMsgCnt(),
+				StartOffset:   int64(start.Offset()),
+				EndOffset:     int64(end.Offset()),
+			})
+		}
+	}
+	return struct {
+		Topic       string                `json:"topic"`
+		DeadLetters []deadLetterTopicInfo `json:"dead_letters"`
+	}{topicName, dlqList}, nil
+}
+
+type deadLetterMessage struct {
+	ID         nsqd.MessageID       `json:"id"`
+	TraceID    uint64               `json:"trace_id"`
+	Body       string               `json:"body"`
+	Ext        string               `json:"ext"`
+	Timestamp  int64                `json:"timestamp"`
+	Attempts   uint16               `json:"attempts"`
+	Offset     nsqd.BackendOffset   `json:"offset"`
+	NextOffset nsqd.BackendOffset   `json:"next_offset"`
+	Source     *nsqd.DeadLetterInfo `json:"source"`
+}
+
+// readDeadLetters read the messages of the dead letter topic from the offset, the
+// start of the queue is used if the offset is not given.
+func (s *httpServer) readDeadLetters(req *http.Request, handler func(*nsqd.Message, *deadLetterMessage) error) (nsqd.BackendOffset, error) {
+	reqParams, t, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return 0, err
+	}
+	if !nsqd.IsDeadLetterTopic(t.GetTopicName()) {
+		return 0, http_api.Err{400, "NOT_DEAD_LETTER_TOPIC"}
+	}
+	cnt := 10
+	if cntStr := reqParams.Get("cnt"); cntStr != "" {
+		cnt, err = strconv.Atoi(cntStr)
+		if err != nil || cnt <= 0 || cnt > 1000 {
+			return 0, http_api.Err{400, "INVALID_CNT"}
+		}
+	}
+	snap := t.GetDiskQueueSnapshot()
+	if snap == nil {
+		return 0, http_api.Err{500, "Failed to get queue reader"}
+	}
+	defer snap.Close()
+	offset := snap.GetQueueReadStart().Offset()
+	if offsetStr := reqParams.Get("offset"); offsetStr != "" {
+		v, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || nsqd.BackendOffset(v) < offset {
+			return 0, http_api.Err{400, "INVALID_OFFSET"}
+		}
+		offset = nsqd.BackendOffset(v)
+	}
+	err = snap.SeekTo(offset)
+	if err != nil {
+		return 0, http_api.Err{400, err.Error()}
+	}
+	for i := 0; i < cnt; i++ {
+		ret := snap.ReadOne()
+		if ret.Err == io.EOF {
+			break
+		}
+		if ret.Err != nil {
+			return offset, http_api.Err{500, ret.Err.Error()}
+		}
+		msg, err := nsqd.DecodeMessage(ret.Data, t.IsExt())
+		if err != nil {
+			return offset, http_api.Err{500, err.Error()}
+		}
+		info, _, _ := nsqd.ParseDeadLetterMessage(msg, true)
+		m := &deadLetterMessage{
+			ID:         msg.ID,
+			TraceID:    msg.TraceID,
+			Body:       string(msg.Body),
+			Ext:        string(msg.ExtBytes),
+			Timestamp:  msg.Timestamp,
+			Attempts:   msg.Attempts,
+			Offset:     ret.Offset,
+			NextOffset: ret.Offset + ret.MovedSize,
+			Source:     info,
+		}
+		err = handler(msg, m)
+		if err != nil {
+			return offset, err
+		}
+		offset = m.NextOffset
+	}
+	return offset, nil
+}
+
+func (s *httpServer) doDeadLetterMessages(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	msgs := make([]*deadLetterMessage, 0)
+	next, err := s.readDeadLetters(req, func(msg *nsqd.Message, m *deadLetterMessage) error {
+		msgs = append(msgs, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Messages   []*deadLetterMessage `json:"messages"`
+		NextOffset nsqd.BackendOffset   `json:"next_offset"`
+	}{msgs, next}, nil
+}
+
+// doDeadLetterRedrive put the dead letters back to the source channel, the dead letter
+// topic is not changed and the next offset should be used for the next redrive.
+func (s *httpServer) doDeadLetterRedrive(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	redriven := 0
+	next, err := s.readDeadLetters(req, func(msg *nsqd.Message, m *deadLetterMessage) error {
+		info, err := s.ctx.RedriveDeadLetter(msg)
+		if err != nil {
+			nsqd.NsqLogger().Logf("redrive dead letter %v at %v to %v failed: %v", msg.ID, m.Offset, info, err)
+			return http_api.Err{500, err.Error()}
+		}
+		redriven++
+		return nil
+	})
+	nsqd.NsqLogger().Logf("redrive %v dead letters to offset %v by client: %v", redriven, next, req.RemoteAddr)
+	if err != nil && redriven == 0 {
+		return nil, err
+	}
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	return struct {
+		Redriven   int                `json:"redriven"`
+		NextOffset nsqd.BackendOffset `json:"next_offset"`
+		Error      string             `json:"error,omitempty"`
+	}{redriven, next, errStr}, nil
+}
+
+func getScheduleErr(err error) error {
+	if err == nsqd.ErrScheduleNotFound {
+		return http_api.Err{404, "SCHEDULE_NOT_FOUND"}
+	}
+	if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
+		if clusterErr.IsEqual(consistence.ErrNotTopicLeader) {
+			return http_api.Err{400, FailedOnNotLeader}
+		}
+		if !clusterErr.IsLocalErr() {
+			return http_api.Err{400, FailedOnNotWritable}
+		}
+	}
+	return http_api.Err{500, err.Error()}
+}
+
+func (s *httpServer) doCancelSchedule(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	scheduleID := reqParams.Get("schedule_id")
+	if !nsqd.IsValidScheduleID(scheduleID) {
+		return nil, http_api.Err{400, "INVALID_SCHEDULE_ID"}
+	}
+	err = s.ctx.CancelScheduledMessage(topic, scheduleID)
+	if err != nil {
+		nsqd.NsqLogger().Logf("topic %v cancel scheduled message %v failed: %v", topic.GetFullName(), scheduleID, err)
+		return nil, getScheduleErr(err)
+	}
+	nsqd.NsqLogger().Logf("topic %v scheduled message %v canceled by client: %v",
+		topic.GetFullName(), scheduleID, req.RemoteAddr)
+	return nil, nil
+}
+
+func (s *httpServer) doReschedule(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	scheduleID := reqParams.Get("schedule_id")
+	if !nsqd.IsValidScheduleID(scheduleID) {
+		return nil, http_api.Err{400, "INVALID_SCHEDULE_ID"}
+	}
+	deliverAt, err := strconv.ParseInt(reqParams.Get("deliver_at"), 10, 64)
+	if err != nil || deliverAt <= 0 {
+		return nil, http_api.Err{400, "INVALID_DELIVER_AT"}
+	}
+	msg, err := s.ctx.RescheduleMessage(topic, scheduleID, time.Unix(0, deliverAt*int64(time.Millisecond)))
+	if err != nil {
+		nsqd.NsqLogger().Logf("topic %v reschedule message %v failed: %v", topic.GetFullName(), scheduleID, err)
+		return nil, getScheduleErr(err)
+	}
+	nsqd.NsqLogger().Logf("topic %v scheduled message %v changed to %v by client: %v",
+		topic.GetFullName(), scheduleID, deliverAt, req.RemoteAddr)
+	return struct {
+		ID        uint64 `json:"id"`
+		DeliverAt int64  `json:"deliver_at"`
+	}{uint64(msg.ID), deliverAt}, nil
+}
+
 func (s *httpServer) doMessageStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, t, chName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -1210,8 +1681,10 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		Version   string            `json:"version"`
 		Health    string            `json:"health"`
 		StartTime int64             `json:"start_time"`
+		DiskUsage float64           `json:"disk_usage"`
+		DiskFull  bool              `json:"disk_full"`
 		Topics    []nsqd.TopicStats `json:"topics"`
-	}{version.Binary, health, startTime.Unix(), stats}, nil
+	}{version.Binary, health, startTime.Unix(), s.ctx.nsqd.GetDiskUsage(), s.ctx.nsqd.IsDiskFull(), stats}, nil
 }
 
 func (s *httpServer) printStats(stats []nsqd.TopicStats, health string, startTime time.Time, uptime time.Duration) []byte {
@@ -1221,6 +1694,7 @@ func (s *httpServer) printStats(stats []nsqd.TopicStats, health string, startTim
 	io.WriteString(w, fmt.Sprintf("%s\n", version.String("nsqd")))
 	io.WriteString(w, fmt.Sprintf("start_time %v\n", startTime.Format(time.RFC3339)))
 	io.WriteString(w, fmt.Sprintf("uptime %s\n", uptime))
+	io.WriteString(w, fmt.Sprintf("disk_usage %.2f, disk_full %v\n", s.ctx.nsqd.GetDiskUsage(), s.ctx.nsqd.IsDiskFull()))
 	if len(stats) == 0 {
 		io.WriteString(w, "\nNO_TOPICS\n")
 		return buf.Bytes()
@@ -1402,3 +1876,174 @@ func (s *httpServer) doDelayedQueueBackupTo(w http.ResponseWriter, req *http.Req
 	}
 	return nil, nil
 }
+
+type delayedMessage struct {
+	ID        nsqd.MessageID `json:"id"`
+	DelayedID nsqd.MessageID `json:"delayed_id"`
+	TraceID   uint64         `json:"trace_id"`
+	Body      string         `json:"body"`
+	Ext       string         `json:"ext"`
+	Timestamp int64          `json:"timestamp"`
+	Attempts  uint16         `json:"attempts"`
+	DeliverAt int64          `json:"deliver_at"`
+}
+
+// readChannelDelayed read a page of the delayed messages of the channel matched the filter in
+// the query, the time range is in unix milliseconds and the cursor is returned by the last page.
+func (s *httpServer) readChannelDelayed(req *http.Request) (*nsqd.Channel, []nsqd.Message, *nsqd.DelayedMsgCursor, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, nil, nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	dq := channel.GetDelayedQueue()
+	if dq == nil {
+		return nil, nil, nil, http_api.Err{400, "No delayed queue on this topic"}
+	}
+	cnt := 10
+	if cntStr := reqParams.Get("cnt"); cntStr != "" {
+		cnt, err = strconv.Atoi(cntStr)
+		if err != nil || cnt <= 0 || cnt > 1000 {
+			return nil, nil, nil, http_api.Err{400, "INVALID_CNT"}
+		}
+	}
+	var filter nsqd.DelayedMsgFilter
+	for name, ts := range map[string]*int64{"start_ts": &filter.StartTs, "end_ts": &filter.EndTs} {
+		if v := reqParams.Get(name); v != "" {
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || ms < 0 {
+				return nil, nil, nil, http_api.Err{400, "INVALID_" + strings.ToUpper(name)}
+			}
+			*ts = ms * int64(time.Millisecond)
+		}
+	}
+	for name, attempts := range map[string]*uint16{"min_attempts": &filter.MinAttempts, "max_attempts": &filter.MaxAttempts} {
+		if v := reqParams.Get(name); v != "" {
+			n, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return nil, nil, nil, http_api.Err{400, "INVALID_" + strings.ToUpper(name)}
+			}
+			*attempts = uint16(n)
+		}
+	}
+	if idsStr := reqParams.Get("ids"); idsStr != "" {
+		filter.IDs = make(map[nsqd.MessageID]bool)
+		for _, idStr := range strings.Split(idsStr, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 64)
+			if err != nil {
+				return nil, nil, nil, http_api.Err{400, "INVALID_IDS"}
+			}
+			filter.IDs[nsqd.MessageID(id)] = true
+		}
+	}
+	if extStr := reqParams.Get("ext_filter"); extStr != "" {
+		if !topic.IsExt() {
+			return nil, nil, nil, http_api.Err{400, "TOPIC_NOT_EXT"}
+		}
+		var data nsqd.ExtFilterData
+		err = json.Unmarshal([]byte(extStr), &data)
+		if err != nil {
+			return nil, nil, nil, http_api.Err{400, "INVALID_FILTER"}
+		}
+		filter.Ext, err = nsqd.NewExtFilter(data)
+		if err != nil {
+			return nil, nil, nil, http_api.Err{400, err.Error()}
+		}
+		filter.ExtInverse = data.Inverse
+	}
+	var cursor *nsqd.DelayedMsgCursor
+	if tsStr := reqParams.Get("cursor_ts"); tsStr != "" {
+		cursor = &nsqd.DelayedMsgCursor{}
+		cursor.Ts, err = strconv.ParseInt(tsStr, 10, 64)
+		if err != nil {
+			return nil, nil, nil, http_api.Err{400, "INVALID_CURSOR"}
+		}
+		id, err := strconv.ParseUint(reqParams.Get("cursor_id"), 10, 64)
+		if err != nil {
+			return nil, nil, nil, http_api.Err{400, "INVALID_CURSOR"}
+		}
+		cursor.ID = nsqd.MessageID(id)
+	}
+	msgs, next, err := dq.ScanChannelDelayed(channelName, cursor, &filter, cnt)
+	if err != nil {
+		return nil, nil, nil, http_api.Err{500, err.Error()}
+	}
+	return channel, msgs, next, nil
+}
+
+func (s *httpServer) doDelayedMessages(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, msgs, next, err := s.readChannelDelayed(req)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*delayedMessage, 0, len(msgs))
+	for _, m := range msgs {
+		results = append(results, &delayedMessage{
+			ID:        m.DelayedOrigID,
+			DelayedID: m.ID,
+			TraceID:   m.TraceID,
+			Body:      string(m.Body),
+			Ext:       string(m.ExtBytes),
+			Timestamp: m.Timestamp,
+			Attempts:  m.Attempts,
+			DeliverAt: m.DelayedTs / int64(time.Millisecond),
+		})
+	}
+	return struct {
+		Messages []*delayedMessage      `json:"messages"`
+		Next     *nsqd.DelayedMsgCursor `json:"next"`
+	}{results, next}, nil
+}
+
+// doDelayedRedelay change the deliver time of the delayed messages of the channel matched
+// the query, the messages will be redelivered immediately if no deliver time given.
+func (s *httpServer) doDelayedRedelay(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	deliverAt := time.Now()
+	if !strings.HasSuffix(req.URL.Path, "redeliver") {
+		ms, err := strconv.ParseInt(req.URL.Query().Get("deliver_at"), 10, 64)
+		if err != nil || ms <= 0 {
+			return nil, http_api.Err{400, "INVALID_DELIVER_AT"}
+		}
+		deliverAt = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	channel, msgs, next, err := s.readChannelDelayed(req)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := s.ctx.RedelayChannelMessages(channel, msgs, deliverAt)
+	nsqd.NsqLogger().Logf("topic %v channel %v redelay %v of %v delayed messages to %v by client: %v, %v",
+		channel.GetTopicName(), channel.GetName(), changed, len(msgs), deliverAt, req.RemoteAddr, err)
+	return changedDelayedResult(changed, next, err)
+}
+
+func (s *httpServer) doDelayedDelete(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	channel, msgs, next, err := s.readChannelDelayed(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkConsumeForMasterWrite(channel.GetTopicName(), channel.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	changed, err := s.ctx.DeleteChannelDelayedMessages(channel, msgs)
+	nsqd.NsqLogger().Logf("topic %v channel %v delete %v of %v delayed messages by client: %v, %v",
+		channel.GetTopicName(), channel.GetName(), changed, len(msgs), req.RemoteAddr, err)
+	return changedDelayedResult(changed, next, err)
+}
+
+func changedDelayedResult(changed int, next *nsqd.DelayedMsgCursor, err error) (interface{}, error) {
+	if err != nil && changed == 0 {
+		return nil, getScheduleErr(err)
+	}
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	return struct {
+		Changed int                    `json:"changed"`
+		Next    *nsqd.DelayedMsgCursor `json:"next"`
+		Error   string                 `json:"error,omitempty"`
+	}{changed, next, errStr}, nil
+}
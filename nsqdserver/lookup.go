@@ -149,6 +149,10 @@ func (n *NsqdServer) lookupLoop(pingInterval time.Duration, metaNotifyChan chan
 			for _, lp := range lookupPeers {
 				nsqd.NsqLogger().LogDebugf("LOOKUPD(%s): sending heartbeat", lp)
 				cmd := nsq.Ping()
+				if n.ctx.nsqd.IsDiskFull() {
+					// let the lookupd know this node should be avoided for new topics
+					cmd.Params = [][]byte{[]byte("disk_full")}
+				}
 				_, err := lp.Command(cmd)
 				if err != nil {
 					nsqd.NsqLogger().Logf("LOOKUPD(%s): ERROR %s - %s", lp, cmd, err)
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/youzan/nsq/consistence"
 	"github.com/youzan/nsq/nsqd"
@@ -139,6 +140,8 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 	s.ctx.tlsConfig = tlsConfig
 	s.ctx.nsqd.SetPubLoop(s.ctx.internalPubLoop)
 	s.ctx.nsqd.SetReqToEndCB(s.ctx.internalRequeueToEnd)
+	s.ctx.nsqd.SetDeadLetterCB(s.ctx.internalDeadLetter)
+	s.ctx.nsqd.SetDataCorruptedCB(s.ctx.internalDataCorrupted)
 
 	nsqd.NsqLogger().Logf(version.String("nsqd"))
 	nsqd.NsqLogger().Logf("ID: %d", opts.ID)
@@ -235,7 +238,35 @@ func (s *NsqdServer) Main() {
 		s.lookupLoop(opts.LookupPingInterval, s.ctx.nsqd.MetaNotifyChan, s.ctx.nsqd.OptsNotificationChan, s.exitChan)
 	})
 
+	s.waitGroup.Wrap(s.delayedPubLoop)
+
 	if opts.StatsdAddress != "" {
 		s.waitGroup.Wrap(s.statsdLoop)
 	}
 }
+
+// delayedPubLoop move the due delayed pub messages of the topics led by this node
+func (s *NsqdServer) delayedPubLoop() {
+	ticker := time.NewTicker(s.ctx.getOpts().QueueScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.exitChan:
+			return
+		case <-ticker.C:
+		}
+		for _, parts := range s.ctx.nsqd.GetTopicMapCopy() {
+			for _, t := range parts {
+				for {
+					n, err := s.ctx.internalDelayedPub(t)
+					if err != nil {
+						nsqd.NsqLogger().LogWarningf("topic %v delayed pub failed: %v", t.GetFullName(), err)
+					}
+					if err != nil || n < delayedPubBatchSize {
+						break
+					}
+				}
+			}
+		}
+	}
+}
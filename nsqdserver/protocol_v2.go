@@ -28,6 +28,10 @@ import (
 const (
 	E_INVALID         = "E_INVALID"
 	E_TOPIC_NOT_EXIST = "E_TOPIC_NOT_EXIST"
+	// the publish is refused by the disk quota and can be retried later
+	E_DISK_QUOTA = "E_DISK_QUOTA"
+	// the producer sequence is invalid, or older than the recent sequences
+	E_INVALID_PRODUCER_SEQ = "E_INVALID_PRODUCER_SEQ"
 )
 
 const maxTimeout = time.Hour
@@ -63,6 +67,9 @@ var offsetMsgCountType = "msgcount"
 var (
 	ErrOrderChannelOnSampleRate = errors.New("order consume is not allowed while sample rate is not 0")
 	ErrPubToWaitTimeout         = errors.New("pub to wait channel timeout")
+	ErrPartitionNotAssigned     = errors.New("the partition is not assigned to the consumer group member")
+	ErrDelayedPubOrdered        = errors.New("delayed pub is not allowed in ordered topic")
+	ErrInvalidPubDelay          = errors.New("pub delay should be positive and not larger than the max req timeout")
 )
 
 type protocolV2 struct {
@@ -402,6 +409,8 @@ func (p *protocolV2) Exec(client *nsqd.ClientV2, params [][]byte) ([]byte, error
 		return p.PUBTRACE(client, params)
 	case bytes.Equal(params[0], []byte("PUB_EXT")):
 		return p.PUBEXT(client, params)
+	case bytes.Equal(params[0], []byte("DPUB")):
+		return p.DPUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB")):
 		return p.MPUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB_TRACE")):
@@ -412,6 +421,8 @@ func (p *protocolV2) Exec(client *nsqd.ClientV2, params [][]byte) ([]byte, error
 		return p.NOP(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
 		return p.TOUCH(client, params)
+	case bytes.Equal(params[0], []byte("TXN")):
+		return p.TXN(client, params)
 	case bytes.Equal(params[0], []byte("SUB")):
 		return p.SUB(client, params)
 	case bytes.Equal(params[0], []byte("SUB_ADVANCED")):
@@ -480,18 +491,12 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 		} else if flushed {
 			// last iteration we flushed...
 			// do not select on the flusher ticker channel
-			clientMsgChan = client.GetTagMsgChannel()
-			if clientMsgChan == nil {
-				clientMsgChan = subChannel.GetClientMsgChan()
-			}
+			clientMsgChan = getClientMsgChan(client, subChannel)
 			flusherChan = nil
 		} else {
 			// we're buffered (if there isn't any more data we should flush)...
 			// select on the flusher ticker channel, too
-			clientMsgChan = client.GetTagMsgChannel()
-			if clientMsgChan == nil {
-				clientMsgChan = subChannel.GetClientMsgChan()
-			}
+			clientMsgChan = getClientMsgChan(client, subChannel)
 			flusherChan = outputBufferTicker.C
 		}
 
@@ -658,6 +663,18 @@ exit:
 	close(stoppedChan)
 }
 
+// getClientMsgChan return the message chan of the broadcast member or the tag if any
+func getClientMsgChan(client *nsqd.ClientV2, channel *nsqd.Channel) chan *nsqd.Message {
+	if msgChan, ok := channel.GetBroadcastMsgChan(client.ID); ok {
+		return msgChan
+	}
+	msgChan := client.GetTagMsgChannel()
+	if msgChan == nil {
+		msgChan = channel.GetClientMsgChan()
+	}
+	return msgChan
+}
+
 func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -994,6 +1011,14 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 		topic.DisableForSlave()
 		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
 	}
+	if ordered {
+		err = p.ctx.checkConsumerGroupAssigned(topicName, partition, channelName, client.GetConsumerGroupMember())
+		if err != nil {
+			nsqd.NsqLogger().Logf("sub ordered %v-%v:%v failed: %v, remote is : %v, member: %v",
+				topicName, partition, channelName, err, client.String(), client.GetConsumerGroupMember())
+			return nil, protocol.NewFatalClientErr(nil, "E_SUB_NOT_ASSIGNED", err.Error())
+		}
+	}
 	channel := topic.GetChannel(channelName)
 	// client with tag is subscribe to topic not support tag, remove client's tag and treat it like untaged consumer
 	if !topic.IsExt() && client.GetDesiredTag() != "" {
@@ -1001,11 +1026,25 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 		client.UnsetDesiredTag()
 	}
 
+	if channel.IsBroadcast() && ordered {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, nsqd.ErrBroadcastOrdered.Error())
+	}
 	err = channel.AddClient(client.ID, client)
 	if err != nil {
 		nsqd.NsqLogger().Logf("sub failed to add client: %v, %v", client, err)
 		return nil, protocol.NewFatalClientErr(nil, FailedOnNotWritable, "")
 	}
+	if channel.IsBroadcast() {
+		created, err := channel.AddBroadcastClient(client.ID, client.ClientID, client)
+		if err != nil {
+			channel.RemoveClient(client.ID, client.GetDesiredTag())
+			return nil, protocol.NewFatalClientErr(nil, E_INVALID, err.Error())
+		}
+		if created {
+			// save the new member, so the messages will be kept for it after restart
+			topic.SaveChannelMeta()
+		}
+	}
 
 	//if client.Tag != nil {
 	//	client.SetTagMsgChannel(channel.GetOrCreateClientMsgChannel(client.Tag))
@@ -1022,6 +1061,16 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 			return nil, protocol.NewFatalClientErr(nil, E_INVALID, ErrOrderChannelOnSampleRate.Error())
 		}
 		channel.SetOrdered(true)
+		if member := client.GetConsumerGroupMember(); member != "" {
+			// the partition may be reassigned, kick the consumers from the old member
+			for _, c := range channel.GetClients() {
+				if c.GetID() != client.ID && c.Stats().ConsumerGroupMember != member {
+					nsqd.NsqLogger().Logf("kick the consumer %v from channel %v since the partition is assigned to %v",
+						c, channelName, member)
+					c.Exit()
+				}
+			}
+		}
 	} else {
 		if !topic.IsOrdered() && channel.IsOrdered() {
 			nsqd.NsqLogger().Infof("channel %v is in ordered state on non-order topic %v but with normal sub command, remote is : %v, should convert state to non-ordered with http api.",
@@ -1136,6 +1185,63 @@ func (p *protocolV2) FIN(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	return nil, nil
 }
 
+// TXN commit the consumed messages (or the consume offset) of the subscribed channel and
+// publish the messages to the destination topics in a transaction.
+func (p *protocolV2) TXN(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+	if state != stateSubscribed {
+		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot TXN in current state")
+	}
+	if client.Channel == nil {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "No channel")
+	}
+
+	bodyLen, err := readLen(client.Reader, client.LenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "TXN failed to read body size")
+	}
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("TXN invalid body size %d", bodyLen))
+	}
+	if int64(bodyLen) > p.ctx.getOpts().MaxBodySize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("TXN body too big %d > %d", bodyLen, p.ctx.getOpts().MaxBodySize))
+	}
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "TXN failed to read body")
+	}
+	var req TxnRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "TXN failed to decode JSON body")
+	}
+
+	if !p.ctx.checkConsumeForMasterWrite(client.Channel.GetTopicName(), client.Channel.GetTopicPart()) {
+		nsqd.NsqLogger().Logf("topic %v txn failed for not leader", client.Channel.GetTopicName())
+		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
+	}
+	err = p.ctx.CommitTxn(client.Channel, client.ID, client.String(), &req)
+	if err != nil {
+		client.IncrSubError(int64(1))
+		nsqd.NsqLogger().LogWarningf("[%s] TXN on channel %v(%v) failed: %v", client,
+			client.Channel.GetName(), client.Channel.GetTopicName(), err)
+		if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
+			if clusterErr.IsEqual(consistence.ErrNotTopicLeader) {
+				return nil, protocol.NewFatalClientErr(err, FailedOnNotLeader, "")
+			}
+			if !clusterErr.IsLocalErr() {
+				return nil, protocol.NewFatalClientErr(err, FailedOnNotWritable, "")
+			}
+		}
+		return nil, protocol.NewClientErr(err, "E_TXN_FAILED", "TXN failed "+err.Error())
+	}
+	return okBytes, nil
+}
+
 func (p *protocolV2) requeueToEnd(client *nsqd.ClientV2, oldMsg *nsqd.Message,
 	timeoutDuration time.Duration) error {
 	err := p.ctx.internalRequeueToEnd(client.Channel, oldMsg, timeoutDuration)
@@ -1197,13 +1303,19 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 
 	msgID := nsqd.GetMessageIDFromFullMsgID(*id)
 	topic, _ := p.ctx.getExistingTopic(client.Channel.GetTopicName(), client.Channel.GetTopicPart())
-	oldMsg, toEnd := client.Channel.ShouldRequeueToEnd(client.ID, client.String(),
-		msgID, timeoutDuration, true)
 	// the channel under non-order topic may also sub with ordered
 	isOrderedCh := client.Channel.IsOrdered()
 	if topic != nil && topic.IsOrdered() {
 		isOrderedCh = true
 	}
+	byPolicy := false
+	if timeoutDuration == 0 && !isOrderedCh {
+		// use the backoff of the channel requeue policy if the client not given
+		timeoutDuration = client.Channel.GetRequeueTimeout(client.ID, msgID)
+		byPolicy = timeoutDuration > 0
+	}
+	oldMsg, toEnd := client.Channel.ShouldRequeueToEnd(client.ID, client.String(),
+		msgID, timeoutDuration, true)
 	if isOrderedCh {
 		toEnd = false
 		// for ordered topic, disable defer since it may block the consume
@@ -1224,6 +1336,10 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	}
 	if !toEnd || err != nil {
 		err = client.Channel.RequeueMessage(client.ID, client.String(), msgID, timeoutDuration, true)
+		if err == nsqd.ErrMsgDeferredTooMuch && byPolicy {
+			// too much deferred in memory, requeue immediately as the client required
+			err = client.Channel.RequeueMessage(client.ID, client.String(), msgID, 0, true)
+		}
 	}
 	if err != nil {
 		client.IncrSubError(int64(1))
@@ -1373,6 +1489,70 @@ func (p *protocolV2) PUB(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	return p.internalPubAndTrace(client, params, false)
 }
 
+// DPUB <topic> <delay_ms> [partition]
+// the message will be written to the delayed queue of the topic and moved to the topic after the delay.
+func (p *protocolV2) DPUB(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	if len(params) < 3 {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "insufficient number of parameters")
+	}
+	delayMs, err := strconv.ParseInt(string(params[2]), 10, 64)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, E_INVALID, "invalid pub delay")
+	}
+	delay := time.Duration(delayMs) * time.Millisecond
+	if delay <= 0 || delay > p.ctx.getOpts().MaxReqTimeout {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID,
+			fmt.Sprintf("pub delay %v out of range (0, %v]", delay, p.ctx.getOpts().MaxReqTimeout))
+	}
+	pubParams := [][]byte{params[0], params[1]}
+	if len(params) > 3 {
+		pubParams = append(pubParams, params[3])
+	}
+	startPub := time.Now().UnixNano()
+	bodyLen, topic, err := p.preparePub(client, pubParams, p.ctx.getOpts().MaxMsgSize, false)
+	if err != nil {
+		return nil, err
+	}
+	if topic.IsOrdered() {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, ErrDelayedPubOrdered.Error())
+	}
+
+	messageBodyBuffer := topic.BufferPoolGet(int(bodyLen))
+	defer topic.BufferPoolPut(messageBodyBuffer)
+	_, err = io.CopyN(messageBodyBuffer, client.Reader, int64(bodyLen))
+	if err != nil {
+		nsqd.NsqLogger().Logf("topic: %v message body read error %v ", topic.GetTopicName(), err.Error())
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "failed to read message body")
+	}
+	messageBody := messageBodyBuffer.Bytes()[:bodyLen]
+
+	if !p.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, true)
+		nsqd.NsqLogger().LogDebugf("should put to master: %v, from %v",
+			topic.GetFullName(), client.String())
+		topic.DisableForSlave()
+		return nil, protocol.NewClientErr(err, FailedOnNotLeader, "")
+	}
+	_, _, _, err = p.ctx.PutDelayedPubMessage(topic, messageBody, ext.NewNoExt(), 0, delay)
+	if err != nil {
+		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, true)
+		nsqd.NsqLogger().LogErrorf("topic %v put delayed message failed: %v", topic.GetFullName(), err)
+		if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
+			if !clusterErr.IsLocalErr() {
+				return nil, protocol.NewClientErr(err, FailedOnNotWritable, "")
+			}
+		}
+		if nsqd.IsDiskQuotaErr(err) {
+			return nil, protocol.NewClientErr(err, E_DISK_QUOTA, err.Error())
+		}
+		return nil, protocol.NewClientErr(err, "E_PUB_FAILED", err.Error())
+	}
+	topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, false)
+	cost := time.Now().UnixNano() - startPub
+	topic.GetDetailStats().UpdateTopicMsgStats(int64(len(messageBody)), cost/1000)
+	return okBytes, nil
+}
+
 func (p *protocolV2) PUBEXT(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	return p.internalPubExtAndTrace(client, params, true, false)
 }
@@ -1488,6 +1668,9 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	var realBody []byte
 	var extContent ext.IExtContent
 	var jsonHeader *simpleJson.Json
+	var producerID string
+	var producerSeq uint64
+	var hasProducerSeq bool
 	extContent = ext.NewNoExt()
 	if traceEnable && !pubExt {
 		traceID = binary.BigEndian.Uint64(messageBody[:nsqd.MsgTraceIDLength])
@@ -1522,6 +1705,33 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 			needTraceRsp = true
 		}
 
+		seqJson, existInJsonHeader := jsonHeader.CheckGet(nsqd.ProducerSeqKey)
+		if existInJsonHeader {
+			seqStr, err := seqJson.String()
+			if err == nil {
+				producerSeq, err = strconv.ParseUint(seqStr, 10, 64)
+			}
+			if err != nil {
+				return nil, protocol.NewClientErr(err, E_INVALID_PRODUCER_SEQ, "invalid producer sequence")
+			}
+			producerID = client.GetProducerID()
+			if producerID == "" {
+				return nil, protocol.NewClientErr(nil, E_INVALID_PRODUCER_SEQ, "producer id should be identified for the sequence")
+			}
+			// the producer id is written with the message, so the sequences can be rebuilt from the data
+			jsonHeader.Set(nsqd.ProducerIDKey, producerID)
+			extJsonBytes, err = jsonHeader.MarshalJSON()
+			if err != nil {
+				return nil, protocol.NewClientErr(err, ext.E_INVALID_JSON_HEADER, "fail to encode json header")
+			}
+			if len(extJsonBytes) > ext.MaxExtLen {
+				return nil, protocol.NewClientErr(nil, ext.E_INVALID_JSON_HEADER, "json header too long")
+			}
+			hasProducerSeq = true
+			// the result of the original publish will be returned for the duplicated sequence
+			needTraceRsp = true
+		}
+
 		jhe := ext.NewJsonHeaderExt()
 		jhe.SetJsonHeaderBytes(extJsonBytes)
 		extContent = jhe
@@ -1533,6 +1743,10 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 		asyncAction = false
 	}
 	if p.ctx.checkForMasterWrite(topicName, partition) {
+		if hasProducerSeq && !topic.IsExt() {
+			return nil, protocol.NewClientErr(nil, ext.E_EXT_NOT_SUPPORT,
+				fmt.Sprintf("producer sequence not supported in topic %v without ext", topicName))
+		}
 		if !topic.IsExt() && extContent.ExtVersion() != ext.NO_EXT_VER {
 			if p.ctx.getOpts().AllowExtCompatible {
 				filterIllegalZanTestHeader(topicName, jsonHeader)
@@ -1547,11 +1761,27 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 					fmt.Sprintf("ext content not supported in topic %v", topicName))
 			}
 		}
+		var deliverAt int64
+		var scheduleID string
+		deliverAt, scheduleID, err = nsqd.GetScheduleHeader(extContent.ExtVersion(), extContent.GetBytes())
+		if err != nil {
+			return nil, protocol.NewClientErr(err, ext.E_INVALID_JSON_HEADER, err.Error())
+		}
+		if deliverAt > 0 && hasProducerSeq {
+			return nil, protocol.NewClientErr(nil, E_INVALID_PRODUCER_SEQ,
+				"producer sequence not supported for the scheduled message")
+		}
 		id := nsqd.MessageID(0)
 		offset := nsqd.BackendOffset(0)
 		rawSize := int32(0)
-		if asyncAction {
+		if deliverAt > 0 {
+			id, offset, rawSize, err = p.ctx.PutScheduledMessage(topic, realBody, extContent, traceID,
+				time.Unix(0, deliverAt*int64(time.Millisecond)), scheduleID)
+		} else if asyncAction {
 			err = internalPubAsync(client.PubTimeout, messageBodyBuffer, topic, extContent)
+		} else if hasProducerSeq {
+			id, offset, rawSize, err = p.ctx.PutMessageIdempotent(topic, realBody, extContent, traceID,
+				producerID, producerSeq)
 		} else {
 			id, offset, rawSize, _, err = p.ctx.PutMessage(topic, realBody, extContent, traceID)
 		}
@@ -1564,6 +1794,12 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 					return nil, protocol.NewClientErr(err, FailedOnNotWritable, "")
 				}
 			}
+			if nsqd.IsDiskQuotaErr(err) {
+				return nil, protocol.NewClientErr(err, E_DISK_QUOTA, err.Error())
+			}
+			if err == nsqd.ErrProducerSeqOutOfOrder {
+				return nil, protocol.NewClientErr(err, E_INVALID_PRODUCER_SEQ, err.Error())
+			}
 			return nil, protocol.NewClientErr(err, "E_PUB_FAILED", err.Error())
 		}
 		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, false)
@@ -1620,6 +1856,9 @@ func (p *protocolV2) internalMPUBEXTAndTrace(client *nsqd.ClientV2, params [][]b
 					return nil, protocol.NewClientErr(err, FailedOnNotWritable, "")
 				}
 			}
+			if nsqd.IsDiskQuotaErr(err) {
+				return nil, protocol.NewClientErr(err, E_DISK_QUOTA, err.Error())
+			}
 			return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", err.Error())
 		}
 		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", int64(len(messages)), false)
@@ -3651,6 +3651,60 @@ func TestDelayMessage(t *testing.T) {
 	test.Equal(t, delayDone < opts.MaxReqTimeout+time.Second+time.Duration(time.Millisecond*500*2), true)
 }
 
+func TestTcpDelayedPub(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.LogLevel = 1
+	opts.SyncEvery = 1
+	opts.QueueScanInterval = time.Millisecond * 100
+	opts.MaxReqTimeout = time.Second * 100
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_delayed_pub" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	cmd := &nsq.Command{Name: []byte("DPUB"), Params: [][]byte{[]byte(topicName), []byte("1000")},
+		Body: []byte("delayed body")}
+	delayStart := time.Now()
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, uint64(1), topic.GetDelayedPubCnt())
+	test.Equal(t, int64(0), topic.TotalDataSize())
+
+	// the delay out of the max req timeout is invalid
+	cmd = &nsq.Command{Name: []byte("DPUB"), Params: [][]byte{[]byte(topicName), []byte("1000000")},
+		Body: []byte("delayed body")}
+	cmd.WriteTo(conn)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, _, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+
+	msgOut := recvNextMsgAndCheck(t, conn, len("delayed body"), 0, true)
+	test.Equal(t, []byte("delayed body"), msgOut.Body)
+	delayDone := time.Since(delayStart)
+	t.Log(delayDone)
+	test.Equal(t, delayDone >= time.Second, true)
+	// the delayed message is confirmed after written to topic
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, uint64(0), nsqdNs.NewTopicStats(topic, nil, true).DelayedPubCount)
+}
+
 func TestDelayMessageToQueueEnd(t *testing.T) {
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/youzan/nsq/consistence"
@@ -120,6 +121,10 @@ func newHTTPServer(ctx *Context) *httpServer {
 	//router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, log, http_api.V1))
 	router.Handle("POST", "/disable/write", http_api.Decorate(s.doDisableClusterWrite, log, http_api.V1))
+	router.Handle("POST", "/consumer_group/join", http_api.Decorate(s.doJoinConsumerGroup, log, http_api.V1))
+	router.Handle("POST", "/consumer_group/heartbeat", http_api.Decorate(s.doHeartbeatConsumerGroup, debugLog, http_api.V1))
+	router.Handle("POST", "/consumer_group/leave", http_api.Decorate(s.doLeaveConsumerGroup, log, http_api.V1))
+	router.Handle("GET", "/consumer_group/info", http_api.Decorate(s.doConsumerGroupInfo, log, http_api.V1))
 
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.NegotiateVersion))
 	// debug
@@ -298,6 +303,115 @@ func (s *httpServer) doDisableClusterWrite(w http.ResponseWriter, req *http.Requ
 	return nil, nil
 }
 
+func getConsumerGroupParams(req *http.Request, needMember bool) (string, string, string, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return "", "", "", http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return "", "", "", http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	channelName := reqParams.Get("channel")
+	if channelName == "" {
+		return "", "", "", http_api.Err{400, "MISSING_ARG_CHANNEL"}
+	}
+	member := reqParams.Get("member")
+	if needMember && member == "" {
+		return "", "", "", http_api.Err{400, "MISSING_ARG_MEMBER"}
+	}
+	return topicName, channelName, member, nil
+}
+
+func consumerGroupResponse(group *consistence.ConsumerGroupInfo, member string) interface{} {
+	members := make([]string, 0, len(group.Members))
+	for _, m := range group.Members {
+		members = append(members, m.ID)
+	}
+	assignment := make(map[string]string, len(group.Assignment))
+	for pid, m := range group.Assignment {
+		assignment[strconv.Itoa(pid)] = m
+	}
+	resp := map[string]interface{}{
+		"topic":              group.Topic,
+		"channel":            group.Channel,
+		"generation":         group.Generation,
+		"members":            members,
+		"assignment":         assignment,
+		"session_timeout_ms": int64(consistence.ConsumerGroupSessionTimeout / time.Millisecond),
+	}
+	if member != "" {
+		resp["partitions"] = group.GetAssignedPartitions(member)
+	}
+	return resp
+}
+
+func (s *httpServer) doJoinConsumerGroup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	topicName, channelName, member, err := getConsumerGroupParams(req, true)
+	if err != nil {
+		return nil, err
+	}
+	group, err := s.ctx.nsqlookupd.coordinator.JoinConsumerGroup(topicName, channelName, member)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return consumerGroupResponse(group, member), nil
+}
+
+func (s *httpServer) doHeartbeatConsumerGroup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	topicName, channelName, member, err := getConsumerGroupParams(req, true)
+	if err != nil {
+		return nil, err
+	}
+	group, err := s.ctx.nsqlookupd.coordinator.HeartbeatConsumerGroup(topicName, channelName, member)
+	if err != nil {
+		if err == consistence.ErrConsumerGroupMemberNotFound {
+			return nil, http_api.Err{404, "MEMBER_NOT_FOUND"}
+		}
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return consumerGroupResponse(group, member), nil
+}
+
+func (s *httpServer) doLeaveConsumerGroup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	topicName, channelName, member, err := getConsumerGroupParams(req, true)
+	if err != nil {
+		return nil, err
+	}
+	err = s.ctx.nsqlookupd.coordinator.LeaveConsumerGroup(topicName, channelName, member)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doConsumerGroupInfo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	topicName, channelName, member, err := getConsumerGroupParams(req, false)
+	if err != nil {
+		return nil, err
+	}
+	group, err := s.ctx.nsqlookupd.coordinator.GetConsumerGroup(topicName, channelName)
+	if err != nil {
+		if err == consistence.ErrConsumerGroupNotFound {
+			return nil, http_api.Err{404, "CONSUMER_GROUP_NOT_FOUND"}
+		}
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return consumerGroupResponse(group, member), nil
+}
+
 func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -543,6 +657,37 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	}
 	allowMultiOrdered := reqParams.Get("orderedmulti")
 	allowExt := reqParams.Get("extend")
+	checksum := reqParams.Get("checksum")
+	compression := reqParams.Get("compression")
+	if _, err := nsqd.ParseCompressCodec(compression); err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_COMPRESSION"}
+	}
+	durability := reqParams.Get("durability")
+	if _, err := nsqd.ParseDurabilityLevel(durability); err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_DURABILITY"}
+	}
+	storage := reqParams.Get("storage")
+	if storage != "" && !nsqd.IsValidBackendStorage(storage) {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_STORAGE"}
+	}
+	compactKey := reqParams.Get("compact_key")
+	if compactKey == consistence.CompactKeyReset || (compactKey != "" && allowExt != "true") {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_COMPACT_KEY"}
+	}
+	diskQuota := int64(0)
+	if diskQuotaStr := reqParams.Get("disk_quota"); diskQuotaStr != "" {
+		diskQuota, err = strconv.ParseInt(diskQuotaStr, 10, 64)
+		if err != nil || diskQuota < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_DISK_QUOTA"}
+		}
+	}
+	dedupWindow := int64(0)
+	if dedupWindowStr := reqParams.Get("dedup_window"); dedupWindowStr != "" {
+		dedupWindow, err = strconv.ParseInt(dedupWindowStr, 10, 64)
+		if err != nil || dedupWindow < 0 || (dedupWindow > 0 && allowExt != "true") {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_DEDUP_WINDOW"}
+		}
+	}
 
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -567,6 +712,15 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	if allowExt == "true" {
 		meta.Ext = true
 	}
+	if checksum == "true" {
+		meta.Checksum = true
+	}
+	meta.Compression = compression
+	meta.Durability = durability
+	meta.Storage = storage
+	meta.CompactKey = compactKey
+	meta.DiskQuota = diskQuota
+	meta.DedupWindow = dedupWindow
 	err = s.ctx.nsqlookupd.coordinator.CreateTopic(topicName, meta)
 	if err != nil {
 		nsqlookupLog.LogErrorf("DB: adding topic(%s) failed: %v", topicName, err)
@@ -686,9 +840,37 @@ func (s *httpServer) doChangeTopicDynamicParam(w http.ResponseWriter, req *http.
 		}
 	}
 	upgradeExtStr := reqParams.Get("upgradeext")
+	var extra consistence.TopicMetaExtraParam
+	extra.Checksum = reqParams.Get("checksum")
+	if extra.Checksum != "" && extra.Checksum != "true" && extra.Checksum != "false" {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_CHECKSUM"}
+	}
+	extra.Compression = reqParams.Get("compression")
+	extra.Durability = reqParams.Get("durability")
+	extra.CompactKey = reqParams.Get("compact_key")
+	if diskQuotaStr := reqParams.Get("disk_quota"); diskQuotaStr != "" {
+		extra.DiskQuota, err = strconv.ParseInt(diskQuotaStr, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_DISK_QUOTA"}
+		}
+		if extra.DiskQuota == 0 {
+			// reset to the default of nsqd
+			extra.DiskQuota = -1
+		}
+	}
+	if dedupWindowStr := reqParams.Get("dedup_window"); dedupWindowStr != "" {
+		extra.DedupWindow, err = strconv.ParseInt(dedupWindowStr, 10, 64)
+		if err != nil || extra.DedupWindow < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_DEDUP_WINDOW"}
+		}
+		if extra.DedupWindow == 0 {
+			// disable the dedup
+			extra.DedupWindow = -1
+		}
+	}
 
-	err = s.ctx.nsqlookupd.coordinator.ChangeTopicMetaParam(topicName, syncEvery,
-		retentionDays, replicator, upgradeExtStr)
+	err = s.ctx.nsqlookupd.coordinator.ChangeTopicMetaParamWithExtra(topicName, syncEvery,
+		retentionDays, replicator, upgradeExtStr, extra)
 	if err != nil {
 		return nil, http_api.Err{400, err.Error()}
 	}
@@ -829,6 +1011,7 @@ type node struct {
 	Tombstones       []bool              `json:"tombstones"`
 	Topics           []string            `json:"topics"`
 	Partitions       map[string][]string `json:"partitions"`
+	DiskFull         bool                `json:"disk_full"`
 }
 
 // return all lookup nodes that registered on etcd, and mark the master/slave info
@@ -931,6 +1114,7 @@ func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httpro
 			Tombstones:       tombstones,
 			Topics:           topics,
 			Partitions:       partitions,
+			DiskFull:         p.IsDiskFull(),
 		}
 	}
 
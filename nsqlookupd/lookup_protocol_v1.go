@@ -332,6 +332,11 @@ func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, erro
 		nsqlookupLog.LogDebugf("CLIENT(%s): pinged (last ping %s)", client.peerInfo.Id,
 			now.Sub(cur))
 		atomic.StoreInt64(&client.peerInfo.lastUpdate, now.UnixNano())
+		diskFull := int32(0)
+		if len(params) > 1 && params[1] == "disk_full" {
+			diskFull = 1
+		}
+		atomic.StoreInt32(&client.peerInfo.diskFull, diskFull)
 	}
 	return []byte("OK"), nil
 }
@@ -25,6 +25,7 @@ type ChannelReg struct {
 
 type PeerInfo struct {
 	lastUpdate       int64
+	diskFull         int32
 	Id               string `json:"id"`
 	RemoteAddress    string `json:"remote_address"`
 	Hostname         string `json:"hostname"`
@@ -36,6 +37,11 @@ type PeerInfo struct {
 	DistributedID string `json:"distributed_id"`
 }
 
+// IsDiskFull return true if the nsqd reported the disk usage exceed the high watermark in the last ping
+func (self *PeerInfo) IsDiskFull() bool {
+	return atomic.LoadInt32(&self.diskFull) == 1
+}
+
 func (self *PeerInfo) IsOldPeer() bool {
 	if self.DistributedID == "" {
 		// this is old nsqd node not in the HA cluster !!